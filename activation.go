@@ -0,0 +1,105 @@
+package reversebin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// noActivationCtxKey marks requests that may use a running backend but not
+// start one.
+type noActivationCtxKey struct{}
+
+// parseActivationRequire records the named matchers given to
+// activation_require and its optional status code.
+func (c *ReverseBin) parseActivationRequire(d *caddyfile.Dispenser) error {
+	args := d.RemainingArgs()
+	if len(args) > 1 {
+		if status, err := strconv.Atoi(args[len(args)-1]); err == nil {
+			if status < 400 || status > 599 {
+				return d.Errf("activation_require status must be a 4xx or 5xx code, got %d", status)
+			}
+			c.ActivationDenyStatus = status
+			args = args[:len(args)-1]
+		}
+	}
+	if len(args) == 0 {
+		return d.ArgErr()
+	}
+	for _, name := range args {
+		if len(name) < 2 || name[0] != '@' {
+			return d.Errf("activation_require takes named matchers, got %s", name)
+		}
+	}
+	c.activationNames = append(c.activationNames, args...)
+	return nil
+}
+
+// resolveActivationMatchers replaces the @names given to activation_require
+// with the matcher sets defined in the site block.
+func (c *ReverseBin) resolveActivationMatchers(h httpcaddyfile.Helper) error {
+	for _, name := range c.activationNames {
+		set, err := namedMatcherSet(h, "activation_require", name)
+		if err != nil {
+			return err
+		}
+		c.ActivationRequire = append(c.ActivationRequire, set)
+	}
+	return nil
+}
+
+// provisionActivation loads the activation_require matchers.
+func (c *ReverseBin) provisionActivation(ctx caddy.Context) error {
+	if c.ActivationRequire == nil {
+		return nil
+	}
+	if s := c.ActivationDenyStatus; s != 0 && (s < 400 || s > 599) {
+		return fmt.Errorf("activation_deny_status must be a 4xx or 5xx code, got %d", s)
+	}
+	mods, err := ctx.LoadModule(c, "ActivationRequire")
+	if err != nil {
+		return fmt.Errorf("loading activation_require matchers: %v", err)
+	}
+	return c.activationRequire.FromInterface(mods)
+}
+
+// checkActivation lets r through if it may start the key's backend or the
+// backend is already running or starting. Otherwise r is refused, since
+// serving it would cost a cold start. A request let through only because the
+// backend runs is marked so that it cannot start a new one either.
+func (c *ReverseBin) checkActivation(r *http.Request, ps *processState) (*http.Request, error) {
+	if len(c.activationRequire) == 0 {
+		return r, nil
+	}
+	match, err := c.activationRequire.AnyMatchWithError(r)
+	if err != nil {
+		return nil, caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	if match {
+		return r, nil
+	}
+	if !ps.running.Load() && !ps.starting.Load() {
+		return nil, c.activationDenied(ps.key)
+	}
+	return r.WithContext(context.WithValue(r.Context(), noActivationCtxKey{}, true)), nil
+}
+
+// mayActivate reports whether r may start a backend.
+func mayActivate(r *http.Request) bool {
+	denied, _ := r.Context().Value(noActivationCtxKey{}).(bool)
+	return !denied
+}
+
+func (c *ReverseBin) activationDenied(key string) error {
+	status := c.ActivationDenyStatus
+	if status == 0 {
+		status = http.StatusServiceUnavailable
+	}
+	return caddyhttp.Error(status, fmt.Errorf("backend for %q is not running and this request may not start it", c.processKeyName(key)))
+}
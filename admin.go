@@ -0,0 +1,479 @@
+package reversebin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// handlers tracks every provisioned reverse-bin handler so the admin API can
+// reach their process state.
+var handlers = struct {
+	mu  sync.Mutex
+	set map[*ReverseBin]struct{}
+}{set: make(map[*ReverseBin]struct{})}
+
+func registerHandler(c *ReverseBin) {
+	handlers.mu.Lock()
+	defer handlers.mu.Unlock()
+	handlers.set[c] = struct{}{}
+}
+
+func unregisterHandler(c *ReverseBin) {
+	handlers.mu.Lock()
+	defer handlers.mu.Unlock()
+	delete(handlers.set, c)
+}
+
+// processKeyName is the key shown to operators: the detector key for dynamic
+// handlers, or the upstream address for static ones (whose internal key is empty).
+func (c *ReverseBin) processKeyName(key string) string {
+	if key == "" || strings.HasPrefix(key, variantSep) || strings.HasPrefix(key, instanceSep) {
+		return c.ReverseProxyTo + key
+	}
+	return key
+}
+
+// lookupProcess finds the process state that operators refer to as name.
+func lookupProcess(name string) (*ReverseBin, *processState) {
+	handlers.mu.Lock()
+	defer handlers.mu.Unlock()
+	for c := range handlers.set {
+		c.mu.Lock()
+		for key, ps := range c.processes {
+			if c.processKeyName(key) == name {
+				c.mu.Unlock()
+				return c, ps
+			}
+		}
+		c.mu.Unlock()
+	}
+	return nil, nil
+}
+
+// lookupStartable finds the process state for name like lookupProcess, and
+// otherwise creates it for keys a handler can start without a request: the
+// upstream of a static handler or the name of an inline app.
+func lookupStartable(name string) (*ReverseBin, *processState) {
+	if c, ps := lookupProcess(name); ps != nil {
+		return c, ps
+	}
+	handlers.mu.Lock()
+	defer handlers.mu.Unlock()
+	for c := range handlers.set {
+		if c.detector == nil && len(c.Apps) == 0 && c.ProvisionAsk == "" && c.ReverseProxyTo == name {
+			return c, c.getOrCreateProcessState("")
+		}
+		if _, ok := c.Apps[name]; ok {
+			return c, c.getOrCreateProcessState(name)
+		}
+	}
+	return nil, nil
+}
+
+// processInfo describes one process key in GET /reverse-bin/processes.
+type processInfo struct {
+	Key            string `json:"key"`
+	State          string `json:"state"`
+	PID            int    `json:"pid,omitempty"`
+	ActiveRequests int64  `json:"active_requests"`
+	Upstream       string `json:"upstream,omitempty"`
+	// Requests waiting for the backend to start, and the longest wait so far
+	WaitingRequests int   `json:"waiting_requests"`
+	LongestWaitMS   int64 `json:"longest_wait_ms,omitempty"`
+}
+
+// processes lists the keys of every handler.
+func processes() []processInfo {
+	handlers.mu.Lock()
+	defer handlers.mu.Unlock()
+	var list []processInfo
+	for c := range handlers.set {
+		list = append(list, c.processInfos()...)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list
+}
+
+// processInfos lists the keys of c sorted by name. Keys in the middle of a
+// cold start, which holds ps.mu, are reported as starting without waiting.
+func (c *ReverseBin) processInfos() []processInfo {
+	var list []processInfo
+	c.mu.Lock()
+	for key, ps := range c.processes {
+		info := processInfo{Key: c.processKeyName(key), State: "starting"}
+		waiting, longest := ps.waiting.snapshot(c.clock().Now())
+		info.WaitingRequests, info.LongestWaitMS = waiting, longest.Milliseconds()
+		if ps.mu.TryLock() {
+			info.State = "stopped"
+			info.ActiveRequests = ps.activeRequests
+			switch {
+			case ps.process != nil:
+				info.State, info.PID = "running", ps.process.Pid()
+			case ps.adopted || ps.scaleDown != nil:
+				info.State = "running"
+			case ps.halted.Load() != nil:
+				info.State = "exited"
+			}
+			if ps.overrides != nil && ps.overrides.ReverseProxyTo != nil {
+				info.Upstream = *ps.overrides.ReverseProxyTo
+			}
+			ps.mu.Unlock()
+		}
+		list = append(list, info)
+	}
+	c.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list
+}
+
+// warm starts the backend of ps for the admin API, clearing a restart policy
+// halt and start backoff first.
+func (c *ReverseBin) warm(ctx context.Context, ps *processState) error {
+	return c.startUnrequested(ctx, ps, "warm", true)
+}
+
+// startUnrequested starts the backend of ps, as a request of kind would, and
+// arms its idle timer; reset clears a restart policy halt and start backoff.
+// Keys of a detector are only started again with the settings of their last
+// start, since the detector's placeholders need a real request; with
+// port_range or upstream_from those settings name a port that is no longer
+// the backend's.
+func (c *ReverseBin) startUnrequested(ctx context.Context, ps *processState, kind string, reset bool) error {
+	ps.mu.Lock()
+	known := ps.overrides != nil
+	ps.mu.Unlock()
+	// Keys listed in prewarm are meant to be started without a request.
+	known = known || slices.Contains(c.PrewarmKeys, ps.key)
+	if _, app := c.Apps[ps.key]; c.detector != nil && !app && (!known || c.PortRange != nil || c.UpstreamFrom != nil) {
+		return fmt.Errorf("process key %q can only be started by a request", c.processKeyName(ps.key))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/", nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+	markInternal(req, kind)
+
+	idleTimeout, err := c.idleTimeoutFor(req, ps)
+	if err != nil {
+		return err
+	}
+	if reset {
+		ps.halted.Store(nil)
+		ps.mu.Lock()
+		ps.clearBackoffLocked(c.clock().Now())
+		ps.mu.Unlock()
+	}
+	ps.incrementRequests(c.logger, ps.key)
+	defer ps.decrementRequests(c.logger, ps.key, idleTimeout, true)
+	// A backend stopped to be restarted leaves a state process_state_ttl
+	// may remove before the request above holds it.
+	if !c.renewState(ps) {
+		return fmt.Errorf("process key %q was forgotten before it could be started", c.processKeyName(ps.key))
+	}
+	_, err = c.ensureProcessRunningAndResolveUpstream(req, ps, ps.key)
+	return err
+}
+
+// adminAPI exposes reverse-bin process state under Caddy's admin endpoint.
+type adminAPI struct{}
+
+// CaddyModule returns the Caddy module information.
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.reverse_bin",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Routes implements caddy.AdminRouter.
+func (a adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{Pattern: "/reverse-bin/logs", Handler: caddy.AdminHandlerFunc(a.handleLogs)},
+		{Pattern: "/reverse-bin/processes", Handler: caddy.AdminHandlerFunc(a.handleProcesses)},
+		{Pattern: "/reverse-bin/stop", Handler: caddy.AdminHandlerFunc(a.handleStop)},
+		{Pattern: "/reverse-bin/warm", Handler: caddy.AdminHandlerFunc(a.handleWarm)},
+	}
+}
+
+// handleLogs streams a process's output as server-sent events: buffered lines
+// first, then live lines until the client disconnects. Clients resuming with
+// Last-Event-ID only receive lines newer than that sequence number.
+func (a adminAPI) handleLogs(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	key := r.URL.Query().Get("key")
+	_, ps := lookupProcess(key)
+	if ps == nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("unknown process key: %q", key),
+		}
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        fmt.Errorf("streaming not supported"),
+		}
+	}
+	var after uint64
+	if lastID := r.Header.Get("Last-Event-ID"); lastID != "" {
+		after, _ = strconv.ParseUint(lastID, 10, 64)
+	}
+
+	backlog, lines, unsubscribe := ps.output.subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	for _, line := range backlog {
+		if line.Seq > after {
+			if err := writeLogEvent(w, line); err != nil {
+				return nil
+			}
+		}
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case line := <-lines:
+			if err := writeLogEvent(w, line); err != nil {
+				return nil
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// handleProcesses lists every process key with its state.
+func (a adminAPI) handleProcesses(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(processes())
+}
+
+// handleStop stops the backend of ?key=; it starts again on the next request.
+// A glob in key, or key_regexp, stops every matching backend.
+func (a adminAPI) handleStop(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	match, err := keySelector(r.URL.Query(), false)
+	if err != nil {
+		return err
+	}
+	if match != nil {
+		return bulk(w, keyNames(false), match, stopKey)
+	}
+	if err := stopKey(r.URL.Query().Get("key")); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// stopKey stops the backend operators refer to as key.
+func stopKey(key string) error {
+	c, ps := lookupProcess(key)
+	if ps == nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("unknown process key: %q", key),
+		}
+	}
+	ps.mu.Lock()
+	stopped := ps.stopLocked("stopped via admin API")
+	// Stopping a key held off after flapping re-enables starts right away.
+	if ps.clearBackoffLocked(c.clock().Now()) {
+		stopped = true
+	}
+	ps.mu.Unlock()
+	// Stopping a key kept stopped by its restart policy re-enables starts.
+	if ps.halted.Swap(nil) != nil {
+		stopped = true
+	}
+	if !stopped {
+		return caddy.APIError{
+			HTTPStatus: http.StatusConflict,
+			Err:        fmt.Errorf("process key %q is not running", key),
+		}
+	}
+	c.logger.Info("backend stopped via admin API", zap.String("key", key))
+	return nil
+}
+
+// handleWarm starts the backend of ?key= ahead of traffic and returns once it
+// is ready. A glob in key, or key_regexp, warms every matching backend.
+func (a adminAPI) handleWarm(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	warmKey := func(key string) error {
+		c, ps := lookupStartable(key)
+		if ps == nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusNotFound,
+				Err:        fmt.Errorf("unknown process key: %q", key),
+			}
+		}
+		if err := c.warm(r.Context(), ps); err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadGateway,
+				Err:        err,
+			}
+		}
+		return nil
+	}
+	match, err := keySelector(r.URL.Query(), true)
+	if err != nil {
+		return err
+	}
+	if match != nil {
+		return bulk(w, keyNames(true), match, warmKey)
+	}
+	if err := warmKey(r.URL.Query().Get("key")); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// keyResult is the outcome of a bulk operation for one process key.
+type keyResult struct {
+	Key   string `json:"key"`
+	Error string `json:"error,omitempty"`
+}
+
+// keySelector returns the matcher of a request selecting several keys: a
+// glob in ?key= (path.Match syntax, e.g. tenant-*) or a regular expression
+// in ?key_regexp=. It returns nil for a single key, including one that
+// merely contains glob characters such as an IPv6 upstream.
+func keySelector(q url.Values, startable bool) (func(string) bool, error) {
+	if expr := q.Get("key_regexp"); expr != "" {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("invalid key_regexp: %v", err),
+			}
+		}
+		return re.MatchString, nil
+	}
+	key := q.Get("key")
+	if !strings.ContainsAny(key, "*?[") || slices.Contains(keyNames(startable), key) {
+		return nil, nil
+	}
+	if _, err := path.Match(key, ""); err != nil {
+		return nil, caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("invalid key pattern %q: %v", key, err),
+		}
+	}
+	return func(name string) bool {
+		ok, _ := path.Match(key, name)
+		return ok
+	}, nil
+}
+
+// keyNames lists the keys of every handler's known processes and, with
+// startable, also the keys handlers can start without a request.
+func keyNames(startable bool) []string {
+	handlers.mu.Lock()
+	defer handlers.mu.Unlock()
+	var names []string
+	for c := range handlers.set {
+		c.mu.Lock()
+		for key := range c.processes {
+			names = append(names, c.processKeyName(key))
+		}
+		c.mu.Unlock()
+		if !startable {
+			continue
+		}
+		if c.detector == nil && len(c.Apps) == 0 && c.ProvisionAsk == "" {
+			names = append(names, c.ReverseProxyTo)
+		}
+		for name := range c.Apps {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// bulk applies op concurrently to every name selected by match and reports
+// each outcome. Selecting nothing is an error, so typos do not go unnoticed.
+func bulk(w http.ResponseWriter, names []string, match func(string) bool, op func(string) error) error {
+	names = slices.DeleteFunc(names, func(name string) bool { return !match(name) })
+	if len(names) == 0 {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no process key matches"),
+		}
+	}
+	results := make([]keyResult, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		results[i].Key = name
+		wg.Go(func() {
+			if err := op(name); err != nil {
+				results[i].Error = err.Error()
+			}
+		})
+	}
+	wg.Wait()
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(results)
+}
+
+func writeLogEvent(w http.ResponseWriter, line outputLine) error {
+	data, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", line.Seq, line.Stream, data)
+	return err
+}
+
+// Interface guards
+var (
+	_ caddy.AdminRouter = (*adminAPI)(nil)
+)
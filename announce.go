@@ -0,0 +1,190 @@
+package reversebin
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// defaultAnnouncePattern matches the PORT=<n> line backends print by default.
+const defaultAnnouncePattern = `PORT=(\d+)`
+
+// UpstreamFrom takes the port of a backend that picks its own from what the
+// backend announces once started, instead of allocating one beforehand. The
+// port replaces {reverse_bin.port} in reverse_proxy_to.
+type UpstreamFrom struct {
+	// "stdout" or "file"
+	Source string `json:"source"`
+	// Regular expression matched against each stdout line, whose first
+	// group is the port (stdout only, default PORT=(\d+))
+	Pattern string `json:"pattern,omitempty"`
+	// File the backend writes its port or PORT=<n> to, relative to its
+	// working directory unless absolute (file only)
+	Path string `json:"path,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// parseUpstreamFrom parses "upstream_from stdout [<regexp>]" or
+// "upstream_from file <path>".
+func parseUpstreamFrom(d *caddyfile.Dispenser) (*UpstreamFrom, error) {
+	args := d.RemainingArgs()
+	if len(args) == 0 || len(args) > 2 {
+		return nil, d.ArgErr()
+	}
+	u := &UpstreamFrom{Source: args[0]}
+	switch {
+	case args[0] == "stdout" && len(args) == 2:
+		u.Pattern = args[1]
+	case args[0] == "file" && len(args) == 2:
+		u.Path = args[1]
+	case args[0] == "stdout":
+	case args[0] == "file":
+		return nil, d.Err("upstream_from file needs the path of the announcement file")
+	default:
+		return nil, d.Errf("upstream_from source must be stdout or file, got %q", args[0])
+	}
+	return u, nil
+}
+
+// validate checks the source and compiles the pattern.
+func (u *UpstreamFrom) validate() error {
+	switch u.Source {
+	case "stdout":
+		pattern := u.Pattern
+		if pattern == "" {
+			pattern = defaultAnnouncePattern
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("upstream_from pattern: %v", err)
+		}
+		if re.NumSubexp() == 0 {
+			return fmt.Errorf("upstream_from pattern %q must capture the port in a group", pattern)
+		}
+		u.re = re
+	case "file":
+		if u.Path == "" {
+			return fmt.Errorf("upstream_from file needs a path")
+		}
+	default:
+		return fmt.Errorf("upstream_from source must be stdout or file, got %q", u.Source)
+	}
+	return nil
+}
+
+// portAnnouncement receives the port one backend announces.
+type portAnnouncement struct {
+	re *regexp.Regexp
+	// path of the announcement file, "" for stdout
+	path string
+	once sync.Once
+	port chan int
+}
+
+// listen prepares to receive the announcement of a backend started in dir.
+// A file left over from a previous start is removed first.
+func (u *UpstreamFrom) listen(dir string) (*portAnnouncement, error) {
+	a := &portAnnouncement{re: u.re, port: make(chan int, 1)}
+	if u.Source == "file" {
+		a.path = u.Path
+		if !filepath.IsAbs(a.path) {
+			a.path = filepath.Join(dir, a.path)
+		}
+		if err := os.Remove(a.path); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to remove stale upstream_from file %s: %w", a.path, err)
+		}
+	}
+	return a, nil
+}
+
+// line looks for the announcement in a line of backend output.
+func (a *portAnnouncement) line(stream, text string) {
+	if a.re == nil || stream != "stdout" {
+		return
+	}
+	m := a.re.FindStringSubmatch(text)
+	if m == nil {
+		return
+	}
+	if port, err := parsePort(m[1]); err == nil {
+		a.announce(port)
+	}
+}
+
+// announce records the first port announced.
+func (a *portAnnouncement) announce(port int) {
+	a.once.Do(func() { a.port <- port })
+}
+
+// waitForAnnouncement returns the port a announces, or an error once exited
+// reports that the backend terminated, timeout passes or ctx ends. The
+// returned channel stands in for exited afterwards: it replays an exit this
+// wait received.
+func (c *ReverseBin) waitForAnnouncement(ctx context.Context, a *portAnnouncement, exited <-chan error, timeout time.Duration) (int, <-chan error, error) {
+	pollCtx, stopPolling := context.WithCancel(ctx)
+	defer stopPolling()
+	if a.path != "" {
+		go func() {
+			ticker := time.NewTicker(50 * time.Millisecond)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					// The file may be read while the backend is still writing
+					// it; a partial port fails to parse and is read again.
+					data, err := os.ReadFile(a.path)
+					if err != nil {
+						continue
+					}
+					if port, err := parsePort(strings.TrimPrefix(strings.TrimSpace(string(data)), "PORT=")); err == nil {
+						a.announce(port)
+						return
+					}
+				case <-pollCtx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	select {
+	case port := <-a.port:
+		return port, exited, nil
+	case err := <-exited:
+		replay := make(chan error, 1)
+		replay <- err
+		return 0, replay, fmt.Errorf("reverse proxy process exited before announcing its port: %v", err)
+	case <-c.clock().After(timeout):
+		return 0, exited, ErrReadinessTimeout
+	case <-ctx.Done():
+		return 0, exited, fmt.Errorf("cold start aborted: %w", ctx.Err())
+	}
+}
+
+// parsePort parses a TCP port number.
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return port, nil
+}
+
+// withUpstreamPort returns a copy of o whose reverse_proxy_to has the port
+// placeholder replaced by port. Unlike withPort, the command line and
+// environment are left alone: the backend chose the port itself.
+func (o *Overrides) withUpstreamPort(port int) *Overrides {
+	copied := *o
+	addr := strings.ReplaceAll(*o.ReverseProxyTo, portPlaceholder, strconv.Itoa(port))
+	copied.ReverseProxyTo = &addr
+	return &copied
+}
@@ -0,0 +1,169 @@
+package reversebin
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// defaultAppKey selects an inline app by the request's host.
+const defaultAppKey = "{http.request.host}"
+
+// App is a backend declared inline in the handler config, replacing a
+// detector when the set of apps is known. Its fields mean the same as the
+// detector output and unset ones fall back to the handler configuration.
+type App struct {
+	Executable       []string            `json:"executable,omitempty"`
+	ExecPlatforms    map[string][]string `json:"exec_platforms,omitempty"`
+	WorkingDirectory string              `json:"working_directory,omitempty"`
+	Envs             []string            `json:"envs,omitempty"`
+	ReverseProxyTo   string              `json:"reverse_proxy_to,omitempty"`
+	ReadinessMethod  string              `json:"readiness_method,omitempty"`
+	ReadinessPath    string              `json:"readiness_path,omitempty"`
+	ReadinessStatus  []int               `json:"readiness_status,omitempty"`
+	HostRewrite      string              `json:"host_rewrite,omitempty"`
+	HeadersUp        map[string]string   `json:"headers_up,omitempty"`
+	HeadersDown      map[string]string   `json:"headers_down,omitempty"`
+	UpstreamTLS      *UpstreamTLS        `json:"upstream_tls,omitempty"`
+	Transport        *TransportConfig    `json:"transport,omitempty"`
+}
+
+func (a *App) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "exec":
+			platform, command, err := parseExec(d)
+			if err != nil {
+				return err
+			}
+			setExec(&a.Executable, &a.ExecPlatforms, platform, command)
+		case "dir":
+			if !d.Args(&a.WorkingDirectory) {
+				return d.ArgErr()
+			}
+		case "env":
+			a.Envs = d.RemainingArgs()
+			if len(a.Envs) == 0 {
+				return d.ArgErr()
+			}
+		case "reverse_proxy_to":
+			if !d.Args(&a.ReverseProxyTo) {
+				return d.ArgErr()
+			}
+		case "readiness_check":
+			method, path, expect, err := parseReadinessCheck(d, "readiness_check", d.RemainingArgs())
+			if err != nil {
+				return err
+			}
+			a.ReadinessMethod, a.ReadinessPath, a.ReadinessStatus = method, path, expect
+		case "host_rewrite":
+			args := d.RemainingArgs()
+			switch len(args) {
+			case 0:
+				a.HostRewrite = defaultHostRewrite
+			case 1:
+				a.HostRewrite = args[0]
+			default:
+				return d.ArgErr()
+			}
+		case "header_up", "header_down":
+			name := d.Val()
+			var field, value string
+			if !d.Args(&field) {
+				return d.ArgErr()
+			}
+			d.Args(&value)
+			hdrs := &a.HeadersUp
+			if name == "header_down" {
+				hdrs = &a.HeadersDown
+			}
+			if *hdrs == nil {
+				*hdrs = make(map[string]string)
+			}
+			(*hdrs)[field] = value
+		case "upstream_tls":
+			a.UpstreamTLS = new(UpstreamTLS)
+			if err := a.UpstreamTLS.unmarshalCaddyfile(d); err != nil {
+				return err
+			}
+		case "transport":
+			a.Transport = new(TransportConfig)
+			if err := a.Transport.unmarshalCaddyfile(d); err != nil {
+				return err
+			}
+		default:
+			return d.Errf("unknown app subdirective: %q", d.Val())
+		}
+	}
+	return nil
+}
+
+// overrides returns the app as detector output.
+func (a *App) overrides() *Overrides {
+	o := &Overrides{
+		HeadersUp:   a.HeadersUp,
+		HeadersDown: a.HeadersDown,
+		UpstreamTLS: a.UpstreamTLS,
+		Transport:   a.Transport,
+	}
+	if len(a.Executable) > 0 {
+		o.Executable = &a.Executable
+	}
+	if a.WorkingDirectory != "" {
+		o.WorkingDirectory = &a.WorkingDirectory
+	}
+	if len(a.Envs) > 0 {
+		o.Envs = &a.Envs
+	}
+	if a.ReverseProxyTo != "" {
+		o.ReverseProxyTo = &a.ReverseProxyTo
+	}
+	if a.ReadinessMethod != "" {
+		o.ReadinessMethod = &a.ReadinessMethod
+		o.ReadinessPath = &a.ReadinessPath
+		o.ReadinessStatus = &a.ReadinessStatus
+	}
+	if a.HostRewrite != "" {
+		o.HostRewrite = &a.HostRewrite
+	}
+	return o
+}
+
+// validateApps checks that every app, combined with the handler defaults,
+// describes a startable backend.
+func (c *ReverseBin) validateApps() error {
+	for name, app := range c.Apps {
+		if len(app.Executable) == 0 && len(c.Executable) == 0 {
+			return fmt.Errorf("app %q: exec is required", name)
+		}
+		to, method, path := app.ReverseProxyTo, app.ReadinessMethod, app.ReadinessPath
+		if to == "" {
+			to = c.ReverseProxyTo
+		}
+		if method == "" {
+			method, path = c.ReadinessMethod, c.ReadinessPath
+		}
+		if to == "" {
+			return fmt.Errorf("app %q: reverse_proxy_to is required", name)
+		}
+		if !isUnixUpstream(to) && c.UpstreamFrom == nil && !readinessConfigured(method, path) {
+			return fmt.Errorf("app %q: readiness_check is required for non-unix reverse_proxy_to targets", name)
+		}
+		if app.UpstreamTLS != nil {
+			if err := app.UpstreamTLS.validate(); err != nil {
+				return fmt.Errorf("app %q: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// appKey returns the name of the inline app serving r.
+func (c *ReverseBin) appKey(r *http.Request) string {
+	tmpl := c.AppKey
+	if tmpl == "" {
+		tmpl = defaultAppKey
+	}
+	return expandWithKey(r, "", tmpl)
+}
@@ -0,0 +1,205 @@
+package reversebin
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddypki"
+)
+
+// defaultBackendCertLifetime is how long minted backend certificates are
+// valid; each start of a backend gets a fresh one.
+const defaultBackendCertLifetime = 7 * 24 * time.Hour
+
+// BackendCert mints a leaf certificate from a CA of Caddy's PKI app for each
+// backend start, for backends that need TLS material of their own, e.g. a
+// client certificate for mTLS to a database. The files are written to a
+// directory per process key and passed to the backend as
+// REVERSE_BIN_TLS_CERT, REVERSE_BIN_TLS_KEY and REVERSE_BIN_TLS_CA.
+type BackendCert struct {
+	// ID of the PKI app CA that signs the certificates (default, local)
+	CA string `json:"ca,omitempty"`
+	// Directory under which each key gets a subdirectory with cert.pem, key.pem and ca.pem
+	// (default, reverse-bin-certs in Caddy's data directory)
+	Dir string `json:"dir,omitempty"`
+	// DNS names or IP addresses in the certificate; {reverse_bin.key} is
+	// replaced by the process key (default, localhost)
+	Names []string `json:"names,omitempty"`
+	// Certificate lifetime in milliseconds (default, 7 days)
+	LifetimeMS int64 `json:"lifetime_ms,omitempty"`
+
+	ca *caddypki.CA
+}
+
+func (b *BackendCert) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "ca":
+			if !d.Args(&b.CA) {
+				return d.ArgErr()
+			}
+		case "dir":
+			if !d.Args(&b.Dir) {
+				return d.ArgErr()
+			}
+		case "names":
+			b.Names = d.RemainingArgs()
+			if len(b.Names) == 0 {
+				return d.ArgErr()
+			}
+		case "lifetime":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil || dur < time.Minute {
+				return d.Errf("lifetime must be a duration of at least 1m: %s", d.Val())
+			}
+			b.LifetimeMS = dur.Milliseconds()
+		default:
+			return d.Errf("unknown backend_cert subdirective: %q", d.Val())
+		}
+	}
+	return nil
+}
+
+// provision looks up the signing CA in the PKI app.
+func (b *BackendCert) provision(ctx caddy.Context) error {
+	id := b.CA
+	if id == "" {
+		id = caddypki.DefaultCAID
+	}
+	app, err := ctx.App("pki")
+	if err != nil {
+		return fmt.Errorf("backend_cert: loading pki app: %v", err)
+	}
+	pkiApp, ok := app.(*caddypki.PKI)
+	if !ok {
+		return fmt.Errorf("backend_cert: pki app is %T", app)
+	}
+	if b.ca, err = pkiApp.GetCA(ctx, id); err != nil {
+		return fmt.Errorf("backend_cert: %v", err)
+	}
+	return nil
+}
+
+// issue writes a fresh certificate for key and returns the environment
+// variables pointing the backend at it.
+func (b *BackendCert) issue(key string) ([]string, error) {
+	chain := b.ca.IntermediateCertificateChain()
+	signer, ok := b.ca.IntermediateKey().(crypto.Signer)
+	if len(chain) == 0 || !ok {
+		return nil, fmt.Errorf("backend_cert: CA has no usable intermediate")
+	}
+	lifetime := defaultBackendCertLifetime
+	if b.LifetimeMS > 0 {
+		lifetime = time.Duration(b.LifetimeMS) * time.Millisecond
+	}
+	names := []string{"localhost"}
+	if len(b.Names) > 0 {
+		names = make([]string, len(b.Names))
+		for i, name := range b.Names {
+			names[i] = strings.ReplaceAll(name, "{"+keyPlaceholder+"}", key)
+		}
+	}
+	certPEM, keyPEM, err := issueLeaf(chain, signer, key, names, lifetime)
+	if err != nil {
+		return nil, fmt.Errorf("backend_cert: %v", err)
+	}
+
+	elem, err := keyFileName(key)
+	if err != nil {
+		return nil, fmt.Errorf("backend_cert: %v", err)
+	}
+	root := b.Dir
+	if root == "" {
+		root = filepath.Join(caddy.AppDataDir(), "reverse-bin-certs")
+		// Only Caddy's user may reach the keys, even if the directory existed.
+		if err := os.MkdirAll(root, 0o700); err != nil {
+			return nil, fmt.Errorf("backend_cert: %v", err)
+		}
+		if err := os.Chmod(root, 0o700); err != nil {
+			return nil, fmt.Errorf("backend_cert: %v", err)
+		}
+	}
+	dir := filepath.Join(root, elem)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("backend_cert: %v", err)
+	}
+	certFile, keyFile, caFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b.ca.RootCertificate().Raw})
+	for _, f := range []struct {
+		path string
+		data []byte
+	}{{keyFile, keyPEM}, {certFile, certPEM}, {caFile, caPEM}} {
+		if err := os.WriteFile(f.path, f.data, 0o600); err != nil {
+			return nil, fmt.Errorf("backend_cert: %v", err)
+		}
+	}
+	return []string{
+		"REVERSE_BIN_TLS_CERT=" + certFile,
+		"REVERSE_BIN_TLS_KEY=" + keyFile,
+		"REVERSE_BIN_TLS_CA=" + caFile,
+	}, nil
+}
+
+// issueLeaf signs a new ECDSA key for the subject with the first certificate
+// of chain, and returns the certificate followed by chain and the key, both
+// PEM-encoded. The certificate never outlives its issuer.
+func issueLeaf(chain []*x509.Certificate, signer crypto.Signer, subject string, names []string, lifetime time.Duration) ([]byte, []byte, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	notAfter := now.Add(lifetime)
+	if notAfter.After(chain[0].NotAfter) {
+		notAfter = chain[0].NotAfter
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: subject},
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, name)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, chain[0], &priv.PublicKey, signer)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	for _, c := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certPEM, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), nil
+}
@@ -0,0 +1,88 @@
+package reversebin
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// bind_check modes.
+const (
+	bindCheckWarn    = "warn"
+	bindCheckEnforce = "enforce"
+)
+
+// checkBind looks for the backend pid, proxied to at the loopback address
+// upstream, also answering on the host's other addresses, as a backend
+// listening on 0.0.0.0 would. It logs a warning, and with bind_check enforce
+// returns an error so that the start fails.
+func (c *ReverseBin) checkBind(key string, pid int, upstream string) error {
+	if isUnixUpstream(upstream) {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(readinessAddress(upstream))
+	if err != nil {
+		return nil
+	}
+	// Only backends meant to be private to this host are checked.
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil
+	}
+	exposed := exposedAddrs(port)
+	if len(exposed) == 0 {
+		return nil
+	}
+	c.logger.Warn("backend is reachable on non-loopback addresses",
+		zap.String("key", c.processKeyName(key)),
+		zap.Int("pid", pid),
+		zap.Strings("addresses", exposed))
+	if c.BindCheck != bindCheckEnforce {
+		return nil
+	}
+	return fmt.Errorf("backend for %q is reachable on %s; bind it to %s only",
+		c.processKeyName(key), strings.Join(exposed, ", "), c.loopbackHost())
+}
+
+// exposedAddrs returns the addresses of this host's non-loopback interfaces
+// on which something accepts connections to port. The addresses are dialed
+// at once, so a host with many of them takes no longer than one.
+func exposedAddrs(port string) []string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	var targets []string
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		// Link-local addresses need a zone to dial and are skipped.
+		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		targets = append(targets, net.JoinHostPort(ipnet.IP.String(), port))
+	}
+	reachable := make([]bool, len(targets))
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := net.DialTimeout("tcp", target, 200*time.Millisecond)
+			if err == nil {
+				_ = conn.Close()
+				reachable[i] = true
+			}
+		}()
+	}
+	wg.Wait()
+	var exposed []string
+	for i, target := range targets {
+		if reachable[i] {
+			exposed = append(exposed, target)
+		}
+	}
+	return exposed
+}
@@ -0,0 +1,214 @@
+package reversebin
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// ColdStartBudget caps how many times a key's backend may be started per
+// period, counted in Caddy's storage so instances sharing it share the
+// budget. Starts beyond it are refused until the next period begins.
+type ColdStartBudget struct {
+	// Starts allowed per period
+	Count int `json:"count"`
+	// Length of a period in milliseconds; periods are aligned to the Unix
+	// epoch, so a day runs from midnight UTC
+	PeriodMS int `json:"period_ms"`
+	// Status for requests refused once the budget is spent (default, 429)
+	Status int `json:"status,omitempty"`
+}
+
+// coldStartRefundTimeout bounds giving back the cold start of a failed start.
+const coldStartRefundTimeout = 10 * time.Second
+
+// coldStartStore is the part of Caddy's storage the budget is kept in.
+type coldStartStore interface {
+	Lock(ctx context.Context, name string) error
+	Unlock(ctx context.Context, name string) error
+	Store(ctx context.Context, key string, value []byte) error
+	Load(ctx context.Context, key string) ([]byte, error)
+}
+
+// coldStartCount is the record stored per key.
+type coldStartCount struct {
+	// Start of the period counted, in Unix seconds
+	Window int64 `json:"window"`
+	Count  int   `json:"count"`
+}
+
+// parseColdStartBudget parses "max_cold_starts <n>/<period> [<status>]",
+// where period is minute, hour, day or a duration.
+func parseColdStartBudget(d *caddyfile.Dispenser) (*ColdStartBudget, error) {
+	args := d.RemainingArgs()
+	if len(args) == 0 || len(args) > 2 {
+		return nil, d.ArgErr()
+	}
+	count, period, err := parseRate(d, "max_cold_starts", args[0])
+	if err != nil {
+		return nil, err
+	}
+	b := &ColdStartBudget{Count: count, PeriodMS: int(period.Milliseconds())}
+	if len(args) == 2 {
+		status, err := strconv.Atoi(args[1])
+		if err != nil || status < 400 || status > 599 {
+			return nil, d.Errf("max_cold_starts status must be a 4xx or 5xx code: %s", args[1])
+		}
+		b.Status = status
+	}
+	return b, nil
+}
+
+// parseRate parses the "<n>/<period>" argument of directive, where period is
+// minute, hour, day or a duration of at least a second.
+func parseRate(d *caddyfile.Dispenser, directive, arg string) (int, time.Duration, error) {
+	count, per, ok := strings.Cut(arg, "/")
+	if !ok {
+		return 0, 0, d.Errf("%s must look like 100/day, got %q", directive, arg)
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 1 {
+		return 0, 0, d.Errf("%s count must be a positive integer: %s", directive, count)
+	}
+	var period time.Duration
+	switch per {
+	case "minute":
+		period = time.Minute
+	case "hour":
+		period = time.Hour
+	case "day":
+		period = 24 * time.Hour
+	default:
+		if period, err = caddy.ParseDuration(per); err != nil || period < time.Second {
+			return 0, 0, d.Errf("%s period must be minute, hour, day or a duration of at least 1s: %s", directive, per)
+		}
+	}
+	return n, period, nil
+}
+
+// validate checks a budget given as JSON.
+func (b *ColdStartBudget) validate() error {
+	if b.Count < 1 {
+		return fmt.Errorf("max_cold_starts count must be positive, got %d", b.Count)
+	}
+	if b.PeriodMS < 1000 {
+		return fmt.Errorf("max_cold_starts period must be at least 1s, got %dms", b.PeriodMS)
+	}
+	if b.Status != 0 && (b.Status < 400 || b.Status > 599) {
+		return fmt.Errorf("max_cold_starts status must be a 4xx or 5xx code, got %d", b.Status)
+	}
+	return nil
+}
+
+// coldStartKey names the storage key counting starts of key.
+func (c *ReverseBin) coldStartKey(key string) string {
+	sum := sha256.Sum256([]byte(c.processKeyName(key)))
+	return "reverse_bin/cold_starts/" + hex.EncodeToString(sum[:8])
+}
+
+// store returns the storage the budget is kept in.
+func (c *ReverseBin) store() coldStartStore {
+	if c.coldStartStore != nil {
+		return c.coldStartStore
+	}
+	return c.ctx.Storage()
+}
+
+// spendColdStart takes one start of key from the budget, or returns the
+// error refusing the request once the current period's budget is spent. The
+// returned func gives the start back, for one that failed.
+func (c *ReverseBin) spendColdStart(ctx context.Context, key string) (func(), error) {
+	b := c.MaxColdStarts
+	if b == nil {
+		return func() {}, nil
+	}
+	period := time.Duration(b.PeriodMS) * time.Millisecond
+	window := c.clock().Now().Truncate(period)
+	err := c.updateColdStarts(ctx, key, func(spent *coldStartCount) error {
+		if spent.Window != window.Unix() {
+			*spent = coldStartCount{Window: window.Unix()}
+		}
+		if spent.Count < b.Count {
+			spent.Count++
+			return nil
+		}
+		next := window.Add(period)
+		c.logger.Warn("cold start budget exhausted",
+			zap.String("key", c.processKeyName(key)),
+			zap.Int("max_cold_starts", b.Count),
+			zap.Time("next_period", next))
+		status := b.Status
+		if status == 0 {
+			status = http.StatusTooManyRequests
+		}
+		return caddyhttp.Error(status, fmt.Errorf("backend for %q used all %d cold starts of this period; next period begins %s",
+			c.processKeyName(key), b.Count, next.UTC().Format(time.RFC3339)))
+	})
+	if err != nil {
+		return nil, err
+	}
+	refund := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), coldStartRefundTimeout)
+		defer cancel()
+		err := c.updateColdStarts(ctx, key, func(spent *coldStartCount) error {
+			if spent.Window == window.Unix() && spent.Count > 0 {
+				spent.Count--
+			}
+			return nil
+		})
+		if err != nil {
+			c.logger.Warn("failed to give back cold start of failed start", zap.String("key", c.processKeyName(key)), zap.Error(err))
+		}
+	}
+	return refund, nil
+}
+
+// updateColdStarts applies update to the stored count of key's starts while
+// holding its storage lock, and stores the result unless update fails.
+func (c *ReverseBin) updateColdStarts(ctx context.Context, key string, update func(*coldStartCount) error) error {
+	storage := c.store()
+	name := c.coldStartKey(key)
+	if err := storage.Lock(ctx, name); err != nil {
+		return fmt.Errorf("failed to acquire cold start budget lock: %v", err)
+	}
+	defer func() {
+		if err := storage.Unlock(context.Background(), name); err != nil {
+			c.logger.Warn("failed to release cold start budget lock", zap.String("lock", name), zap.Error(err))
+		}
+	}()
+
+	var spent coldStartCount
+	data, err := storage.Load(ctx, name)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return fmt.Errorf("failed to load cold start budget: %v", err)
+	default:
+		if err := json.Unmarshal(data, &spent); err != nil {
+			c.logger.Warn("resetting unreadable cold start budget", zap.String("key", c.processKeyName(key)), zap.Error(err))
+		}
+	}
+	if err := update(&spent); err != nil {
+		return err
+	}
+	if data, err = json.Marshal(spent); err != nil {
+		return err
+	}
+	if err := storage.Store(ctx, name, data); err != nil {
+		return fmt.Errorf("failed to store cold start budget: %v", err)
+	}
+	return nil
+}
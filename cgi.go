@@ -0,0 +1,138 @@
+package reversebin
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/cgi"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// CGIMode serves a key whose backend is not running by running the executable
+// once per request as a CGI script. Once requests for the key arrive faster
+// than Count per period, it is started as a persistent backend instead, and
+// goes back to CGI after its idle timeout. The executable has to support both
+// modes; under CGI it finds GATEWAY_INTERFACE set.
+type CGIMode struct {
+	// Requests per period at which the key is promoted
+	Count int `json:"count"`
+	// Length of the period in milliseconds
+	PeriodMS int `json:"period_ms"`
+}
+
+// parseCGIMode parses "cgi_until <n>/<period>".
+func parseCGIMode(d *caddyfile.Dispenser) (*CGIMode, error) {
+	var rate string
+	if !d.Args(&rate) {
+		return nil, d.ArgErr()
+	}
+	count, period, err := parseRate(d, "cgi_until", rate)
+	if err != nil {
+		return nil, err
+	}
+	return &CGIMode{Count: count, PeriodMS: int(period.Milliseconds())}, nil
+}
+
+func (m *CGIMode) validate() error {
+	if m.Count < 1 || m.PeriodMS < 1000 {
+		return fmt.Errorf("cgi_until needs a positive count per period of at least 1s")
+	}
+	return nil
+}
+
+// requestRate remembers the times of a key's latest requests or starts.
+type requestRate struct {
+	mu   sync.Mutex
+	hits []time.Time
+}
+
+// add records an event at now and reports whether it is the count-th within
+// period, starting a new count if so.
+func (r *requestRate) add(now time.Time, count int, period time.Duration) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hits = append(r.hits, now)
+	if len(r.hits) > count {
+		r.hits = r.hits[len(r.hits)-count:]
+	}
+	if len(r.hits) < count || now.Sub(r.hits[0]) >= period {
+		return false
+	}
+	r.hits = r.hits[:0]
+	return true
+}
+
+func (r *requestRate) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hits = nil
+}
+
+// serveCGI serves r by running the key's executable as a CGI script, unless
+// the request rate calls for promoting the key to a persistent backend. It
+// reports whether it served the request. The detector runs for the key's
+// first CGI request only, not for every one.
+func (c *ReverseBin) serveCGI(w http.ResponseWriter, r *http.Request, ps *processState, key string) (bool, error) {
+	if ps.running.Load() || ps.starting.Load() {
+		return false, nil
+	}
+	if ps.cgiRate.add(c.clock().Now(), c.CGI.Count, time.Duration(c.CGI.PeriodMS)*time.Millisecond) {
+		c.logger.Info("promoting CGI key to a persistent backend",
+			zap.String("key", c.processKeyName(key)),
+			zap.Int("requests", c.CGI.Count),
+			zap.Duration("period", time.Duration(c.CGI.PeriodMS)*time.Millisecond))
+		// The persistent backend detects afresh, and so will CGI requests
+		// once it has gone idle.
+		ps.cgiOverrides.Store(nil)
+		return false, nil
+	}
+	var err error
+	overrides := ps.cgiOverrides.Load()
+	if overrides == nil {
+		if overrides, err = c.resolveOverrides(r, key); err != nil {
+			return true, caddyhttp.Error(http.StatusBadGateway, err)
+		}
+		ps.cgiOverrides.Store(overrides)
+	}
+	exe := c.wrapExecutable(*overrides.Executable)
+	path := exe[0]
+	// Like exec.Command, bare names are looked up in PATH and other paths
+	// are relative to the working directory.
+	if !strings.ContainsRune(path, filepath.Separator) {
+		if path, err = exec.LookPath(path); err != nil {
+			return true, caddyhttp.Error(http.StatusBadGateway, err)
+		}
+	}
+	handler := &cgi.Handler{
+		Path:   path,
+		Args:   exe[1:],
+		Dir:    *overrides.WorkingDirectory,
+		Env:    append(c.baseEnv(), *overrides.Envs...),
+		Stderr: cgiStderr{c.logger, ps.output},
+	}
+	stripInternal(r.Header)
+	handler.ServeHTTP(w, r)
+	return true, nil
+}
+
+// cgiStderr passes a CGI script's stderr to the key's output, like a
+// persistent backend's.
+type cgiStderr struct {
+	logger *zap.Logger
+	output *outputBuffer
+}
+
+func (s cgiStderr) Write(p []byte) (int, error) {
+	for line := range bytes.Lines(p) {
+		s.output.write(s.logger, 0, "stderr", strings.TrimRight(string(line), "\r\n"))
+	}
+	return len(p), nil
+}
@@ -0,0 +1,65 @@
+//go:build linux
+
+package reversebin
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+var cgroupSeq atomic.Uint64
+
+// backendCgroup is a cgroup v2 directory holding exactly one backend's process tree.
+type backendCgroup struct {
+	path string
+	dir  *os.File
+}
+
+func newBackendCgroup(parent string) (*backendCgroup, error) {
+	// Best effort: the cpu controller must be enabled for children of parent.
+	_ = os.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), []byte("+cpu"), 0o644)
+
+	path := filepath.Join(parent, fmt.Sprintf("reverse-bin-%d-%d", os.Getpid(), cgroupSeq.Add(1)))
+	if err := os.Mkdir(path, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create cgroup: %w", err)
+	}
+	dir, err := os.Open(path)
+	if err != nil {
+		_ = os.Remove(path)
+		return nil, fmt.Errorf("failed to open cgroup: %w", err)
+	}
+	return &backendCgroup{path: path, dir: dir}, nil
+}
+
+func (g *backendCgroup) setCPUMax(cpus float64) error {
+	return os.WriteFile(filepath.Join(g.path, "cpu.max"), []byte(cpuMaxValue(cpus)), 0o644)
+}
+
+// attach makes cmd start directly inside the cgroup, so no child it forks
+// can escape the limit.
+func (g *backendCgroup) attach(cmd *exec.Cmd) {
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(g.dir.Fd())
+}
+
+// populated reports whether any process is still in the cgroup.
+func (g *backendCgroup) populated() bool {
+	events, err := os.ReadFile(filepath.Join(g.path, "cgroup.events"))
+	return err == nil && strings.Contains(string(events), "populated 1")
+}
+
+// kill sends SIGKILL to every process in the cgroup, including ones that
+// left the backend's process group.
+func (g *backendCgroup) kill() error {
+	return os.WriteFile(filepath.Join(g.path, "cgroup.kill"), []byte("1"), 0o644)
+}
+
+// remove deletes the cgroup once its processes are gone.
+func (g *backendCgroup) remove() error {
+	_ = g.dir.Close()
+	return os.Remove(g.path)
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+
+package reversebin
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+type backendCgroup struct{}
+
+func newBackendCgroup(parent string) (*backendCgroup, error) {
+	return nil, fmt.Errorf("cgroups are only supported on Linux")
+}
+
+func (g *backendCgroup) setCPUMax(cpus float64) error { return nil }
+
+func (g *backendCgroup) attach(cmd *exec.Cmd) {}
+
+func (g *backendCgroup) populated() bool { return false }
+
+func (g *backendCgroup) kill() error { return nil }
+
+func (g *backendCgroup) remove() error { return nil }
@@ -10,15 +10,18 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"strings"
-	"syscall"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
-	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	_ "github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	_ "github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	reversebin "github.com/tarasglek/reverse-bin"
 )
 
 // getRepoRoot returns the repository root directory.
@@ -38,6 +41,32 @@ func requireIntegration(t *testing.T) {
 	}
 }
 
+// isolatedEnv names the test that a re-executed test binary runs on its own.
+const isolatedEnv = "REVERSE_BIN_ISOLATED_TEST"
+
+// runIsolated runs t in a test binary of its own, since Caddy runs one
+// configuration per process, so that tests run in parallel. It reports true
+// in the parent, which is then done, and false in the child, which goes on
+// with the test.
+func runIsolated(t *testing.T) bool {
+	t.Helper()
+	if os.Getenv(isolatedEnv) == t.Name() {
+		return false
+	}
+	t.Parallel()
+	cmd := exec.Command(os.Args[0], "-test.run=^"+regexp.QuoteMeta(t.Name())+"$", "-test.v", "-test.count=1")
+	cmd.Env = append(os.Environ(), isolatedEnv+"="+t.Name())
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("isolated run failed: %v\n%s", err, out)
+	}
+	if strings.Contains(string(out), "--- SKIP: "+t.Name()+" ") {
+		t.Skipf("isolated run skipped:\n%s", out)
+	}
+	t.Logf("isolated run:\n%s", out)
+	return true
+}
+
 // GetFreePort asks the kernel for a free open port that is ready to use.
 func GetFreePort() (port int, err error) {
 	var a *net.TCPAddr
@@ -165,20 +194,9 @@ func newTestHTTPClient() *http.Client {
 func assertGetResponse(t *testing.T, client *http.Client, requestURI string, expectedStatusCode int, expectedBodyContains string, invariant string) (*http.Response, string) {
 	t.Helper()
 
-	var (
-		resp *http.Response
-		err  error
-	)
-	deadline := time.Now().Add(2 * time.Second)
-	for {
-		resp, err = client.Get(requestURI)
-		if err == nil {
-			break
-		}
-		if time.Now().After(deadline) {
-			t.Fatalf("%s: failed to call server: %v", invariant, err)
-		}
-		time.Sleep(50 * time.Millisecond)
+	resp, err := client.Get(requestURI)
+	if err != nil {
+		t.Fatalf("%s: failed to call server: %v", invariant, err)
 	}
 	defer resp.Body.Close()
 
@@ -201,10 +219,107 @@ func ptr(s string) *string {
 	return &s
 }
 
+// logRecorder keeps the messages logged by reverse-bin handlers so tests can
+// wait for lifecycle events instead of sleeping.
+type logRecorder struct {
+	mu      sync.Mutex
+	entries []reversebin.LogEntry
+	// changed is closed and replaced whenever an entry is recorded.
+	changed chan struct{}
+}
+
+func newLogRecorder() *logRecorder {
+	return &logRecorder{changed: make(chan struct{})}
+}
+
+func (r *logRecorder) record(e reversebin.LogEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, e)
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// waitFor returns the first entry matching match, waiting up to timeout for
+// it to be logged.
+func (r *logRecorder) waitFor(timeout time.Duration, match func(reversebin.LogEntry) bool) (reversebin.LogEntry, bool) {
+	deadline := time.After(timeout)
+	for {
+		r.mu.Lock()
+		for _, e := range r.entries {
+			if match(e) {
+				r.mu.Unlock()
+				return e, true
+			}
+		}
+		changed := r.changed
+		r.mu.Unlock()
+		select {
+		case <-changed:
+		case <-deadline:
+			return reversebin.LogEntry{}, false
+		}
+	}
+}
+
+// startedPIDs returns the pids of every backend started so far.
+func (r *logRecorder) startedPIDs() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var pids []int
+	for _, e := range r.entries {
+		if pid, ok := e.Fields["pid"].(int64); ok && e.Message == "started proxy subprocess" {
+			pids = append(pids, int(pid))
+		}
+	}
+	return pids
+}
+
 type reverseProxySetup struct {
-	Port int
+	Port      int
+	adminPort int
+	logs      *logRecorder
 }
 
+// waitForExit waits until reverse-bin logs the exit of backend pid and
+// returns that log entry, whose "reason" field says why it stopped.
+func (s *reverseProxySetup) waitForExit(t *testing.T, pid int) reversebin.LogEntry {
+	t.Helper()
+	e, ok := s.logs.waitFor(5*time.Second, func(e reversebin.LogEntry) bool {
+		return e.Message == "proxy subprocess terminated" && e.Fields["pid"] == int64(pid)
+	})
+	if !ok {
+		t.Fatalf("backend pid %d did not exit within timeout", pid)
+	}
+	return e
+}
+
+// teardown unloads the configuration through the admin API and waits for
+// every backend the test started to exit, so no process outlives the test.
+func (s *reverseProxySetup) teardown(t *testing.T) {
+	t.Helper()
+	// Deleting the apps stops the HTTP server and runs each handler's Cleanup.
+	req, _ := http.NewRequest(http.MethodDelete, fmt.Sprintf("http://localhost:%d/config/apps", s.adminPort), nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to unload config via admin API: %v", err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unloading config via admin API returned %d", resp.StatusCode)
+	}
+	for _, pid := range s.logs.startedPIDs() {
+		s.waitForExit(t, pid)
+	}
+	_ = caddy.Stop()
+}
+
+// createReverseProxySetup loads a Caddyfile serving handleBlock into the
+// in-process Caddy. Loading is synchronous, so the server accepts requests
+// once it returns. Caddy runs one configuration per process, so tests using
+// it run in a process of their own through runIsolated, each with its own
+// HTTP and admin ports.
 func createReverseProxySetup(t *testing.T, handleBlock string, values map[string]string) (*reverseProxySetup, func()) {
 	t.Helper()
 
@@ -212,6 +327,10 @@ func createReverseProxySetup(t *testing.T, handleBlock string, values map[string
 	if err != nil {
 		t.Fatalf("failed to get free port: %v", err)
 	}
+	adminPort, err := GetFreePort()
+	if err != nil {
+		t.Fatalf("failed to get free admin port: %v", err)
+	}
 
 	vars := map[string]string{}
 	for k, v := range values {
@@ -219,10 +338,9 @@ func createReverseProxySetup(t *testing.T, handleBlock string, values map[string
 	}
 	resolvedHandle := renderTemplate(handleBlock, vars)
 
-	caddyfilePath := filepath.Join(t.TempDir(), "Caddyfile")
 	fixture := `
 {
-	admin off
+	admin localhost:{{ADMIN_PORT}}
 	http_port {{HTTP_PORT}}
 }
 
@@ -231,23 +349,28 @@ http://localhost:{{HTTP_PORT}} {
 }
 `
 	rendered := renderTemplate(fixture, map[string]string{
+		"ADMIN_PORT":   fmt.Sprintf("%d", adminPort),
 		"HTTP_PORT":    fmt.Sprintf("%d", port),
 		"HANDLE_BLOCK": resolvedHandle,
 	})
-	if err := os.WriteFile(caddyfilePath, []byte(rendered), 0o600); err != nil {
-		t.Fatalf("failed to write temp Caddyfile: %v", err)
+	cfgJSON, _, err := caddyconfig.GetAdapter("caddyfile").Adapt([]byte(rendered), nil)
+	if err != nil {
+		t.Fatalf("failed to adapt Caddyfile: %v", err)
 	}
 
-	prevArgs := os.Args
-	os.Args = []string{"caddy", "run", "--config", caddyfilePath, "--adapter", "caddyfile"}
-	go caddycmd.Main()
+	setup := &reverseProxySetup{Port: port, adminPort: adminPort, logs: newLogRecorder()}
+	stopLogs := reversebin.ObserveLogs(setup.logs.record)
+	if err := caddy.Load(cfgJSON, true); err != nil {
+		stopLogs()
+		t.Fatalf("failed to load config: %v", err)
+	}
 
 	dispose := func() {
-		os.Args = prevArgs
-		_ = caddy.Stop()
+		defer stopLogs()
+		setup.teardown(t)
 	}
 
-	return &reverseProxySetup{Port: port}, dispose
+	return setup, dispose
 }
 
 func createBasicReverseProxySetup(t *testing.T, f fixtures) (*reverseProxySetup, func()) {
@@ -273,6 +396,9 @@ func createBasicReverseProxySetup(t *testing.T, f fixtures) (*reverseProxySetup,
 // verify one request succeeds through the Unix-socket backend.
 func TestBasicReverseProxy(t *testing.T) {
 	requireIntegration(t)
+	if runIsolated(t) {
+		return
+	}
 
 	setup, dispose := createBasicReverseProxySetup(t, mustFixtures(t))
 	defer dispose()
@@ -289,6 +415,9 @@ func TestBasicReverseProxy(t *testing.T) {
 //  3. Second request via Caddy succeeds and returns a different PID (restarted process).
 func TestProcessCrashAndRestart(t *testing.T) {
 	requireIntegration(t)
+	if runIsolated(t) {
+		return
+	}
 	f := mustFixtures(t)
 
 	socketPath := createSocketPath(t)
@@ -338,17 +467,9 @@ func TestProcessCrashAndRestart(t *testing.T) {
 		_ = resp.Body.Close()
 	}
 
-	// Wait until crashed process PID is gone.
-	deadline := time.Now().Add(2 * time.Second)
-	for {
-		err := syscall.Kill(pid1, 0)
-		if err != nil {
-			break
-		}
-		if time.Now().After(deadline) {
-			t.Fatalf("backend pid %d did not exit after /crash within timeout", pid1)
-		}
-		time.Sleep(25 * time.Millisecond)
+	// Wait until reverse-bin has noticed the crash.
+	if e := setup.waitForExit(t, pid1); e.Fields["reason"] != "unexpected exit" {
+		t.Fatalf("crashed backend must be reported as an unexpected exit, got %v", e.Fields["reason"])
 	}
 
 	// Second request via Caddy must succeed and come from a new backend PID.
@@ -367,6 +488,9 @@ func TestProcessCrashAndRestart(t *testing.T) {
 //     served by static route. This proves matcher scoping + discovery/proxy flow.
 func TestDynamicDiscovery(t *testing.T) {
 	requireIntegration(t)
+	if runIsolated(t) {
+		return
+	}
 	f := mustFixtures(t)
 
 	socketPath := createSocketPath(t)
@@ -417,6 +541,9 @@ print(json.dumps(result))
 // executable main.py apps and routes requests through the discovered backend.
 func TestDynamicDiscovery_WithDiscoverAppPython(t *testing.T) {
 	requireIntegration(t)
+	if runIsolated(t) {
+		return
+	}
 	f := mustFixtures(t)
 	requireCommand(t, "uv")
 
@@ -442,6 +569,9 @@ func TestDynamicDiscovery_WithDiscoverAppPython(t *testing.T) {
 // main.ts apps and routes requests through the deno backend.
 func TestDynamicDiscovery_WithDiscoverAppDeno(t *testing.T) {
 	requireIntegration(t)
+	if runIsolated(t) {
+		return
+	}
 	f := mustFixtures(t)
 	requireCommand(t, "uv")
 	requireCommand(t, "deno")
@@ -468,6 +598,9 @@ func TestDynamicDiscovery_WithDiscoverAppDeno(t *testing.T) {
 // dynamic detector exits non-zero for a dynamic route.
 func TestDynamicDiscovery_DetectorFailure(t *testing.T) {
 	requireIntegration(t)
+	if runIsolated(t) {
+		return
+	}
 
 	failDetector := createExecutableScript(t, t.TempDir(), "detector-fail.py", `#!/usr/bin/env python3
 import sys
@@ -497,6 +630,9 @@ sys.exit(2)
 // TestReadinessCheck verifies Unix readiness behavior for GET, HEAD, and null readiness_check.
 func TestReadinessCheck(t *testing.T) {
 	requireIntegration(t)
+	if runIsolated(t) {
+		return
+	}
 	f := mustFixtures(t)
 
 	testCases := []struct {
@@ -573,6 +709,9 @@ func TestReadinessCheck(t *testing.T) {
 // cannot succeed and reverse-bin must fail request with service unavailable.
 func TestReadinessFailureTimeout(t *testing.T) {
 	requireIntegration(t)
+	if runIsolated(t) {
+		return
+	}
 
 	port, err := GetFreePort()
 	if err != nil {
@@ -604,6 +743,9 @@ sleep 30
 // TestLifecycleIdleTimeout verifies a backend process is terminated after configured idle_timeout_ms.
 func TestLifecycleIdleTimeout(t *testing.T) {
 	requireIntegration(t)
+	if runIsolated(t) {
+		return
+	}
 	f := mustFixtures(t)
 
 	socketPath := createSocketPath(t)
@@ -642,8 +784,10 @@ func TestLifecycleIdleTimeout(t *testing.T) {
 	_, body1 := assertGetResponse(t, client, fmt.Sprintf("http://localhost:%d/test/first", setup.Port), 200, "", "first idle-timeout request must start backend and return pid")
 	pid1 := parsePID(t, body1)
 
-	// Wait without traffic so idle timeout can fire naturally.
-	time.Sleep(250 * time.Millisecond)
+	// Without traffic the idle timeout fires and stops the backend.
+	if e := setup.waitForExit(t, pid1); e.Fields["reason"] != "idle timeout" {
+		t.Fatalf("backend must be stopped by the idle timeout, got %v", e.Fields["reason"])
+	}
 
 	// Next request should be served by a newly spawned process.
 	_, body2 := assertGetResponse(t, client, fmt.Sprintf("http://localhost:%d/test/second", setup.Port), 200, "", "second idle-timeout request must succeed after respawn")
@@ -657,6 +801,9 @@ func TestLifecycleIdleTimeout(t *testing.T) {
 // with separate Unix sockets and processes.
 func TestMultipleApps(t *testing.T) {
 	requireIntegration(t)
+	if runIsolated(t) {
+		return
+	}
 	f := mustFixtures(t)
 
 	socket1 := createSocketPath(t)
@@ -722,6 +869,9 @@ func TestMultipleApps(t *testing.T) {
 // TestAllowDomainViaPathWildcard validates /allow/{app} path wildcard mapping to allow-domain checker decisions.
 func TestAllowDomainViaPathWildcard(t *testing.T) {
 	requireIntegration(t)
+	if runIsolated(t) {
+		return
+	}
 
 	appRoot := t.TempDir()
 	if err := os.Mkdir(filepath.Join(appRoot, "existingapp"), 0o755); err != nil {
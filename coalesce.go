@@ -0,0 +1,156 @@
+package reversebin
+
+import (
+	"bytes"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// coalesceMaxBody caps the response a coalesced request buffers for its
+// followers; larger responses are not shared.
+const coalesceMaxBody = 1 << 20
+
+// coalescer merges identical GET and HEAD requests that arrive while a key's
+// backend is cold: the first is proxied and its response is replayed to the
+// others once the backend has answered.
+type coalescer struct {
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+// coalescedCall is one proxied request and the response it recorded.
+type coalescedCall struct {
+	done     chan struct{}
+	shared   bool
+	status   int
+	header   http.Header
+	body     bytes.Buffer
+	overflow bool
+}
+
+// coalesceKey identifies requests that may share a response. Credentials
+// are part of it so responses never cross between users, and so are the
+// negotiated representation headers so a client never gets an encoding or
+// type it did not ask for. Range requests are not coalesced.
+func coalesceKey(r *http.Request) (string, bool) {
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) || r.ContentLength > 0 || r.Header.Get("Range") != "" {
+		return "", false
+	}
+	return strings.Join([]string{
+		r.Method, r.Host, r.URL.RequestURI(),
+		r.Header.Get("Authorization"), r.Header.Get("Cookie"),
+		r.Header.Get("Accept"), r.Header.Get("Accept-Encoding"),
+	}, "\x00"), true
+}
+
+// join returns the call r should wait for, or nil after registering r as the
+// leader whose response is shared. lead is non-nil for the leader only.
+func (co *coalescer) join(r *http.Request) (wait, lead *coalescedCall, key string) {
+	key, ok := coalesceKey(r)
+	if !ok {
+		return nil, nil, ""
+	}
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	if call, ok := co.calls[key]; ok {
+		return call, nil, key
+	}
+	if co.calls == nil {
+		co.calls = make(map[string]*coalescedCall)
+	}
+	call := &coalescedCall{done: make(chan struct{})}
+	co.calls[key] = call
+	return nil, call, key
+}
+
+// finish publishes the leader's response to its followers. Responses that
+// failed, were too large or are private to the client are not shared.
+func (co *coalescer) finish(key string, call *coalescedCall, failed bool) {
+	co.mu.Lock()
+	delete(co.calls, key)
+	co.mu.Unlock()
+	call.shared = !failed && call.status != 0 && !call.overflow && shareable(call.status, call.header)
+	close(call.done)
+}
+
+// shareable reports whether a response may be replayed to other clients.
+// Partial responses and those that vary on headers outside coalesceKey are
+// not, nor are those setting cookies of the backend's; the affinity cookie
+// is left out of the recorded headers beforehand.
+func shareable(status int, h http.Header) bool {
+	if status == http.StatusPartialContent || h.Get("Set-Cookie") != "" || h.Get("Vary") != "" {
+		return false
+	}
+	cc := strings.ToLower(h.Get("Cache-Control"))
+	return !strings.Contains(cc, "private") && !strings.Contains(cc, "no-store")
+}
+
+// replay writes the leader's response to w.
+func (call *coalescedCall) replay(w http.ResponseWriter) error {
+	for name, values := range call.header {
+		w.Header()[name] = slices.Clone(values)
+	}
+	w.WriteHeader(call.status)
+	_, err := w.Write(call.body.Bytes())
+	return err
+}
+
+// cold reports whether the key's backend is starting or not running, the
+// only time requests are coalesced. It does not take ps.mu, which a cold
+// start holds throughout.
+func (ps *processState) cold() bool {
+	return ps.starting.Load() || !ps.running.Load()
+}
+
+// recorder passes the leader's response through while keeping a copy.
+type recorder struct {
+	*caddyhttp.ResponseWriterWrapper
+	call *coalescedCall
+	// ownCookie names the replica_affinity cookie set for the leader's
+	// client, which is left out of the copy; followers get their own
+	ownCookie string
+}
+
+func (rec *recorder) WriteHeader(status int) {
+	// 1xx responses, such as cold start hints, are not the response.
+	if status >= 200 && rec.call.status == 0 {
+		rec.call.status = status
+		rec.call.header = rec.Header().Clone()
+		if rec.ownCookie != "" {
+			dropCookie(rec.call.header, rec.ownCookie)
+		}
+	}
+	rec.ResponseWriterWrapper.WriteHeader(status)
+}
+
+// dropCookie removes the Set-Cookie headers of h that set the cookie name.
+func dropCookie(h http.Header, name string) {
+	kept := slices.DeleteFunc(h["Set-Cookie"], func(v string) bool {
+		cookie, err := http.ParseSetCookie(v)
+		return err == nil && cookie.Name == name
+	})
+	if len(kept) == 0 {
+		delete(h, "Set-Cookie")
+	} else {
+		h["Set-Cookie"] = kept
+	}
+}
+
+func (rec *recorder) Write(b []byte) (int, error) {
+	if rec.call.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if !rec.call.overflow {
+		if rec.call.body.Len()+len(b) > coalesceMaxBody {
+			rec.call.overflow = true
+			rec.call.body = bytes.Buffer{}
+		} else {
+			rec.call.body.Write(b)
+		}
+	}
+	return rec.ResponseWriterWrapper.Write(b)
+}
@@ -0,0 +1,170 @@
+package reversebin
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "reverse-bin",
+		Usage: "ps|stop <key>|warm <key>|logs <key> [--address <admin-api-address>] [--config <path> [--adapter <name>]]",
+		Short: "Manages reverse-bin backends of a running Caddy",
+		Long: `
+Lists, stops, starts and tails the backends of reverse-bin handlers through
+the admin endpoint of a running Caddy instance.
+
+	ps            lists every process key with its state and PID
+	stop <key>    stops a backend; the next request starts it again
+	warm <key>    starts a backend ahead of traffic and waits until it is ready
+	logs <key>    follows a backend's output
+
+<key> is the detector key for dynamic handlers, or the reverse_proxy_to
+address of a static handler. stop and warm also take a glob such as
+'tenant-*' and then act on every matching key. The admin endpoint is found like for
+'caddy stop': --address, else the admin address of --config, else the
+default.`,
+		CobraFunc: func(cmd *cobra.Command) {
+			cmd.PersistentFlags().String("address", "", "The address to use to reach the admin API endpoint, if not the default")
+			cmd.PersistentFlags().StringP("config", "c", "", "Configuration file to use to parse the admin address, if --address is not used")
+			cmd.PersistentFlags().StringP("adapter", "a", "", "Name of config adapter to apply (when --config is used)")
+			cmd.AddCommand(
+				&cobra.Command{
+					Use:   "ps",
+					Short: "Lists reverse-bin backends",
+					Args:  cobra.NoArgs,
+					RunE:  caddycmd.WrapCommandFuncForCobra(cmdPs),
+				},
+				&cobra.Command{
+					Use:   "stop <key>",
+					Short: "Stops a reverse-bin backend",
+					Args:  cobra.ExactArgs(1),
+					RunE:  caddycmd.WrapCommandFuncForCobra(cmdKeyAction("stop")),
+				},
+				&cobra.Command{
+					Use:   "warm <key>",
+					Short: "Starts a reverse-bin backend ahead of traffic",
+					Args:  cobra.ExactArgs(1),
+					RunE:  caddycmd.WrapCommandFuncForCobra(cmdKeyAction("warm")),
+				},
+				&cobra.Command{
+					Use:   "logs <key>",
+					Short: "Follows the output of a reverse-bin backend",
+					Args:  cobra.ExactArgs(1),
+					RunE:  caddycmd.WrapCommandFuncForCobra(cmdLogs),
+				},
+				&cobra.Command{
+					Use:                sandboxCommand + " [tmpfs=<path>|bind=<path>]... -- <command> [args...]",
+					Short:              "Runs a backend with an isolated filesystem (used internally)",
+					Hidden:             true,
+					DisableFlagParsing: true,
+					RunE: func(_ *cobra.Command, args []string) error {
+						return runSandboxed(args)
+					},
+				},
+			)
+		},
+	})
+}
+
+// adminRequest sends a request to the admin endpoint selected by the flags.
+func adminRequest(fl caddycmd.Flags, method, uri string) (*http.Response, error) {
+	addr, err := caddycmd.DetermineAdminAPIAddress(fl.String("address"), nil, fl.String("config"), fl.String("adapter"))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't determine admin API address: %v", err)
+	}
+	return caddycmd.AdminAPIRequest(addr, method, uri, nil, nil)
+}
+
+func cmdPs(fl caddycmd.Flags) (int, error) {
+	resp, err := adminRequest(fl, http.MethodGet, "/reverse-bin/processes")
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer resp.Body.Close()
+	var list []processInfo
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("decoding process list: %v", err)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tSTATE\tPID\tACTIVE\tUPSTREAM")
+	for _, p := range list {
+		pid := "-"
+		if p.PID != 0 {
+			pid = fmt.Sprint(p.PID)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n", p.Key, p.State, pid, p.ActiveRequests, p.Upstream)
+	}
+	return caddy.ExitCodeSuccess, tw.Flush()
+}
+
+// cmdKeyAction posts to /reverse-bin/<action>?key=<key>. For a glob, it
+// prints the outcome for each matching key and fails if any failed.
+func cmdKeyAction(action string) caddycmd.CommandFunc {
+	return func(fl caddycmd.Flags) (int, error) {
+		key := fl.Arg(0)
+		resp, err := adminRequest(fl, http.MethodPost, "/reverse-bin/"+action+"?key="+url.QueryEscape(key))
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNoContent {
+			return caddy.ExitCodeSuccess, nil
+		}
+		var results []keyResult
+		if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("decoding results: %v", err)
+		}
+		failed := 0
+		for _, res := range results {
+			if res.Error != "" {
+				failed++
+				fmt.Printf("%s: %s\n", res.Key, res.Error)
+			} else {
+				fmt.Printf("%s: ok\n", res.Key)
+			}
+		}
+		if failed > 0 {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("%s failed for %d of %d keys", action, failed, len(results))
+		}
+		return caddy.ExitCodeSuccess, nil
+	}
+}
+
+// cmdLogs prints a backend's output as it arrives until interrupted.
+func cmdLogs(fl caddycmd.Flags) (int, error) {
+	key := fl.Arg(0)
+	resp, err := adminRequest(fl, http.MethodGet, "/reverse-bin/logs?key="+url.QueryEscape(key))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer resp.Body.Close()
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		data, ok := strings.CutPrefix(sc.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var line outputLine
+		if err := json.Unmarshal([]byte(data), &line); err != nil {
+			continue
+		}
+		out := os.Stdout
+		if line.Stream == "stderr" {
+			out = os.Stderr
+		}
+		fmt.Fprintln(out, line.Text)
+	}
+	return caddy.ExitCodeSuccess, sc.Err()
+}
@@ -0,0 +1,84 @@
+package reversebin
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// defaultCompatMaxBuffer is the largest chunked request body compat_mode
+// buffers unless configured otherwise.
+const defaultCompatMaxBuffer = 10 << 20
+
+// CompatMode normalizes requests for backends whose HTTP servers mishandle
+// some of HTTP/1.1, such as tiny script servers: Expect: 100-continue is
+// answered by Caddy and chunked bodies are sent with a Content-Length.
+type CompatMode struct {
+	// Largest chunked request body buffered (default, 10MiB); larger ones are
+	// refused with 413
+	MaxBufferBytes int64 `json:"max_buffer_bytes,omitempty"`
+}
+
+// parseCompatMode parses "compat_mode [max_buffer <size>]".
+func parseCompatMode(d *caddyfile.Dispenser) (*CompatMode, error) {
+	args := d.RemainingArgs()
+	m := &CompatMode{}
+	switch len(args) {
+	case 0:
+	case 2:
+		size, err := parseByteSize(args[1])
+		if args[0] != "max_buffer" || err != nil || size < 1 {
+			return nil, d.Errf("compat_mode expects max_buffer <size> with a positive size, got %s %s", args[0], args[1])
+		}
+		m.MaxBufferBytes = size
+	default:
+		return nil, d.ArgErr()
+	}
+	return m, nil
+}
+
+func (m *CompatMode) maxBuffer() int64 {
+	if m.MaxBufferBytes > 0 {
+		return m.MaxBufferBytes
+	}
+	return defaultCompatMaxBuffer
+}
+
+// normalizeRequest rewrites r under compat_mode before it is proxied. Caddy
+// sends 100 Continue itself once the body is read, so Expect is dropped, and
+// a body of unknown length is read into memory so the backend gets it with a
+// Content-Length instead of chunked. HTTP/1.0 requests go on as HTTP/1.1.
+func (c *ReverseBin) normalizeRequest(r *http.Request) error {
+	m := c.CompatMode
+	if m == nil {
+		return nil
+	}
+	r.Header.Del("Expect")
+	r.Proto, r.ProtoMajor, r.ProtoMinor = "HTTP/1.1", 1, 1
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength >= 0 {
+		return nil
+	}
+
+	limit := m.maxBuffer()
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	r.Body.Close()
+	if err != nil {
+		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("failed to buffer request body: %w", err))
+	}
+	if int64(len(body)) > limit {
+		return caddyhttp.Error(http.StatusRequestEntityTooLarge,
+			fmt.Errorf("chunked request body exceeds the compat_mode buffer of %d bytes", limit))
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	r.ContentLength = int64(len(body))
+	r.TransferEncoding = nil
+	r.Header.Del("Transfer-Encoding")
+	return nil
+}
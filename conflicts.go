@@ -0,0 +1,114 @@
+package reversebin
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// upstreamIdentity names the socket or port a static handler's backend binds,
+// so that spellings of the same address compare equal.
+func upstreamIdentity(addr string) string {
+	if isUnixUpstream(addr) {
+		return "unix/" + filepath.Clean(strings.TrimPrefix(addr, "unix/"))
+	}
+	host, port, err := net.SplitHostPort(readinessAddress(addr))
+	if err != nil {
+		return addr
+	}
+	switch host {
+	case "", "localhost", "127.0.0.1", "::1":
+		host = "loopback"
+	}
+	return host + ":" + port
+}
+
+// checkUpstreamConflicts fails provisioning when another handler of the same
+// configuration starts a different executable on the same socket or port;
+// the two backends would otherwise take turns replacing each other.
+// Handlers of a configuration being replaced by a reload are not compared.
+func (c *ReverseBin) checkUpstreamConflicts() error {
+	// Ports from port_range are allocated without overlap.
+	if c.ReverseProxyTo == "" || len(c.Executable) == 0 || c.Kubernetes != nil ||
+		strings.Contains(c.ReverseProxyTo, portPlaceholder) {
+		return nil
+	}
+	id := upstreamIdentity(c.ReverseProxyTo)
+	handlers.mu.Lock()
+	defer handlers.mu.Unlock()
+	for other := range handlers.set {
+		if other == c || other.ctx.Context != c.ctx.Context || other.Kubernetes != nil {
+			continue
+		}
+		if other.ReverseProxyTo == "" || upstreamIdentity(other.ReverseProxyTo) != id {
+			continue
+		}
+		if !slices.Equal(other.Executable, c.Executable) || other.WorkingDirectory != c.WorkingDirectory {
+			return fmt.Errorf("reverse_proxy_to %s is also used by another reverse-bin handler running %q; each backend needs its own socket or port",
+				c.ReverseProxyTo, strings.Join(other.Executable, " "))
+		}
+	}
+	return nil
+}
+
+// probeUpstreams fails provisioning under probe_upstream when something
+// already accepts connections on a socket or port the handler's backends
+// bind, as an unrelated service would; proxying to it would go unnoticed.
+// Backends of reverse-bin handlers, such as those of the configuration a
+// reload replaces, are not conflicts.
+func (c *ReverseBin) probeUpstreams() error {
+	if !c.ProbeUpstream {
+		return nil
+	}
+	addrs := []string{c.ReverseProxyTo}
+	for _, app := range c.Apps {
+		addrs = append(addrs, app.ReverseProxyTo)
+	}
+	for _, addr := range addrs {
+		// Ports from port_range and copies' addresses are only known at start.
+		if addr == "" || strings.Contains(addr, portPlaceholder) || strings.Contains(addr, instancePlaceholder) {
+			continue
+		}
+		if !upstreamReachable(addr) || backendListening(upstreamIdentity(addr)) {
+			continue
+		}
+		return fmt.Errorf("reverse_proxy_to %s already accepts connections from a process reverse-bin did not start; stop it or pick another socket or port", addr)
+	}
+	return nil
+}
+
+// backendListening reports whether a reverse-bin handler has a backend
+// running or starting that binds the socket or port id.
+func backendListening(id string) bool {
+	handlers.mu.Lock()
+	defer handlers.mu.Unlock()
+	for other := range handlers.set {
+		if !other.binds(id) {
+			continue
+		}
+		other.mu.Lock()
+		for _, ps := range other.processes {
+			if ps.running.Load() || ps.starting.Load() {
+				other.mu.Unlock()
+				return true
+			}
+		}
+		other.mu.Unlock()
+	}
+	return false
+}
+
+// binds reports whether the backends of c are configured to bind id.
+func (c *ReverseBin) binds(id string) bool {
+	if c.ReverseProxyTo != "" && upstreamIdentity(c.ReverseProxyTo) == id {
+		return true
+	}
+	for _, app := range c.Apps {
+		if app.ReverseProxyTo != "" && upstreamIdentity(app.ReverseProxyTo) == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,189 @@
+package reversebin
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// CaptureCore lets backends write core dumps and collects the dump of a
+// backend that crashed, so native backends can be debugged post-mortem.
+// Where the kernel writes the dump is set system-wide by
+// kernel.core_pattern; reverse-bin only finds it and optionally moves it.
+type CaptureCore struct {
+	// Core size limit in MiB (0 = unlimited)
+	MaxMB int `json:"max_mb,omitempty"`
+	// Directory dumps are moved to as core.<key>.<pid> (default, left where the kernel wrote them)
+	Dir string `json:"dir,omitempty"`
+}
+
+// parseCaptureCore parses "capture_core [on|off] { max_mb <n>; dir <path> }".
+// It returns nil for off.
+func parseCaptureCore(d *caddyfile.Dispenser) (*CaptureCore, error) {
+	cc := new(CaptureCore)
+	switch args := d.RemainingArgs(); {
+	case len(args) > 1:
+		return nil, d.ArgErr()
+	case len(args) == 0 || args[0] == "on":
+	case args[0] == "off":
+		cc = nil
+	default:
+		return nil, d.Errf("capture_core must be on or off, got %q", args[0])
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		if cc == nil {
+			return nil, d.Err("capture_core off takes no block")
+		}
+		name := d.Val()
+		if !d.NextArg() {
+			return nil, d.ArgErr()
+		}
+		switch name {
+		case "max_mb":
+			v, err := strconv.Atoi(d.Val())
+			if err != nil || v <= 0 {
+				return nil, d.Err("max_mb must be a positive integer")
+			}
+			cc.MaxMB = v
+		case "dir":
+			cc.Dir = d.Val()
+		default:
+			return nil, d.Errf("unknown capture_core subdirective: %q", name)
+		}
+	}
+	return cc, nil
+}
+
+// limit returns the RLIMIT_CORE value for backends.
+func (cc *CaptureCore) limit() uint64 {
+	if cc.MaxMB == 0 {
+		return ^uint64(0)
+	}
+	return uint64(cc.MaxMB) << 20
+}
+
+// dumpedCore reports whether a backend's exit error says it dumped core.
+func dumpedCore(err error) bool {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return false
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	return ok && status.CoreDump()
+}
+
+// collect returns where the core dump of the backend pid, run in dir, ended
+// up, after moving it to cc.Dir if configured. It returns "" when the dump
+// cannot be found.
+func (cc *CaptureCore) collect(logger *zap.Logger, key string, pid int, dir string) string {
+	raw, err := os.ReadFile("/proc/sys/kernel/core_pattern")
+	if err != nil {
+		return ""
+	}
+	pattern := strings.TrimSpace(string(raw))
+	if helper, ok := strings.CutPrefix(pattern, "|"); ok {
+		// systemd-coredump and friends keep the dump themselves.
+		if fields := strings.Fields(helper); len(fields) > 0 {
+			helper = fields[0]
+		}
+		return "piped to " + helper
+	}
+	usesPID, _ := os.ReadFile("/proc/sys/kernel/core_uses_pid")
+	glob := expandCorePattern(pattern, pid, strings.TrimSpace(string(usesPID)) == "1")
+	if !filepath.IsAbs(glob) {
+		glob = filepath.Join(dir, glob)
+	}
+	path := newestMatch(glob)
+	if path == "" || cc.Dir == "" {
+		return path
+	}
+	if err := os.MkdirAll(cc.Dir, 0o755); err != nil {
+		logger.Warn("cannot create capture_core dir", zap.String("dir", cc.Dir), zap.Error(err))
+		return path
+	}
+	target := filepath.Join(cc.Dir, fmt.Sprintf("core.%s.%d", escapeKey(key), pid))
+	if err := os.Rename(path, target); err != nil {
+		logger.Warn("cannot move core dump", zap.String("core", path), zap.String("dir", cc.Dir), zap.Error(err))
+		return path
+	}
+	return target
+}
+
+// expandCorePattern turns a kernel.core_pattern into a glob matching the dump
+// of pid: %p and %P become the PID and every other specifier a wildcard.
+func expandCorePattern(pattern string, pid int, usesPID bool) string {
+	var b strings.Builder
+	hasPID := false
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' || i+1 == len(pattern) {
+			b.WriteByte(pattern[i])
+			continue
+		}
+		i++
+		switch pattern[i] {
+		case '%':
+			b.WriteByte('%')
+		case 'p', 'P':
+			b.WriteString(strconv.Itoa(pid))
+			hasPID = true
+		default:
+			b.WriteByte('*')
+		}
+	}
+	if usesPID && !hasPID {
+		b.WriteString("." + strconv.Itoa(pid))
+	}
+	return b.String()
+}
+
+// newestMatch returns the most recently modified file matching glob.
+func newestMatch(glob string) string {
+	matches, _ := filepath.Glob(glob)
+	var newest string
+	var newestInfo os.FileInfo
+	for _, m := range matches {
+		info, err := os.Stat(m)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if newestInfo == nil || info.ModTime().After(newestInfo.ModTime()) {
+			newest, newestInfo = m, info
+		}
+	}
+	return newest
+}
+
+// escapeKey encodes a process key for use in a file name. Bytes other than
+// letters, digits, '.', '-' and '_' become %XX, so distinct keys never share
+// a name and the result holds no path separator.
+func escapeKey(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		ch := key[i]
+		if ch == '.' || ch == '-' || ch == '_' || ch >= '0' && ch <= '9' || ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' {
+			b.WriteByte(ch)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", ch)
+	}
+	return b.String()
+}
+
+// keyFileName returns the escaped process key for use as a path element,
+// e.g. a directory per key. Empty keys and keys starting with a dot, which
+// include "." and "..", are refused, so the element never names a hidden
+// file or leaves its parent directory.
+func keyFileName(key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, ".") {
+		return "", fmt.Errorf("process key %q cannot be used in a file path", key)
+	}
+	return escapeKey(key), nil
+}
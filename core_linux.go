@@ -0,0 +1,19 @@
+//go:build linux
+
+package reversebin
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// setCoreLimit sets RLIMIT_CORE of the running process pid.
+func setCoreLimit(pid int, limit uint64) error {
+	rlim := syscall.Rlimit{Cur: limit, Max: limit}
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), syscall.RLIMIT_CORE,
+		uintptr(unsafe.Pointer(&rlim)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
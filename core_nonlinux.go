@@ -0,0 +1,9 @@
+//go:build !linux
+
+package reversebin
+
+import "fmt"
+
+func setCoreLimit(pid int, limit uint64) error {
+	return fmt.Errorf("capture_core is only supported on Linux")
+}
@@ -0,0 +1,69 @@
+package reversebin
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// cpuPeriodMicros is the cgroup v2 cpu.max period used for all quotas.
+const cpuPeriodMicros = 100000
+
+// CPULimit confines each backend to its own cgroup v2 CPU quota. A higher
+// quota can be granted while the backend starts (JIT-heavy runtimes need a
+// brief burst) and is tightened once it passes readiness.
+type CPULimit struct {
+	// Delegated cgroup v2 directory under which per-backend cgroups are created
+	CgroupParent string `json:"cgroup_parent"`
+	// Steady-state CPU limit in CPUs, e.g. 0.5 (0 = unlimited)
+	Max float64 `json:"max,omitempty"`
+	// CPU limit in CPUs until the backend is ready (0 = same as Max)
+	StartupBurst float64 `json:"startup_cpu_burst,omitempty"`
+}
+
+func (l *CPULimit) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "cgroup_parent":
+			if !d.Args(&l.CgroupParent) {
+				return d.ArgErr()
+			}
+		case "max", "startup_cpu_burst":
+			name := d.Val()
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			v, err := strconv.ParseFloat(d.Val(), 64)
+			if err != nil || v < 0 {
+				return d.Errf("%s must be a number of CPUs, or 0 for no limit", name)
+			}
+			if name == "max" {
+				l.Max = v
+			} else {
+				l.StartupBurst = v
+			}
+		default:
+			return d.Errf("unknown cpu_limit subdirective: %q", d.Val())
+		}
+	}
+	if l.CgroupParent == "" {
+		return d.Err("cpu_limit requires cgroup_parent")
+	}
+	return nil
+}
+
+func (l *CPULimit) startupQuota() float64 {
+	if l.StartupBurst > 0 {
+		return l.StartupBurst
+	}
+	return l.Max
+}
+
+// cpuMaxValue formats a CPU count as the contents of a cgroup v2 cpu.max file.
+func cpuMaxValue(cpus float64) string {
+	if cpus <= 0 {
+		return fmt.Sprintf("max %d", cpuPeriodMicros)
+	}
+	return fmt.Sprintf("%d %d", int64(cpus*cpuPeriodMicros), cpuPeriodMicros)
+}
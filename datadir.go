@@ -0,0 +1,175 @@
+package reversebin
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// dataDirMarker is created in every data directory reverse-bin manages. Its
+// modification time records when the key last ran, and only directories
+// containing it are ever garbage-collected.
+const dataDirMarker = ".reverse-bin"
+
+// dataDirGCInterval is how often unused data directories are looked for.
+const dataDirGCInterval = time.Hour
+
+// minDataDirGCAfter keeps gc_after well above the interval at which running
+// backends refresh their markers.
+const minDataDirGCAfter = 24 * time.Hour
+
+// DataDir gives each process key a persistent directory, created on its first
+// start and passed to the backend as REVERSE_BIN_DATA_DIR.
+type DataDir struct {
+	// Directory per key; {reverse_bin.key} is replaced by the escaped key
+	Path string `json:"path"`
+	// Remove directories of keys that have not run for this many
+	// milliseconds (0 = keep forever)
+	GCAfterMS int `json:"gc_after_ms,omitempty"`
+}
+
+func (dd *DataDir) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	args := d.RemainingArgs()
+	if len(args) != 1 {
+		return d.ArgErr()
+	}
+	dd.Path = args[0]
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "gc_after":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil || dur < time.Millisecond {
+				return d.Errf("gc_after must be a positive duration: %s", d.Val())
+			}
+			dd.GCAfterMS = int(dur.Milliseconds())
+		default:
+			return d.Errf("unknown data_dir subdirective: %q", d.Val())
+		}
+	}
+	return nil
+}
+
+func (dd *DataDir) validate() error {
+	if dd.GCAfterMS > 0 && dd.GCAfterMS < int(minDataDirGCAfter.Milliseconds()) {
+		return fmt.Errorf("data_dir gc_after must be at least %s", minDataDirGCAfter)
+	}
+	if dd.GCAfterMS > 0 && !strings.Contains(dd.Path, "{"+keyPlaceholder+"}") {
+		return fmt.Errorf("data_dir gc_after requires {%s} in the path", keyPlaceholder)
+	}
+	return nil
+}
+
+// dirFor returns the data directory of the process key named name. Keys that
+// cannot be a path element, such as "..", are refused.
+func (dd *DataDir) dirFor(name string) (string, error) {
+	if !strings.Contains(dd.Path, "{"+keyPlaceholder+"}") {
+		return dd.Path, nil
+	}
+	elem, err := keyFileName(name)
+	if err != nil {
+		return "", fmt.Errorf("data_dir: %v", err)
+	}
+	return strings.ReplaceAll(dd.Path, "{"+keyPlaceholder+"}", elem), nil
+}
+
+// prepare creates the data directory of name if needed, marks it as used now
+// and returns the environment passing it to the backend.
+func (dd *DataDir) prepare(name string) ([]string, error) {
+	dir, err := dd.dirFor(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("creating data_dir: %v", err)
+	}
+	if err := dd.touch(name); err != nil {
+		return nil, fmt.Errorf("marking data_dir: %v", err)
+	}
+	return []string{"REVERSE_BIN_DATA_DIR=" + dir}, nil
+}
+
+// touch records that the key named name ran until now.
+func (dd *DataDir) touch(name string) error {
+	dir, err := dd.dirFor(name)
+	if err != nil {
+		return err
+	}
+	marker := filepath.Join(dir, dataDirMarker)
+	if err := os.WriteFile(marker, nil, 0o600); err != nil {
+		return err
+	}
+	now := time.Now()
+	return os.Chtimes(marker, now, now)
+}
+
+// collect removes the data directories whose keys have not run for
+// GCAfterMS, sparing those in live, and returns the removed paths.
+func (dd *DataDir) collect(logger *zap.Logger, live map[string]bool, now time.Time) []string {
+	pattern := strings.ReplaceAll(dd.Path, "{"+keyPlaceholder+"}", "*")
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		logger.Warn("data_dir: invalid path pattern", zap.String("pattern", pattern), zap.Error(err))
+		return nil
+	}
+	maxAge := time.Duration(dd.GCAfterMS) * time.Millisecond
+	var removed []string
+	for _, dir := range matches {
+		if live[dir] {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(dir, dataDirMarker))
+		if err != nil || now.Sub(info.ModTime()) < maxAge {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			logger.Warn("data_dir: failed to remove unused directory", zap.String("dir", dir), zap.Error(err))
+			continue
+		}
+		logger.Info("data_dir: removed unused directory",
+			zap.String("dir", dir),
+			zap.Time("last_used", info.ModTime()))
+		removed = append(removed, dir)
+	}
+	return removed
+}
+
+// runDataDirGC removes unused data directories until the handler is cleaned
+// up. Directories of running or starting backends are never removed.
+func (c *ReverseBin) runDataDirGC() {
+	ticker := time.NewTicker(dataDirGCInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		live := make(map[string]bool)
+		var running []string
+		c.mu.Lock()
+		for key, ps := range c.processes {
+			// ps.mu is held through cold starts, so only the flags are read.
+			if ps.running.Load() || ps.starting.Load() {
+				if dir, err := c.DataDir.dirFor(c.dataDirName(key)); err == nil {
+					live[dir] = true
+					running = append(running, c.dataDirName(key))
+				}
+			}
+		}
+		c.mu.Unlock()
+		// Long-running backends stay marked as used for handlers sharing the path.
+		for _, name := range running {
+			_ = c.DataDir.touch(name)
+		}
+		c.DataDir.collect(c.logger, live, time.Now())
+	}
+}
@@ -0,0 +1,257 @@
+package reversebin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(ExecDetector{})
+}
+
+// Detector determines the backend of each process key. Detectors are Caddy
+// modules in the reverse_bin.detectors namespace, so they can be compiled
+// into Caddy; the exec detector, configured by dynamic_proxy_detector, runs
+// an external program instead.
+type Detector interface {
+	// Key returns the process key of r; requests with the same key share a backend.
+	Key(r *http.Request) string
+	// Detect returns the backend settings for key. A nil result, like unset
+	// fields, falls back to the handler configuration.
+	Detect(r *http.Request, key string) (*Overrides, error)
+}
+
+// detectorTimeout bounds a single run of the exec detector.
+const detectorTimeout = 10 * time.Second
+
+const (
+	// detectorMaxStdout caps the JSON a dynamic proxy detector may print.
+	detectorMaxStdout = 1 << 20
+	// detectorMaxStderr caps the detector stderr kept for logs; only its
+	// tail is kept beyond that.
+	detectorMaxStderr = 64 << 10
+	// detectorTailBytes is how much of the end of the output diagnostics show.
+	detectorTailBytes = 2 << 10
+)
+
+// cappedBuffer collects up to limit bytes of a detector stream. Past the
+// limit it records the overflow, calls onOverflow once and from then on keeps
+// only the last detectorTailBytes, so a runaway detector cannot exhaust memory.
+type cappedBuffer struct {
+	limit      int
+	onOverflow func()
+	buf        []byte
+	total      int64
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	b.total += int64(len(p))
+	if !b.exceeded() {
+		b.buf = append(b.buf, p...)
+		return len(p), nil
+	}
+	if b.onOverflow != nil {
+		b.onOverflow()
+		b.onOverflow = nil
+	}
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > detectorTailBytes {
+		b.buf = append(b.buf[:0], b.buf[len(b.buf)-detectorTailBytes:]...)
+	}
+	return len(p), nil
+}
+
+// exceeded reports whether more than limit bytes were written.
+func (b *cappedBuffer) exceeded() bool {
+	return b.total > int64(b.limit)
+}
+
+// Bytes returns the collected output; it is complete unless exceeded.
+func (b *cappedBuffer) Bytes() []byte {
+	return b.buf
+}
+
+// Len returns the number of bytes written, including discarded ones.
+func (b *cappedBuffer) Len() int64 {
+	return b.total
+}
+
+// tail returns the end of the output for error messages, marked when
+// earlier output was dropped.
+func (b *cappedBuffer) tail() string {
+	out := b.buf
+	if len(out) <= detectorTailBytes && !b.exceeded() {
+		return string(out)
+	}
+	if len(out) > detectorTailBytes {
+		out = out[len(out)-detectorTailBytes:]
+	}
+	// Do not start the excerpt in the middle of a character.
+	for len(out) > 0 && !utf8.RuneStart(out[0]) {
+		out = out[1:]
+	}
+	return fmt.Sprintf("[%d bytes truncated] ...%s", b.total-int64(len(out)), out)
+}
+
+// provisionDetector loads the detector module, or wraps
+// dynamic_proxy_detector in the exec detector.
+func (c *ReverseBin) provisionDetector(ctx caddy.Context) error {
+	switch {
+	case c.DetectorRaw != nil && len(c.DynamicProxyDetector) > 0:
+		return fmt.Errorf("detector and dynamic_proxy_detector cannot be combined")
+	case c.DetectorRaw != nil:
+		mod, err := ctx.LoadModule(c, "DetectorRaw")
+		if err != nil {
+			return fmt.Errorf("loading detector: %v", err)
+		}
+		det, ok := mod.(Detector)
+		if !ok {
+			return fmt.Errorf("module %T is not a reverse-bin detector", mod)
+		}
+		c.detector = det
+	case len(c.DynamicProxyDetector) > 0:
+		det := &ExecDetector{Command: c.DynamicProxyDetector}
+		if err := det.Provision(ctx); err != nil {
+			return err
+		}
+		c.detector = det
+	}
+	return nil
+}
+
+// ExecDetector runs a program per cold start that prints the key's Overrides
+// as JSON. Its expanded arguments are the process key.
+type ExecDetector struct {
+	// Program and arguments; request placeholders and {reverse_bin.key} are expanded
+	Command []string `json:"command"`
+
+	ctx    caddy.Context
+	logger *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (ExecDetector) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "reverse_bin.detectors.exec",
+		New: func() caddy.Module { return new(ExecDetector) },
+	}
+}
+
+// UnmarshalCaddyfile parses "exec <program> [<args...>]".
+func (e *ExecDetector) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // detector name
+	e.Command = d.RemainingArgs()
+	if len(e.Command) == 0 {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+func (e *ExecDetector) Provision(ctx caddy.Context) error {
+	if len(e.Command) == 0 {
+		return fmt.Errorf("exec detector needs a command")
+	}
+	e.ctx = ctx
+	e.logger = ctx.Logger()
+	return nil
+}
+
+// Key joins the command arguments with request placeholders expanded.
+func (e *ExecDetector) Key(r *http.Request) string {
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	var sb strings.Builder
+	for i, arg := range e.Command {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		sb.WriteString(repl.ReplaceAll(arg, ""))
+	}
+	return sb.String()
+}
+
+func (e *ExecDetector) Detect(r *http.Request, key string) (*Overrides, error) {
+	args := make([]string, len(e.Command))
+	for i, arg := range e.Command {
+		args[i] = expandWithKey(r, key, arg)
+	}
+
+	e.logger.Debug("running dynamic proxy detector",
+		zap.String("command", args[0]),
+		zap.Strings("args", args[1:]))
+
+	// Use a timeout for the detector to prevent hanging the request indefinitely
+	detCtx, detCancel := context.WithTimeout(e.ctx, detectorTimeout)
+	defer detCancel()
+
+	detectorCmd := exec.CommandContext(detCtx, args[0], args[1:]...)
+
+	configureDetectorProcAttrs(detectorCmd)
+
+	// Output beyond the caps is dropped; oversized stdout also stops the
+	// detector, since its JSON could not be used anyway.
+	outBuf := &cappedBuffer{limit: detectorMaxStdout, onOverflow: detCancel}
+	errBuf := &cappedBuffer{limit: detectorMaxStderr}
+	detectorCmd.Stdout = outBuf
+	detectorCmd.Stderr = errBuf
+	// A child that inherits stdout and outlives the detector must not
+	// hold the request until the timeout.
+	detectorCmd.WaitDelay = time.Second
+
+	detStart := time.Now()
+	err := detectorCmd.Run()
+	traceFrom(r).step("detector", detStart, args[0])
+
+	if errBuf.Len() > 0 {
+		e.logger.Info("dynamic proxy detector stderr",
+			zap.String("stderr", errBuf.tail()))
+	}
+
+	failed := func(format string, args ...any) error {
+		exitCode := -1
+		if state := detectorCmd.ProcessState; state != nil {
+			exitCode = state.ExitCode()
+		}
+		args = append(args, outBuf.tail())
+		return &DetectorError{ExitCode: exitCode, Stderr: errBuf.tail(), Err: fmt.Errorf(format+"\nOutput: %s", args...)}
+	}
+
+	if outBuf.exceeded() {
+		return nil, failed("dynamic proxy detector output exceeds %d bytes", detectorMaxStdout)
+	}
+
+	if detCtx.Err() == context.DeadlineExceeded {
+		return nil, failed("dynamic proxy detector timed out")
+	}
+
+	if errors.Is(err, exec.ErrWaitDelay) {
+		return nil, failed("dynamic proxy detector exited but a process it started kept its output open")
+	}
+
+	if err != nil {
+		return nil, failed("dynamic proxy detector failed: %v", err)
+	}
+
+	overrides := new(Overrides)
+	if err := json.Unmarshal(outBuf.Bytes(), overrides); err != nil {
+		return nil, failed("failed to unmarshal detector output: %v", err)
+	}
+	return overrides, nil
+}
+
+// Interface guards
+var (
+	_ Detector              = (*ExecDetector)(nil)
+	_ caddy.Provisioner     = (*ExecDetector)(nil)
+	_ caddyfile.Unmarshaler = (*ExecDetector)(nil)
+)
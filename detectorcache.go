@@ -0,0 +1,136 @@
+package reversebin
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DetectorCache reuses the detector's result for a key instead of running
+// the detector on every start. Results are kept in Caddy's storage, so they
+// survive restarts and are shared by instances sharing the storage.
+type DetectorCache struct {
+	// Milliseconds a result is reused
+	TTLMS int `json:"ttl_ms"`
+}
+
+// detectorCacheStore is the part of Caddy's storage detector results are
+// kept in.
+type detectorCacheStore interface {
+	Store(ctx context.Context, key string, value []byte) error
+	Load(ctx context.Context, key string) ([]byte, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// detectedEntry is the record stored per key.
+type detectedEntry struct {
+	// End of the entry's life, in Unix milliseconds
+	Expires   int64      `json:"expires"`
+	Overrides *Overrides `json:"overrides"`
+}
+
+func (dc *DetectorCache) validate() error {
+	if dc.TTLMS < 1000 {
+		return fmt.Errorf("detector_cache ttl must be at least 1s, got %dms", dc.TTLMS)
+	}
+	return nil
+}
+
+// detectorCacheName names the storage key of the result for key. It covers
+// the detector's configuration, so that changing the detector starts afresh.
+func (c *ReverseBin) detectorCacheName(key string) string {
+	h := sha256.New()
+	_ = json.NewEncoder(h).Encode([]any{c.DynamicProxyDetector, c.DetectorRaw, key})
+	return "reverse_bin/detector_cache/" + hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+func (c *ReverseBin) detectorStore() detectorCacheStore {
+	if c.detectorCacheStore != nil {
+		return c.detectorCacheStore
+	}
+	return c.ctx.Storage()
+}
+
+// runDetector runs the detector for key, classifying its failures as
+// detector failures whichever module it is.
+func (c *ReverseBin) runDetector(r *http.Request, key string) (*Overrides, error) {
+	detected, err := c.detector.Detect(r, key)
+	if err != nil {
+		return nil, detectorError(err)
+	}
+	return detected, nil
+}
+
+// detect returns the detector's result for key, from the cache when it has
+// an entry that has not expired. Storage errors are logged and fall back to
+// the detector.
+func (c *ReverseBin) detect(r *http.Request, key string) (*Overrides, error) {
+	if c.DetectorCache == nil {
+		return c.runDetector(r, key)
+	}
+	name := c.detectorCacheName(key)
+	now := c.clock().Now()
+	data, err := c.detectorStore().Load(r.Context(), name)
+	var entry detectedEntry
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		c.logger.Warn("failed to load cached detector result", zap.String("key", key), zap.Error(err))
+	case json.Unmarshal(data, &entry) != nil:
+		c.logger.Warn("ignoring unreadable cached detector result", zap.String("key", key))
+	case now.UnixMilli() < entry.Expires:
+		c.countDetectorCache(key, "hit")
+		return entry.Overrides, nil
+	default:
+		c.forgetDetected(r.Context(), key)
+	}
+	c.countDetectorCache(key, "miss")
+
+	detected, err := c.runDetector(r, key)
+	if err != nil {
+		return nil, err
+	}
+	entry = detectedEntry{
+		Expires:   now.Add(time.Duration(c.DetectorCache.TTLMS) * time.Millisecond).UnixMilli(),
+		Overrides: detected,
+	}
+	if data, err = json.Marshal(entry); err == nil {
+		err = c.detectorStore().Store(r.Context(), name, data)
+	}
+	if err != nil {
+		c.logger.Warn("failed to cache detector result", zap.String("key", key), zap.Error(err))
+	}
+	return detected, nil
+}
+
+// forgetDetected evicts the cached detector result for key, e.g. once it has
+// expired or a backend started with it failed.
+func (c *ReverseBin) forgetDetected(ctx context.Context, key string) {
+	err := c.detectorStore().Delete(ctx, c.detectorCacheName(key))
+	switch {
+	case err == nil:
+		c.countDetectorCache(key, "eviction")
+	case !errors.Is(err, fs.ErrNotExist):
+		c.logger.Warn("failed to evict cached detector result", zap.String("key", key), zap.Error(err))
+	}
+}
+
+func (c *ReverseBin) countDetectorCache(key, event string) {
+	if c.metrics == nil {
+		return
+	}
+	switch event {
+	case "eviction":
+		c.metrics.detectorCacheEvictions.WithLabelValues(key).Inc()
+	default:
+		c.metrics.detectorCacheLookups.WithLabelValues(key, event).Inc()
+	}
+}
@@ -0,0 +1,65 @@
+package reversebin
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+)
+
+// pinDialAddress resolves the host name in dialAddr and returns the first of
+// its addresses that accepts a connection, so every request to a backend
+// goes to the instance that passed readiness rather than to whatever a later
+// lookup returns. IP literals, unix sockets and names that cannot be
+// resolved or reached are returned unchanged.
+func pinDialAddress(ctx context.Context, dialAddr string) string {
+	if isUnixUpstream(dialAddr) {
+		return dialAddr
+	}
+	host, port, err := net.SplitHostPort(dialAddr)
+	if err != nil || net.ParseIP(host) != nil {
+		return dialAddr
+	}
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return dialAddr
+	}
+	var d net.Dialer
+	for _, ip := range ips {
+		addr := net.JoinHostPort(ip, port)
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			_ = conn.Close()
+			return addr
+		}
+	}
+	return dialAddr
+}
+
+// isDialError reports whether err means no connection to the upstream could
+// be made, as opposed to a failure on an established connection.
+func isDialError(err error) bool {
+	var dialErr reverseproxy.DialError
+	if errors.As(err, &dialErr) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// unpin forgets the key's resolved upstream after a connection failure; the
+// next request resolves the name again.
+func (ps *processState) unpin() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.pinned == "" {
+		return
+	}
+	ps.pinned = ""
+	ps.upstreams = nil
+	ps.warm.Store(nil)
+}
@@ -0,0 +1,109 @@
+package reversebin
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// ErrReadinessTimeout is returned when a backend does not pass its readiness
+// check, or announce its port, within the start timeout.
+var ErrReadinessTimeout = errors.New("timeout waiting for reverse proxy process readiness")
+
+// ErrSpawnFailed is wrapped by errors starting a backend's process, such as a
+// missing executable.
+var ErrSpawnFailed = errors.New("failed to start backend process")
+
+// ErrQueueTimeout is wrapped by the error of a request that waited longer
+// than the queue timeout for an inflight slot.
+var ErrQueueTimeout = errors.New("timed out waiting for an inflight slot")
+
+// ErrQueueFull is wrapped by the error of a request turned away because
+// queue_size requests were already waiting for a slot of its key.
+var ErrQueueFull = errors.New("request queue is full")
+
+// ErrRateLimited is wrapped by the error of a request turned away because
+// upstream_rate_limit would not let it reach the backend within the queue
+// timeout.
+var ErrRateLimited = errors.New("upstream rate limit exceeded")
+
+// ErrMaxProcesses is wrapped by the error of a request whose backend may not
+// start because max_processes backends are running and none is idle.
+var ErrMaxProcesses = errors.New("too many backends running")
+
+// ErrDetectorFailed matches every *DetectorError with errors.Is.
+var ErrDetectorFailed = errors.New("dynamic proxy detector failed")
+
+// DetectorError is returned when the exec detector fails, times out or
+// prints output that is not a detector result.
+type DetectorError struct {
+	// Exit code of the exec detector, or -1 when it did not exit on its own
+	// or the detector is another module
+	ExitCode int
+	// Tail of what the detector wrote to stderr
+	Stderr string
+	// What went wrong, with the tail of the detector's stdout
+	Err error
+}
+
+func (e *DetectorError) Error() string { return e.Err.Error() }
+
+func (e *DetectorError) Unwrap() error { return e.Err }
+
+func (e *DetectorError) Is(target error) bool { return target == ErrDetectorFailed }
+
+// detectorError classifies a failure of any detector module as a
+// *DetectorError. Errors that already are one, and 4xx errors refusing the
+// request, are returned as they are; other handler errors keep their status.
+func detectorError(err error) error {
+	if errors.Is(err, ErrDetectorFailed) {
+		return err
+	}
+	var he caddyhttp.HandlerError
+	if errors.As(err, &he) {
+		if he.StatusCode >= 400 && he.StatusCode < 500 {
+			return err
+		}
+		he.Err = &DetectorError{ExitCode: -1, Err: he.Err}
+		return he
+	}
+	return &DetectorError{ExitCode: -1, Err: err}
+}
+
+// errorPlaceholder names the kind of error that failed to start a request's
+// backend, for handle_errors routes.
+const errorPlaceholder = "reverse_bin.error"
+
+// errorCode returns the value of {reverse_bin.error} for err, or "".
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrReadinessTimeout):
+		return "readiness_timeout"
+	case errors.Is(err, ErrDetectorFailed):
+		return "detector_failed"
+	case errors.Is(err, ErrSpawnFailed):
+		return "spawn_failed"
+	case errors.Is(err, ErrQueueTimeout):
+		return "queue_timeout"
+	case errors.Is(err, ErrQueueFull):
+		return "queue_full"
+	case errors.Is(err, ErrRateLimited):
+		return "rate_limited"
+	case errors.Is(err, ErrMaxProcesses):
+		return "max_processes"
+	}
+	return ""
+}
+
+// recordError sets {reverse_bin.error} for r when err is of a known kind.
+func recordError(r *http.Request, err error) {
+	code := errorCode(err)
+	if code == "" {
+		return
+	}
+	if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		repl.Set(errorPlaceholder, code)
+	}
+}
@@ -0,0 +1,30 @@
+package reversebin
+
+import (
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// execWrapperOption is the Caddyfile global option giving the exec_wrapper
+// of every reverse-bin handler that does not set its own.
+const execWrapperOption = "reverse_bin_exec_wrapper"
+
+// parseExecWrapperOption parses the global "reverse_bin_exec_wrapper
+// <command> [<args>...]" option.
+func parseExecWrapperOption(d *caddyfile.Dispenser, _ any) (any, error) {
+	d.Next() // consume option name
+	args := d.RemainingArgs()
+	if len(args) == 0 {
+		return nil, d.ArgErr()
+	}
+	return args, nil
+}
+
+// wrapExecutable prepends the exec_wrapper to a backend's command line. The
+// wrapper becomes the process Caddy starts, and so the leader of the
+// backend's process group.
+func (c *ReverseBin) wrapExecutable(exe []string) []string {
+	if len(c.ExecWrapper) == 0 || len(exe) == 0 {
+		return exe
+	}
+	return append(append([]string(nil), c.ExecWrapper...), exe...)
+}
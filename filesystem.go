@@ -0,0 +1,153 @@
+package reversebin
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// sandboxCommand is the hidden "caddy reverse-bin" subcommand that sets up a
+// backend's mount namespace and then executes the backend in its place.
+const sandboxCommand = "sandbox-exec"
+
+// Filesystem isolates a backend's view of the filesystem in its own mount
+// namespace (Linux only). In readonly mode every mount is read-only for the
+// backend, so tenant apps cannot modify their own code.
+type Filesystem struct {
+	// Only "readonly" is supported
+	Mode string `json:"mode"`
+	// Paths covered by an empty private tmpfs the backend may write to,
+	// relative to its working directory unless absolute
+	Tmpfs []string `json:"tmpfs,omitempty"`
+}
+
+// parseFilesystem parses "filesystem readonly" with an optional block of
+// "tmpfs <path>..." lines.
+func parseFilesystem(d *caddyfile.Dispenser) (*Filesystem, error) {
+	args := d.RemainingArgs()
+	if len(args) != 1 {
+		return nil, d.ArgErr()
+	}
+	if args[0] != "readonly" {
+		return nil, d.Errf("filesystem mode must be readonly, got %q", args[0])
+	}
+	f := &Filesystem{Mode: args[0]}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "tmpfs":
+			paths := d.RemainingArgs()
+			if len(paths) == 0 {
+				return nil, d.ArgErr()
+			}
+			f.Tmpfs = append(f.Tmpfs, paths...)
+		default:
+			return nil, d.Errf("unknown filesystem subdirective: %q", d.Val())
+		}
+	}
+	return f, nil
+}
+
+// wrap returns the command running execPath through the sandbox helper.
+// Directories in keep stay writable and shared with Caddy, e.g. the
+// data_dir and the directory of a unix socket upstream.
+func (f *Filesystem) wrap(execPath string, execArgs, keep []string) (string, []string, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return "", nil, fmt.Errorf("locating caddy executable for filesystem isolation: %v", err)
+	}
+	// Resolve bare names with Caddy's PATH, as exec.Command would.
+	if !strings.ContainsRune(execPath, filepath.Separator) {
+		if execPath, err = exec.LookPath(execPath); err != nil {
+			return "", nil, err
+		}
+	}
+	args := []string{"reverse-bin", sandboxCommand}
+	for _, p := range f.Tmpfs {
+		args = append(args, "tmpfs="+p)
+	}
+	for _, p := range keep {
+		args = append(args, "bind="+p)
+	}
+	args = append(append(args, "--", execPath), execArgs...)
+	return self, args, nil
+}
+
+// writableDirs returns the directories a sandboxed backend shares with Caddy.
+func (c *ReverseBin) writableDirs(spec ProcessSpec) []string {
+	var dirs []string
+	// A key without a data directory has already failed to start.
+	if c.DataDir != nil {
+		if dir, err := c.DataDir.dirFor(c.dataDirName(spec.Key)); err == nil {
+			dirs = append(dirs, dir)
+		}
+	}
+	if isUnixUpstream(spec.ReverseProxyTo) {
+		dirs = append(dirs, filepath.Dir(strings.TrimPrefix(spec.ReverseProxyTo, "unix/")))
+	}
+	return dirs
+}
+
+// parseSandboxArgs splits the arguments of the sandbox helper into tmpfs
+// paths, writable bind paths and the backend command line.
+func parseSandboxArgs(args []string) (tmpfs, bind, argv []string, err error) {
+	for i, arg := range args {
+		if arg == "--" {
+			if i+1 == len(args) {
+				break
+			}
+			return tmpfs, bind, args[i+1:], nil
+		}
+		kind, path, ok := strings.Cut(arg, "=")
+		switch {
+		case ok && kind == "tmpfs":
+			tmpfs = append(tmpfs, path)
+		case ok && kind == "bind":
+			bind = append(bind, path)
+		default:
+			return nil, nil, nil, fmt.Errorf("unexpected sandbox argument %q", arg)
+		}
+	}
+	return nil, nil, nil, fmt.Errorf("no command given after --")
+}
+
+// mountPoints returns the mount points listed in /proc/self/mountinfo
+// contents, with their per-mount options, in mount order.
+func mountPoints(mountinfo []byte) (points []string, options [][]string) {
+	sc := bufio.NewScanner(bytes.NewReader(mountinfo))
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 6 {
+			continue
+		}
+		points = append(points, unescapeMountPath(fields[4]))
+		options = append(options, strings.Split(fields[5], ","))
+	}
+	return points, options
+}
+
+// unescapeMountPath decodes the octal escapes (\040 for a space) the kernel
+// uses in mountinfo paths.
+func unescapeMountPath(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,117 @@
+//go:build linux
+
+package reversebin
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// attach starts the sandbox helper in a new mount namespace. This needs
+// CAP_SYS_ADMIN, so Caddy must run as root or be granted it.
+func (f *Filesystem) attach(cmd *exec.Cmd) error {
+	cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNS
+	return nil
+}
+
+// runSandboxed runs in the sandbox helper, inside the backend's new mount
+// namespace: it makes every mount read-only, mounts the tmpfs and writable
+// bind paths, and replaces itself with the backend.
+func runSandboxed(args []string) error {
+	tmpfs, bind, argv, err := parseSandboxArgs(args)
+	if err != nil {
+		return err
+	}
+	// Keep every change below inside this namespace.
+	if err := syscall.Mount("none", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making mounts private: %v", err)
+	}
+	for i, p := range bind {
+		if bind[i], err = filepath.Abs(p); err != nil {
+			return err
+		}
+		// Bind mounts taken now keep their own flags when the originals are
+		// made read-only below.
+		if err := syscall.Mount(bind[i], bind[i], "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("binding writable %s: %v", bind[i], err)
+		}
+	}
+	mountinfo, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return err
+	}
+	points, options := mountPoints(mountinfo)
+	for i, point := range points {
+		if kernelMount(point) || keptWritable(point, bind) {
+			continue
+		}
+		flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+		flags |= mountFlags(options[i])
+		if err := syscall.Mount("none", point, "", flags, ""); err != nil {
+			return fmt.Errorf("making %s read-only: %v", point, err)
+		}
+	}
+	for _, p := range tmpfs {
+		if p, err = filepath.Abs(p); err != nil {
+			return err
+		}
+		if err := syscall.Mount("tmpfs", p, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+			return fmt.Errorf("mounting tmpfs on %s: %v", p, err)
+		}
+	}
+	path := argv[0]
+	if !strings.ContainsRune(path, filepath.Separator) {
+		if path, err = exec.LookPath(path); err != nil {
+			return err
+		}
+	}
+	return syscall.Exec(path, argv, os.Environ())
+}
+
+// kernelMount reports whether point belongs to /proc, /sys or /dev, whose
+// contents are not the backend's files and cannot all be remounted.
+func kernelMount(point string) bool {
+	for _, dir := range []string{"/proc", "/sys", "/dev"} {
+		if point == dir || strings.HasPrefix(point, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// keptWritable reports whether point is one of the writable bind mounts.
+func keptWritable(point string, bind []string) bool {
+	for _, p := range bind {
+		if point == p {
+			return true
+		}
+	}
+	return false
+}
+
+// mountFlags returns the flags that must be repeated when remounting a
+// mount with the given per-mount options.
+func mountFlags(options []string) uintptr {
+	var flags uintptr
+	for _, o := range options {
+		switch o {
+		case "nosuid":
+			flags |= syscall.MS_NOSUID
+		case "nodev":
+			flags |= syscall.MS_NODEV
+		case "noexec":
+			flags |= syscall.MS_NOEXEC
+		case "noatime":
+			flags |= syscall.MS_NOATIME
+		case "nodiratime":
+			flags |= syscall.MS_NODIRATIME
+		case "relatime":
+			flags |= syscall.MS_RELATIME
+		}
+	}
+	return flags
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package reversebin
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+func (f *Filesystem) attach(cmd *exec.Cmd) error {
+	return fmt.Errorf("filesystem isolation is only supported on Linux")
+}
+
+func runSandboxed(args []string) error {
+	return fmt.Errorf("filesystem isolation is only supported on Linux")
+}
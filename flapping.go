@@ -0,0 +1,164 @@
+package reversebin
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// maxFlapBackoff caps how long starts are held off after repeated flaps.
+const maxFlapBackoff = 5 * time.Minute
+
+// waitStableLocked waits min_stable_time after the backend of ps became
+// ready, and fails the start if gone reports its exit first. The caller must
+// hold ps.mu.
+func (c *ReverseBin) waitStableLocked(ctx context.Context, ps *processState, key string, pid int, gone <-chan struct{}) error {
+	stable := time.Duration(c.MinStableTimeMS) * time.Millisecond
+	c.logger.Info("waiting for reverse proxy process to stay up",
+		zap.Int("pid", pid),
+		zap.Duration("min_stable_time", stable))
+	select {
+	case <-gone:
+		return c.flappedLocked(ps, key, pid)
+	case <-c.clock().After(stable):
+		ps.clearBackoffLocked(c.clock().Now())
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("cold start aborted: %w", ctx.Err())
+	}
+}
+
+// flappedLocked records that the backend pid exited within min_stable_time of
+// becoming ready and holds off the key's next start, doubling the wait with
+// each flap in a row. The caller must hold ps.mu.
+func (c *ReverseBin) flappedLocked(ps *processState, key string, pid int) error {
+	ps.flaps++
+	backoff := time.Duration(c.MinStableTimeMS) * time.Millisecond
+	for i := 1; i < ps.flaps && backoff < maxFlapBackoff; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, maxFlapBackoff)
+	ps.holdOff(c.clock().Now().Add(backoff),
+		fmt.Sprintf("backend for %q keeps exiting right after becoming ready", c.processKeyName(key)))
+	c.logger.Warn("proxy subprocess exited right after becoming ready",
+		zap.String("key", c.processKeyName(key)),
+		zap.Int("pid", pid),
+		zap.Int("flaps", ps.flaps),
+		zap.Duration("backoff", backoff))
+	return fmt.Errorf("backend for %q exited within min_stable_time of becoming ready", c.processKeyName(key))
+}
+
+// holdOff holds off the key's starts until until, unless they already are for
+// longer, and explains why to requests meanwhile.
+func (ps *processState) holdOff(until time.Time, reason string) {
+	if until.UnixNano() <= ps.retryAt.Load() {
+		return
+	}
+	ps.retryReason.Store(&reason)
+	ps.retryAt.Store(until.UnixNano())
+}
+
+// backoffError returns the 503 for a request arriving while the key's starts
+// are held off after a flap or crash, or nil.
+func (c *ReverseBin) backoffError(w http.ResponseWriter, ps *processState) error {
+	until := ps.retryAt.Load()
+	if until == 0 {
+		return nil
+	}
+	left := time.Unix(0, until).Sub(c.clock().Now())
+	if left <= 0 {
+		return nil
+	}
+	if w != nil {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(left.Seconds()))))
+	}
+	reason := "backend is held off"
+	if r := ps.retryReason.Load(); r != nil {
+		reason = *r
+	}
+	return caddyhttp.Error(http.StatusServiceUnavailable,
+		fmt.Errorf("%s; next start in %s", reason, left.Round(time.Second)))
+}
+
+// clearBackoffLocked allows the key to start again right away and reports
+// whether its starts were still held off at now. The caller must hold ps.mu.
+func (ps *processState) clearBackoffLocked(now time.Time) bool {
+	ps.flaps = 0
+	ps.crashes = 0
+	ps.startRate.reset()
+	return ps.retryAt.Swap(0) > now.UnixNano()
+}
+
+// CrashLoop cools a key down once its backend was started Count times within
+// a period after exiting on its own or failing to start: further starts are refused for Cooldown, so requests fail fast
+// instead of each paying for detection, spawn and readiness.
+type CrashLoop struct {
+	// Starts per period that count as a crash loop
+	Count int `json:"count"`
+	// Length of the period in milliseconds
+	PeriodMS int `json:"period_ms"`
+	// Milliseconds starts are refused for (default, the period)
+	CooldownMS int `json:"cooldown_ms,omitempty"`
+}
+
+// parseCrashLoop parses "crash_loop <n>/<period> [<cooldown>]".
+func parseCrashLoop(d *caddyfile.Dispenser) (*CrashLoop, error) {
+	args := d.RemainingArgs()
+	if len(args) == 0 || len(args) > 2 {
+		return nil, d.ArgErr()
+	}
+	count, period, err := parseRate(d, "crash_loop", args[0])
+	if err != nil {
+		return nil, err
+	}
+	l := &CrashLoop{Count: count, PeriodMS: int(period.Milliseconds())}
+	if len(args) == 2 {
+		cooldown, err := caddy.ParseDuration(args[1])
+		if err != nil || cooldown < time.Millisecond {
+			return nil, d.Errf("crash_loop cooldown must be a positive duration: %s", args[1])
+		}
+		l.CooldownMS = int(cooldown.Milliseconds())
+	}
+	return l, nil
+}
+
+func (l *CrashLoop) validate() error {
+	if l.Count < 2 || l.PeriodMS < 1000 {
+		return fmt.Errorf("crash_loop needs a count of at least 2 per period of at least 1s")
+	}
+	return nil
+}
+
+// startedLocked counts a start of the key's backend that follows a failure
+// and cools the key down once the starts amount to a crash loop. The start
+// being made goes ahead. The caller must hold ps.mu.
+func (c *ReverseBin) startedLocked(ps *processState) {
+	if c.CrashLoop == nil || !ps.failed {
+		return
+	}
+	l := c.CrashLoop
+	period := time.Duration(l.PeriodMS) * time.Millisecond
+	now := c.clock().Now()
+	if !ps.startRate.add(now, l.Count, period) {
+		return
+	}
+	cooldown := period
+	if l.CooldownMS > 0 {
+		cooldown = time.Duration(l.CooldownMS) * time.Millisecond
+	}
+	name := c.processKeyName(ps.key)
+	ps.holdOff(now.Add(cooldown), fmt.Sprintf("backend for %q is crash-looping (%d starts within %s)", name, l.Count, period))
+	c.logger.Warn("backend is crash-looping; cooling down",
+		zap.String("key", name),
+		zap.Int("starts", l.Count),
+		zap.Duration("period", period),
+		zap.Duration("cooldown", cooldown))
+}
@@ -0,0 +1,146 @@
+package reversebin
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// readinessGRPC is the readiness_check method of the gRPC health checking
+// protocol (grpc.health.v1); its path holds the service to check, "" for the
+// server as a whole.
+const readinessGRPC = "GRPC"
+
+// grpcServing is HealthCheckResponse.ServingStatus SERVING.
+const grpcServing = 1
+
+// grpcHealthClient returns a client speaking HTTP/2 to upstream, as gRPC
+// requires: over TLS for TLS upstreams, in cleartext (h2c) otherwise.
+func grpcHealthClient(upstream string, readinessTLS *tls.Config) *http.Client {
+	var protocols http.Protocols
+	if readinessTLS != nil || strings.HasPrefix(upstream, "https://") {
+		protocols.SetHTTP2(true)
+	} else {
+		protocols.SetUnencryptedHTTP2(true)
+	}
+	transport := &http.Transport{Protocols: &protocols, TLSClientConfig: readinessTLS}
+	if isUnixUpstream(upstream) {
+		socketPath := strings.TrimPrefix(upstream, "unix/")
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socketPath)
+		}
+	}
+	return &http.Client{Timeout: 500 * time.Millisecond, Transport: transport}
+}
+
+// grpcProbe returns a function that calls grpc.health.v1.Health/Check for
+// service on the backend at upstream once and reports whether it answered
+// SERVING. Calls are marked as internal traffic of kind.
+func grpcProbe(upstream, service, host string, tlsConfig *tls.Config, kind string) func() bool {
+	baseURL := "http://" + readinessAddress(upstream)
+	if isUnixUpstream(upstream) {
+		baseURL = "http://localhost"
+	}
+	if strings.HasPrefix(upstream, "https://") || tlsConfig != nil {
+		baseURL = "https" + strings.TrimPrefix(baseURL, "http")
+	}
+	client := grpcHealthClient(upstream, tlsConfig)
+	return func() bool {
+		// Checks are seconds apart, so no connection is kept in between.
+		defer client.CloseIdleConnections()
+		return grpcHealthy(client, baseURL, host, service, kind)
+	}
+}
+
+// grpcHealthy makes one health check call. The messages are encoded by hand;
+// they have one field each.
+func grpcHealthy(client *http.Client, baseURL, host, service, kind string) bool {
+	var msg []byte
+	if service != "" {
+		msg = append([]byte{0x0a}, binary.AppendUvarint(nil, uint64(len(service)))...)
+		msg = append(msg, service...)
+	}
+	frame := binary.BigEndian.AppendUint32([]byte{0}, uint32(len(msg)))
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/grpc.health.v1.Health/Check", bytes.NewReader(append(frame, msg...)))
+	if err != nil {
+		return false
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	markInternal(req, kind)
+	if host != "" {
+		req.Host = host
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	_ = resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return false
+	}
+	// Errors without a message carry grpc-status in the headers.
+	status := resp.Trailer.Get("Grpc-Status")
+	if status == "" {
+		status = resp.Header.Get("Grpc-Status")
+	}
+	if status != "0" || len(body) < 5 || body[0] != 0 {
+		return false
+	}
+	n := binary.BigEndian.Uint32(body[1:5])
+	if uint32(len(body)-5) < n {
+		return false
+	}
+	return grpcServingStatus(body[5:5+n]) == grpcServing
+}
+
+// grpcServingStatus decodes field 1 (status) of a HealthCheckResponse,
+// skipping fields added to the message later. It is 0 (UNKNOWN) when absent
+// or malformed.
+func grpcServingStatus(msg []byte) uint64 {
+	var status uint64
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return 0
+		}
+		msg = msg[n:]
+		var size uint64
+		switch tag & 7 {
+		case 0: // varint
+			v, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return 0
+			}
+			if tag>>3 == 1 {
+				status = v
+			}
+			size = uint64(n)
+		case 1: // fixed64
+			size = 8
+		case 2: // length-delimited
+			l, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return 0
+			}
+			size = uint64(n) + l
+		case 5: // fixed32
+			size = 4
+		default:
+			return 0
+		}
+		if size > uint64(len(msg)) {
+			return 0
+		}
+		msg = msg[size:]
+	}
+	return status
+}
@@ -0,0 +1,63 @@
+package reversebin
+
+import (
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// applyHeaders sets each header in hdrs on h; an empty value removes the header.
+func applyHeaders(h http.Header, hdrs map[string]string) {
+	for name, value := range hdrs {
+		if value == "" {
+			h.Del(name)
+			continue
+		}
+		h.Set(name, value)
+	}
+}
+
+// headersUp returns the detector-provided request headers for this key.
+func (ps *processState) headersUp() map[string]string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.overrides == nil {
+		return nil
+	}
+	return ps.overrides.HeadersUp
+}
+
+// headersDown returns the detector-provided response headers for this key.
+func (ps *processState) headersDown() map[string]string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.overrides == nil {
+		return nil
+	}
+	return ps.overrides.HeadersDown
+}
+
+// headersDownWriter applies a key's headers_down to the final response. The
+// overrides are read when the response header is written because on a cold
+// start they are only known once the detector has run.
+type headersDownWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	ps      *processState
+	applied bool
+}
+
+func (w *headersDownWriter) WriteHeader(status int) {
+	// 1xx responses are informational; wait for the final status.
+	if status >= 200 && !w.applied {
+		w.applied = true
+		applyHeaders(w.Header(), w.ps.headersDown())
+	}
+	w.ResponseWriterWrapper.WriteHeader(status)
+}
+
+func (w *headersDownWriter) Write(b []byte) (int, error) {
+	if !w.applied {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriterWrapper.Write(b)
+}
@@ -0,0 +1,43 @@
+package reversebin
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+type coldStartHintCtxKey struct{}
+
+// coldStartHint sends one informational response to the client of a request
+// that triggers a cold start.
+type coldStartHint struct {
+	once   sync.Once
+	w      http.ResponseWriter
+	status int
+}
+
+// withColdStartHint arranges for status to be written to w if serving r
+// starts a backend. HTTP/1.0 clients do not understand 1xx responses and are
+// left alone.
+func withColdStartHint(r *http.Request, w http.ResponseWriter, status int) *http.Request {
+	if status == 0 || !r.ProtoAtLeast(1, 1) {
+		return r
+	}
+	hint := &coldStartHint{w: w, status: status}
+	return r.WithContext(context.WithValue(r.Context(), coldStartHintCtxKey{}, hint))
+}
+
+// sendColdStartHint writes the request's informational response, at most once
+// even when the proxy retries upstream selection.
+func sendColdStartHint(r *http.Request) {
+	hint, ok := r.Context().Value(coldStartHintCtxKey{}).(*coldStartHint)
+	if !ok {
+		return
+	}
+	hint.once.Do(func() {
+		hint.w.WriteHeader(hint.status)
+		if f, ok := hint.w.(http.Flusher); ok {
+			f.Flush()
+		}
+	})
+}
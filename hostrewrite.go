@@ -0,0 +1,45 @@
+package reversebin
+
+import (
+	"net"
+	"strings"
+)
+
+// defaultHostRewrite is the host host_rewrite sends without an argument.
+const defaultHostRewrite = "localhost"
+
+// upstreamHost returns the Host header for requests to the backend of o, or
+// "" to pass the client's through. A host_rewrite without a port gets the
+// port of the TCP upstream, e.g. localhost:8080.
+func (o *Overrides) upstreamHost() string {
+	if o == nil || o.HostRewrite == nil || *o.HostRewrite == "" {
+		return ""
+	}
+	host := *o.HostRewrite
+	if o.ReverseProxyTo == nil || isUnixUpstream(*o.ReverseProxyTo) {
+		return host
+	}
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	_, port, err := net.SplitHostPort(readinessAddress(*o.ReverseProxyTo))
+	if err != nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// serverName returns the TLS server name matching a host_rewrite value.
+func serverName(hostRewrite string) string {
+	if host, _, err := net.SplitHostPort(hostRewrite); err == nil {
+		return host
+	}
+	return strings.Trim(hostRewrite, "[]")
+}
+
+// upstreamHost returns the Host header for requests to the key's backend.
+func (ps *processState) upstreamHost() string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.overrides.upstreamHost()
+}
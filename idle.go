@@ -0,0 +1,286 @@
+package reversebin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// IdleOverride sets the idle timeout armed by requests matching a route.
+type IdleOverride struct {
+	MatcherSetsRaw caddyhttp.RawMatcherSets `json:"match,omitempty" caddy:"namespace=http.matchers"`
+	// Idle timeout in milliseconds after a matching request finishes
+	TimeoutMS int `json:"timeout_ms"`
+
+	// matcherName is the Caddyfile @name, resolved by parseCaddyfile
+	matcherName string
+	matcherSets caddyhttp.MatcherSets
+}
+
+// parseIdleTimeout parses the arguments of idle_timeout: a duration, or a
+// named matcher followed by a duration.
+func (c *ReverseBin) parseIdleTimeout(d *caddyfile.Dispenser) error {
+	args := d.RemainingArgs()
+	var name string
+	switch {
+	case len(args) == 1:
+	case len(args) == 2 && len(args[0]) > 1 && args[0][0] == '@':
+		name, args = args[0], args[1:]
+	default:
+		return d.ArgErr()
+	}
+	dur, err := caddy.ParseDuration(args[0])
+	if err != nil || dur < time.Millisecond {
+		return d.Errf("idle_timeout must be a positive duration: %s", args[0])
+	}
+	if name == "" {
+		c.IdleTimeoutMS = int(dur.Milliseconds())
+		return nil
+	}
+	c.IdleOverrides = append(c.IdleOverrides, &IdleOverride{
+		TimeoutMS:   int(dur.Milliseconds()),
+		matcherName: name,
+	})
+	return nil
+}
+
+// parseIdleIgnore records the named matchers given to idle_ignore, or the
+// CEL expression given as "idle_ignore expression <expr>".
+func (c *ReverseBin) parseIdleIgnore(d *caddyfile.Dispenser) error {
+	names := d.RemainingArgs()
+	if len(names) == 0 {
+		return d.ArgErr()
+	}
+	if names[0] == "expression" {
+		if len(names) == 1 {
+			return d.ArgErr()
+		}
+		expr, err := json.Marshal(caddyhttp.MatchExpression{Expr: strings.Join(names[1:], " ")})
+		if err != nil {
+			return err
+		}
+		c.IdleIgnore = append(c.IdleIgnore, caddy.ModuleMap{"expression": expr})
+		return nil
+	}
+	for _, name := range names {
+		if len(name) < 2 || name[0] != '@' {
+			return d.Errf("idle_ignore takes named matchers, got %s", name)
+		}
+	}
+	c.idleIgnoreNames = append(c.idleIgnoreNames, names...)
+	return nil
+}
+
+// resolveIdleMatchers replaces the @names recorded while parsing with the
+// matcher sets defined in the site block.
+func (c *ReverseBin) resolveIdleMatchers(h httpcaddyfile.Helper) error {
+	for _, ov := range c.IdleOverrides {
+		if ov.matcherName == "" {
+			continue
+		}
+		set, err := namedMatcherSet(h, "idle_timeout", ov.matcherName)
+		if err != nil {
+			return err
+		}
+		ov.MatcherSetsRaw = caddyhttp.RawMatcherSets{set}
+	}
+	for _, name := range c.idleIgnoreNames {
+		set, err := namedMatcherSet(h, "idle_ignore", name)
+		if err != nil {
+			return err
+		}
+		c.IdleIgnore = append(c.IdleIgnore, set)
+	}
+	return nil
+}
+
+// namedMatcherSet looks up the matcher set defined as name in the site block.
+func namedMatcherSet(h httpcaddyfile.Helper, directive, name string) (caddy.ModuleMap, error) {
+	d := caddyfile.NewDispenser([]caddyfile.Token{{Text: name}})
+	d.Next()
+	set, ok, err := h.WithDispenser(d).MatcherToken()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("%s: unknown matcher %s", directive, name)
+	}
+	return set, nil
+}
+
+// provisionIdleOverrides loads the matchers of idle_timeout overrides and
+// idle_ignore.
+func (c *ReverseBin) provisionIdleOverrides(ctx caddy.Context) error {
+	for _, ov := range c.IdleOverrides {
+		if ov.TimeoutMS <= 0 {
+			return fmt.Errorf("idle_timeout override needs a positive timeout")
+		}
+		mods, err := ctx.LoadModule(ov, "MatcherSetsRaw")
+		if err != nil {
+			return fmt.Errorf("loading idle_timeout matchers: %v", err)
+		}
+		if err := ov.matcherSets.FromInterface(mods); err != nil {
+			return err
+		}
+	}
+	if c.IdleIgnore != nil {
+		mods, err := ctx.LoadModule(c, "IdleIgnore")
+		if err != nil {
+			return fmt.Errorf("loading idle_ignore matchers: %v", err)
+		}
+		if err := c.idleIgnore.FromInterface(mods); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extendsIdle reports whether r pushes back the idle deadline. Requests
+// matching idle_ignore, such as health checks, are proxied without doing so.
+func (c *ReverseBin) extendsIdle(r *http.Request) (bool, error) {
+	if len(c.idleIgnore) == 0 {
+		return true, nil
+	}
+	match, err := c.idleIgnore.AnyMatchWithError(r)
+	return !match, err
+}
+
+// idleTimeoutFor returns the idle timeout armed once r for the key of ps
+// finishes: that of the first matching override, else the one the detector
+// gave for the key, else the key's adaptive timeout under idle_policy, else
+// idle_timeout. Zero keeps the backend running.
+func (c *ReverseBin) idleTimeoutFor(r *http.Request, ps *processState) (time.Duration, error) {
+	if c.NoKillOnIdle || c.keptRunning(ps.key) {
+		return 0, nil
+	}
+	for _, ov := range c.IdleOverrides {
+		match, err := ov.matcherSets.AnyMatchWithError(r)
+		if err != nil {
+			return 0, err
+		}
+		if match {
+			return time.Duration(ov.TimeoutMS) * time.Millisecond, nil
+		}
+	}
+	if detected := ps.detectedIdle.Load(); detected > 0 {
+		return time.Duration(detected), nil
+	}
+	if adaptive := ps.adaptiveIdle.Load(); adaptive > 0 {
+		return time.Duration(adaptive), nil
+	}
+	return time.Duration(c.IdleTimeoutMS) * time.Millisecond, nil
+}
+
+// setDetectedIdle records the idle timeout the detector gave in overrides
+// for the key's start. Values below a millisecond are ignored.
+func (ps *processState) setDetectedIdle(overrides *Overrides) {
+	var d time.Duration
+	if overrides.IdleTimeoutMS != nil && *overrides.IdleTimeoutMS > 0 {
+		d = time.Duration(*overrides.IdleTimeoutMS) * time.Millisecond
+	}
+	ps.detectedIdle.Store(int64(d))
+}
+
+// defaultIdleHintHeader is the header idle_hint_header sets without a name.
+const defaultIdleHintHeader = "X-Reverse-Bin-Idle-Ms"
+
+// hintIdle tells the backend in h that its key stops after idleTimeout
+// without requests, so it can keep its keep-alive timeouts below that. The
+// header is dropped when the backend is not stopped for being idle.
+func (c *ReverseBin) hintIdle(h http.Header, idleTimeout time.Duration) {
+	if c.IdleHintHeader == "" {
+		return
+	}
+	if idleTimeout <= 0 {
+		h.Del(c.IdleHintHeader)
+		return
+	}
+	h.Set(c.IdleHintHeader, strconv.FormatInt(idleTimeout.Milliseconds(), 10))
+}
+
+// IdlePolicy derives each key's idle timeout from its own startup history:
+// the p95 of recent startups times Factor, bounded by Min and Max. Keys that
+// are slow to start stay up longer, since stopping them costs more; fast ones
+// give back their memory sooner. Keys without history use idle_timeout.
+type IdlePolicy struct {
+	// Only "adaptive" is supported
+	Mode string `json:"mode"`
+	// Multiplier applied to the p95 startup duration (default, 60)
+	Factor float64 `json:"factor,omitempty"`
+	// Lower bound of the timeout in milliseconds (default, 1000)
+	MinMS int `json:"min_ms,omitempty"`
+	// Upper bound of the timeout in milliseconds (default, 1800000)
+	MaxMS int `json:"max_ms,omitempty"`
+}
+
+// unmarshalCaddyfile parses "idle_policy adaptive" with an optional block of
+// factor, min and max.
+func (p *IdlePolicy) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if !d.Args(&p.Mode) {
+		return d.ArgErr()
+	}
+	if p.Mode != "adaptive" {
+		return d.Errf("idle_policy must be adaptive, got %q", p.Mode)
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		name := d.Val()
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		switch name {
+		case "factor":
+			v, err := strconv.ParseFloat(d.Val(), 64)
+			if err != nil || v <= 0 {
+				return d.Errf("idle_policy factor must be a positive number")
+			}
+			p.Factor = v
+		case "min", "max":
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil || dur < time.Millisecond {
+				return d.Errf("idle_policy %s must be a positive duration: %s", name, d.Val())
+			}
+			if name == "min" {
+				p.MinMS = int(dur.Milliseconds())
+			} else {
+				p.MaxMS = int(dur.Milliseconds())
+			}
+		default:
+			return d.Errf("unknown idle_policy subdirective: %q", name)
+		}
+	}
+	return p.validate()
+}
+
+func (p *IdlePolicy) validate() error {
+	if p.Mode != "adaptive" {
+		return fmt.Errorf("idle_policy mode must be adaptive, got %q", p.Mode)
+	}
+	if p.MinMS > 0 && p.MaxMS > 0 && p.MinMS > p.MaxMS {
+		return fmt.Errorf("idle_policy min must not exceed max")
+	}
+	return nil
+}
+
+// timeout returns the idle timeout for a key with the given history.
+func (p *IdlePolicy) timeout(history []time.Duration) time.Duration {
+	lo, hi, factor := time.Second, 30*time.Minute, 60.0
+	if p.MinMS > 0 {
+		lo = time.Duration(p.MinMS) * time.Millisecond
+	}
+	if p.MaxMS > 0 {
+		hi = time.Duration(p.MaxMS) * time.Millisecond
+	}
+	if p.Factor > 0 {
+		factor = p.Factor
+	}
+	d := time.Duration(float64(percentile(history, 0.95)) * factor)
+	return min(max(d, lo), hi)
+}
@@ -0,0 +1,89 @@
+package reversebin
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// defaultInitLockTimeout bounds the wait for init_lock when no timeout is given.
+const defaultInitLockTimeout = 2 * time.Minute
+
+// initLockPoll is how often a waiting backend retries the lock.
+const initLockPoll = 100 * time.Millisecond
+
+// InitLock serializes backend startups that share a data directory: a backend
+// holds an advisory lock on Path from spawn until it is ready, so migrations
+// and other first-run initialization never run concurrently.
+type InitLock struct {
+	// Lock file, relative to the backend's working directory unless absolute
+	Path string `json:"path"`
+	// How long a start waits for the lock in milliseconds (default, 120000)
+	TimeoutMS int `json:"timeout_ms,omitempty"`
+}
+
+// parseInitLock parses "init_lock <path> [<timeout>]".
+func parseInitLock(d *caddyfile.Dispenser) (*InitLock, error) {
+	args := d.RemainingArgs()
+	if len(args) == 0 || len(args) > 2 {
+		return nil, d.ArgErr()
+	}
+	l := &InitLock{Path: args[0]}
+	if len(args) == 2 {
+		dur, err := caddy.ParseDuration(args[1])
+		if err != nil || dur < time.Millisecond {
+			return nil, d.Errf("init_lock timeout must be a positive duration: %s", args[1])
+		}
+		l.TimeoutMS = int(dur.Milliseconds())
+	}
+	return l, nil
+}
+
+func (l *InitLock) timeout() time.Duration {
+	if l.TimeoutMS > 0 {
+		return time.Duration(l.TimeoutMS) * time.Millisecond
+	}
+	return defaultInitLockTimeout
+}
+
+// acquire takes the lock for a backend started in dir, waiting while another
+// backend holds it. The returned function releases it.
+func (l *InitLock) acquire(ctx context.Context, dir string) (func(), error) {
+	path := l.Path
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening init_lock %s: %v", path, err)
+	}
+	deadline := time.NewTimer(l.timeout())
+	defer deadline.Stop()
+	for {
+		locked, err := tryLockFile(f)
+		if err != nil {
+			_ = f.Close()
+			return nil, fmt.Errorf("locking init_lock %s: %v", path, err)
+		}
+		if locked {
+			return func() {
+				_ = unlockFile(f)
+				_ = f.Close()
+			}, nil
+		}
+		select {
+		case <-ctx.Done():
+			_ = f.Close()
+			return nil, ctx.Err()
+		case <-deadline.C:
+			_ = f.Close()
+			return nil, fmt.Errorf("init_lock %s still held by another backend after %s", path, l.timeout())
+		case <-time.After(initLockPoll):
+		}
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package reversebin
+
+import (
+	"fmt"
+	"os"
+)
+
+func tryLockFile(f *os.File) (bool, error) {
+	return false, fmt.Errorf("init_lock is only supported on Unix")
+}
+
+func unlockFile(f *os.File) error { return nil }
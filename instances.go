@@ -0,0 +1,328 @@
+package reversebin
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// instancePlaceholder is replaced by the number of a copy of a key's backend,
+// from 0, in its executable, envs and reverse_proxy_to, so that each of the
+// copies of replicas and min_instances gets its own socket or port.
+const instancePlaceholder = "{reverse_bin.instance}"
+
+// instanceSep joins a process key and the number of a copy of its backend
+// other than the first, which keeps the key.
+const instanceSep = "@"
+
+// replicaPolicies are the values of replica_policy.
+var replicaPolicies = []string{"least_conn", "round_robin", "random"}
+
+// defaultAffinityCookie names the cookie of replica_affinity cookie.
+const defaultAffinityCookie = "reverse_bin_replica"
+
+// ReplicaAffinity keeps a client on the same copy of a backend, for apps that
+// hold sessions in memory. Exactly one of Cookie and Header is set.
+type ReplicaAffinity struct {
+	// Cookie recording the copy that served the client, set on its first
+	// response; the handler's fingerprint is appended to the name
+	Cookie string `json:"cookie,omitempty"`
+	// Request header whose value, e.g. a session or user ID, is hashed to
+	// pick the copy
+	Header string `json:"header,omitempty"`
+}
+
+// parseReplicaAffinity parses "replica_affinity cookie [<name>]" and
+// "replica_affinity header <name>".
+func parseReplicaAffinity(d *caddyfile.Dispenser) (*ReplicaAffinity, error) {
+	args := d.RemainingArgs()
+	switch {
+	case len(args) == 1 && args[0] == "cookie":
+		return &ReplicaAffinity{Cookie: defaultAffinityCookie}, nil
+	case len(args) == 2 && args[0] == "cookie":
+		return &ReplicaAffinity{Cookie: args[1]}, nil
+	case len(args) == 2 && args[0] == "header":
+		return &ReplicaAffinity{Header: args[1]}, nil
+	}
+	return nil, d.Errf("replica_affinity takes cookie [<name>] or header <name>")
+}
+
+func (a *ReplicaAffinity) validate() error {
+	if (a.Cookie == "") == (a.Header == "") {
+		return fmt.Errorf("replica_affinity needs either a cookie or a header")
+	}
+	return nil
+}
+
+// copyFor returns the copy r is bound to, out of n, if any. cookie is the
+// name the handler gives the affinity cookie; one naming a copy beyond n,
+// e.g. after replicas was lowered, binds to none.
+func (a *ReplicaAffinity) copyFor(r *http.Request, cookie string, n int) (int, bool) {
+	if a.Header != "" {
+		value := r.Header.Get(a.Header)
+		if value == "" {
+			return 0, false
+		}
+		h := fnv.New32a()
+		h.Write([]byte(value))
+		return int(h.Sum32() % uint32(n)), true
+	}
+	bound, err := r.Cookie(cookie)
+	if err != nil {
+		return 0, false
+	}
+	i, err := strconv.Atoi(bound.Value)
+	if err != nil || i < 0 || i >= n {
+		return 0, false
+	}
+	return i, true
+}
+
+// instanceCheckInterval is how often copies that exited are started again.
+const instanceCheckInterval = 5 * time.Second
+
+// copies returns how many copies of a backend each key may run, or 0 when
+// neither replicas nor min_instances is set.
+func (c *ReverseBin) copies() int {
+	return max(c.Replicas, c.MinInstances)
+}
+
+func instanceKey(key string, i int) string {
+	if i == 0 {
+		return key
+	}
+	return key + instanceSep + strconv.Itoa(i)
+}
+
+// splitInstance splits the key of a copy into the key it belongs to and the
+// copy's number.
+func (c *ReverseBin) splitInstance(key string) (string, int) {
+	i := strings.LastIndex(key, instanceSep)
+	if i < 0 || c.copies() < 2 {
+		return key, 0
+	}
+	n, err := strconv.Atoi(key[i+len(instanceSep):])
+	if err != nil || n < 1 || n >= c.copies() {
+		return key, 0
+	}
+	return key[:i], n
+}
+
+// dataDirName is the data_dir name of key, which copies share.
+func (c *ReverseBin) dataDirName(key string) string {
+	key, _ = c.splitInstance(key)
+	return c.processKeyName(key)
+}
+
+// keptRunning reports whether key is a copy min_instances keeps running.
+func (c *ReverseBin) keptRunning(key string) bool {
+	base, n := c.splitInstance(key)
+	return base == "" && n < c.MinInstances
+}
+
+func (c *ReverseBin) validateInstances() error {
+	if c.Replicas < 0 || c.MinInstances < 0 {
+		return fmt.Errorf("replicas and min_instances must not be negative")
+	}
+	if c.ReplicaPolicy != "" && !slices.Contains(replicaPolicies, c.ReplicaPolicy) {
+		return fmt.Errorf("replica_policy must be least_conn, round_robin or random, got %q", c.ReplicaPolicy)
+	}
+	if c.ReplicaAffinity != nil {
+		if err := c.ReplicaAffinity.validate(); err != nil {
+			return err
+		}
+		if c.copies() < 2 {
+			return fmt.Errorf("replica_affinity requires replicas or min_instances of at least 2")
+		}
+	}
+	if c.copies() == 0 {
+		if c.ReplicaPolicy != "" {
+			return fmt.Errorf("replica_policy requires replicas or min_instances")
+		}
+		return nil
+	}
+	if c.Kubernetes != nil || c.CGI != nil || c.SharedStart {
+		return fmt.Errorf("replicas and min_instances cannot be combined with the kubernetes runtime, cgi_until or shared_start")
+	}
+	if c.MinInstances > 0 && (c.detector != nil || len(c.Apps) > 0 || c.ProvisionAsk != "") {
+		return fmt.Errorf("min_instances requires a single backend, without a detector, apps or provision_ask")
+	}
+	if c.copies() < 2 || c.PortRange != nil || c.UpstreamFrom != nil {
+		return nil
+	}
+	// Detectors may give each key its own address; inline ones are checked.
+	addrs := map[string]string{"": c.ReverseProxyTo}
+	if c.detector != nil || c.ProvisionAsk != "" {
+		delete(addrs, "")
+	}
+	for name, app := range c.Apps {
+		if app.ReverseProxyTo != "" {
+			addrs[name] = app.ReverseProxyTo
+		}
+	}
+	for name, addr := range addrs {
+		if addr != "" && !strings.Contains(addr, instancePlaceholder) {
+			what := "reverse_proxy_to"
+			if name != "" {
+				what = fmt.Sprintf("reverse_proxy_to of app %q", name)
+			}
+			return fmt.Errorf("%s needs %s, or port_range or upstream_from, so each copy of a backend gets its own address", what, instancePlaceholder)
+		}
+	}
+	return nil
+}
+
+// load returns the requests in flight to ps, or false while ps.mu is held,
+// e.g. by a cold start.
+func (ps *processState) load() (int64, bool) {
+	if !ps.mu.TryLock() {
+		return 0, false
+	}
+	defer ps.mu.Unlock()
+	return ps.activeRequests, true
+}
+
+// affinityCookie names the replica_affinity cookie of key's copies. The name
+// ends in a fingerprint of the handler's command and upstream and of the key,
+// so that handlers serving one site each bind a client on their own, while
+// configuration edits that keep them leave clients bound.
+func (c *ReverseBin) affinityCookie(key string) string {
+	h := fnv.New32a()
+	for _, part := range append(slices.Clone(c.Executable), c.ReverseProxyTo, key) {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return fmt.Sprintf("%s_%08x", c.ReplicaAffinity.Cookie, h.Sum32())
+}
+
+// ownCookie returns the name of the affinity cookie replicaFor sets on
+// responses for the copy key, or "" when it sets none.
+func (c *ReverseBin) ownCookie(key string) string {
+	if a := c.ReplicaAffinity; a == nil || a.Cookie == "" || c.copies() < 2 {
+		return ""
+	}
+	base, _ := c.splitInstance(key)
+	return c.affinityCookie(base)
+}
+
+// replicaFor returns the copy of key's backend to serve r: the one r is bound
+// to by replica_affinity, or else one picked by replica_policy, to which a
+// client given an affinity cookie is bound from then on.
+func (c *ReverseBin) replicaFor(w http.ResponseWriter, r *http.Request, key string) string {
+	a := c.ReplicaAffinity
+	if a != nil {
+		if i, ok := a.copyFor(r, c.affinityCookie(key), c.copies()); ok {
+			return instanceKey(key, i)
+		}
+	}
+	picked := c.pickInstance(key)
+	if a != nil && a.Cookie != "" {
+		_, i := c.splitInstance(picked)
+		http.SetCookie(w, &http.Cookie{
+			Name:     c.affinityCookie(key),
+			Value:    strconv.Itoa(i),
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	return picked
+}
+
+// pickInstance returns the copy of key's backend to serve a request. With
+// round_robin and random, that may be a copy that is not running yet.
+func (c *ReverseBin) pickInstance(key string) string {
+	n := c.copies()
+	first := int(c.nextInstance.Add(1) % uint64(n))
+	switch c.ReplicaPolicy {
+	case "round_robin":
+		return instanceKey(key, first)
+	case "random":
+		return instanceKey(key, rand.IntN(n))
+	}
+	return c.leastConnInstance(key, first)
+}
+
+// leastConnInstance returns a running copy without requests, else a copy that
+// is not running when none is starting, else the least busy running copy.
+// Copies are scanned from first on, so that they take turns.
+func (c *ReverseBin) leastConnInstance(key string, first int) string {
+	n := c.copies()
+	var least, stopped, starting string
+	leastLoad := int64(math.MaxInt64)
+	for j := range n {
+		k := instanceKey(key, (first+j)%n)
+		ps := c.getOrCreateProcessState(k)
+		switch {
+		case ps.running.Load():
+			load, ok := ps.load()
+			if !ok {
+				continue
+			}
+			if load == 0 {
+				return k
+			}
+			if load < leastLoad {
+				least, leastLoad = k, load
+			}
+		case ps.starting.Load():
+			starting = k
+		case stopped == "":
+			stopped = k
+		}
+	}
+	switch {
+	case stopped != "" && starting == "":
+		return stopped
+	case least != "":
+		return least
+	case starting != "":
+		return starting
+	case stopped != "":
+		return stopped
+	}
+	return key
+}
+
+// runMinInstances keeps min_instances copies of the backend running until
+// the handler is cleaned up, starting the ones that are not.
+func (c *ReverseBin) runMinInstances() {
+	ticker := time.NewTicker(instanceCheckInterval)
+	defer ticker.Stop()
+	for {
+		c.startMissingInstances()
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *ReverseBin) startMissingInstances() {
+	var wg sync.WaitGroup
+	for i := range c.MinInstances {
+		ps := c.getOrCreateProcessState(instanceKey("", i))
+		if ps.running.Load() || ps.starting.Load() {
+			continue
+		}
+		wg.Go(func() {
+			if err := c.startUnrequested(c.ctx, ps, "min_instances", false); err != nil && c.ctx.Err() == nil {
+				c.logger.Warn("failed to start backend copy for min_instances",
+					zap.String("key", c.processKeyName(ps.key)), zap.Error(err))
+			}
+		})
+	}
+	wg.Wait()
+}
@@ -0,0 +1,70 @@
+package reversebin
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// keepAlivePrefix starts the stdout line by which a backend asks to be kept
+// running, e.g. while it finishes a job after its last request.
+const keepAlivePrefix = "REVERSE_BIN_KEEPALIVE="
+
+// keepAliveEnv returns the environment telling a backend that it may ask to
+// be kept running, and for how long at most.
+func (c *ReverseBin) keepAliveEnv() []string {
+	if c.BackendKeepAliveMaxMS <= 0 {
+		return nil
+	}
+	return []string{"REVERSE_BIN_KEEPALIVE_MAX_MS=" + strconv.Itoa(c.BackendKeepAliveMaxMS)}
+}
+
+// keepAliveLine handles a line of output of the backend pid of ps, extending
+// its idle timeout if the line asks for it. ps.mu is taken in the background,
+// since a cold start holds it while the backend prints.
+func (c *ReverseBin) keepAliveLine(ps *processState, pid int, stream, text string) {
+	if c.BackendKeepAliveMaxMS <= 0 || stream != "stdout" {
+		return
+	}
+	value, ok := strings.CutPrefix(strings.TrimSpace(text), keepAlivePrefix)
+	if !ok {
+		return
+	}
+	dur, err := caddy.ParseDuration(value)
+	if err != nil || dur <= 0 {
+		c.logger.Warn("ignoring invalid keepalive request from backend",
+			zap.String("key", c.processKeyName(ps.key)), zap.Int("pid", pid), zap.String("line", text))
+		return
+	}
+	go c.keepAlive(ps, pid, dur)
+}
+
+// keepAlive keeps the backend pid of ps running for dur more, but no longer
+// than backend_keepalive after its last request ended. Backends that are not
+// stopped when idle are left alone.
+func (c *ReverseBin) keepAlive(ps *processState, pid int, dur time.Duration) {
+	key := c.processKeyName(ps.key)
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.process == nil || ps.process.Pid() != pid || (ps.activeRequests == 0 && ps.idleTimer == nil) {
+		return
+	}
+	until := ps.clock.Now().Add(dur)
+	if limit := ps.lastRequestEnd.Add(time.Duration(c.BackendKeepAliveMaxMS) * time.Millisecond); until.After(limit) {
+		until = limit
+	}
+	if !until.After(ps.idleDeadline) {
+		return
+	}
+	ps.idleDeadline = until
+	if ps.activeRequests == 0 {
+		ps.idleTimer.Stop()
+		ps.armIdleTimerLocked(c.logger, ps.key)
+	}
+	if ce := c.logger.Check(zap.DebugLevel, "backend extended its idle timeout"); ce != nil {
+		ce.Write(zap.String("key", key), zap.Int("pid", pid), zap.Time("until", until))
+	}
+}
@@ -0,0 +1,108 @@
+package reversebin
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// keyPlaceholder exposes the resolved process key to detector arguments.
+const keyPlaceholder = "reverse_bin.key"
+
+// jwtClaimKey returns the value of a claim from a token already validated by an
+// authentication handler earlier in the route. Such handlers publish claims as
+// {http.auth.user.<claim>} placeholders; tokens are never parsed here, so an
+// unauthenticated request yields an empty key.
+func (c *ReverseBin) jwtClaimKey(r *http.Request) string {
+	repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return ""
+	}
+	return repl.ReplaceAll("{http.auth.user."+c.KeyJWTClaim+"}", "")
+}
+
+// KeyRule gives requests matching a CEL expression, in the language of
+// Caddy's expression matcher, a process key of their own.
+type KeyRule struct {
+	// CEL expression, e.g. {path}.startsWith('/beta/')
+	Expression string `json:"expression"`
+	// Key of matching requests, with placeholders replaced; a request for
+	// which it is empty goes on to the next rule
+	Key string `json:"key"`
+
+	matcher caddyhttp.RequestMatcherWithError
+}
+
+// parseKeyRule parses "key_when <expression> <key>".
+func parseKeyRule(d *caddyfile.Dispenser) (*KeyRule, error) {
+	var rule KeyRule
+	if !d.Args(&rule.Expression, &rule.Key) || d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	return &rule, nil
+}
+
+// provisionKeyRules compiles the expressions of key_when.
+func (c *ReverseBin) provisionKeyRules(ctx caddy.Context) error {
+	for _, rule := range c.KeyRules {
+		if rule.Expression == "" || rule.Key == "" {
+			return fmt.Errorf("key_when needs an expression and a key")
+		}
+		m := &caddyhttp.MatchExpression{Expr: rule.Expression}
+		if err := m.Provision(ctx); err != nil {
+			return fmt.Errorf("key_when %q: %v", rule.Expression, err)
+		}
+		rule.matcher = m
+	}
+	return nil
+}
+
+// ruleKey returns the key of the first key_when rule matching r. Rules that
+// fail to evaluate are logged and skipped.
+func (c *ReverseBin) ruleKey(r *http.Request) (string, bool) {
+	repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return "", false
+	}
+	for _, rule := range c.KeyRules {
+		match, err := rule.matcher.MatchWithError(r)
+		if err != nil {
+			c.logger.Warn("key_when expression failed", zap.String("expression", rule.Expression), zap.Error(err))
+			continue
+		}
+		if !match {
+			continue
+		}
+		if key := repl.ReplaceAll(rule.Key, ""); key != "" {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// expandWithKey replaces placeholders in s for r, including the resolved
+// process key as {reverse_bin.key}.
+func expandWithKey(r *http.Request, key, s string) string {
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set(keyPlaceholder, key)
+	return repl.ReplaceAll(s, "")
+}
+
+// expandKeyPath is expandWithKey for file paths: the key is escaped like a
+// file name, so that a key such as "../etc" cannot point the path outside
+// its directory. Keys that cannot be a file name are refused.
+func expandKeyPath(r *http.Request, key, path string) (string, error) {
+	if strings.Contains(path, "{"+keyPlaceholder+"}") {
+		elem, err := keyFileName(key)
+		if err != nil {
+			return "", err
+		}
+		path = strings.ReplaceAll(path, "{"+keyPlaceholder+"}", elem)
+	}
+	return expandWithKey(r, key, path), nil
+}
@@ -0,0 +1,191 @@
+package reversebin
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// KubernetesRuntime replaces the local process with an in-cluster workload:
+// the referenced Deployment or StatefulSet is scaled from 0 to 1 replica on
+// the first request and back to 0 when idle, while traffic is proxied to its
+// Service via reverse_proxy_to.
+type KubernetesRuntime struct {
+	// Workload kind: deployment or statefulset
+	Kind string `json:"kind"`
+	// Workload name
+	Name string `json:"name"`
+	// Namespace (default, the namespace of Caddy's service account)
+	Namespace string `json:"namespace,omitempty"`
+	// API server URL (default, in-cluster from KUBERNETES_SERVICE_HOST/PORT)
+	APIServer string `json:"api_server,omitempty"`
+	// Bearer token file (default, the mounted service account token)
+	TokenFile string `json:"token_file,omitempty"`
+	// CA bundle for the API server (default, the mounted service account CA)
+	CAFile string `json:"ca_file,omitempty"`
+
+	client *http.Client
+}
+
+func (k *KubernetesRuntime) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "deployment", "statefulset":
+			k.Kind = d.Val()
+			if !d.Args(&k.Name) {
+				return d.ArgErr()
+			}
+		case "namespace":
+			if !d.Args(&k.Namespace) {
+				return d.ArgErr()
+			}
+		case "api_server":
+			if !d.Args(&k.APIServer) {
+				return d.ArgErr()
+			}
+		case "token_file":
+			if !d.Args(&k.TokenFile) {
+				return d.ArgErr()
+			}
+		case "ca_file":
+			if !d.Args(&k.CAFile) {
+				return d.ArgErr()
+			}
+		default:
+			return d.Errf("unknown kubernetes runtime subdirective: %q", d.Val())
+		}
+	}
+	return nil
+}
+
+// provision validates the config and resolves in-cluster defaults.
+func (k *KubernetesRuntime) provision() error {
+	if k.Kind != "deployment" && k.Kind != "statefulset" {
+		return fmt.Errorf("kubernetes runtime: kind must be deployment or statefulset, got %q", k.Kind)
+	}
+	if k.Name == "" {
+		return fmt.Errorf("kubernetes runtime: workload name is required")
+	}
+	if k.Namespace == "" {
+		ns, err := os.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			k.Namespace = "default"
+		} else {
+			k.Namespace = strings.TrimSpace(string(ns))
+		}
+	}
+	if k.APIServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return fmt.Errorf("kubernetes runtime: api_server not set and not running in a cluster")
+		}
+		k.APIServer = "https://" + net.JoinHostPort(host, port)
+	}
+	if k.TokenFile == "" {
+		k.TokenFile = serviceAccountDir + "/token"
+	}
+	if k.CAFile == "" {
+		k.CAFile = serviceAccountDir + "/ca.crt"
+	}
+
+	tlsCfg := &tls.Config{}
+	if pem, err := os.ReadFile(k.CAFile); err == nil {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("kubernetes runtime: no certificates found in %s", k.CAFile)
+		}
+		tlsCfg.RootCAs = pool
+	}
+	k.client = &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsCfg},
+	}
+	return nil
+}
+
+// scale sets the workload's replica count through its scale subresource.
+func (k *KubernetesRuntime) scale(ctx context.Context, replicas int) error {
+	url := fmt.Sprintf("%s/apis/apps/v1/namespaces/%s/%ss/%s/scale",
+		strings.TrimSuffix(k.APIServer, "/"), k.Namespace, k.Kind, k.Name)
+	body := fmt.Sprintf(`{"spec":{"replicas":%d}}`, replicas)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, url, bytes.NewBufferString(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	// Service account tokens are rotated, so read the token on every call.
+	if token, err := os.ReadFile(k.TokenFile); err == nil {
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("scaling %s/%s: %v", k.Kind, k.Name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("scaling %s/%s: unexpected status %d", k.Kind, k.Name, resp.StatusCode)
+	}
+	return nil
+}
+
+// scaleUpLocked scales the workload to one replica and waits until its
+// Service passes the readiness check. The caller must hold ps.mu.
+func (c *ReverseBin) scaleUpLocked(ctx context.Context, r *http.Request, ps *processState, key string) error {
+	overrides, err := c.resolveOverrides(r, key)
+	if err != nil {
+		return err
+	}
+	k := c.Kubernetes
+	c.logger.Info("scaling up kubernetes workload",
+		zap.String("kind", k.Kind),
+		zap.String("name", k.Name),
+		zap.String("namespace", k.Namespace))
+	started := time.Now()
+	if err := k.scale(ctx, 1); err != nil {
+		return err
+	}
+	traceFrom(r).step("scale", started, k.Kind+"/"+k.Name)
+
+	var readinessTLS *tls.Config
+	if c.UpstreamTLS != nil {
+		if readinessTLS, err = c.UpstreamTLS.clientConfig(); err != nil {
+			return err
+		}
+	}
+	readyStart := time.Now()
+	err = c.waitForReadiness(ctx, overrides, readinessTLS, nil, c.readinessTimeoutLocked(ps))
+	traceFrom(r).step("readiness", readyStart, *overrides.ReverseProxyTo)
+	if err != nil {
+		return err
+	}
+	startup := time.Since(started)
+	c.recordStartupLocked(ps, key, startup)
+	c.logger.Info("kubernetes workload ready",
+		zap.String("name", k.Name),
+		zap.String("address", *overrides.ReverseProxyTo),
+		zap.Duration("startup", startup))
+
+	ps.overrides = overrides
+	ps.scaleDown = func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := k.scale(ctx, 0); err != nil {
+			c.logger.Warn("failed to scale down kubernetes workload", zap.String("name", k.Name), zap.Error(err))
+			return
+		}
+		c.logger.Info("scaled down kubernetes workload", zap.String("name", k.Name))
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package reversebin
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// recycleDrainTimeout is how long a backend due to be recycled may keep
+// serving requests before it is recycled while some are in flight.
+const recycleDrainTimeout = time.Minute
+
+// recyclePollInterval is how often a backend due to be recycled is checked
+// for in-flight requests.
+const recyclePollInterval = time.Second
+
+// MaxLifetime recycles backends that have run for long, e.g. to bound the
+// memory an app leaks.
+type MaxLifetime struct {
+	// Milliseconds a backend may run
+	DurationMS int `json:"duration_ms"`
+	// Up to this many milliseconds are taken off each backend's lifetime at
+	// random, so that backends started together are not recycled together
+	// (default, a tenth of the duration)
+	JitterMS int `json:"jitter_ms,omitempty"`
+}
+
+// parseMaxLifetime parses "max_lifetime <duration> [<jitter>]".
+func parseMaxLifetime(d *caddyfile.Dispenser) (*MaxLifetime, error) {
+	args := d.RemainingArgs()
+	if len(args) == 0 || len(args) > 2 {
+		return nil, d.ArgErr()
+	}
+	dur, err := caddy.ParseDuration(args[0])
+	if err != nil || dur < time.Minute {
+		return nil, d.Errf("max_lifetime must be a duration of at least 1m: %s", args[0])
+	}
+	l := &MaxLifetime{DurationMS: int(dur.Milliseconds())}
+	if len(args) == 2 {
+		jitter, err := caddy.ParseDuration(args[1])
+		if err != nil || jitter < time.Millisecond {
+			return nil, d.Errf("max_lifetime jitter must be a positive duration: %s", args[1])
+		}
+		l.JitterMS = int(jitter.Milliseconds())
+	}
+	return l, nil
+}
+
+func (l *MaxLifetime) validate() error {
+	if l.DurationMS < 60000 {
+		return fmt.Errorf("max_lifetime must be at least 1m")
+	}
+	if l.JitterMS < 0 || l.JitterMS >= l.DurationMS {
+		return fmt.Errorf("max_lifetime jitter must be shorter than the lifetime")
+	}
+	return nil
+}
+
+// lifetime returns how long a backend starting now may run: the duration
+// less a random part of the jitter.
+func (l *MaxLifetime) lifetime() time.Duration {
+	jitter := l.JitterMS
+	if jitter == 0 {
+		jitter = l.DurationMS / 10
+	}
+	return time.Duration(l.DurationMS-rand.IntN(jitter+1)) * time.Millisecond
+}
+
+// watchLifetime recycles the backend pid of ps once it has run for its
+// lifetime, also after a reload hands it to another handler. Backends that
+// exit first are left alone.
+func (c *ReverseBin) watchLifetime(ps *processState, pid int, gone <-chan struct{}) {
+	lifetime := c.MaxLifetime.lifetime()
+	select {
+	case <-c.clock().After(lifetime):
+	case <-gone:
+		return
+	}
+
+	c.recycle(ps, pid, gone, "max_lifetime", "max lifetime reached", zap.Duration("lifetime", lifetime))
+}
+
+// recycle stops the backend pid of ps as soon as no request is in flight, or
+// after recycleDrainTimeout regardless, like on idle, and starts a new one in
+// its place. The key has no backend in between, even where the new one would
+// listen on another address, since a start holds the key; copies of a key
+// are recycled one at a time, so the others serve meanwhile. kind names the
+// trigger in metrics, and reason is logged. The handler owning ps by then
+// does the recycling.
+func (c *ReverseBin) recycle(ps *processState, pid int, gone <-chan struct{}, kind, reason string, fields ...zap.Field) {
+	c = ps.handler(c)
+	key := c.processKeyName(ps.key)
+	base, _ := c.splitInstance(ps.key)
+	turn, claimer := false, c
+	defer func() {
+		if turn {
+			claimer.recycleDone(base)
+		}
+	}()
+	drainUntil := c.clock().Now().Add(recycleDrainTimeout)
+	for {
+		if !turn {
+			turn = c.recycleTurn(base)
+		}
+		ps.mu.Lock()
+		current := ps.process != nil && ps.process.Pid() == pid
+		active := ps.activeRequests
+		if current && turn && (active == 0 || c.clock().Now().After(drainUntil)) {
+			ps.stopLocked(reason)
+			ps.mu.Unlock()
+			break
+		}
+		ps.mu.Unlock()
+		if !current {
+			return
+		}
+		select {
+		case <-c.clock().After(recyclePollInterval):
+		case <-gone:
+			return
+		}
+	}
+
+	// A reload may have handed the backend over while it drained.
+	c = ps.handler(c)
+	c.logger.Info("recycling backend", append([]zap.Field{
+		zap.String("key", key),
+		zap.Int("pid", pid),
+		zap.String("reason", reason)}, fields...)...)
+	if c.metrics != nil {
+		c.metrics.recycles.WithLabelValues(key, kind).Inc()
+	}
+	if err := c.startUnrequested(c.ctx, ps, kind, false); err != nil && c.ctx.Err() == nil {
+		c.logger.Warn("failed to start backend after recycling it; the next request starts it",
+			zap.String("key", key), zap.Error(err))
+	}
+}
+
+// recycleTurn claims the recycling of a copy of the key base and reports
+// whether it got it; it does not while another copy is being recycled.
+func (c *ReverseBin) recycleTurn(base string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.recycling[base] {
+		return false
+	}
+	if c.recycling == nil {
+		c.recycling = make(map[string]bool)
+	}
+	c.recycling[base] = true
+	return true
+}
+
+// recycleDone ends the recycling claimed by recycleTurn.
+func (c *ReverseBin) recycleDone(base string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.recycling, base)
+}
@@ -0,0 +1,116 @@
+package reversebin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// acquireSlot blocks until the request may be proxied under the per-key and
+// handler-wide inflight caps and upstream_rate_limit. The per-key slot is
+// taken first, so a hot key can hold at most MaxInflightPerKey of the
+// handler-wide slots and other keys keep making progress. The request's turn
+// under the rate limit comes before both, so that waiting for it holds no
+// slot. The whole wait is bounded by the queue timeout. The returned func
+// releases both slots.
+func (c *ReverseBin) acquireSlot(ctx context.Context, ps *processState, name string) (func(), error) {
+	start := time.Now()
+	if c.QueueTimeoutMS > 0 && (ps.inflight != nil || c.inflight != nil || c.UpstreamRateLimit != nil) {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, time.Duration(c.QueueTimeoutMS)*time.Millisecond, ErrQueueTimeout)
+		defer cancel()
+	}
+	var keySlot, globalSlot bool
+	release := func() {
+		if globalSlot {
+			<-c.inflight
+		}
+		if keySlot {
+			<-ps.inflight
+		}
+	}
+
+	if err := c.waitTurn(ctx, ps); err != nil {
+		return nil, err
+	}
+	if ps.inflight != nil {
+		if err := c.waitKeySlot(ctx, ps); err != nil {
+			return nil, err
+		}
+		keySlot = true
+	}
+	if c.inflight != nil {
+		select {
+		case c.inflight <- struct{}{}:
+			globalSlot = true
+		case <-ctx.Done():
+			release()
+			return nil, slotError(ctx)
+		}
+	}
+
+	if c.metrics != nil {
+		c.metrics.queueWait.WithLabelValues(name).Observe(time.Since(start).Seconds())
+		gauge := c.metrics.inflight.WithLabelValues(name)
+		gauge.Inc()
+		releaseSlots := release
+		release = func() {
+			gauge.Dec()
+			releaseSlots()
+		}
+	}
+	return release, nil
+}
+
+// waitKeySlot takes a slot of ps, waiting while all are taken unless
+// queue_size requests already wait for one.
+func (c *ReverseBin) waitKeySlot(ctx context.Context, ps *processState) error {
+	select {
+	case ps.inflight <- struct{}{}:
+		return nil
+	default:
+	}
+	if c.QueueSize > 0 {
+		if ps.queued.Add(1) > int64(c.QueueSize) {
+			ps.queued.Add(-1)
+			return caddyhttp.Error(http.StatusTooManyRequests,
+				fmt.Errorf("%w: %d requests are already waiting", ErrQueueFull, c.QueueSize))
+		}
+		defer ps.queued.Add(-1)
+	}
+	if ce := c.logger.Check(zap.DebugLevel, "request queued for a slot"); ce != nil {
+		ce.Write(zap.String("key", c.processKeyName(ps.key)))
+	}
+	select {
+	case ps.inflight <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return slotError(ctx)
+	}
+}
+
+// shedLoad tells a client turned away by a full queue, the queue timeout or
+// the upstream rate limit when to retry, and counts the request.
+func (c *ReverseBin) shedLoad(w http.ResponseWriter, name string, err error) {
+	reason := errorCode(err)
+	if reason != "queue_full" && reason != "queue_timeout" && reason != "rate_limited" {
+		return
+	}
+	w.Header().Set("Retry-After", "1")
+	if c.metrics != nil {
+		c.metrics.shed.WithLabelValues(name, reason).Inc()
+	}
+}
+
+// slotError is the error of a request that stopped waiting for a slot.
+func slotError(ctx context.Context) error {
+	if cause := context.Cause(ctx); errors.Is(cause, ErrQueueTimeout) {
+		return caddyhttp.Error(http.StatusServiceUnavailable, cause)
+	}
+	return caddyhttp.Error(http.StatusServiceUnavailable, fmt.Errorf("gave up waiting for inflight slot: %w", ctx.Err()))
+}
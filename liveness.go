@@ -0,0 +1,141 @@
+package reversebin
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// Defaults of liveness_check.
+const (
+	defaultLivenessInterval = 10 * time.Second
+	defaultLivenessFailures = 3
+)
+
+// LivenessCheck keeps probing a backend once it is ready and restarts it
+// after consecutive failed probes, before requests find it hung.
+type LivenessCheck struct {
+	// HTTP method, or GRPC for the gRPC health checking protocol
+	Method string `json:"method"`
+	// Path to request, or the service to check with GRPC
+	Path string `json:"path,omitempty"`
+	// Status codes that pass (default, any 2xx or 3xx)
+	Status []int `json:"status,omitempty"`
+	// Milliseconds between probes (default, 10000)
+	IntervalMS int `json:"interval_ms,omitempty"`
+	// Failed probes in a row that restart the backend (default, 3)
+	Failures int `json:"failures,omitempty"`
+}
+
+// unmarshalCaddyfile parses "liveness_check <method> <path> [expect
+// <status>...]" or "liveness_check grpc [service]", with an optional block of
+// interval and failures.
+func (l *LivenessCheck) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	var err error
+	if l.Method, l.Path, l.Status, err = parseReadinessCheck(d, "liveness_check", d.RemainingArgs()); err != nil {
+		return err
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil || dur < time.Millisecond {
+				return d.Errf("liveness_check interval must be a positive duration: %s", d.Val())
+			}
+			l.IntervalMS = int(dur.Milliseconds())
+		case "failures":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil || n < 1 {
+				return d.Errf("liveness_check failures must be a positive integer, got %q", d.Val())
+			}
+			l.Failures = n
+		default:
+			return d.Errf("unknown liveness_check subdirective: %q", d.Val())
+		}
+	}
+	return nil
+}
+
+func (l *LivenessCheck) validate() error {
+	if !readinessConfigured(l.Method, l.Path) {
+		return fmt.Errorf("liveness_check needs a method and path, or grpc")
+	}
+	if l.IntervalMS < 0 || l.Failures < 0 {
+		return fmt.Errorf("liveness_check interval and failures must not be negative")
+	}
+	return nil
+}
+
+func (l *LivenessCheck) interval() time.Duration {
+	if l.IntervalMS > 0 {
+		return time.Duration(l.IntervalMS) * time.Millisecond
+	}
+	return defaultLivenessInterval
+}
+
+func (l *LivenessCheck) failures() int {
+	if l.Failures > 0 {
+		return l.Failures
+	}
+	return defaultLivenessFailures
+}
+
+// watchLiveness probes the backend pid of ps, ready at overrides, until it
+// exits and gone is closed, also after a reload hands it to another handler.
+// Once the check failed often enough in a row, the backend is stopped and
+// started again.
+func (c *ReverseBin) watchLiveness(ps *processState, pid int, overrides *Overrides, tlsConfig *tls.Config, gone <-chan struct{}) {
+	l := c.LivenessCheck
+	upstream, host := *overrides.ReverseProxyTo, overrides.upstreamHost()
+	var probe func() bool
+	if strings.EqualFold(l.Method, readinessGRPC) {
+		probe = grpcProbe(upstream, l.Path, host, tlsConfig, "liveness")
+	} else {
+		_, probe = httpProbe(upstream, l.Method, l.Path, host, l.Status, tlsConfig, "liveness")
+	}
+	failed := 0
+	for failed < l.failures() {
+		select {
+		case <-ps.handler(c).clock().After(l.interval()):
+		case <-gone:
+			return
+		}
+		if probe() {
+			failed = 0
+		} else {
+			failed++
+		}
+	}
+
+	c = ps.handler(c)
+	key := c.processKeyName(ps.key)
+	ps.mu.Lock()
+	current := ps.process != nil && ps.process.Pid() == pid
+	if current {
+		ps.stopLocked("liveness check failed")
+	}
+	ps.mu.Unlock()
+	if !current {
+		return
+	}
+	c.logger.Warn("backend failed its liveness check; restarting",
+		zap.String("key", key),
+		zap.Int("pid", pid),
+		zap.Int("failures", failed))
+	if err := c.startUnrequested(c.ctx, ps, "liveness", false); err != nil {
+		c.logger.Error("failed to restart backend after liveness check",
+			zap.String("key", key), zap.Error(err))
+	}
+}
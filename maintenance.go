@@ -0,0 +1,98 @@
+package reversebin
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// defaultMaintenancePage is the body served when no maintenance page is configured.
+const defaultMaintenancePage = "Service temporarily unavailable for maintenance.\n"
+
+// Maintenance takes an app offline while a marker file exists, without
+// starting or touching its backend. Paths may use placeholders such as
+// {reverse_bin.key}, so each tenant can toggle its own app.
+type Maintenance struct {
+	// Marker file; requests get the maintenance response while it exists
+	File string `json:"file"`
+	// File whose contents are the response body (default, a short notice)
+	Page string `json:"page,omitempty"`
+	// Response status (default, 503)
+	Status int `json:"status,omitempty"`
+}
+
+func (m *Maintenance) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if !d.Args(&m.File) {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "page":
+			if !d.Args(&m.Page) {
+				return d.ArgErr()
+			}
+		case "status":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			status, err := strconv.Atoi(d.Val())
+			if err != nil || status < 400 || status > 599 {
+				return d.Errf("maintenance status must be an HTTP error status, got %q", d.Val())
+			}
+			m.Status = status
+		default:
+			return d.Errf("unknown maintenance_file subdirective: %q", d.Val())
+		}
+	}
+	return nil
+}
+
+// serveIfActive writes the maintenance response and reports true when the
+// marker file for key exists. Keys that cannot be a file name, such as "..",
+// never have one.
+func (m *Maintenance) serveIfActive(w http.ResponseWriter, r *http.Request, key string) bool {
+	file, err := expandKeyPath(r, key, m.File)
+	if err != nil {
+		return false
+	}
+	if _, err := os.Stat(file); err != nil {
+		return false
+	}
+	// The page is read per request so tenants can edit it while offline.
+	body, contentType := []byte(defaultMaintenancePage), "text/plain; charset=utf-8"
+	if data, pageType, ok := readKeyPage(r, key, m.Page); ok {
+		body, contentType = data, pageType
+	}
+	status := m.Status
+	if status == 0 {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+	return true
+}
+
+// readKeyPage reads the response page at path, if set, for key and returns
+// it with its content type. Keys that cannot be a file name have no page.
+func readKeyPage(r *http.Request, key, path string) ([]byte, string, bool) {
+	if path == "" {
+		return nil, "", false
+	}
+	page, err := expandKeyPath(r, key, path)
+	if err != nil {
+		return nil, "", false
+	}
+	data, err := os.ReadFile(page)
+	if err != nil {
+		return nil, "", false
+	}
+	if strings.HasSuffix(page, ".html") || strings.HasSuffix(page, ".htm") {
+		return data, "text/html; charset=utf-8", true
+	}
+	return data, "text/plain; charset=utf-8", true
+}
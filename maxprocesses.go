@@ -0,0 +1,157 @@
+package reversebin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// maxProcessesOption is the Caddyfile global option capping the backends
+// running at once across every reverse-bin handler of the process.
+const maxProcessesOption = "reverse_bin_max_processes"
+
+// parseMaxProcessesOption parses the global "reverse_bin_max_processes <n>"
+// option.
+func parseMaxProcessesOption(d *caddyfile.Dispenser, _ any) (any, error) {
+	d.Next() // consume option name
+	return parseMaxProcesses(d)
+}
+
+// parseMaxProcesses parses the argument of max_processes.
+func parseMaxProcesses(d *caddyfile.Dispenser) (int, error) {
+	name := d.Val()
+	if !d.NextArg() {
+		return 0, d.ArgErr()
+	}
+	v, err := strconv.Atoi(d.Val())
+	if err != nil || v <= 0 {
+		return 0, d.Errf("%s must be a positive integer", name)
+	}
+	if d.NextArg() {
+		return 0, d.ArgErr()
+	}
+	return v, nil
+}
+
+// evictForStartLocked makes room for the backend of ps when max_processes
+// backends of the handler, or global_max_processes backends of all handlers,
+// are running, by stopping the one of another key that has been idle the
+// longest. ps.mu is released meanwhile, since the other keys' states are
+// locked, and held again on return.
+func (c *ReverseBin) evictForStartLocked(ps *processState) error {
+	ps.mu.Unlock()
+	defer ps.mu.Lock()
+
+	if c.MaxProcesses > 0 {
+		if err := c.evictOne(ps, c.otherStates(ps), c.MaxProcesses, "max_processes"); err != nil {
+			return err
+		}
+	}
+	if c.GlobalMaxProcesses > 0 {
+		return c.evictOne(ps, c.globalStates(ps), c.GlobalMaxProcesses, maxProcessesOption)
+	}
+	return nil
+}
+
+// otherStates returns the states of the handler's keys other than ps.
+func (c *ReverseBin) otherStates(ps *processState) []*processState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	others := make([]*processState, 0, len(c.processes))
+	for _, other := range c.processes {
+		if other != ps {
+			others = append(others, other)
+		}
+	}
+	return others
+}
+
+// globalStates returns the states of every key of every loaded handler,
+// other than ps. A backend carried over by a reload is listed once.
+func (c *ReverseBin) globalStates(ps *processState) []*processState {
+	seen := map[*processState]bool{ps: true}
+	var others []*processState
+	collect := func(h *ReverseBin) {
+		for _, other := range h.otherStates(ps) {
+			if !seen[other] {
+				seen[other] = true
+				others = append(others, other)
+			}
+		}
+	}
+	handlers.mu.Lock()
+	defer handlers.mu.Unlock()
+	collect(c)
+	for h := range handlers.set {
+		if h != c {
+			collect(h)
+		}
+	}
+	return others
+}
+
+// evictOne stops the backend idle the longest among others when limit of
+// them are running, and fails when none is idle. option names the limit in
+// errors and logs.
+func (c *ReverseBin) evictOne(ps *processState, others []*processState, limit int, option string) error {
+	running := 0
+	var victim *processState
+	var victimUsed time.Time
+	for _, other := range others {
+		if !other.running.Load() && !other.starting.Load() {
+			continue
+		}
+		running++
+		// States that are locked are busy, so not idle.
+		if other.starting.Load() || !other.mu.TryLock() {
+			continue
+		}
+		if other.process != nil && other.activeRequests == 0 && (victim == nil || other.lastRequestEnd.Before(victimUsed)) {
+			victim, victimUsed = other, other.lastRequestEnd
+		}
+		other.mu.Unlock()
+	}
+	if running < limit {
+		return nil
+	}
+	if victim == nil {
+		return caddyhttp.Error(http.StatusServiceUnavailable,
+			fmt.Errorf("%w: %d backends are running and none is idle (%s)", ErrMaxProcesses, running, option))
+	}
+
+	victim.mu.Lock()
+	stopped := victim.process != nil && victim.activeRequests == 0
+	var pid int
+	if stopped {
+		pid = victim.process.Pid()
+		victim.stopLocked(fmt.Sprintf("evicted to make room for another backend (%s)", option))
+	}
+	stopping := victim.stopping
+	victim.mu.Unlock()
+	if !stopped {
+		return caddyhttp.Error(http.StatusServiceUnavailable,
+			fmt.Errorf("%w: the idle backend to evict became busy", ErrMaxProcesses))
+	}
+	// The room is made once the victim is gone, after its pre-stop
+	// notification.
+	_ = awaitStopped(context.Background(), stopping)
+
+	owner := victim.handler(c)
+	name := owner.processKeyName(victim.key)
+	c.logger.Info("evicted idle backend to make room for another",
+		zap.String("key", name),
+		zap.Int("pid", pid),
+		zap.String("for", c.processKeyName(ps.key)),
+		zap.String("limit", option),
+		zap.Int("max_processes", limit))
+	if owner.metrics != nil {
+		owner.metrics.evictions.WithLabelValues(name).Inc()
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package reversebin
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metrics holds the Prometheus collectors shared by all reverse-bin handlers
+// of one config. Series are labeled by the operator-facing process key.
+type metrics struct {
+	queueWait *prometheus.HistogramVec
+	inflight  *prometheus.GaugeVec
+	shed      *prometheus.CounterVec
+
+	startupDuration    *prometheus.HistogramVec
+	startCancellations *prometheus.CounterVec
+	waiting            *prometheus.GaugeVec
+
+	upstreamLatency   *prometheus.HistogramVec
+	upstreamResponses *prometheus.CounterVec
+	upstreamFailures  *prometheus.CounterVec
+
+	detectorCacheLookups   *prometheus.CounterVec
+	detectorCacheEvictions *prometheus.CounterVec
+
+	socketsRemoved prometheus.Counter
+	recycles       *prometheus.CounterVec
+	evictions      *prometheus.CounterVec
+}
+
+func newMetrics(reg prometheus.Registerer) *metrics {
+	const ns, sub = "caddy", "reverse_bin"
+	return &metrics{
+		queueWait: register(reg, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "queue_wait_seconds",
+			Help:      "Time requests waited for an inflight slot before being proxied.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"key"})),
+		inflight: register(reg, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "inflight_requests",
+			Help:      "Requests currently being proxied to a backend.",
+		}, []string{"key"})),
+		shed: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "shed_requests_total",
+			Help:      "Requests turned away without a slot by reason: queue_full, queue_timeout or rate_limited.",
+		}, []string{"key", "reason"})),
+		startupDuration: register(reg, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "startup_duration_seconds",
+			Help:      "Time from starting a backend until it passed readiness.",
+			Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+		}, []string{"key"})),
+		startCancellations: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "start_cancellations_total",
+			Help:      "Requests that gave up waiting for a backend to start because they were cancelled.",
+		}, []string{"key"})),
+		waiting: register(reg, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "waiting_requests",
+			Help:      "Requests currently waiting for a backend to start or become ready.",
+		}, []string{"key"})),
+		upstreamLatency: register(reg, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "upstream_latency_seconds",
+			Help:      "Time from sending a request to a backend until its response headers arrived.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"key"})),
+		upstreamResponses: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "upstream_responses_total",
+			Help:      "Responses from backends by status class (2xx..5xx), or error when the round trip failed.",
+		}, []string{"key", "class"})),
+		upstreamFailures: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "upstream_failures_total",
+			Help:      "Failed requests to backends by kind: app when the backend was running, lifecycle when it had exited.",
+		}, []string{"key", "kind"})),
+		detectorCacheLookups: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "detector_cache_lookups_total",
+			Help:      "Lookups of cached detector results by result: hit or miss.",
+		}, []string{"key", "result"})),
+		detectorCacheEvictions: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "detector_cache_evictions_total",
+			Help:      "Cached detector results removed because they expired or a backend started with them failed.",
+		}, []string{"key"})),
+		socketsRemoved: register(reg, prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "orphaned_sockets_removed_total",
+			Help:      "Unix sockets removed by socket_cleanup because no backend used them.",
+		})),
+		recycles: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "backend_recycles_total",
+			Help:      "Backends stopped and started again by reason: max_lifetime or rss.",
+		}, []string{"key", "reason"})),
+		evictions: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "backend_evictions_total",
+			Help:      "Idle backends stopped by max_processes to make room for another key's.",
+		}, []string{"key"})),
+	}
+}
+
+// observeUpstream records the outcome of one round trip to key's backend.
+func (m *metrics) observeUpstream(key string, start time.Time, resp *http.Response, err error) {
+	class := "error"
+	if err == nil {
+		class = strconv.Itoa(resp.StatusCode/100) + "xx"
+		m.upstreamLatency.WithLabelValues(key).Observe(time.Since(start).Seconds())
+	}
+	m.upstreamResponses.WithLabelValues(key, class).Inc()
+}
+
+// register adds c to reg, or returns the identical collector another handler
+// already registered.
+func register[T prometheus.Collector](reg prometheus.Registerer, c T) T {
+	if err := reg.Register(c); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if errors.As(err, &are) {
+			if existing, ok := are.ExistingCollector.(T); ok {
+				return existing
+			}
+		}
+	}
+	return c
+}
@@ -18,17 +18,22 @@ package reversebin
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
-	"os"
+	"net/http"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/fileserver"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
 	"go.uber.org/zap"
 )
@@ -42,12 +47,20 @@ func init() {
 	// "respond" handler in the HTTP middleware chain. This makes the "order"
 	// block in the Caddyfile redundant.
 	httpcaddyfile.RegisterDirectiveOrder("reverse-bin", httpcaddyfile.Before, "respond")
+	httpcaddyfile.RegisterGlobalOption(execWrapperOption, parseExecWrapperOption)
+	httpcaddyfile.RegisterGlobalOption(maxProcessesOption, parseMaxProcessesOption)
 }
 
 // ReverseBin supervises executable backends and proxies HTTP traffic to them.
 type ReverseBin struct {
 	// Name of executable script or binary and its arguments
 	Executable []string `json:"executable"`
+	// Executables for particular GOOS/GOARCH platforms, e.g. "linux/arm64";
+	// the one of the host Caddy runs on replaces executable when provisioned
+	ExecPlatforms map[string][]string `json:"exec_platforms,omitempty"`
+	// Command and arguments prepended to every backend's executable, e.g.
+	// qemu-aarch64 or nsjail --quiet --
+	ExecWrapper []string `json:"exec_wrapper,omitempty"`
 	// Working directory (default, current Caddy working directory)
 	WorkingDirectory string `json:"workingDirectory,omitempty"`
 	// Environment key value pairs (key=value) for this particular app
@@ -59,33 +72,388 @@ type ReverseBin struct {
 
 	// Address to proxy to (for proxy mode)
 	ReverseProxyTo string `json:"reverse_proxy_to,omitempty"`
-	// Readiness check method (GET or HEAD)
+	// Readiness check method (GET or HEAD), or GRPC for the gRPC health
+	// checking protocol
 	ReadinessMethod string `json:"readinessMethod,omitempty"`
-	// Readiness check path
+	// Readiness check path, or the service to check with GRPC
 	ReadinessPath string `json:"readinessPath,omitempty"`
+	// Status codes that pass the readiness check (default, any 2xx or 3xx)
+	ReadinessStatus []int `json:"readiness_status,omitempty"`
+	// Host header sent to the backend, and server name for TLS upstreams,
+	// instead of the client's (e.g. "localhost"; the upstream port is added
+	// when none is given)
+	HostRewrite string `json:"host_rewrite,omitempty"`
 	// Binary and arguments to run to determine proxy parameters dynamically
 	DynamicProxyDetector []string `json:"dynamic_proxy_detector,omitempty"`
+	// Detector module that determines the backend per process key, as an
+	// alternative to dynamic_proxy_detector
+	DetectorRaw json.RawMessage `json:"detector,omitempty" caddy:"namespace=reverse_bin.detectors inline_key=detector"`
+	// Reuse the detector's result for a key, kept in Caddy's storage
+	DetectorCache *DetectorCache `json:"detector_cache,omitempty"`
+	// JWT claim, published by an auth handler as {http.auth.user.<claim>},
+	// whose value is used as the process key instead of the detector arguments
+	KeyJWTClaim string `json:"key_jwt_claim,omitempty"`
+	// Process keys of requests matching CEL expressions; the first matching
+	// rule wins, and other requests are keyed as usual
+	KeyRules []*KeyRule `json:"key_rules,omitempty"`
 	// Idle timeout in milliseconds before stopping backend process after last request
 	IdleTimeoutMS int `json:"idleTimeoutMs,omitempty"`
+	// Derive each key's idle timeout from its observed startup times instead
+	IdlePolicy *IdlePolicy `json:"idle_policy,omitempty"`
+	// Idle timeouts for requests matching a route, e.g. to keep a backend warm
+	// longer after admin requests; the first match wins
+	IdleOverrides []*IdleOverride `json:"idle_overrides,omitempty"`
+	// Requests that are proxied without keeping the backend warm, e.g. uptime checks
+	IdleIgnore caddyhttp.RawMatcherSets `json:"idle_ignore,omitempty" caddy:"namespace=http.matchers"`
+	// Request header telling backends the idle timeout of each request in
+	// milliseconds, e.g. X-Reverse-Bin-Idle-Ms, to tune their keep-alive by
+	IdleHintHeader string `json:"idle_hint_header,omitempty"`
+	// Let backends extend their idle timeout by printing
+	// REVERSE_BIN_KEEPALIVE=<duration>, up to this many milliseconds after
+	// their last request
+	BackendKeepAliveMaxMS int `json:"backend_keepalive_max_ms,omitempty"`
+	// Requests allowed to start a backend, e.g. authenticated ones; others
+	// are only proxied to a backend that is already running
+	ActivationRequire caddyhttp.RawMatcherSets `json:"activation_require,omitempty" caddy:"namespace=http.matchers"`
+	// Status for requests refused by activation_require (default, 503), e.g. 402
+	ActivationDenyStatus int `json:"activation_deny_status,omitempty"`
+	// Caps the starts of each key's backend per period
+	MaxColdStarts *ColdStartBudget `json:"max_cold_starts,omitempty"`
+	// Alternative backends for matching requests, e.g. a staging build
+	// behind a preview cookie; the first matching variant wins
+	Variants []*Variant `json:"variants,omitempty"`
+	// Maximum concurrently proxied requests per process key; excess requests wait (0 = unlimited)
+	MaxInflightPerKey int `json:"max_inflight_per_key,omitempty"`
+	// Maximum concurrently proxied requests across all keys of this handler (0 = unlimited)
+	MaxInflight int `json:"max_inflight,omitempty"`
+	// Maximum backends of this handler running at once; starting another
+	// stops the one idle the longest, or fails with 503 when none is idle
+	// (0 = unlimited)
+	MaxProcesses int `json:"max_processes,omitempty"`
+	// Maximum backends running at once across every reverse-bin handler
+	// that sets it, evicting like max_processes; set by the global option
+	// reverse_bin_max_processes (0 = unlimited)
+	GlobalMaxProcesses int `json:"global_max_processes,omitempty"`
+	// Milliseconds a request waits for an inflight slot before failing with
+	// 503 (0 = until the client gives up)
+	QueueTimeoutMS int `json:"queue_timeout_ms,omitempty"`
+	// Requests that may wait for a slot of a key at max_inflight_per_key;
+	// further ones are turned away with 429 (0 = unlimited)
+	QueueSize int `json:"queue_size,omitempty"`
+	// Caps the rate of requests sent to each backend; requests over it wait
+	// their turn, or get 429 if it would come after the queue timeout
+	UpstreamRateLimit *UpstreamRateLimit `json:"upstream_rate_limit,omitempty"`
+	// Normalizes requests for backends with naive HTTP servers: strips
+	// Expect and sends chunked bodies with a Content-Length
+	CompatMode *CompatMode `json:"compat_mode,omitempty"`
+	// Milliseconds after readiness during which a backend's concurrency ramps
+	// from one request up to max_inflight_per_key (default, 100), e.g. for JIT warm-up
+	SlowStartMS int `json:"slow_start_ms,omitempty"`
+	// Milliseconds a backend must keep running after readiness for its start
+	// to succeed; earlier exits fail the start and hold off the next one
+	MinStableTimeMS int `json:"min_stable_time_ms,omitempty"`
+	// Advisory lock held from spawn until readiness, serializing backends that share a data directory
+	InitLock *InitLock `json:"init_lock,omitempty"`
+	// Whether a backend that exited on its own is started again: always (default), on-failure or never
+	RestartPolicy string `json:"restart_policy,omitempty"`
+	// Exit codes after which a backend is never started again, e.g. 0 or 143
+	NoRestartCodes []int `json:"no_restart_codes,omitempty"`
+	// Refuse starts for a while once a key was started too often within a
+	// period, e.g. 5 starts in 30s
+	CrashLoop *CrashLoop `json:"crash_loop,omitempty"`
+	// Crashes in a row after which the key is kept stopped (default, unlimited)
+	MaxRestarts int `json:"max_restarts,omitempty"`
+	// Milliseconds the start after a crash is held off, doubling with each
+	// crash in a row (default, no wait)
+	RestartBackoffMS int `json:"restart_backoff_ms,omitempty"`
+	// Upper bound of the restart backoff in milliseconds (default, 300000)
+	RestartBackoffMaxMS int `json:"restart_backoff_max_ms,omitempty"`
+	// Persistent directory per process key, passed as REVERSE_BIN_DATA_DIR
+	DataDir *DataDir `json:"data_dir,omitempty"`
+	// Periodically write the process table to a file (JSON, or the Prometheus
+	// text format for paths ending in .prom)
+	StateFile *StateFile `json:"state_file,omitempty"`
+	// Start the backend, or every app, when the config loads rather than on
+	// the first request
+	Prewarm bool `json:"prewarm,omitempty"`
+	// Keys to start when the config loads, for detectors and provision_ask
+	PrewarmKeys []string `json:"prewarm_keys,omitempty"`
+	// Periodically remove unix sockets no backend uses from a directory
+	SocketCleanup *SocketCleanup `json:"socket_cleanup,omitempty"`
+	// Forget the state of keys that have had no backend and no requests for
+	// this many milliseconds, e.g. in multi-tenant setups (0 = never)
+	ProcessStateTTLMS int `json:"process_state_ttl_ms,omitempty"`
+	// Mint a certificate from Caddy's internal CA for each backend start
+	BackendCert *BackendCert `json:"backend_cert,omitempty"`
+	// Allow backends to dump core and collect the dump when one crashes (Linux only)
+	CaptureCore *CaptureCore `json:"capture_core,omitempty"`
+	// Read-only view of the filesystem for the backend, with tmpfs overlays for
+	// writable paths (Linux only)
+	Filesystem *Filesystem `json:"filesystem,omitempty"`
+	// cgroup v2 CPU quota for the backend, optionally relaxed during startup (Linux only)
+	CPULimit *CPULimit `json:"cpu_limit,omitempty"`
+	// Serialize cold starts across Caddy instances through the configured storage
+	// lock; instances finding the upstream already up proxy to it instead of spawning
+	SharedStart bool `json:"shared_start,omitempty"`
+	// Fail config load when something already accepts connections on
+	// reverse_proxy_to that reverse-bin did not start
+	ProbeUpstream bool `json:"probe_upstream,omitempty"`
+	// Lower backend scheduling priority while the host CPUs are saturated
+	AutoNice *AutoNice `json:"auto_nice,omitempty"`
+	// Consul or etcd registry announcing ready backends
+	ServiceRegistry *ServiceRegistry `json:"service_registry,omitempty"`
+	// Stop a cold start when the request that triggered it disconnects
+	// (default, the start completes for later requests)
+	AbortStartOnDisconnect bool `json:"abort_start_on_disconnect,omitempty"`
+	// Informational status (103 Early Hints or 102 Processing) sent to a client
+	// whose request triggers a cold start (0 = disabled)
+	ColdStartHint int `json:"cold_start_hint,omitempty"`
+	// Forward only one of identical GET/HEAD requests arriving while a backend
+	// is cold and replay its response to the others
+	CoalesceColdStart bool `json:"coalesce_cold_start,omitempty"`
+	// External services that must be reachable before a backend is started
+	WaitFor []*WaitFor `json:"wait_for,omitempty"`
+	// Milliseconds a backend may take from spawn to readiness (default, 10000)
+	StartTimeoutMS int `json:"start_timeout_ms,omitempty"`
+	// Adapt the readiness deadline to each key's observed startup times (default, fixed start_timeout)
+	StartupTimeout *StartupTimeout `json:"startup_timeout,omitempty"`
+	// Milliseconds between readiness polls (default, 200 for HTTP checks and
+	// 50 for sockets and announced ports)
+	ReadinessIntervalMS int `json:"readiness_interval_ms,omitempty"`
+	// Double the wait after each failed readiness poll up to this many
+	// milliseconds (default, fixed interval)
+	ReadinessBackoffMaxMS int `json:"readiness_backoff_max_ms,omitempty"`
+	// Serve keys whose backend is not running as CGI scripts until requests
+	// arrive at this rate, then start a persistent backend
+	CGI *CGIMode `json:"cgi_until,omitempty"`
+	// Keep probing ready backends and restart ones that stop passing
+	LivenessCheck *LivenessCheck `json:"liveness_check,omitempty"`
+	// Stop and start again backends that have run this long
+	MaxLifetime *MaxLifetime `json:"max_lifetime,omitempty"`
+	// Stop and start again backends whose processes use more resident
+	// memory than this many bytes
+	RestartRSSAboveBytes int64 `json:"restart_if_rss_above,omitempty"`
+	// Run the backend as a Kubernetes workload scaled on demand instead of a local process
+	Kubernetes *KubernetesRuntime `json:"kubernetes,omitempty"`
+	// Backends declared inline, selected by process key
+	Apps map[string]*App `json:"apps,omitempty"`
+	// Placeholder template producing the key that selects an app (default, {http.request.host})
+	AppKey string `json:"app_key,omitempty"`
+	// URL asked (?domain=<host>&key=<key>) before cold-starting a key that is
+	// not an inline app; a 2xx allows it, optionally returning detector output
+	ProvisionAsk string `json:"provision_ask,omitempty"`
+	// Path prefix the app is mounted at, e.g. /app1 behind handle_path; redirects
+	// to / are moved under it and HTML pages get a matching <base href>
+	MountPrefix string `json:"mount_prefix,omitempty"`
+	// Serve a maintenance response instead of proxying while a marker file exists
+	Maintenance *Maintenance `json:"maintenance,omitempty"`
+	// Daily windows outside which requests get a static response instead of
+	// reaching or starting a backend
+	ActiveHours *ActiveHours `json:"active_hours,omitempty"`
+	// Loopback address family for port-only addresses such as ":8080":
+	// "ipv4" (default, 127.0.0.1) or "ipv6" ([::1])
+	Loopback string `json:"loopback,omitempty"`
+	// Check after readiness that TCP backends on loopback are not also
+	// reachable on the host's other addresses: "warn" logs a warning and
+	// "enforce" fails the start. Backends get the loopback host to bind to
+	// in REVERSE_BIN_HOST.
+	BindCheck string `json:"bind_check,omitempty"`
+	// TCP ports allocated to backends, substituted for {reverse_bin.port}
+	PortRange *PortRange `json:"port_range,omitempty"`
+	// Where backends that pick their own port announce it; the port is
+	// substituted for {reverse_bin.port} in reverse_proxy_to
+	UpstreamFrom *UpstreamFrom `json:"upstream_from,omitempty"`
+	// Connection settings (HTTP versions, pool size) for each key's transport
+	Transport *TransportConfig `json:"transport,omitempty"`
+	// Compression between Caddy and backends: "off" asks backends for
+	// uncompressed responses, "passthrough" relays the client's
+	// Accept-Encoding and compressed bodies unchanged (default, the transport
+	// requests gzip itself and decompresses)
+	UpstreamCompression string `json:"upstream_compression,omitempty"`
+	// TLS settings (client certificate, CA) for connections to the backend
+	UpstreamTLS *UpstreamTLS `json:"upstream_tls,omitempty"`
+	// Notification sent to a backend before it is stopped for being idle or via the admin API
+	PreStop *PreStop `json:"pre_stop,omitempty"`
+	// How backends are killed: "group" (default) signals the whole process
+	// group, "process" only the backend itself, sparing e.g. an attached debugger
+	KillMode string `json:"kill_mode,omitempty"`
+	// Keep a backend whose first process exited running while processes it
+	// started remain in its process group, or its cgroup with cpu_limit
+	FollowReexec bool `json:"follow_reexec,omitempty"`
+	// Milliseconds backends get to exit after stop_signal before they are sent
+	// SIGKILL (default, 0 sends SIGKILL right away, or 10000 with stop_signal)
+	StopTimeoutMS int `json:"stop_timeout_ms,omitempty"`
+	// Signal asking backends to exit before they are killed, e.g. SIGQUIT for
+	// gunicorn (default, SIGTERM when stop_timeout is set)
+	StopSignal string `json:"stop_signal,omitempty"`
+	// Keep backends running when idle (development only)
+	NoKillOnIdle bool `json:"no_kill_on_idle,omitempty"`
+	// Copies of each key's backend started as requests need them; above 1,
+	// {reverse_bin.instance} gives each its own address
+	Replicas int `json:"replicas,omitempty"`
+	// Copies of the backend kept running even when idle
+	MinInstances int `json:"min_instances,omitempty"`
+	// How requests are spread over the copies: least_conn (default),
+	// round_robin or random
+	ReplicaPolicy string `json:"replica_policy,omitempty"`
+	// Keep each client on the copy that first served it
+	ReplicaAffinity *ReplicaAffinity `json:"replica_affinity,omitempty"`
+
+	// Log a timed trace of every request's lifecycle at INFO and explain 5xx
+	// errors in the response body (development only)
+	Debug bool `json:"debug,omitempty"`
+
+	// Runner replaces os/exec for starting backends, e.g. with a fake in tests
+	Runner Runner `json:"-"`
+	// Clock replaces the wall clock for idle timeouts and readiness deadlines
+	Clock Clock `json:"-"`
+	// Observer is told about backend state transitions and proxied requests,
+	// e.g. by stress tests checking lifecycle invariants
+	Observer Observer `json:"-"`
 
 	// Internal state for proxy mode
 	processes map[string]*processState
 	mu        sync.Mutex
+	// provisioned holds provision_ask responses by key, guarded by mu
+	provisioned map[string]*Overrides
+	// asks holds the provision_ask requests in flight by key, guarded by mu
+	asks map[string]*provisionAsk
+	// recycling holds the keys a copy of which is being recycled, guarded by
+	// mu
+	recycling map[string]bool
+
+	// configHash is the fingerprint of the configuration; handedOver holds
+	// the process states taken over by the handler replacing this one on a
+	// reload, guarded by mu; adoptedFrom is the handler this one took them
+	// from, guarded by handlers.mu
+	configHash  string
+	handedOver  map[*processState]struct{}
+	adoptedFrom *ReverseBin
 
 	reverseProxy *reverseproxy.Handler
+	inflight     chan struct{}
+	metrics      *metrics
 	ctx          caddy.Context
+	// fileServer serves detector-reported static asset directories
+	fileServer *fileserver.FileServer
+
+	// detector is the loaded detector module, or the exec detector built
+	// from dynamic_proxy_detector
+	detector Detector
+
+	// idleIgnoreNames are the Caddyfile @names given to idle_ignore
+	idleIgnoreNames []string
+	idleIgnore      caddyhttp.MatcherSets
+	// activationNames are the Caddyfile @names given to activation_require
+	activationNames   []string
+	activationRequire caddyhttp.MatcherSets
+	// coldStartStore replaces Caddy's storage for max_cold_starts in tests
+	coldStartStore coldStartStore
+	// detectorCacheStore replaces Caddy's storage for detector_cache in tests
+	detectorCacheStore detectorCacheStore
+	// nextInstance rotates requests among the copies of a key's backend
+	nextInstance atomic.Uint64
 
 	logger *zap.Logger
 }
 
 type processState struct {
-	process        *os.Process
+	key            string
+	process        Process
 	cancel         context.CancelFunc
 	activeRequests int64
-	idleTimer      *time.Timer
+	idleTimer      Timer
+	// idleDeadline is the latest end of an idle window granted by a finished
+	// request; a short timeout never cuts a longer one short
+	idleDeadline time.Time
+	// lastRequestEnd bounds how long backend_keepalive may extend
+	// idleDeadline, and ranks idle backends for eviction by max_processes
+	lastRequestEnd time.Time
+	// lastUsed is when a request last looked the key up, for
+	// process_state_ttl; guarded by the handler's mu
+	lastUsed       time.Time
 	terminationMsg string
-	overrides      *proxyOverrides
-	mu             sync.Mutex
+	overrides      *Overrides
+	output         *outputBuffer
+	transport      *reverseproxy.HTTPTransport
+	// transportPID is the backend the transport connects to, or 0
+	transportPID int
+	inflight     chan struct{}
+	// queued counts requests waiting for a slot of inflight, for queue_size
+	queued atomic.Int64
+	// rate spaces out requests to the backend, for upstream_rate_limit
+	rate rateBucket
+	// upstreams is the cached upstream list for upstreamsAddr
+	upstreams     []*reverseproxy.Upstream
+	upstreamsAddr string
+	// pinned is the resolved dial address of a named upstream, or empty
+	pinned string
+	// starting is set during a cold start and running while a transport to
+	// a backend exists; both are read without ps.mu
+	starting atomic.Bool
+	running  atomic.Bool
+	// coldStarts counts finished cold starts, the last of which failed with
+	// startErr (guarded by mu), so that requests that waited for a start
+	// share its failure unless it was the starting request's own
+	coldStarts atomic.Uint64
+	startErr   error
+	coalesce   coalescer
+	// warm is set while warm requests may skip the slow path
+	warm atomic.Pointer[warmRoute]
+	// halted explains why the restart policy keeps the key stopped, or is nil
+	halted atomic.Pointer[string]
+	// retryAt holds off starts until this UnixNano time after a flap or
+	// crash, or is 0
+	retryAt atomic.Int64
+	// retryReason explains retryAt to the requests it turns away
+	retryReason atomic.Pointer[string]
+	// flaps counts starts in a row whose backend exited within min_stable_time
+	flaps int
+	// crashes counts backends in a row that exited on their own
+	crashes int
+	// cgiRate tracks requests served as CGI, for cgi_until
+	cgiRate requestRate
+	// cgiOverrides is what the key's CGI requests run, resolved by the first
+	// of them and kept until the key is promoted
+	cgiOverrides atomic.Pointer[Overrides]
+	// startRate tracks starts of the key's backend, for crash_loop, which
+	// counts only those made while failed is set: the last backend exited on
+	// its own or the last start failed
+	startRate requestRate
+	failed    bool
+	// staticDir is the asset directory served without the backend, or nil
+	staticDir atomic.Pointer[string]
+	// adopted is set when another Caddy instance owns the running backend
+	adopted bool
+	// preStop notifies the running backend before it is stopped, or is nil
+	preStop func()
+	// awaitExit waits up to stop_timeout for a stopped backend to exit, or is nil
+	awaitExit func()
+	// stopping is closed once the backend last stopped after a pre-stop
+	// notification is gone, or is nil
+	stopping chan struct{}
+	// scaleDown is set while a kubernetes runtime workload is scaled up
+	scaleDown func()
+	// gate serializes upstream resolution and cold starts for the key
+	gate chan struct{}
+	// waiting tracks requests parked on the gate or a coalesced cold start
+	waiting waitQueue
+	// ramp limits concurrency while slow_start is in effect
+	ramp rampState
+	// startupHistory holds recent durations from start to readiness
+	startupHistory []time.Duration
+	// adaptiveIdle is the idle timeout idle_policy derived from
+	// startupHistory, in nanoseconds, or 0
+	adaptiveIdle atomic.Int64
+	// detectedIdle is the idle timeout the detector gave for the last start,
+	// in nanoseconds, or 0
+	detectedIdle atomic.Int64
+	// owner is the handler in charge of the backend's exit, which a reload
+	// may hand to the handler replacing it
+	owner    atomic.Pointer[ReverseBin]
+	clock    Clock
+	observer Observer
+	mu       sync.Mutex
 }
 
 func isUnixUpstream(addr string) bool {
@@ -93,6 +461,9 @@ func isUnixUpstream(addr string) bool {
 }
 
 func readinessConfigured(method, path string) bool {
+	if strings.EqualFold(method, readinessGRPC) {
+		return true
+	}
 	return strings.TrimSpace(method) != "" && strings.TrimSpace(path) != ""
 }
 
@@ -121,9 +492,15 @@ func (c *ReverseBin) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 		for d.NextBlock(0) {
 			switch d.Val() {
 			case "exec":
-				c.Executable = d.RemainingArgs()
-				if len(c.Executable) < 1 {
-					return d.Err("an executable needs to be specified")
+				platform, command, err := parseExec(d)
+				if err != nil {
+					return err
+				}
+				setExec(&c.Executable, &c.ExecPlatforms, platform, command)
+			case "exec_wrapper":
+				c.ExecWrapper = d.RemainingArgs()
+				if len(c.ExecWrapper) == 0 {
+					return d.ArgErr()
 				}
 			case "dir":
 				if !d.Args(&c.WorkingDirectory) {
@@ -150,18 +527,49 @@ func (c *ReverseBin) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				if len(args) == 1 && strings.EqualFold(args[0], "null") {
 					c.ReadinessMethod = ""
 					c.ReadinessPath = ""
+					c.ReadinessStatus = nil
 					continue
 				}
-				if len(args) != 2 {
+				method, path, expect, err := parseReadinessCheck(d, "readiness_check", args)
+				if err != nil {
+					return err
+				}
+				c.ReadinessMethod, c.ReadinessPath, c.ReadinessStatus = method, path, expect
+			case "host_rewrite":
+				args := d.RemainingArgs()
+				switch len(args) {
+				case 0:
+					c.HostRewrite = defaultHostRewrite
+				case 1:
+					c.HostRewrite = args[0]
+				default:
 					return d.ArgErr()
 				}
-				c.ReadinessMethod = strings.ToUpper(args[0])
-				c.ReadinessPath = args[1]
 			case "dynamic_proxy_detector":
 				c.DynamicProxyDetector = d.RemainingArgs()
 				if len(c.DynamicProxyDetector) == 0 {
 					return d.ArgErr()
 				}
+			case "detector":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				name := d.Val()
+				mod, err := caddyfile.UnmarshalModule(d, "reverse_bin.detectors."+name)
+				if err != nil {
+					return err
+				}
+				c.DetectorRaw = caddyconfig.JSONModuleObject(mod, "detector", name, nil)
+			case "key_jwt_claim":
+				if !d.Args(&c.KeyJWTClaim) {
+					return d.ArgErr()
+				}
+			case "key_when":
+				rule, err := parseKeyRule(d)
+				if err != nil {
+					return err
+				}
+				c.KeyRules = append(c.KeyRules, rule)
 			case "idle_timeout_ms":
 				if !d.NextArg() {
 					return d.ArgErr()
@@ -171,6 +579,478 @@ func (c *ReverseBin) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 					return d.Err("idle_timeout_ms must be a positive integer")
 				}
 				c.IdleTimeoutMS = v
+			case "idle_timeout":
+				if err := c.parseIdleTimeout(d); err != nil {
+					return err
+				}
+			case "loopback":
+				if !d.Args(&c.Loopback) {
+					return d.ArgErr()
+				}
+				if c.Loopback != "ipv4" && c.Loopback != "ipv6" {
+					return d.Errf("loopback must be ipv4 or ipv6, got %q", c.Loopback)
+				}
+			case "bind_check":
+				if !d.Args(&c.BindCheck) {
+					return d.ArgErr()
+				}
+				if c.BindCheck != bindCheckWarn && c.BindCheck != bindCheckEnforce {
+					return d.Errf("bind_check must be warn or enforce, got %q", c.BindCheck)
+				}
+			case "port_range":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				pr, err := parsePortRange(d.Val())
+				if err != nil {
+					return d.Err(err.Error())
+				}
+				c.PortRange = pr
+			case "upstream_from":
+				u, err := parseUpstreamFrom(d)
+				if err != nil {
+					return err
+				}
+				c.UpstreamFrom = u
+			case "coalesce_cold_start":
+				c.CoalesceColdStart = true
+			case "variant":
+				if err := c.parseVariant(d); err != nil {
+					return err
+				}
+			case "idle_ignore":
+				if err := c.parseIdleIgnore(d); err != nil {
+					return err
+				}
+			case "idle_hint_header":
+				c.IdleHintHeader = defaultIdleHintHeader
+				if d.NextArg() {
+					c.IdleHintHeader = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "backend_keepalive":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil || dur < time.Second {
+					return d.Errf("backend_keepalive must be a duration of at least 1s: %s", d.Val())
+				}
+				c.BackendKeepAliveMaxMS = int(dur.Milliseconds())
+			case "detector_cache":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				ttl, err := caddy.ParseDuration(d.Val())
+				if err != nil || ttl < time.Second {
+					return d.Errf("detector_cache must be a duration of at least 1s: %s", d.Val())
+				}
+				c.DetectorCache = &DetectorCache{TTLMS: int(ttl.Milliseconds())}
+			case "max_cold_starts":
+				b, err := parseColdStartBudget(d)
+				if err != nil {
+					return err
+				}
+				c.MaxColdStarts = b
+			case "activation_require":
+				if err := c.parseActivationRequire(d); err != nil {
+					return err
+				}
+			case "max_inflight_per_key", "max_concurrent_requests", "max_inflight":
+				name := d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				v, err := strconv.Atoi(d.Val())
+				if err != nil || v <= 0 {
+					return d.Errf("%s must be a positive integer", name)
+				}
+				if name == "max_inflight" {
+					c.MaxInflight = v
+				} else {
+					c.MaxInflightPerKey = v
+				}
+				if d.NextArg() {
+					dur, err := caddy.ParseDuration(d.Val())
+					if err != nil || dur < time.Millisecond {
+						return d.Errf("%s queue timeout must be a positive duration: %s", name, d.Val())
+					}
+					c.QueueTimeoutMS = int(dur.Milliseconds())
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "max_processes":
+				v, err := parseMaxProcesses(d)
+				if err != nil {
+					return err
+				}
+				c.MaxProcesses = v
+			case "queue_size":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				v, err := strconv.Atoi(d.Val())
+				if err != nil || v < 0 {
+					return d.Errf("queue_size must be a non-negative integer")
+				}
+				c.QueueSize = v
+			case "compat_mode":
+				m, err := parseCompatMode(d)
+				if err != nil {
+					return err
+				}
+				c.CompatMode = m
+			case "upstream_rate_limit":
+				l, err := parseUpstreamRateLimit(d)
+				if err != nil {
+					return err
+				}
+				c.UpstreamRateLimit = l
+			case "queue_timeout":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil || dur < time.Millisecond {
+					return d.Errf("queue_timeout must be a positive duration: %s", d.Val())
+				}
+				c.QueueTimeoutMS = int(dur.Milliseconds())
+			case "slow_start":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil || dur < time.Millisecond {
+					return d.Errf("slow_start must be a positive duration: %s", d.Val())
+				}
+				c.SlowStartMS = int(dur.Milliseconds())
+			case "min_stable_time":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil || dur < time.Millisecond {
+					return d.Errf("min_stable_time must be a positive duration: %s", d.Val())
+				}
+				c.MinStableTimeMS = int(dur.Milliseconds())
+			case "init_lock":
+				l, err := parseInitLock(d)
+				if err != nil {
+					return err
+				}
+				c.InitLock = l
+			case "restart_policy":
+				if !d.Args(&c.RestartPolicy) {
+					return d.ArgErr()
+				}
+				switch c.RestartPolicy {
+				case restartAlways, restartOnFailure, restartNever:
+				default:
+					return d.Errf("restart_policy must be always, on-failure or never, got %q", c.RestartPolicy)
+				}
+			case "no_restart_codes":
+				codes, err := parseNoRestartCodes(d)
+				if err != nil {
+					return err
+				}
+				c.NoRestartCodes = append(c.NoRestartCodes, codes...)
+			case "crash_loop":
+				l, err := parseCrashLoop(d)
+				if err != nil {
+					return err
+				}
+				c.CrashLoop = l
+			case "max_restarts":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				n, err := strconv.Atoi(d.Val())
+				if err != nil || n < 1 {
+					return d.Errf("max_restarts must be a positive integer, got %q", d.Val())
+				}
+				c.MaxRestarts = n
+			case "restart_backoff":
+				if err := c.parseRestartBackoff(d); err != nil {
+					return err
+				}
+			case "data_dir":
+				c.DataDir = new(DataDir)
+				if err := c.DataDir.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+			case "state_file":
+				sf, err := parseStateFile(d)
+				if err != nil {
+					return err
+				}
+				c.StateFile = sf
+			case "prewarm":
+				c.Prewarm = true
+				c.PrewarmKeys = append(c.PrewarmKeys, d.RemainingArgs()...)
+			case "process_state_ttl":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil || dur < time.Minute {
+					return d.Errf("process_state_ttl must be a duration of at least 1m: %s", d.Val())
+				}
+				c.ProcessStateTTLMS = int(dur.Milliseconds())
+			case "socket_cleanup":
+				sc, err := parseSocketCleanup(d)
+				if err != nil {
+					return err
+				}
+				c.SocketCleanup = sc
+			case "backend_cert":
+				c.BackendCert = new(BackendCert)
+				if err := c.BackendCert.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+			case "capture_core":
+				cc, err := parseCaptureCore(d)
+				if err != nil {
+					return err
+				}
+				c.CaptureCore = cc
+			case "filesystem":
+				f, err := parseFilesystem(d)
+				if err != nil {
+					return err
+				}
+				c.Filesystem = f
+			case "cpu_limit":
+				c.CPULimit = new(CPULimit)
+				if err := c.CPULimit.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+			case "app":
+				var name string
+				if !d.Args(&name) {
+					return d.ArgErr()
+				}
+				if c.Apps == nil {
+					c.Apps = make(map[string]*App)
+				}
+				if _, dup := c.Apps[name]; dup {
+					return d.Errf("duplicate app %q", name)
+				}
+				app := new(App)
+				if err := app.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+				c.Apps[name] = app
+			case "app_key":
+				if !d.Args(&c.AppKey) {
+					return d.ArgErr()
+				}
+			case "provision_ask":
+				if !d.Args(&c.ProvisionAsk) {
+					return d.ArgErr()
+				}
+			case "mount_prefix":
+				if !d.Args(&c.MountPrefix) {
+					return d.ArgErr()
+				}
+				if !strings.HasPrefix(c.MountPrefix, "/") {
+					return d.Errf("mount_prefix must start with /, got %q", c.MountPrefix)
+				}
+			case "active_hours":
+				c.ActiveHours = new(ActiveHours)
+				if err := c.ActiveHours.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+			case "maintenance_file":
+				c.Maintenance = new(Maintenance)
+				if err := c.Maintenance.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+			case "upstream_compression":
+				if !d.Args(&c.UpstreamCompression) {
+					return d.ArgErr()
+				}
+				if c.UpstreamCompression != compressionOff && c.UpstreamCompression != compressionPassthrough {
+					return d.Errf("upstream_compression must be off or passthrough, got %q", c.UpstreamCompression)
+				}
+			case "transport":
+				c.Transport = new(TransportConfig)
+				if err := c.Transport.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+			case "abort_start_on_disconnect":
+				c.AbortStartOnDisconnect = true
+			case "cold_start_hint":
+				c.ColdStartHint = http.StatusEarlyHints
+				if d.NextArg() {
+					status, err := strconv.Atoi(d.Val())
+					if err != nil || (status != http.StatusEarlyHints && status != http.StatusProcessing) {
+						return d.Errf("cold_start_hint must be 103 or 102, got %q", d.Val())
+					}
+					c.ColdStartHint = status
+				}
+			case "pre_stop_request", "pre_stop_signal":
+				if c.PreStop == nil {
+					c.PreStop = new(PreStop)
+				}
+				unmarshal := c.PreStop.unmarshalRequest
+				if d.Val() == "pre_stop_signal" {
+					unmarshal = c.PreStop.unmarshalSignal
+				}
+				if err := unmarshal(d); err != nil {
+					return err
+				}
+			case "kill_mode":
+				if !d.Args(&c.KillMode) {
+					return d.ArgErr()
+				}
+				if c.KillMode != "group" && c.KillMode != "process" {
+					return d.Errf("kill_mode must be group or process, got %q", c.KillMode)
+				}
+			case "follow_reexec":
+				c.FollowReexec = true
+			case "stop_timeout":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil || dur < time.Millisecond {
+					return d.Errf("stop_timeout must be a positive duration: %s", d.Val())
+				}
+				c.StopTimeoutMS = int(dur.Milliseconds())
+			case "stop_signal":
+				var sig string
+				if !d.Args(&sig) {
+					return d.ArgErr()
+				}
+				name, ok := signalName(sig)
+				if !ok {
+					return d.Errf("unsupported stop_signal: %q", sig)
+				}
+				c.StopSignal = name
+			case "no_kill_on_idle":
+				c.NoKillOnIdle = true
+			case "replicas", "min_instances":
+				name := d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				n, err := strconv.Atoi(d.Val())
+				if err != nil || n < 1 {
+					return d.Errf("%s must be a positive integer, got %q", name, d.Val())
+				}
+				if name == "replicas" {
+					c.Replicas = n
+				} else {
+					c.MinInstances = n
+				}
+			case "replica_policy":
+				if !d.Args(&c.ReplicaPolicy) {
+					return d.ArgErr()
+				}
+				if !slices.Contains(replicaPolicies, c.ReplicaPolicy) {
+					return d.Errf("replica_policy must be least_conn, round_robin or random, got %q", c.ReplicaPolicy)
+				}
+			case "replica_affinity":
+				a, err := parseReplicaAffinity(d)
+				if err != nil {
+					return err
+				}
+				c.ReplicaAffinity = a
+			case "debug":
+				c.Debug = true
+			case "start_timeout":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil || dur < time.Millisecond {
+					return d.Errf("start_timeout must be a positive duration: %s", d.Val())
+				}
+				c.StartTimeoutMS = int(dur.Milliseconds())
+			case "readiness_interval":
+				if err := c.parseReadinessInterval(d); err != nil {
+					return err
+				}
+			case "cgi_until":
+				mode, err := parseCGIMode(d)
+				if err != nil {
+					return err
+				}
+				c.CGI = mode
+			case "liveness_check":
+				c.LivenessCheck = new(LivenessCheck)
+				if err := c.LivenessCheck.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+			case "max_lifetime":
+				l, err := parseMaxLifetime(d)
+				if err != nil {
+					return err
+				}
+				c.MaxLifetime = l
+			case "restart_if_rss_above":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				size, err := parseByteSize(d.Val())
+				if err != nil || size < 1<<20 {
+					return d.Errf("restart_if_rss_above must be a size of at least 1MiB: %s", d.Val())
+				}
+				c.RestartRSSAboveBytes = size
+			case "wait_for":
+				w, err := parseWaitFor(d)
+				if err != nil {
+					return err
+				}
+				c.WaitFor = append(c.WaitFor, w)
+			case "idle_policy":
+				c.IdlePolicy = new(IdlePolicy)
+				if err := c.IdlePolicy.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+			case "startup_timeout":
+				c.StartupTimeout = new(StartupTimeout)
+				if err := c.StartupTimeout.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+			case "auto_nice":
+				c.AutoNice = new(AutoNice)
+				if err := c.AutoNice.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+			case "shared_start":
+				c.SharedStart = true
+			case "probe_upstream":
+				c.ProbeUpstream = true
+			case "service_registry":
+				c.ServiceRegistry = new(ServiceRegistry)
+				if err := c.ServiceRegistry.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+			case "runtime":
+				var runtime string
+				if !d.Args(&runtime) {
+					return d.ArgErr()
+				}
+				switch runtime {
+				case "process":
+					c.Kubernetes = nil
+				case "kubernetes":
+					c.Kubernetes = new(KubernetesRuntime)
+					if err := c.Kubernetes.unmarshalCaddyfile(d); err != nil {
+						return err
+					}
+				default:
+					return d.Errf("unknown runtime: %q", runtime)
+				}
+			case "upstream_tls":
+				c.UpstreamTLS = new(UpstreamTLS)
+				if err := c.UpstreamTLS.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
 			default:
 				return d.Errf("unknown subdirective: %q", d.Val())
 			}
@@ -183,15 +1063,151 @@ func (c *ReverseBin) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 // internal state and provisions the underlying reverse proxy handler.
 func (c *ReverseBin) Provision(ctx caddy.Context) error {
 	c.ctx = ctx
-	c.logger = ctx.Logger(c)
+	c.logger = observedLogger(ctx.Logger(c))
+	c.configHash = c.fingerprint()
 	c.processes = make(map[string]*processState)
+	c.provisioned = make(map[string]*Overrides)
 
 	c.logger.Info("reverse-bin module provisioned",
 		zap.String("version", Version),
 		zap.String("commit", Commit),
 		zap.String("build_date", BuildDate))
 
-	if len(c.DynamicProxyDetector) == 0 {
+	if err := c.resolvePlatformExecs(hostPlatform); err != nil {
+		return err
+	}
+
+	if c.PortRange != nil {
+		if err := c.PortRange.validate(); err != nil {
+			return err
+		}
+		if c.SharedStart || c.Kubernetes != nil {
+			return fmt.Errorf("port_range cannot be combined with shared_start or the kubernetes runtime")
+		}
+		if c.ReverseProxyTo == "" {
+			c.ReverseProxyTo = ":" + portPlaceholder
+		}
+	}
+	if c.UpstreamFrom != nil {
+		if err := c.UpstreamFrom.validate(); err != nil {
+			return err
+		}
+		if c.PortRange != nil || c.SharedStart || c.Kubernetes != nil {
+			return fmt.Errorf("upstream_from cannot be combined with port_range, shared_start or the kubernetes runtime")
+		}
+		if c.ReverseProxyTo == "" {
+			c.ReverseProxyTo = ":" + portPlaceholder
+		}
+		if !strings.Contains(c.ReverseProxyTo, portPlaceholder) {
+			return fmt.Errorf("reverse_proxy_to must contain %s to use the port announced for upstream_from", portPlaceholder)
+		}
+	}
+	if c.MaxColdStarts != nil {
+		if err := c.MaxColdStarts.validate(); err != nil {
+			return err
+		}
+	}
+	if c.DetectorCache != nil {
+		if err := c.DetectorCache.validate(); err != nil {
+			return err
+		}
+		if len(c.DynamicProxyDetector) == 0 && c.DetectorRaw == nil {
+			return fmt.Errorf("detector_cache requires a detector")
+		}
+	}
+	if c.BindCheck != "" && c.BindCheck != bindCheckWarn && c.BindCheck != bindCheckEnforce {
+		return fmt.Errorf("bind_check must be warn or enforce, got %q", c.BindCheck)
+	}
+	if c.BindCheck != "" && c.Kubernetes != nil {
+		return fmt.Errorf("bind_check cannot be combined with the kubernetes runtime")
+	}
+	if c.CrashLoop != nil {
+		if err := c.CrashLoop.validate(); err != nil {
+			return err
+		}
+	}
+	if c.CGI != nil {
+		if err := c.CGI.validate(); err != nil {
+			return err
+		}
+		if c.Kubernetes != nil || c.SharedStart {
+			return fmt.Errorf("cgi_until cannot be combined with shared_start or the kubernetes runtime")
+		}
+	}
+	if c.LivenessCheck != nil {
+		if err := c.LivenessCheck.validate(); err != nil {
+			return err
+		}
+		if c.Kubernetes != nil {
+			return fmt.Errorf("liveness_check cannot be combined with the kubernetes runtime")
+		}
+	}
+	if c.QueueSize > 0 && c.MaxInflightPerKey == 0 {
+		return fmt.Errorf("queue_size requires max_inflight_per_key")
+	}
+	if c.UpstreamRateLimit != nil {
+		if err := c.UpstreamRateLimit.validate(); err != nil {
+			return err
+		}
+	}
+	if c.ProcessStateTTLMS != 0 && c.ProcessStateTTLMS < 60000 {
+		return fmt.Errorf("process_state_ttl must be at least 1m")
+	}
+	if c.ProbeUpstream && (c.SharedStart || c.Kubernetes != nil) {
+		return fmt.Errorf("probe_upstream cannot be combined with shared_start, which adopts a listening backend, or the kubernetes runtime")
+	}
+	if (c.MaxProcesses > 0 || c.GlobalMaxProcesses > 0) && c.Kubernetes != nil {
+		return fmt.Errorf("max_processes cannot be combined with the kubernetes runtime")
+	}
+	if c.MaxLifetime != nil {
+		if err := c.MaxLifetime.validate(); err != nil {
+			return err
+		}
+		if c.Kubernetes != nil {
+			return fmt.Errorf("max_lifetime cannot be combined with the kubernetes runtime")
+		}
+	}
+	if c.RestartRSSAboveBytes != 0 && (c.RestartRSSAboveBytes < 0 || c.Kubernetes != nil) {
+		return fmt.Errorf("restart_if_rss_above must be positive and cannot be combined with the kubernetes runtime")
+	}
+	for _, w := range c.WaitFor {
+		if err := w.validate(); err != nil {
+			return err
+		}
+	}
+	if c.IdlePolicy != nil {
+		if err := c.IdlePolicy.validate(); err != nil {
+			return err
+		}
+	}
+	if c.ActiveHours != nil {
+		if err := c.ActiveHours.provision(); err != nil {
+			return err
+		}
+	}
+	if c.StateFile != nil && c.StateFile.Path == "" {
+		return fmt.Errorf("state_file needs a path")
+	}
+
+	if err := c.provisionDetector(ctx); err != nil {
+		return err
+	}
+
+	if c.Kubernetes != nil {
+		if c.detector != nil || len(c.Apps) > 0 {
+			return fmt.Errorf("detectors and app are not supported with the kubernetes runtime")
+		}
+		if c.ReverseProxyTo == "" {
+			return fmt.Errorf("reverse_proxy_to (the workload's Service address) is required for the kubernetes runtime")
+		}
+		if err := c.Kubernetes.provision(); err != nil {
+			return err
+		}
+	} else if len(c.Apps) > 0 {
+		if err := c.validateApps(); err != nil {
+			return err
+		}
+	} else if c.detector == nil && c.ProvisionAsk == "" {
 		if len(c.Executable) == 0 {
 			return fmt.Errorf("exec (executable) is required when dynamic_proxy_detector is not set")
 		}
@@ -201,24 +1217,144 @@ func (c *ReverseBin) Provision(ctx caddy.Context) error {
 		}
 	}
 
+	if c.KeyJWTClaim != "" && c.detector == nil && len(c.Apps) == 0 && c.ProvisionAsk == "" {
+		return fmt.Errorf("key_jwt_claim requires a detector, app or provision_ask")
+	}
+	if len(c.KeyRules) > 0 && c.detector == nil && len(c.Apps) == 0 && c.ProvisionAsk == "" {
+		return fmt.Errorf("key_when requires a detector, app or provision_ask")
+	}
+	if c.FollowReexec && c.KillMode == "process" && c.CPULimit == nil {
+		return fmt.Errorf("follow_reexec needs kill_mode group, or cpu_limit")
+	}
+	if err := c.validatePrewarm(); err != nil {
+		return err
+	}
+	if err := c.validateInstances(); err != nil {
+		return err
+	}
+
 	if c.ReadinessMethod != "" {
 		c.ReadinessMethod = strings.ToUpper(c.ReadinessMethod)
 	}
 	if c.IdleTimeoutMS <= 0 {
 		c.IdleTimeoutMS = 5000
 	}
+	if c.BackendCert != nil {
+		if c.Kubernetes != nil {
+			return fmt.Errorf("backend_cert is not supported with the kubernetes runtime")
+		}
+		if err := c.BackendCert.provision(ctx); err != nil {
+			return err
+		}
+	}
+	if c.ReadinessBackoffMaxMS > 0 && c.ReadinessBackoffMaxMS < c.ReadinessIntervalMS {
+		return fmt.Errorf("readiness_backoff_max_ms must be at least readiness_interval_ms")
+	}
+	if c.StartTimeoutMS > 0 && c.StartupTimeout != nil {
+		return fmt.Errorf("start_timeout and startup_timeout cannot be combined; use startup_timeout max_ms")
+	}
+	if len(c.ExecWrapper) > 0 && c.Kubernetes != nil {
+		return fmt.Errorf("exec_wrapper is not supported with the kubernetes runtime")
+	}
+	if c.StopSignal != "" {
+		if _, ok := preStopSignals[c.StopSignal]; !ok {
+			return fmt.Errorf("unsupported stop_signal: %q", c.StopSignal)
+		}
+	}
+	if (c.StopTimeoutMS > 0 || c.StopSignal != "") && c.Kubernetes != nil {
+		return fmt.Errorf("stop_timeout and stop_signal are not supported with the kubernetes runtime")
+	}
+	if c.Filesystem != nil && c.Kubernetes != nil {
+		return fmt.Errorf("filesystem is not supported with the kubernetes runtime")
+	}
+	if c.DataDir != nil {
+		if c.Kubernetes != nil {
+			return fmt.Errorf("data_dir is not supported with the kubernetes runtime")
+		}
+		if err := c.DataDir.validate(); err != nil {
+			return err
+		}
+	}
+	if err := c.provisionVariants(ctx); err != nil {
+		return err
+	}
+	if err := c.provisionKeyRules(ctx); err != nil {
+		return err
+	}
+	if err := c.provisionIdleOverrides(ctx); err != nil {
+		return err
+	}
+	if err := c.provisionActivation(ctx); err != nil {
+		return err
+	}
+	if c.ServiceRegistry != nil {
+		if err := c.ServiceRegistry.validate(); err != nil {
+			return err
+		}
+	}
+	if c.MaxInflight > 0 {
+		c.inflight = make(chan struct{}, c.MaxInflight)
+	}
+	if c.detector != nil {
+		if err := c.provisionFileServer(ctx); err != nil {
+			return fmt.Errorf("failed to provision static file server: %v", err)
+		}
+	}
+	if reg := ctx.GetMetricsRegistry(); reg != nil {
+		c.metrics = newMetrics(reg)
+	}
 
-	if !isUnixUpstream(c.ReverseProxyTo) && c.ReverseProxyTo != "" && !readinessConfigured(c.ReadinessMethod, c.ReadinessPath) {
+	// An announced port is ready once it accepts connections.
+	if !isUnixUpstream(c.ReverseProxyTo) && c.ReverseProxyTo != "" && c.UpstreamFrom == nil && !readinessConfigured(c.ReadinessMethod, c.ReadinessPath) {
 		return fmt.Errorf("readiness_check is required for non-unix reverse_proxy_to targets")
 	}
 
+	if c.UpstreamTLS != nil {
+		if err := c.UpstreamTLS.validate(); err != nil {
+			return err
+		}
+	}
+	if err := c.checkUpstreamConflicts(); err != nil {
+		return err
+	}
+	if err := c.checkStateFileConflicts(); err != nil {
+		return err
+	}
+	if err := c.probeUpstreams(); err != nil {
+		return err
+	}
+
 	rp := &reverseproxy.Handler{
 		DynamicUpstreams: c,
+		Transport:        keyedTransport{c: c},
 	}
 	if err := rp.Provision(ctx); err != nil {
 		return fmt.Errorf("failed to provision reverse proxy: %v", err)
 	}
 	c.reverseProxy = rp
+	c.adoptPredecessor()
+	registerHandler(c)
+	if c.AutoNice != nil {
+		go c.runAutoNice()
+	}
+	if c.DataDir != nil && c.DataDir.GCAfterMS > 0 {
+		go c.runDataDirGC()
+	}
+	if c.StateFile != nil {
+		go c.runStateFile()
+	}
+	if c.SocketCleanup != nil {
+		go c.runSocketCleanup()
+	}
+	if c.ProcessStateTTLMS > 0 {
+		go c.runStateReaper()
+	}
+	if c.Prewarm || len(c.PrewarmKeys) > 0 {
+		go c.prewarm()
+	}
+	if c.MinInstances > 0 {
+		go c.runMinInstances()
+	}
 
 	return nil
 }
@@ -231,69 +1367,177 @@ func (c *ReverseBin) getOrCreateProcessState(key string) *processState {
 	ps, ok := c.processes[key]
 	if !ok {
 		c.logger.Debug("creating new process state", zap.String("key", key))
-		ps = &processState{}
+		ps = &processState{
+			key:      key,
+			output:   newOutputBuffer(outputBufferLines),
+			clock:    c.clock(),
+			observer: c.Observer,
+			gate:     make(chan struct{}, 1),
+		}
+		if c.MaxInflightPerKey > 0 {
+			ps.inflight = make(chan struct{}, c.MaxInflightPerKey)
+		}
+		ps.owner.Store(c)
 		c.processes[key] = ps
 	}
+	ps.lastUsed = c.clock().Now()
 	return ps
 }
 
+// handler returns the handler in charge of ps, or fallback for a state that
+// was not created by one.
+func (ps *processState) handler(fallback *ReverseBin) *ReverseBin {
+	if h := ps.owner.Load(); h != nil {
+		return h
+	}
+	return fallback
+}
+
 func (ps *processState) incrementRequests(logger *zap.Logger, key string) {
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
 	ps.activeRequests++
-	logger.Debug("incremented active requests",
-		zap.String("key", key),
-		zap.Int64("count", ps.activeRequests),
-		zap.Bool("timer_stopped", ps.idleTimer != nil))
+	if ce := logger.Check(zap.DebugLevel, "incremented active requests"); ce != nil {
+		ce.Write(zap.String("key", key),
+			zap.Int64("count", ps.activeRequests),
+			zap.Bool("timer_stopped", ps.idleTimer != nil))
+	}
 	if ps.idleTimer != nil {
 		ps.idleTimer.Stop()
 		ps.idleTimer = nil
 	}
 }
 
-func (ps *processState) decrementRequests(logger *zap.Logger, key string, idleTimeout time.Duration) {
+// decrementRequests arms the idle timer once the last request finishes. A
+// request that does not extend the idle window only sets it if none is open.
+func (ps *processState) decrementRequests(logger *zap.Logger, key string, idleTimeout time.Duration, extend bool) {
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
 	ps.activeRequests--
-	logger.Debug("decremented active requests", zap.String("key", key), zap.Int64("count", ps.activeRequests))
+	if ce := logger.Check(zap.DebugLevel, "decremented active requests"); ce != nil {
+		ce.Write(zap.String("key", key), zap.Int64("count", ps.activeRequests))
+	}
 
+	now := ps.clock.Now()
+	ps.lastRequestEnd = now
+	// A zero idleTimeout (no_kill_on_idle) keeps the backend running.
+	if idleTimeout <= 0 {
+		return
+	}
+	if deadline := now.Add(idleTimeout); (extend || ps.idleDeadline.IsZero()) && deadline.After(ps.idleDeadline) {
+		ps.idleDeadline = deadline
+	}
 	if ps.activeRequests == 0 {
-		logger.Debug("starting idle timer", zap.String("key", key), zap.Duration("duration", idleTimeout))
-		ps.idleTimer = time.AfterFunc(idleTimeout, func() {
-			ps.mu.Lock()
-			defer ps.mu.Unlock()
-			if ps.activeRequests == 0 && ps.process != nil {
-				logger.Info("idle timer fired, terminating process", zap.String("key", key), zap.Int("pid", ps.process.Pid))
-				ps.terminationMsg = "idle timeout"
-				if ps.cancel != nil {
-					ps.cancel()
-				}
-				ps.process = nil
-			} else {
-				logger.Debug("idle timer fired but process active or already gone",
-					zap.String("key", key),
-					zap.Int64("active_requests", ps.activeRequests),
-					zap.Bool("process_nil", ps.process == nil))
-			}
-		})
+		ps.armIdleTimerLocked(logger, key)
+	}
+}
+
+// armIdleTimerLocked stops the backend once ps.idleDeadline passes without
+// requests. The caller must hold ps.mu.
+func (ps *processState) armIdleTimerLocked(logger *zap.Logger, key string) {
+	wait := ps.idleDeadline.Sub(ps.clock.Now())
+	if ce := logger.Check(zap.DebugLevel, "starting idle timer"); ce != nil {
+		ce.Write(zap.String("key", key), zap.Duration("duration", wait))
+	}
+	ps.idleTimer = ps.clock.AfterFunc(wait, func() {
+		ps.mu.Lock()
+		defer ps.mu.Unlock()
+		ps.idleDeadline = time.Time{}
+		if ps.activeRequests == 0 && (ps.process != nil || ps.scaleDown != nil) {
+			logger.Info("idle timer fired, stopping backend", zap.String("key", key))
+			ps.stopLocked("idle timeout")
+		} else {
+			logger.Debug("idle timer fired but process active or already gone",
+				zap.String("key", key),
+				zap.Int64("active_requests", ps.activeRequests),
+				zap.Bool("process_nil", ps.process == nil))
+		}
+	})
+}
+
+// stopLocked stops the key's backend, or scales down its workload, and
+// reports whether one was running. The caller must hold ps.mu.
+func (ps *processState) stopLocked(reason string) bool {
+	switch {
+	case ps.process != nil:
+		// Requests that already picked this backend fail instead of reaching it.
+		ps.setTransportLocked(nil)
+		ps.observe(ps.process.Pid(), BackendDraining)
+		ps.terminationMsg = reason
+		if ps.preStop != nil {
+			// The backend may take its time to acknowledge, so it is notified
+			// and stopped without ps.mu; starts of the key wait for stopping.
+			stopping := make(chan struct{})
+			go func(preStop, cancel, awaitExit func()) {
+				defer close(stopping)
+				preStop()
+				if cancel != nil {
+					cancel()
+				}
+				if awaitExit != nil {
+					awaitExit()
+				}
+			}(ps.preStop, ps.cancel, ps.awaitExit)
+			ps.stopping = stopping
+			ps.preStop = nil
+			ps.awaitExit = nil
+			ps.process = nil
+			break
+		}
+		if ps.cancel != nil {
+			ps.cancel()
+		}
+		// A backend given time to shut down keeps its address meanwhile, so
+		// requests wait for it rather than starting another one.
+		if ps.awaitExit != nil {
+			ps.awaitExit()
+			ps.awaitExit = nil
+		}
+		ps.process = nil
+	case ps.scaleDown != nil:
+		go ps.scaleDown()
+		ps.scaleDown = nil
+		ps.setTransportLocked(nil)
+	default:
+		return false
+	}
+	if ps.idleTimer != nil {
+		ps.idleTimer.Stop()
+		ps.idleTimer = nil
 	}
+	return true
 }
 
 func (c *ReverseBin) Cleanup() error {
+	unregisterHandler(c)
+	c.returnAdopted()
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	for _, ps := range c.processes {
+		if _, ok := c.handedOver[ps]; ok {
+			continue
+		}
 		ps.mu.Lock()
 		if ps.idleTimer != nil {
 			ps.idleTimer.Stop()
 			ps.idleTimer = nil
 		}
 		if ps.process != nil {
-			c.logger.Info("cleaning up proxy subprocess", zap.Int("pid", ps.process.Pid))
-			c.killProcessGroup(ps.process)
+			// Its ports are released once it has exited, so that no other
+			// backend is handed one it still listens on.
+			c.logger.Info("cleaning up proxy subprocess", zap.Int("pid", ps.process.Pid()))
+			ps.process.Kill()
 			ps.process = nil
+		} else {
+			releasePorts(ps)
 		}
+		if ps.scaleDown != nil {
+			ps.scaleDown()
+			ps.scaleDown = nil
+		}
+		ps.setTransportLocked(nil)
 		ps.mu.Unlock()
 	}
 
@@ -303,6 +1547,20 @@ func (c *ReverseBin) Cleanup() error {
 // parseCaddyfile unmarshals tokens from h into a new Middleware.
 func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
 	c := new(ReverseBin)
-	err := c.UnmarshalCaddyfile(h.Dispenser)
-	return c, err
+	if err := c.UnmarshalCaddyfile(h.Dispenser); err != nil {
+		return nil, err
+	}
+	if wrapper, ok := h.Option(execWrapperOption).([]string); ok && len(c.ExecWrapper) == 0 {
+		c.ExecWrapper = wrapper
+	}
+	if limit, ok := h.Option(maxProcessesOption).(int); ok && c.Kubernetes == nil {
+		c.GlobalMaxProcesses = limit
+	}
+	if err := c.resolveVariantMatchers(h); err != nil {
+		return nil, err
+	}
+	if err := c.resolveIdleMatchers(h); err != nil {
+		return nil, err
+	}
+	return c, c.resolveActivationMatchers(h)
 }
@@ -0,0 +1,136 @@
+package reversebin
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// AutoNice lowers the scheduling priority of backends while the host's CPUs
+// are saturated, so managed processes cannot starve Caddy's accept loop, and
+// restores it once load drops.
+type AutoNice struct {
+	// Busy fraction of all CPUs (0-1) at which backends are deprioritized (default, 0.9)
+	Threshold float64 `json:"threshold,omitempty"`
+	// Nice value applied while saturated (default, 10)
+	Nice int `json:"nice,omitempty"`
+	// Sampling interval in milliseconds (default, 1000)
+	IntervalMS int `json:"interval_ms,omitempty"`
+}
+
+func (a *AutoNice) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		name := d.Val()
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		switch name {
+		case "threshold":
+			v, err := strconv.ParseFloat(d.Val(), 64)
+			if err != nil || v <= 0 || v > 1 {
+				return d.Errf("threshold must be a fraction between 0 and 1")
+			}
+			a.Threshold = v
+		case "nice":
+			v, err := strconv.Atoi(d.Val())
+			if err != nil || v < 1 || v > 19 {
+				return d.Errf("nice must be between 1 and 19")
+			}
+			a.Nice = v
+		case "interval_ms":
+			v, err := strconv.Atoi(d.Val())
+			if err != nil || v <= 0 {
+				return d.Errf("interval_ms must be a positive integer")
+			}
+			a.IntervalMS = v
+		default:
+			return d.Errf("unknown auto_nice subdirective: %q", name)
+		}
+	}
+	return nil
+}
+
+func (a *AutoNice) withDefaults() AutoNice {
+	out := *a
+	if out.Threshold == 0 {
+		out.Threshold = 0.9
+	}
+	if out.Nice == 0 {
+		out.Nice = 10
+	}
+	if out.IntervalMS == 0 {
+		out.IntervalMS = 1000
+	}
+	return out
+}
+
+// runAutoNice samples CPU usage until the handler is cleaned up. Backends
+// started while saturated are deprioritized on the next sample.
+func (c *ReverseBin) runAutoNice() {
+	cfg := c.AutoNice.withDefaults()
+	ticker := time.NewTicker(time.Duration(cfg.IntervalMS) * time.Millisecond)
+	defer ticker.Stop()
+
+	var sampler cpuSampler
+	saturated := false
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		busy, err := sampler.busy()
+		if err != nil {
+			c.logger.Warn("auto_nice: cannot sample cpu usage; disabling", zap.Error(err))
+			return
+		}
+		was := saturated
+		saturated = cfg.saturated(was, busy)
+		switch {
+		case saturated && !was:
+			c.logger.Info("cpu saturated, lowering backend priority",
+				zap.Float64("busy", busy),
+				zap.Int("nice", cfg.Nice))
+		case !saturated && was:
+			c.logger.Info("cpu load dropped, restoring backend priority", zap.Float64("busy", busy))
+			c.reniceBackends(0)
+		}
+		if saturated {
+			c.reniceBackends(cfg.Nice)
+		}
+	}
+}
+
+// saturated reports whether the CPUs count as saturated at busy, given
+// whether they did at the last sample. Hysteresis keeps priorities from
+// flapping around the threshold.
+func (a AutoNice) saturated(was bool, busy float64) bool {
+	if was {
+		return busy >= a.Threshold-0.1
+	}
+	return busy >= a.Threshold
+}
+
+// reniceBackends sets the nice value of every running backend's process group.
+func (c *ReverseBin) reniceBackends(nice int) {
+	c.mu.Lock()
+	var pids []int
+	for _, ps := range c.processes {
+		ps.mu.Lock()
+		// Only real processes; a fake runner's pids mean nothing to the kernel.
+		if p, ok := ps.process.(osProcess); ok {
+			pids = append(pids, p.Pid())
+		}
+		ps.mu.Unlock()
+	}
+	c.mu.Unlock()
+
+	for _, pid := range pids {
+		if err := setProcessGroupNice(pid, nice); err != nil {
+			// Raising priority back needs CAP_SYS_NICE or a suitable RLIMIT_NICE.
+			c.logger.Debug("auto_nice: setpriority failed", zap.Int("pid", pid), zap.Int("nice", nice), zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,52 @@
+//go:build linux
+
+package reversebin
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// cpuSampler computes the busy fraction of all CPUs between calls from /proc/stat.
+type cpuSampler struct {
+	idle, total uint64
+}
+
+func (s *cpuSampler) busy() (float64, error) {
+	data, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return 0, err
+	}
+	line, _, _ := strings.Cut(string(data), "\n")
+	fields := strings.Fields(line)
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return 0, fmt.Errorf("unexpected /proc/stat format")
+	}
+	var idle, total uint64
+	for i, f := range fields[1:] {
+		v, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("unexpected /proc/stat format: %v", err)
+		}
+		total += v
+		// idle and iowait
+		if i == 3 || i == 4 {
+			idle += v
+		}
+	}
+	prevIdle, prevTotal := s.idle, s.total
+	s.idle, s.total = idle, total
+	if prevTotal == 0 || total <= prevTotal {
+		return 0, nil
+	}
+	return 1 - float64(idle-prevIdle)/float64(total-prevTotal), nil
+}
+
+// setProcessGroupNice applies nice to the process group led by pgid, which
+// covers a backend and all of its children.
+func setProcessGroupNice(pgid, nice int) error {
+	return syscall.Setpriority(syscall.PRIO_PGRP, pgid, nice)
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package reversebin
+
+import "fmt"
+
+type cpuSampler struct{}
+
+func (s *cpuSampler) busy() (float64, error) {
+	return 0, fmt.Errorf("cpu sampling is only supported on Linux")
+}
+
+func setProcessGroupNice(pgid, nice int) error { return nil }
@@ -0,0 +1,140 @@
+package reversebin
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// BackendState is a stage in the life of a backend process reported to an
+// Observer.
+type BackendState string
+
+const (
+	// BackendStarting: the process was spawned and is not ready yet.
+	BackendStarting BackendState = "starting"
+	// BackendReady: the process passed readiness and may receive requests.
+	BackendReady BackendState = "ready"
+	// BackendDraining: the process is being stopped and must receive no
+	// further requests.
+	BackendDraining BackendState = "draining"
+	// BackendExited: the process is gone.
+	BackendExited BackendState = "exited"
+)
+
+// Observer receives a handler's backend state transitions and the requests
+// it proxies, so stress tests can check that no request is sent to a backend
+// that is not ready. Calls are made synchronously, some while the key's
+// state is locked: implementations must be fast and must not call back into
+// the handler.
+type Observer interface {
+	// BackendChanged reports that the backend pid of the process key entered
+	// state; key is "" for a handler without detector or apps.
+	BackendChanged(key string, pid int, state BackendState)
+	// Proxying reports that a request is about to be sent to the backend
+	// pid of key; pid is 0 for a backend another Caddy instance started.
+	Proxying(key string, pid int)
+}
+
+// observe reports a state transition of ps's backend to the handler's
+// observer, if any.
+func (ps *processState) observe(pid int, state BackendState) {
+	if ps.observer != nil {
+		ps.observer.BackendChanged(ps.key, pid, state)
+	}
+}
+
+// LogEntry is a message logged by a reverse-bin handler.
+type LogEntry struct {
+	Level   string
+	Message string
+	// Fields as encoded for JSON logs, e.g. zap.Int values are int64.
+	Fields map[string]any
+}
+
+var logObservers struct {
+	mu     sync.Mutex
+	next   int
+	fns    map[int]func(LogEntry)
+	active atomic.Int32
+}
+
+// ObserveLogs calls f with every message logged by reverse-bin handlers, at
+// all levels and whatever Caddy's log configuration, until the returned func
+// is called. In-process tests use it to wait for lifecycle events such as
+// "proxy subprocess terminated" instead of sleeping. f is called
+// synchronously from the logging goroutine and must not block.
+func ObserveLogs(f func(LogEntry)) (stop func()) {
+	logObservers.mu.Lock()
+	defer logObservers.mu.Unlock()
+	if logObservers.fns == nil {
+		logObservers.fns = map[int]func(LogEntry){}
+	}
+	id := logObservers.next
+	logObservers.next++
+	logObservers.fns[id] = f
+	logObservers.active.Add(1)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			logObservers.mu.Lock()
+			defer logObservers.mu.Unlock()
+			delete(logObservers.fns, id)
+			logObservers.active.Add(-1)
+		})
+	}
+}
+
+// observedLogger tees logger to the observers registered with ObserveLogs.
+func observedLogger(logger *zap.Logger) *zap.Logger {
+	return logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return zapcore.NewTee(core, logObserverCore{})
+	}))
+}
+
+// logObserverCore is a zapcore.Core delivering entries to log observers. It is
+// disabled while there are none, so unobserved handlers pay nothing.
+type logObserverCore struct {
+	fields []zapcore.Field
+}
+
+func (c logObserverCore) Enabled(zapcore.Level) bool {
+	return logObservers.active.Load() > 0
+}
+
+func (c logObserverCore) With(fields []zapcore.Field) zapcore.Core {
+	return logObserverCore{fields: append(c.fields[:len(c.fields):len(c.fields)], fields...)}
+}
+
+func (c logObserverCore) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(e.Level) {
+		return ce.AddCore(e, c)
+	}
+	return ce
+}
+
+func (c logObserverCore) Write(e zapcore.Entry, fields []zapcore.Field) error {
+	enc := zapcore.NewMapObjectEncoder()
+	for _, f := range c.fields {
+		f.AddTo(enc)
+	}
+	for _, f := range fields {
+		f.AddTo(enc)
+	}
+	entry := LogEntry{Level: e.Level.String(), Message: e.Message, Fields: enc.Fields}
+
+	logObservers.mu.Lock()
+	fns := make([]func(LogEntry), 0, len(logObservers.fns))
+	for _, f := range logObservers.fns {
+		fns = append(fns, f)
+	}
+	logObservers.mu.Unlock()
+	for _, f := range fns {
+		f(entry)
+	}
+	return nil
+}
+
+func (logObserverCore) Sync() error { return nil }
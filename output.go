@@ -0,0 +1,108 @@
+package reversebin
+
+import (
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// outputBufferLines is the number of most recent backend output lines kept per process key.
+const outputBufferLines = 500
+
+// outputLine is a single line of backend output tagged with the order in which
+// reverse-bin received it.
+type outputLine struct {
+	Seq    uint64    `json:"seq"`
+	Time   time.Time `json:"time"`
+	PID    int       `json:"pid"`
+	Stream string    `json:"stream"`
+	Text   string    `json:"text"`
+}
+
+// outputBuffer merges stdout and stderr of a backend into one stream.
+// Sequence numbers and timestamps are assigned under a single lock, so the
+// interleaving of both pipes can be reconstructed from logs or from the ring
+// of recent lines.
+type outputBuffer struct {
+	mu          sync.Mutex
+	seq         uint64
+	lines       []outputLine
+	start       int
+	subscribers map[chan outputLine]struct{}
+}
+
+func newOutputBuffer(size int) *outputBuffer {
+	return &outputBuffer{
+		lines:       make([]outputLine, 0, size),
+		subscribers: make(map[chan outputLine]struct{}),
+	}
+}
+
+// write records a line and logs it while still holding the lock so log order
+// matches sequence order.
+func (b *outputBuffer) write(logger *zap.Logger, pid int, stream, text string) outputLine {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	line := outputLine{
+		Seq:    b.seq,
+		Time:   time.Now(),
+		PID:    pid,
+		Stream: stream,
+		Text:   text,
+	}
+	if len(b.lines) < cap(b.lines) {
+		b.lines = append(b.lines, line)
+	} else if cap(b.lines) > 0 {
+		b.lines[b.start] = line
+		b.start = (b.start + 1) % len(b.lines)
+	}
+
+	logger.Info("",
+		zap.Int("pid", pid),
+		zap.Uint64("seq", line.Seq),
+		zap.Time("ts", line.Time),
+		zap.String(stream, text))
+
+	// Slow subscribers miss lines rather than stall the backend's pipes.
+	for ch := range b.subscribers {
+		select {
+		case ch <- line:
+		default:
+		}
+	}
+	return line
+}
+
+// snapshot returns buffered lines ordered oldest first.
+func (b *outputBuffer) snapshot() []outputLine {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.snapshotLocked()
+}
+
+// subscribe returns the buffered lines plus a channel receiving every line
+// written afterwards; both are taken under one lock so no line is missed or
+// duplicated. The returned func must be called to unsubscribe.
+func (b *outputBuffer) subscribe() ([]outputLine, <-chan outputLine, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan outputLine, 64)
+	b.subscribers[ch] = struct{}{}
+	unsubscribe := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subscribers, ch)
+	}
+	return b.snapshotLocked(), ch, unsubscribe
+}
+
+func (b *outputBuffer) snapshotLocked() []outputLine {
+	out := make([]outputLine, 0, len(b.lines))
+	out = append(out, b.lines[b.start:]...)
+	out = append(out, b.lines[:b.start]...)
+	return out
+}
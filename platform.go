@@ -0,0 +1,90 @@
+package reversebin
+
+import (
+	"fmt"
+	"maps"
+	"runtime"
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// knownGOOS are the operating systems recognized as the platform of an exec
+// line, so that a relative path such as bin/server is not mistaken for one.
+var knownGOOS = []string{
+	"aix", "android", "darwin", "dragonfly", "freebsd", "illumos", "ios", "js",
+	"linux", "netbsd", "openbsd", "plan9", "solaris", "wasip1", "windows",
+}
+
+// knownGOARCH are the architectures recognized alongside knownGOOS.
+var knownGOARCH = []string{
+	"386", "amd64", "arm", "arm64", "loong64", "mips", "mips64", "mips64le",
+	"mipsle", "ppc64", "ppc64le", "riscv64", "s390x", "wasm",
+}
+
+// hostPlatform is the GOOS/GOARCH Caddy runs on.
+var hostPlatform = runtime.GOOS + "/" + runtime.GOARCH
+
+// parseExec parses "exec [<goos>/<goarch>] <command>...", returning "" as the
+// platform of a plain exec line.
+func parseExec(d *caddyfile.Dispenser) (platform string, command []string, err error) {
+	args := d.RemainingArgs()
+	if len(args) > 0 && isPlatform(args[0]) {
+		platform, args = args[0], args[1:]
+	}
+	if len(args) == 0 {
+		return "", nil, d.Err("an executable needs to be specified")
+	}
+	return platform, args, nil
+}
+
+func isPlatform(s string) bool {
+	goos, goarch, ok := strings.Cut(s, "/")
+	return ok && slices.Contains(knownGOOS, goos) && slices.Contains(knownGOARCH, goarch)
+}
+
+// setExec records an exec line in exe, or in byPlatform for a platform.
+func setExec(exe *[]string, byPlatform *map[string][]string, platform string, command []string) {
+	if platform == "" {
+		*exe = command
+		return
+	}
+	if *byPlatform == nil {
+		*byPlatform = map[string][]string{}
+	}
+	(*byPlatform)[platform] = command
+}
+
+// platformExec returns the command of byPlatform for platform, or fallback
+// when there is none. what names the config block in errors.
+func platformExec(what string, byPlatform map[string][]string, fallback []string, platform string) ([]string, error) {
+	if exe, ok := byPlatform[platform]; ok {
+		return exe, nil
+	}
+	if len(byPlatform) > 0 && len(fallback) == 0 {
+		return nil, fmt.Errorf("%s has no exec for %s (only for %s)", what, platform,
+			strings.Join(slices.Sorted(maps.Keys(byPlatform)), ", "))
+	}
+	return fallback, nil
+}
+
+// resolvePlatformExecs replaces the executables of the handler and its apps
+// with the ones given for platform. An app with execs for other platforms
+// only is an error, rather than falling back to the handler's exec.
+func (c *ReverseBin) resolvePlatformExecs(platform string) error {
+	exe, err := platformExec("reverse-bin", c.ExecPlatforms, c.Executable, platform)
+	if err != nil {
+		return err
+	}
+	c.Executable = exe
+	for name, app := range c.Apps {
+		// Apps without an exec of their own use the handler's.
+		exe, err := platformExec(fmt.Sprintf("app %q", name), app.ExecPlatforms, app.Executable, platform)
+		if err != nil {
+			return err
+		}
+		app.Executable = exe
+	}
+	return nil
+}
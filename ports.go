@@ -0,0 +1,135 @@
+package reversebin
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// portPlaceholder is replaced by the port allocated from port_range in the
+// executable, envs and reverse_proxy_to of a backend, or by the port it
+// announced for upstream_from in reverse_proxy_to.
+const portPlaceholder = "{reverse_bin.port}"
+
+// PortRange is an inclusive range of TCP ports handed out to backends.
+type PortRange struct {
+	First int `json:"first"`
+	Last  int `json:"last"`
+}
+
+// parsePortRange parses "first-last".
+func parsePortRange(s string) (*PortRange, error) {
+	first, last, ok := strings.Cut(s, "-")
+	if !ok {
+		return nil, fmt.Errorf("port_range must look like 20000-20100, got %q", s)
+	}
+	pr := new(PortRange)
+	var err error
+	if pr.First, err = strconv.Atoi(first); err != nil {
+		return nil, fmt.Errorf("invalid port_range start %q", first)
+	}
+	if pr.Last, err = strconv.Atoi(last); err != nil {
+		return nil, fmt.Errorf("invalid port_range end %q", last)
+	}
+	return pr, pr.validate()
+}
+
+func (pr *PortRange) validate() error {
+	if pr.First < 1 || pr.Last > 65535 || pr.First > pr.Last {
+		return fmt.Errorf("port_range %d-%d is not a valid range of ports", pr.First, pr.Last)
+	}
+	return nil
+}
+
+// ports tracks allocations across all handlers, so blocks with overlapping
+// ranges never hand out the same port twice.
+var ports = struct {
+	mu     sync.Mutex
+	leases map[int]*processState
+}{leases: make(map[int]*processState)}
+
+// portFree reports whether nothing is listening on port at host.
+func portFree(host string, port int) bool {
+	ln, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return false
+	}
+	_ = ln.Close()
+	return true
+}
+
+// allocatePort leases to ps the first port of the range that is neither
+// allocated nor in use by another program.
+func (c *ReverseBin) allocatePort(ps *processState) (int, error) {
+	ports.mu.Lock()
+	defer ports.mu.Unlock()
+	for port := c.PortRange.First; port <= c.PortRange.Last; port++ {
+		if _, taken := ports.leases[port]; taken {
+			continue
+		}
+		if !portFree(c.loopbackHost(), port) {
+			c.logger.Warn("port in port_range is in use outside reverse-bin; skipping",
+				zap.Int("port", port))
+			continue
+		}
+		ports.leases[port] = ps
+		return port, nil
+	}
+	return 0, fmt.Errorf("port_range %d-%d exhausted; cannot start backend for %q",
+		c.PortRange.First, c.PortRange.Last, c.processKeyName(ps.key))
+}
+
+// releasePort returns port to the pool once its backend has exited. A port
+// still bound at that point was leaked, typically by an orphaned child of
+// the backend, and stays allocated so it is not handed to another key.
+func (c *ReverseBin) releasePort(ps *processState, port int) {
+	ports.mu.Lock()
+	defer ports.mu.Unlock()
+	if ports.leases[port] != ps {
+		return
+	}
+	if !portFree(c.loopbackHost(), port) {
+		c.logger.Warn("backend exited but its port is still bound; keeping it reserved",
+			zap.String("key", c.processKeyName(ps.key)),
+			zap.Int("port", port))
+		return
+	}
+	delete(ports.leases, port)
+}
+
+// releasePorts drops every lease held by ps, e.g. when its handler unloads.
+func releasePorts(ps *processState) {
+	ports.mu.Lock()
+	defer ports.mu.Unlock()
+	for port, owner := range ports.leases {
+		if owner == ps {
+			delete(ports.leases, port)
+		}
+	}
+}
+
+// withPort returns a copy of o with the port placeholder replaced by port.
+func (o *Overrides) withPort(port int) *Overrides {
+	return o.replacing(portPlaceholder, strconv.Itoa(port))
+}
+
+// replacing returns a copy of o with placeholder replaced by value in the
+// executable, envs and reverse_proxy_to.
+func (o *Overrides) replacing(placeholder, value string) *Overrides {
+	copied := *o
+	exe := make([]string, len(*o.Executable))
+	for i, arg := range *o.Executable {
+		exe[i] = strings.ReplaceAll(arg, placeholder, value)
+	}
+	envs := make([]string, len(*o.Envs))
+	for i, env := range *o.Envs {
+		envs[i] = strings.ReplaceAll(env, placeholder, value)
+	}
+	addr := strings.ReplaceAll(*o.ReverseProxyTo, placeholder, value)
+	copied.Executable, copied.Envs, copied.ReverseProxyTo = &exe, &envs, &addr
+	return &copied
+}
@@ -0,0 +1,217 @@
+package reversebin
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// defaultPreStopTimeout bounds the wait for a backend to acknowledge a
+// pre-stop notification when no timeout is given.
+const defaultPreStopTimeout = 10 * time.Second
+
+// defaultStopTimeout bounds the wait for a backend to exit after stop_signal
+// when no stop_timeout is given.
+const defaultStopTimeout = 10 * time.Second
+
+// preStopSignals are the signals pre_stop_signal and stop_signal accept.
+var preStopSignals = map[string]syscall.Signal{
+	"SIGTERM": syscall.SIGTERM,
+	"SIGINT":  syscall.SIGINT,
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+}
+
+// PreStop tells a backend it is about to be stopped for being idle or via
+// the admin API, and waits for it to acknowledge, so apps can checkpoint
+// state. The request is sent first, then the signal; the backend is killed
+// afterwards either way.
+type PreStop struct {
+	// HTTP method and path requested from the backend, e.g. POST /_shutdown;
+	// a 2xx response acknowledges
+	Method string `json:"method,omitempty"`
+	Path   string `json:"path,omitempty"`
+	// Signal sent to the backend, e.g. SIGTERM; its exit acknowledges
+	Signal string `json:"signal,omitempty"`
+	// How long to wait for each acknowledgment in milliseconds (default, 10000)
+	TimeoutMS int `json:"timeout_ms,omitempty"`
+}
+
+// unmarshalRequest parses "pre_stop_request <method> <path> [<timeout>]".
+func (p *PreStop) unmarshalRequest(d *caddyfile.Dispenser) error {
+	args := d.RemainingArgs()
+	if len(args) < 2 || len(args) > 3 {
+		return d.ArgErr()
+	}
+	if !strings.HasPrefix(args[1], "/") {
+		return d.Errf("pre_stop_request path must start with /, got %q", args[1])
+	}
+	p.Method, p.Path = strings.ToUpper(args[0]), args[1]
+	return p.parseTimeout(d, args[2:])
+}
+
+// unmarshalSignal parses "pre_stop_signal <signal> [<timeout>]".
+func (p *PreStop) unmarshalSignal(d *caddyfile.Dispenser) error {
+	args := d.RemainingArgs()
+	if len(args) < 1 || len(args) > 2 {
+		return d.ArgErr()
+	}
+	name, ok := signalName(args[0])
+	if !ok {
+		return d.Errf("unsupported pre_stop_signal: %q", args[0])
+	}
+	p.Signal = name
+	return p.parseTimeout(d, args[1:])
+}
+
+// signalName returns the canonical name of a signal given as e.g. "term",
+// "TERM" or "SIGTERM", and whether it is one of preStopSignals.
+func signalName(s string) (string, bool) {
+	name := strings.ToUpper(s)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	_, ok := preStopSignals[name]
+	return name, ok
+}
+
+func (p *PreStop) parseTimeout(d *caddyfile.Dispenser, args []string) error {
+	if len(args) == 0 {
+		return nil
+	}
+	dur, err := caddy.ParseDuration(args[0])
+	if err != nil || dur < time.Millisecond {
+		return d.Errf("pre-stop timeout must be a positive duration: %s", args[0])
+	}
+	p.TimeoutMS = int(dur.Milliseconds())
+	return nil
+}
+
+func (p *PreStop) timeout() time.Duration {
+	if p.TimeoutMS > 0 {
+		return time.Duration(p.TimeoutMS) * time.Millisecond
+	}
+	return defaultPreStopTimeout
+}
+
+// hook returns the notification for the backend proc serving upstream. gone
+// is closed once proc has exited. The hook runs without ps.mu, and gives up
+// after timeout for each acknowledgment; starts of the key wait for it via
+// awaitStopped.
+func (p *PreStop) hook(logger *zap.Logger, proc Process, upstream string, upstreamTLS *tls.Config, gone <-chan struct{}) func() {
+	return func() {
+		pid := proc.Pid()
+		if p.Method != "" {
+			if err := p.request(upstream, upstreamTLS); err != nil {
+				logger.Warn("backend did not acknowledge pre-stop request", zap.Int("pid", pid), zap.Error(err))
+			}
+		}
+		if p.Signal == "" {
+			return
+		}
+		// Backends of a custom Runner cannot be signalled.
+		osProc, ok := proc.(osProcess)
+		if !ok {
+			return
+		}
+		if err := osProc.Signal(preStopSignals[p.Signal]); err != nil {
+			logger.Warn("failed to send pre-stop signal", zap.Int("pid", pid), zap.String("signal", p.Signal), zap.Error(err))
+			return
+		}
+		timer := time.NewTimer(p.timeout())
+		defer timer.Stop()
+		select {
+		case <-gone:
+		case <-timer.C:
+			logger.Warn("backend did not exit after pre-stop signal", zap.Int("pid", pid), zap.String("signal", p.Signal))
+		}
+	}
+}
+
+// request sends the configured pre-stop request to upstream and reports
+// whether it was acknowledged in time.
+func (p *PreStop) request(upstream string, upstreamTLS *tls.Config) error {
+	scheme := "http"
+	if strings.HasPrefix(upstream, "https://") || upstreamTLS != nil {
+		scheme = "https"
+	}
+	transport := &http.Transport{TLSClientConfig: upstreamTLS}
+	host := readinessAddress(upstream)
+	if isUnixUpstream(upstream) {
+		socketPath := strings.TrimPrefix(upstream, "unix/")
+		// For unix sockets, the host in the URL is ignored by the custom dialer
+		host = "localhost"
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socketPath)
+		}
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Timeout: p.timeout(), Transport: transport}
+	req, err := http.NewRequest(p.Method, fmt.Sprintf("%s://%s%s", scheme, host, p.Path), nil)
+	if err != nil {
+		return err
+	}
+	markInternal(req, "pre-stop")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("pre-stop request returned %s", resp.Status)
+	}
+	return nil
+}
+
+// awaitExit returns a wait for gone to be closed that gives up after timeout.
+func awaitExit(gone <-chan struct{}, timeout time.Duration) func() {
+	return func() {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-gone:
+		case <-timer.C:
+		}
+	}
+}
+
+// awaitStopped waits for stopping, the processState field, to be closed, and
+// fails once ctx is done. A nil stopping is no stop in progress.
+func awaitStopped(ctx context.Context, stopping <-chan struct{}) error {
+	if stopping == nil {
+		return nil
+	}
+	select {
+	case <-stopping:
+		return nil
+	case <-ctx.Done():
+		return slotError(ctx)
+	}
+}
+
+// stopInProgress reports whether stopping is open.
+func stopInProgress(stopping <-chan struct{}) bool {
+	if stopping == nil {
+		return false
+	}
+	select {
+	case <-stopping:
+		return false
+	default:
+		return true
+	}
+}
@@ -0,0 +1,82 @@
+package reversebin
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// prewarmKeys returns the keys prewarm starts: the configured ones, or else
+// the handler's backend, or every app.
+func (c *ReverseBin) prewarmKeys() []string {
+	if len(c.PrewarmKeys) > 0 {
+		return c.PrewarmKeys
+	}
+	if !c.Prewarm {
+		return nil
+	}
+	if len(c.Apps) > 0 {
+		keys := make([]string, 0, len(c.Apps))
+		for name := range c.Apps {
+			keys = append(keys, name)
+		}
+		slices.Sort(keys)
+		return keys
+	}
+	return []string{""}
+}
+
+func (c *ReverseBin) validatePrewarm() error {
+	if c.Prewarm && len(c.PrewarmKeys) == 0 && len(c.Apps) == 0 && (c.detector != nil || c.ProvisionAsk != "") {
+		return fmt.Errorf("prewarm needs the keys to start with a detector or provision_ask")
+	}
+	if len(c.PrewarmKeys) > 0 && c.detector == nil && len(c.Apps) == 0 && c.ProvisionAsk == "" {
+		return fmt.Errorf("prewarm keys require a detector, app or provision_ask")
+	}
+	if len(c.PrewarmKeys) > 0 && (c.PortRange != nil || c.UpstreamFrom != nil) {
+		return fmt.Errorf("prewarm keys cannot be combined with port_range or upstream_from")
+	}
+	return nil
+}
+
+// prewarm starts the backends of prewarmKeys ahead of their first request and
+// returns once each is ready or failed. Backends taken over from the previous
+// config are left as they are. Like any other start, a prewarmed backend is
+// stopped after its idle timeout.
+func (c *ReverseBin) prewarm() {
+	var wg sync.WaitGroup
+	for _, key := range c.prewarmKeys() {
+		wg.Go(func() {
+			start := c.clock().Now()
+			if err := c.prewarmKey(key); err != nil {
+				c.logger.Error("failed to prewarm backend",
+					zap.String("key", c.processKeyName(key)), zap.Error(err))
+				return
+			}
+			c.logger.Info("prewarmed backend",
+				zap.String("key", c.processKeyName(key)),
+				zap.Duration("duration", c.clock().Now().Sub(start).Round(time.Millisecond)))
+		})
+	}
+	wg.Wait()
+}
+
+// prewarmKey starts the backend of key with a synthetic request. A key that
+// provision_ask decides on is asked first, without a domain.
+func (c *ReverseBin) prewarmKey(key string) error {
+	if c.ProvisionAsk != "" && c.Apps[key] == nil {
+		req, err := http.NewRequestWithContext(c.ctx, http.MethodGet, "/", nil)
+		if err != nil {
+			return err
+		}
+		markInternal(req, "prewarm")
+		if err := c.askProvision(req, key); err != nil {
+			return err
+		}
+	}
+	return c.startUnrequested(c.ctx, c.getOrCreateProcessState(key), "prewarm", false)
+}
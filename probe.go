@@ -0,0 +1,25 @@
+package reversebin
+
+import "net/http"
+
+// internalHeader marks requests generated by reverse-bin itself, such as
+// readiness checks, so backends can keep them out of their analytics. The
+// value names the kind of probe.
+const internalHeader = "X-Reverse-Bin-Internal"
+
+// markInternal flags req as synthetic traffic of the given kind.
+func markInternal(req *http.Request, kind string) {
+	req.Header.Set(internalHeader, kind)
+}
+
+// isInternal reports whether req is one of reverse-bin's own, such as the
+// request of a warm or prewarm start.
+func isInternal(req *http.Request) bool {
+	return req.Header.Get(internalHeader) != ""
+}
+
+// stripInternal removes a client-supplied internal marker so that backends
+// only ever see it on reverse-bin's own requests.
+func stripInternal(h http.Header) {
+	h.Del(internalHeader)
+}
@@ -0,0 +1,125 @@
+package reversebin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// askProvision asks the provision_ask endpoint whether the backend for key
+// may be started. It is consulted on every cold start of a key that is not
+// an inline app, so tenants are onboarded and offboarded without a reload.
+// Like Caddy's on-demand TLS ask, the request carries ?domain=<host> (plus
+// &key=<key>), so one endpoint can approve a tenant's certificate and
+// process. A 2xx allows the start; a JSON body in the detector output format
+// then configures the backend. Any other status rejects the request with 404.
+//
+// Requests for a key arriving while its ask is in flight share the answer
+// rather than asking again.
+func (c *ReverseBin) askProvision(r *http.Request, key string) error {
+	if c.backendRunning(key) {
+		return nil
+	}
+	c.mu.Lock()
+	if ask, ok := c.asks[key]; ok {
+		c.mu.Unlock()
+		if ce := c.logger.Check(zap.DebugLevel, "waiting for provision_ask in flight"); ce != nil {
+			ce.Write(zap.String("key", key))
+		}
+		<-ask.done
+		return ask.err
+	}
+	ask := &provisionAsk{done: make(chan struct{})}
+	if c.asks == nil {
+		c.asks = make(map[string]*provisionAsk)
+	}
+	c.asks[key] = ask
+	c.mu.Unlock()
+
+	ask.err = c.sendProvisionAsk(r, key)
+	c.mu.Lock()
+	delete(c.asks, key)
+	c.mu.Unlock()
+	close(ask.done)
+	return ask.err
+}
+
+// provisionAsk is an ask of provision_ask in flight; err is set once done is
+// closed.
+type provisionAsk struct {
+	done chan struct{}
+	err  error
+}
+
+// sendProvisionAsk asks provision_ask about key and records its answer.
+func (c *ReverseBin) sendProvisionAsk(r *http.Request, key string) error {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	u, err := url.Parse(c.ProvisionAsk)
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, fmt.Errorf("invalid provision_ask URL: %v", err))
+	}
+	q := u.Query()
+	q.Set("domain", host)
+	q.Set("key", key)
+	u.RawQuery = q.Encode()
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return caddyhttp.Error(http.StatusBadGateway, fmt.Errorf("provision_ask request failed: %v", err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		c.logger.Info("provision_ask rejected key",
+			zap.String("key", key),
+			zap.Int("status", resp.StatusCode))
+		return caddyhttp.Error(http.StatusNotFound, fmt.Errorf("provisioning of %q not allowed", key))
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return caddyhttp.Error(http.StatusBadGateway, fmt.Errorf("reading provision_ask response: %v", err))
+	}
+	var overrides *Overrides
+	if len(body) > 0 {
+		overrides = new(Overrides)
+		if err := json.Unmarshal(body, overrides); err != nil {
+			return caddyhttp.Error(http.StatusBadGateway, fmt.Errorf("invalid provision_ask response: %v", err))
+		}
+	}
+	c.mu.Lock()
+	c.provisioned[key] = overrides
+	c.mu.Unlock()
+	return nil
+}
+
+// backendRunning reports whether key already has a live or adopted backend.
+func (c *ReverseBin) backendRunning(key string) bool {
+	c.mu.Lock()
+	ps, ok := c.processes[key]
+	c.mu.Unlock()
+	if !ok {
+		return false
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.process != nil || ps.adopted || ps.scaleDown != nil
+}
+
+// provisionedOverrides returns the backend settings from the last approving
+// provision_ask response for key, if it carried any.
+func (c *ReverseBin) provisionedOverrides(key string) *Overrides {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.provisioned[key]
+}
@@ -0,0 +1,146 @@
+package reversebin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// UpstreamRateLimit caps the rate of requests proxied to each backend, e.g.
+// to smooth load on a fragile single-threaded app. Requests over the rate
+// wait their turn.
+type UpstreamRateLimit struct {
+	// Requests allowed per period
+	Requests int `json:"requests"`
+	// Length of a period in milliseconds
+	PeriodMS int `json:"period_ms"`
+	// Requests that may be sent at once after a quiet spell (default, 1)
+	Burst int `json:"burst,omitempty"`
+}
+
+// parseUpstreamRateLimit parses "upstream_rate_limit <n>r/<unit> [burst <n>]",
+// where unit is s, m or h, or any period parseRate accepts.
+func parseUpstreamRateLimit(d *caddyfile.Dispenser) (*UpstreamRateLimit, error) {
+	args := d.RemainingArgs()
+	if len(args) != 1 && len(args) != 3 {
+		return nil, d.ArgErr()
+	}
+	count, per, _ := strings.Cut(args[0], "/")
+	switch per {
+	case "s":
+		per = "1s"
+	case "m":
+		per = "minute"
+	case "h":
+		per = "hour"
+	}
+	n, period, err := parseRate(d, "upstream_rate_limit", strings.TrimSuffix(count, "r")+"/"+per)
+	if err != nil {
+		return nil, err
+	}
+	l := &UpstreamRateLimit{Requests: n, PeriodMS: int(period.Milliseconds())}
+	if len(args) == 3 {
+		burst, err := strconv.Atoi(args[2])
+		if args[1] != "burst" || err != nil || burst < 1 {
+			return nil, d.Errf("upstream_rate_limit expects burst <n> with a positive n, got %s %s", args[1], args[2])
+		}
+		l.Burst = burst
+	}
+	return l, nil
+}
+
+func (l *UpstreamRateLimit) validate() error {
+	if l.Requests < 1 || l.PeriodMS < 1 {
+		return fmt.Errorf("upstream_rate_limit must allow a positive number of requests per period")
+	}
+	if l.Burst < 0 {
+		return fmt.Errorf("upstream_rate_limit burst must not be negative")
+	}
+	return nil
+}
+
+// interval is the time it takes to earn one request.
+func (l *UpstreamRateLimit) interval() time.Duration {
+	return time.Duration(l.PeriodMS) * time.Millisecond / time.Duration(l.Requests)
+}
+
+func (l *UpstreamRateLimit) burst() int {
+	return max(l.Burst, 1)
+}
+
+// rateBucket hands out the turns of a backend's requests under
+// upstream_rate_limit.
+type rateBucket struct {
+	mu sync.Mutex
+	// due is when the latest turn handed out would be due were requests sent
+	// evenly at the rate; up to burst turns may come before theirs
+	due time.Time
+}
+
+// reserve takes the next turn and returns when it is due, for cancel, and
+// how long after now it comes, unless that is past deadline, in which case it
+// takes none.
+func (b *rateBucket) reserve(now, deadline time.Time, l *UpstreamRateLimit) (time.Time, time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	interval := l.interval()
+	due := b.due
+	if due.Before(now) {
+		due = now
+	}
+	due = due.Add(interval)
+	wait := max(due.Sub(now)-time.Duration(l.burst())*interval, 0)
+	if !deadline.IsZero() && now.Add(wait).After(deadline) {
+		return time.Time{}, wait, false
+	}
+	b.due = due
+	return due, wait, true
+}
+
+// cancel gives back the turn due at due, taken by a request that stopped
+// waiting for it. Only the latest turn can be given back; once later ones
+// are handed out, theirs would move earlier, so the turn is left unused.
+func (b *rateBucket) cancel(due time.Time, l *UpstreamRateLimit) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.due.Equal(due) {
+		b.due = due.Add(-l.interval())
+	}
+}
+
+// waitTurn holds the request until upstream_rate_limit lets it be sent to
+// the backend of ps. A request whose turn comes after the queue timeout is
+// turned away with 429 at once.
+func (c *ReverseBin) waitTurn(ctx context.Context, ps *processState) error {
+	l := c.UpstreamRateLimit
+	if l == nil {
+		return nil
+	}
+	deadline, _ := ctx.Deadline()
+	clock := c.clock()
+	due, wait, ok := ps.rate.reserve(clock.Now(), deadline, l)
+	if !ok {
+		return caddyhttp.Error(http.StatusTooManyRequests,
+			fmt.Errorf("%w: the request's turn would come in %s", ErrRateLimited, wait.Round(time.Millisecond)))
+	}
+	if wait == 0 {
+		return nil
+	}
+	turn := make(chan struct{})
+	timer := clock.AfterFunc(wait, func() { close(turn) })
+	defer timer.Stop()
+	select {
+	case <-turn:
+		return nil
+	case <-ctx.Done():
+		ps.rate.cancel(due, l)
+		return slotError(ctx)
+	}
+}
@@ -0,0 +1,151 @@
+package reversebin
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// parseReadinessInterval parses "readiness_interval <interval> [backoff <max>]".
+func (c *ReverseBin) parseReadinessInterval(d *caddyfile.Dispenser) error {
+	args := d.RemainingArgs()
+	if len(args) != 1 && (len(args) != 3 || args[1] != "backoff") {
+		return d.ArgErr()
+	}
+	interval, err := caddy.ParseDuration(args[0])
+	if err != nil || interval < time.Millisecond {
+		return d.Errf("readiness_interval must be a positive duration: %s", args[0])
+	}
+	c.ReadinessIntervalMS = int(interval.Milliseconds())
+	if len(args) == 3 {
+		max, err := caddy.ParseDuration(args[2])
+		if err != nil || max < interval {
+			return d.Errf("readiness_interval backoff must be a duration of at least the interval: %s", args[2])
+		}
+		c.ReadinessBackoffMaxMS = int(max.Milliseconds())
+	}
+	return nil
+}
+
+// pollReadiness calls probe until it succeeds, then reports readiness on
+// ready. Polls are def apart unless readiness_interval is set; with a backoff
+// the wait doubles after each failed poll until it reaches the maximum.
+func (c *ReverseBin) pollReadiness(ctx context.Context, def time.Duration, probe func() bool, ready chan<- bool) {
+	delay := def
+	if c.ReadinessIntervalMS > 0 {
+		delay = time.Duration(c.ReadinessIntervalMS) * time.Millisecond
+	}
+	max := time.Duration(c.ReadinessBackoffMaxMS) * time.Millisecond
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			if probe() {
+				ready <- true
+				return
+			}
+			if delay < max {
+				delay = min(2*delay, max)
+			}
+			timer.Reset(delay)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// parseReadinessCheck parses the arguments of directive, readiness_check or
+// liveness_check: "<method> <path> [expect <status>...]" or "grpc [service]".
+func parseReadinessCheck(d *caddyfile.Dispenser, directive string, args []string) (method, path string, expect []int, err error) {
+	if len(args) > 0 && strings.EqualFold(args[0], readinessGRPC) {
+		if len(args) > 2 {
+			return "", "", nil, d.ArgErr()
+		}
+		if len(args) == 2 {
+			path = args[1]
+		}
+		return readinessGRPC, path, nil, nil
+	}
+	if len(args) < 2 || len(args) == 3 || (len(args) > 3 && args[2] != "expect") {
+		return "", "", nil, d.ArgErr()
+	}
+	for _, arg := range args[min(len(args), 3):] {
+		code, err := strconv.Atoi(arg)
+		if err != nil || code < 100 || code > 599 {
+			return "", "", nil, d.Errf("%s expect takes HTTP status codes, got %q", directive, arg)
+		}
+		expect = append(expect, code)
+	}
+	return strings.ToUpper(args[0]), args[1], expect, nil
+}
+
+// httpProbe returns the URL of an HTTP check of the backend at upstream and a
+// function that requests it once and reports whether it passed. Requests are
+// marked as internal traffic of kind. No connection is kept open between
+// checks, which may be far apart or outlive the backend.
+func httpProbe(upstream, method, path, host string, expect []int, tlsConfig *tls.Config, kind string) (string, func() bool) {
+	scheme := "http"
+	if strings.HasPrefix(upstream, "https://") || tlsConfig != nil {
+		scheme = "https"
+	}
+
+	var checkURL string
+	var client *http.Client
+
+	if strings.HasPrefix(upstream, "unix/") {
+		socketPath := strings.TrimPrefix(upstream, "unix/")
+		// For unix sockets, the host in the URL is ignored by the custom dialer
+		checkURL = fmt.Sprintf("%s://localhost%s", scheme, path)
+		client = &http.Client{
+			Timeout: 500 * time.Millisecond,
+			Transport: &http.Transport{
+				DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+					return net.Dial("unix", socketPath)
+				},
+				TLSClientConfig: tlsConfig,
+			},
+		}
+	} else {
+		checkURL = fmt.Sprintf("%s://%s%s", scheme, readinessAddress(upstream), path)
+		client = &http.Client{
+			Timeout:   500 * time.Millisecond,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		}
+	}
+
+	return checkURL, func() bool {
+		req, _ := http.NewRequest(method, checkURL, nil)
+		markInternal(req, kind)
+		if host != "" {
+			req.Host = host
+		}
+		defer client.CloseIdleConnections()
+		resp, err := client.Do(req)
+		if err != nil {
+			return false
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		return readinessPassed(resp.StatusCode, expect)
+	}
+}
+
+// readinessPassed reports whether a readiness check answered with status
+// succeeded: any 2xx or 3xx unless specific codes are expected.
+func readinessPassed(status int, expect []int) bool {
+	if len(expect) > 0 {
+		return slices.Contains(expect, status)
+	}
+	return status >= 200 && status < 400
+}
@@ -0,0 +1,75 @@
+package reversebin
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// stateReapInterval is how often process_state_ttl looks for stale keys.
+const stateReapInterval = time.Minute
+
+// runStateReaper forgets stale keys every stateReapInterval until the
+// handler is unloaded.
+func (c *ReverseBin) runStateReaper() {
+	ticker := time.NewTicker(stateReapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if removed := c.reapStates(c.clock().Now()); removed > 0 {
+			c.logger.Debug("forgot stale process keys", zap.Int("keys", removed))
+		}
+	}
+}
+
+// reapStates removes the state of every key that has had no backend and no
+// requests since process_state_ttl before now, and returns how many it
+// removed, along with the key's provision_ask approval. Since a lookup of
+// the key renews it, no request still holds a state that is removed; the
+// next one starts from a fresh state.
+func (c *ReverseBin) reapStates(now time.Time) int {
+	ttl := time.Duration(c.ProcessStateTTLMS) * time.Millisecond
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	removed := 0
+	for key, ps := range c.processes {
+		if now.Sub(ps.lastUsed) < ttl || !ps.stale(now) {
+			continue
+		}
+		delete(c.processes, key)
+		delete(c.provisioned, key)
+		releasePorts(ps)
+		removed++
+	}
+	return removed
+}
+
+// renewState marks ps as used, like a lookup of its key, and reports whether
+// it still is the key's state rather than one reapStates removed.
+func (c *ReverseBin) renewState(ps *processState) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.processes[ps.key] != ps {
+		return false
+	}
+	ps.lastUsed = c.clock().Now()
+	return true
+}
+
+// stale reports whether ps has nothing worth keeping: no backend, not even
+// one still being stopped, no requests and no backoff or halt still in effect. A state locked by
+// someone else is in use.
+func (ps *processState) stale(now time.Time) bool {
+	if ps.starting.Load() || ps.running.Load() || !ps.mu.TryLock() {
+		return false
+	}
+	defer ps.mu.Unlock()
+	waiting, _ := ps.waiting.snapshot(now)
+	return ps.process == nil && !ps.adopted && ps.scaleDown == nil && !stopInProgress(ps.stopping) &&
+		ps.activeRequests == 0 && waiting == 0 && len(ps.gate) == 0 &&
+		ps.halted.Load() == nil && ps.retryAt.Load() <= now.UnixNano()
+}
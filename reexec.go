@@ -0,0 +1,119 @@
+package reversebin
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// reexecPollInterval is how often a backend whose first process exited is
+// checked for processes it left running.
+const reexecPollInterval = 250 * time.Millisecond
+
+// backendMembers returns a function reporting whether any process of the
+// backend started as pid is left: in its cgroup when it has one, which
+// children calling setsid cannot leave, or else in its process group.
+func backendMembers(pid int, cgroup *backendCgroup) func() bool {
+	if cgroup != nil {
+		return cgroup.populated
+	}
+	return func() bool { return processGroupAlive(pid) }
+}
+
+// processGroupAlive reports whether the process group pgid has a member that
+// is not a zombie. Orphaned zombies count as gone, since containers without
+// an init may never reap them.
+func processGroupAlive(pgid int) bool {
+	if runtime.GOOS != "linux" {
+		return syscall.Kill(-pgid, 0) == nil
+	}
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return syscall.Kill(-pgid, 0) == nil
+	}
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err != nil {
+			continue
+		}
+		data, err := os.ReadFile("/proc/" + entry.Name() + "/stat")
+		if err != nil {
+			continue
+		}
+		// "pid (comm) state ppid pgrp ..."; comm may contain spaces.
+		closeIdx := bytes.LastIndexByte(data, ')')
+		if closeIdx == -1 {
+			continue
+		}
+		fields := strings.Fields(string(data[closeIdx+1:]))
+		if len(fields) > 2 && fields[0] != "Z" && fields[2] == strconv.Itoa(pgid) {
+			return true
+		}
+	}
+	return false
+}
+
+// followReexec keeps a backend whose first process exited alive while the
+// processes it started remain, as with watchers and npm scripts that replace
+// themselves. Cancelling ctx stops them like the backend itself.
+func (c *ReverseBin) followReexec(ctx context.Context, spec ProcessSpec, proc osProcess, cgroup *backendCgroup) {
+	key := c.processKeyName(spec.Key)
+	members := backendMembers(proc.Pid(), cgroup)
+	if !members() {
+		if ctx.Err() == nil && upstreamAccepts(spec.ReverseProxyTo) {
+			c.logger.Warn("backend exited but its upstream still accepts connections; a process outside its process group serves it",
+				zap.String("key", key),
+				zap.Int("pid", proc.Pid()),
+				zap.String("upstream", spec.ReverseProxyTo))
+		}
+		return
+	}
+	c.logger.Info("backend process exited; following the processes it left running",
+		zap.String("key", key),
+		zap.Int("pid", proc.Pid()))
+	ticker := time.NewTicker(reexecPollInterval)
+	defer ticker.Stop()
+	stopping := ctx.Done()
+	var escalate <-chan time.Time
+	for members() {
+		select {
+		case <-stopping:
+			stopping = nil
+			proc.Kill()
+			if cgroup != nil {
+				// Processes that left the process group miss its signals.
+				escalate = time.After(c.stopGrace())
+			}
+		case <-escalate:
+			escalate = nil
+			if err := cgroup.kill(); err != nil {
+				c.logger.Warn("failed to kill backend cgroup", zap.String("key", key), zap.Error(err))
+			}
+		case <-ticker.C:
+		}
+	}
+}
+
+// upstreamAccepts reports whether something accepts connections at upstream.
+func upstreamAccepts(upstream string) bool {
+	if upstream == "" {
+		return false
+	}
+	network, addr := "tcp", readinessAddress(upstream)
+	if isUnixUpstream(upstream) {
+		network, addr = "unix", strings.TrimPrefix(upstream, "unix/")
+	}
+	conn, err := net.DialTimeout(network, addr, 200*time.Millisecond)
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
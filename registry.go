@@ -0,0 +1,224 @@
+package reversebin
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// ServiceRegistry announces ready backends in Consul or etcd so service meshes
+// and monitoring can discover processes managed by Caddy. Entries are removed
+// when the backend stops.
+type ServiceRegistry struct {
+	// Registry type: consul or etcd
+	Type string `json:"type"`
+	// Base URL of the Consul agent or etcd v3 HTTP gateway
+	Endpoint string `json:"endpoint"`
+	// Service name (default "reverse-bin")
+	Service string `json:"service,omitempty"`
+	// Tags attached to every registration
+	Tags []string `json:"tags,omitempty"`
+	// etcd key prefix (default "/reverse-bin/")
+	Prefix string `json:"prefix,omitempty"`
+}
+
+func (sr *ServiceRegistry) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if !d.Args(&sr.Type, &sr.Endpoint) {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "service":
+			if !d.Args(&sr.Service) {
+				return d.ArgErr()
+			}
+		case "tags":
+			sr.Tags = d.RemainingArgs()
+		case "prefix":
+			if !d.Args(&sr.Prefix) {
+				return d.ArgErr()
+			}
+		default:
+			return d.Errf("unknown service_registry subdirective: %q", d.Val())
+		}
+	}
+	return sr.validate()
+}
+
+func (sr *ServiceRegistry) validate() error {
+	if sr.Type != "consul" && sr.Type != "etcd" {
+		return fmt.Errorf("service_registry type must be consul or etcd, got %q", sr.Type)
+	}
+	if sr.Endpoint == "" {
+		return fmt.Errorf("service_registry endpoint is required")
+	}
+	return nil
+}
+
+// registration is one backend's entry. register and deregister may run
+// concurrently; once deregistered, a late register is skipped.
+type registration struct {
+	sr      *ServiceRegistry
+	service string
+	id      string
+	key     string
+	address string
+	pid     int
+
+	mu   sync.Mutex
+	done bool
+}
+
+// newRegistration returns nil when no registry is configured; the methods of a
+// nil registration do nothing.
+func (sr *ServiceRegistry) newRegistration(key, address string, pid int) *registration {
+	if sr == nil {
+		return nil
+	}
+	service := sr.Service
+	if service == "" {
+		service = "reverse-bin"
+	}
+	sum := sha256.Sum256([]byte(key))
+	return &registration{
+		sr:      sr,
+		service: service,
+		id:      service + "-" + hex.EncodeToString(sum[:]),
+		key:     key,
+		address: address,
+		pid:     pid,
+	}
+}
+
+func (reg *registration) register(logger *zap.Logger) {
+	if reg == nil {
+		return
+	}
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if reg.done {
+		return
+	}
+	if err := reg.send(true); err != nil {
+		logger.Warn("service registration failed", zap.String("id", reg.id), zap.Error(err))
+		return
+	}
+	logger.Info("registered backend", zap.String("registry", reg.sr.Type), zap.String("id", reg.id))
+}
+
+func (reg *registration) deregister(logger *zap.Logger) {
+	if reg == nil {
+		return
+	}
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if reg.done {
+		return
+	}
+	reg.done = true
+	if err := reg.send(false); err != nil {
+		logger.Warn("service deregistration failed", zap.String("id", reg.id), zap.Error(err))
+	}
+}
+
+func (reg *registration) send(add bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	endpoint := strings.TrimSuffix(reg.sr.Endpoint, "/")
+	var url string
+	var body any
+	switch reg.sr.Type {
+	case "consul":
+		if add {
+			url = endpoint + "/v1/agent/service/register"
+			body = reg.consulService()
+		} else {
+			url = endpoint + "/v1/agent/service/deregister/" + reg.id
+		}
+	case "etcd":
+		prefix := reg.sr.Prefix
+		if prefix == "" {
+			prefix = "/reverse-bin/"
+		}
+		etcdKey := base64.StdEncoding.EncodeToString([]byte(prefix + reg.id))
+		if add {
+			value, err := json.Marshal(map[string]any{
+				"key":     reg.key,
+				"address": reg.address,
+				"pid":     reg.pid,
+				"tags":    reg.sr.Tags,
+			})
+			if err != nil {
+				return err
+			}
+			url = endpoint + "/v3/kv/put"
+			body = map[string]string{"key": etcdKey, "value": base64.StdEncoding.EncodeToString(value)}
+		} else {
+			url = endpoint + "/v3/kv/deleterange"
+			body = map[string]string{"key": etcdKey}
+		}
+	}
+
+	method := http.MethodPost
+	if reg.sr.Type == "consul" {
+		method = http.MethodPut
+	}
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: unexpected status %d", method, url, resp.StatusCode)
+	}
+	return nil
+}
+
+func (reg *registration) consulService() map[string]any {
+	svc := map[string]any{
+		"ID":   reg.id,
+		"Name": reg.service,
+		"Tags": reg.sr.Tags,
+		"Meta": map[string]string{
+			"key": reg.key,
+			"pid": strconv.Itoa(reg.pid),
+		},
+	}
+	if isUnixUpstream(reg.address) {
+		svc["Address"] = reg.address
+		return svc
+	}
+	if dial, err := resolveDialAddress(reg.address); err == nil {
+		if host, port, err := net.SplitHostPort(dial); err == nil {
+			svc["Address"] = host
+			svc["Port"], _ = strconv.Atoi(port)
+		}
+	}
+	return svc
+}
@@ -0,0 +1,85 @@
+package reversebin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"go.uber.org/zap"
+)
+
+// fingerprint identifies the handler's configuration, so that a reload can
+// recognise a handler it leaves unchanged.
+func (c *ReverseBin) fingerprint() string {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// adoptPredecessor takes over the backends of an identical handler from the
+// configuration being replaced. Caddy provisions the new configuration
+// before cleaning up the old one, so the backends keep running and the old
+// handler's Cleanup leaves them alone. Should the new configuration fail to
+// load, returnAdopted gives them back.
+func (c *ReverseBin) adoptPredecessor() {
+	if c.configHash == "" {
+		return
+	}
+	handlers.mu.Lock()
+	defer handlers.mu.Unlock()
+	for prev := range handlers.set {
+		if prev.configHash != c.configHash || prev.ctx.Context == c.ctx.Context || prev.handedOver != nil {
+			continue
+		}
+		prev.mu.Lock()
+		prev.handedOver = make(map[*processState]struct{}, len(prev.processes))
+		for key, ps := range prev.processes {
+			c.processes[key] = ps
+			prev.handedOver[ps] = struct{}{}
+			ps.owner.Store(c)
+		}
+		for key, o := range prev.provisioned {
+			c.provisioned[key] = o
+		}
+		prev.mu.Unlock()
+		c.adoptedFrom = prev
+		c.logger.Info("carrying over backends of unchanged handler",
+			zap.Int("keys", len(c.processes)))
+		return
+	}
+}
+
+// returnAdopted gives the backends taken over by adoptPredecessor back to
+// the predecessor when it is still loaded, which means this handler's
+// configuration never replaced it. Once the new configuration is running,
+// Caddy has already cleaned up the predecessor and the backends stay here.
+func (c *ReverseBin) returnAdopted() {
+	handlers.mu.Lock()
+	defer handlers.mu.Unlock()
+	prev := c.adoptedFrom
+	c.adoptedFrom = nil
+	if prev == nil {
+		return
+	}
+	if _, loaded := handlers.set[prev]; !loaded {
+		return
+	}
+	prev.mu.Lock()
+	returned := prev.handedOver
+	prev.handedOver = nil
+	prev.mu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, ps := range c.processes {
+		if _, ok := returned[ps]; ok {
+			ps.owner.Store(prev)
+			delete(c.processes, key)
+		}
+	}
+	c.logger.Info("returning backends to the handler still loaded",
+		zap.Int("keys", len(returned)))
+}
@@ -0,0 +1,153 @@
+package reversebin
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// Restart policies. Backends are always started on demand; the policy
+// decides whether a backend that exited on its own may be started again.
+const (
+	restartAlways    = "always"
+	restartOnFailure = "on-failure"
+	restartNever     = "never"
+)
+
+// defaultRestartBackoffMax caps restart_backoff when no maximum is given.
+const defaultRestartBackoffMax = 5 * time.Minute
+
+// parseRestartBackoff parses "restart_backoff <initial> [<max>]".
+func (c *ReverseBin) parseRestartBackoff(d *caddyfile.Dispenser) error {
+	args := d.RemainingArgs()
+	if len(args) < 1 || len(args) > 2 {
+		return d.ArgErr()
+	}
+	initial, err := caddy.ParseDuration(args[0])
+	if err != nil || initial < time.Millisecond {
+		return d.Errf("restart_backoff must be a positive duration: %s", args[0])
+	}
+	c.RestartBackoffMS = int(initial.Milliseconds())
+	if len(args) == 2 {
+		max, err := caddy.ParseDuration(args[1])
+		if err != nil || max < initial {
+			return d.Errf("restart_backoff maximum must be a duration of at least the initial wait: %s", args[1])
+		}
+		c.RestartBackoffMaxMS = int(max.Milliseconds())
+	}
+	return nil
+}
+
+// parseNoRestartCodes parses the exit codes given to no_restart_codes.
+func parseNoRestartCodes(d *caddyfile.Dispenser) ([]int, error) {
+	args := d.RemainingArgs()
+	if len(args) == 0 {
+		return nil, d.ArgErr()
+	}
+	codes := make([]int, 0, len(args))
+	for _, arg := range args {
+		code, err := strconv.Atoi(arg)
+		if err != nil || code < 0 || code > 255 {
+			return nil, d.Errf("no_restart_codes takes exit codes from 0 to 255, got %q", arg)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// exitCode returns the exit code of a backend from its exit error. A backend
+// killed by a signal gets 128 plus the signal number, as in a shell; errors
+// without a code give -1.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return -1
+	}
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return exitErr.ExitCode()
+}
+
+// restartAllowed reports whether a backend that exited on its own with code
+// may be started again by the next request.
+func (c *ReverseBin) restartAllowed(code int) bool {
+	switch c.RestartPolicy {
+	case restartNever:
+		return false
+	case restartOnFailure:
+		if code == 0 {
+			return false
+		}
+	}
+	return !slices.Contains(c.NoRestartCodes, code)
+}
+
+// haltLocked keeps the key stopped after its backend exited with code, when
+// the restart policy says so. The caller must hold ps.mu.
+func (c *ReverseBin) haltLocked(ps *processState, code int) bool {
+	if c.restartAllowed(code) {
+		return false
+	}
+	policy := c.RestartPolicy
+	if policy == "" {
+		policy = restartAlways
+	}
+	msg := fmt.Sprintf("backend for %q exited with code %d and restart_policy %s keeps it stopped",
+		c.processKeyName(ps.key), code, policy)
+	ps.halted.Store(&msg)
+	return true
+}
+
+func (c *ReverseBin) restartBackoffMax() time.Duration {
+	if c.RestartBackoffMaxMS > 0 {
+		return time.Duration(c.RestartBackoffMaxMS) * time.Millisecond
+	}
+	return defaultRestartBackoffMax
+}
+
+// crashedLocked records that the backend of ps exited on its own after
+// running for uptime, with the restart policy allowing another start. It
+// keeps the key stopped and reports true once more than max_restarts crashes
+// happened in a row; otherwise restart_backoff holds off the next start,
+// doubling the wait with each crash. A backend that ran for the backoff
+// maximum starts a new series. The caller must hold ps.mu.
+func (c *ReverseBin) crashedLocked(ps *processState, uptime time.Duration) bool {
+	max := c.restartBackoffMax()
+	if uptime >= max {
+		ps.crashes = 0
+	}
+	ps.crashes++
+	name := c.processKeyName(ps.key)
+	if c.MaxRestarts > 0 && ps.crashes > c.MaxRestarts {
+		msg := fmt.Sprintf("backend for %q crashed %d times in a row and max_restarts %d keeps it stopped",
+			name, ps.crashes, c.MaxRestarts)
+		ps.halted.Store(&msg)
+		return true
+	}
+	if c.RestartBackoffMS <= 0 {
+		return false
+	}
+	backoff := time.Duration(c.RestartBackoffMS) * time.Millisecond
+	for i := 1; i < ps.crashes && backoff < max; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, max)
+	ps.holdOff(c.clock().Now().Add(backoff), fmt.Sprintf("backend for %q crashed %d times in a row", name, ps.crashes))
+	c.logger.Warn("holding off restart of crashed backend",
+		zap.String("key", name),
+		zap.Int("crashes", ps.crashes),
+		zap.Duration("backoff", backoff))
+	return false
+}
@@ -22,7 +22,8 @@ import (
 	"bufio"
 	"bytes"
 	"context"
-	"encoding/json"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -31,12 +32,13 @@ import (
 	"os"
 	"os/exec"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
 	"go.uber.org/zap"
@@ -46,33 +48,163 @@ import (
 // ServeHTTP implements caddyhttp.MiddlewareHandler; it handles the HTTP request
 // manages idle process killing
 func (c *ReverseBin) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-	c.logger.Debug("ServeHTTP", zap.String("uri", r.RequestURI))
+	if ce := c.logger.Check(zap.DebugLevel, "ServeHTTP"); ce != nil {
+		ce.Write(zap.String("uri", r.RequestURI))
+	}
+	// Clients may not pass their requests off as reverse-bin's own.
+	stripInternal(r.Header)
+	var tr *requestTrace
+	if c.Debug {
+		tr = &requestTrace{start: time.Now()}
+		r = withTrace(r, tr)
+	}
+	keyStart := time.Now()
 	key := c.getProcessKey(r)
+	tr.step("key", keyStart, c.processKeyName(key))
+	if c.KeyJWTClaim != "" && key == "" {
+		return caddyhttp.Error(http.StatusUnauthorized, fmt.Errorf("missing %q claim for process key", c.KeyJWTClaim))
+	}
+	if c.ProvisionAsk != "" && c.Apps[key] == nil {
+		if err := c.askProvision(r, key); err != nil {
+			return err
+		}
+	} else if len(c.Apps) > 0 && c.Apps[key] == nil && c.detector == nil {
+		return caddyhttp.Error(http.StatusNotFound, fmt.Errorf("no app configured for %q", key))
+	}
+	if c.Maintenance != nil && c.Maintenance.serveIfActive(w, r, key) {
+		return nil
+	}
+	if c.ActiveHours != nil && c.ActiveHours.serveIfClosed(w, r, key, c.clock().Now()) {
+		return nil
+	}
+	if len(c.Variants) > 0 {
+		withVariant, err := c.variantKey(r, key)
+		if err != nil {
+			return err
+		}
+		key = withVariant
+	}
+	if c.copies() > 1 {
+		key = c.replicaFor(w, r, key)
+	}
 	ps := c.getOrCreateProcessState(key)
+	idleTimeout, err := c.idleTimeoutFor(r, ps)
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	extendIdle, err := c.extendsIdle(r)
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	if served, err := c.serveStatic(w, r, ps, next); served {
+		return err
+	}
+	if halted := ps.halted.Load(); halted != nil {
+		return caddyhttp.Error(http.StatusServiceUnavailable, errors.New(*halted))
+	}
+	if err := c.backoffError(w, ps); err != nil {
+		return err
+	}
+	if c.CGI != nil {
+		if served, err := c.serveCGI(w, r, ps, key); served {
+			return err
+		}
+	}
+	if r, err = c.checkActivation(r, ps); err != nil {
+		return err
+	}
 
+	var lead *coalescedCall
+	var leadKey string
+	leadFailed := true
+	if c.CoalesceColdStart && ps.cold() {
+		var wait *coalescedCall
+		wait, lead, leadKey = ps.coalesce.join(r)
+		if wait != nil {
+			unpark := c.parkRequest(r, ps, key)
+			select {
+			case <-wait.done:
+			case <-r.Context().Done():
+				unpark()
+				return r.Context().Err()
+			}
+			unpark()
+			if wait.shared {
+				out, release := c.withMountPrefix(&headersDownWriter{ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w}, ps: ps})
+				defer release()
+				return wait.replay(out)
+			}
+			// The response could not be shared; proxy this request itself.
+		}
+		if lead != nil {
+			defer func() { ps.coalesce.finish(leadKey, lead, leadFailed) }()
+		}
+	}
+
+	if err := c.normalizeRequest(r); err != nil {
+		return err
+	}
+	detectedIdle := ps.detectedIdle.Load()
 	ps.incrementRequests(c.logger, key)
-	defer ps.decrementRequests(c.logger, key, time.Duration(c.IdleTimeoutMS)*time.Millisecond)
+	defer func() {
+		// The cold start this request waited for may have set the key's own
+		// idle timeout.
+		if ps.detectedIdle.Load() != detectedIdle {
+			if d, err := c.idleTimeoutFor(r, ps); err == nil {
+				idleTimeout = d
+			}
+		}
+		ps.decrementRequests(c.logger, key, idleTimeout, extendIdle)
+	}()
 
 	if c.reverseProxy == nil {
 		return fmt.Errorf("reverse proxy not initialized")
 	}
 
-	return c.reverseProxy.ServeHTTP(w, r, next)
+	queueStart := time.Now()
+	release, err := c.acquireSlot(r.Context(), ps, c.processKeyName(key))
+	if err != nil {
+		recordError(r, err)
+		c.shedLoad(w, c.processKeyName(key), err)
+		return err
+	}
+	defer release()
+	tr.step("queue", queueStart, "")
+
+	c.hintIdle(r.Header, idleTimeout)
+	r = withProcessState(r, ps)
+	hw := &headersDownWriter{ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w}, ps: ps}
+	r = withColdStartHint(r, hw, c.ColdStartHint)
+	out, releaseBody := c.withMountPrefix(hw)
+	if lead != nil {
+		out = &recorder{ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: out}, call: lead, ownCookie: c.ownCookie(key)}
+	}
+	proxyStart := time.Now()
+	err = c.reverseProxy.ServeHTTP(out, r, next)
+	releaseBody()
+	leadFailed = err != nil
+	if tr != nil {
+		tr.step("proxy", proxyStart, "")
+		return c.finishTrace(hw, r, tr, key, err)
+	}
+	return err
 }
 
 func (c *ReverseBin) getProcessKey(r *http.Request) string {
-	if len(c.DynamicProxyDetector) == 0 {
+	keyedByApp := len(c.Apps) > 0 || c.ProvisionAsk != ""
+	if c.detector == nil && !keyedByApp {
 		return ""
 	}
-	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
-	var sb strings.Builder
-	for i, arg := range c.DynamicProxyDetector {
-		if i > 0 {
-			sb.WriteByte(' ')
-		}
-		sb.WriteString(repl.ReplaceAll(arg, ""))
+	if c.KeyJWTClaim != "" {
+		return c.jwtClaimKey(r)
+	}
+	if key, ok := c.ruleKey(r); ok {
+		return key
 	}
-	return sb.String()
+	if keyedByApp {
+		return c.appKey(r)
+	}
+	return c.detector.Key(r)
 }
 
 // GetUpstreams implements reverseproxy.UpstreamSource which allows dynamic selection of backend process
@@ -81,30 +213,155 @@ func (c *ReverseBin) getProcessKey(r *http.Request) string {
 // request that triggers a process start, the request tracking must be initialized here
 // to ensure the idle timer starts correctly after the first request completes.
 func (c *ReverseBin) GetUpstreams(r *http.Request) ([]*reverseproxy.Upstream, error) {
-	c.logger.Debug("GetUpstreams", zap.String("uri", r.RequestURI))
-	key := c.getProcessKey(r)
-	ps := c.getOrCreateProcessState(key)
+	if ce := c.logger.Check(zap.DebugLevel, "GetUpstreams"); ce != nil {
+		ce.Write(zap.String("uri", r.RequestURI))
+	}
+	// ServeHTTP already derived the key; only requests reaching the proxy
+	// some other way derive it again.
+	ps := processStateFrom(r)
+	if ps == nil {
+		ps = c.getOrCreateProcessState(c.getProcessKey(r))
+	}
+	if route := ps.warm.Load(); route != nil {
+		c.prepareUpstreamHeaders(r.Header, route.headersUp)
+		if route.host != "" {
+			r.Host = route.host
+		}
+		return route.upstreams, nil
+	}
+	key := ps.key
 
+	upstreamStart := time.Now()
 	toAddr, err := c.ensureProcessRunningAndResolveUpstream(r, ps, key)
+	if err != nil {
+		recordError(r, err)
+		return nil, err
+	}
+
+	upstreams, err := ps.upstreamsFor(r.Context(), toAddr, c.fastPathEligible())
 	if err != nil {
 		return nil, err
 	}
 
+	// r is the request the proxy is about to send upstream, so detector
+	// headers set here reach only this key's backend.
+	c.prepareUpstreamHeaders(r.Header, ps.headersUp())
+	if host := ps.upstreamHost(); host != "" {
+		r.Host = host
+	}
+
+	if ce := c.logger.Check(zap.DebugLevel, "selected upstream"); ce != nil {
+		ce.Write(zap.String("dial", upstreams[0].Dial))
+	}
+	traceFrom(r).step("upstream", upstreamStart, upstreams[0].Dial)
+	return upstreams, nil
+}
+
+// upstreamsFor returns the upstream list for toAddr, resolving the dial
+// address only when toAddr changes or a named upstream was unpinned. Like
+// Caddy's own dynamic upstream sources, the same slice is handed to every
+// request. With publish, the list also becomes the key's warm route. Names
+// are resolved without holding ps.mu, for no longer than ctx allows.
+func (ps *processState) upstreamsFor(ctx context.Context, toAddr string, publish bool) ([]*reverseproxy.Upstream, error) {
+	ps.mu.Lock()
+	if ps.upstreams != nil && ps.upstreamsAddr == toAddr {
+		defer ps.mu.Unlock()
+		if publish {
+			ps.publishWarmLocked()
+		}
+		return ps.upstreams, nil
+	}
+	pinned := ps.pinned
+	if ps.upstreamsAddr != toAddr {
+		pinned = ""
+	}
+	ps.mu.Unlock()
+
 	dialAddr, err := resolveDialAddress(toAddr)
 	if err != nil {
 		return nil, err
 	}
+	if pinned == "" {
+		pinned = pinDialAddress(ctx, dialAddr)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
 
-	c.logger.Debug("selected upstream", zap.String("dial", dialAddr))
-	return []*reverseproxy.Upstream{{Dial: dialAddr}}, nil
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	// Another request may have resolved toAddr meanwhile.
+	if ps.upstreams == nil || ps.upstreamsAddr != toAddr {
+		ps.pinned = pinned
+		ps.upstreams = []*reverseproxy.Upstream{{Dial: pinned}}
+		ps.upstreamsAddr = toAddr
+	}
+	if publish {
+		ps.publishWarmLocked()
+	}
+	return ps.upstreams, nil
 }
 
 func (c *ReverseBin) ensureProcessRunningAndResolveUpstream(r *http.Request, ps *processState, key string) (string, error) {
+	defer c.parkRequest(r, ps, key)()
+	// A request arriving during a cold start waits for it and takes its
+	// outcome, rather than running the detector and a start once more.
+	seen := ps.coldStarts.Load()
+	joined := ps.starting.Load()
+	if joined {
+		if ce := c.logger.Check(zap.DebugLevel, "waiting for the cold start in progress"); ce != nil {
+			ce.Write(zap.String("key", c.processKeyName(key)))
+		}
+	}
+	// The gate serializes upstream resolution per key and is held for the
+	// whole of a cold start; waiting for it, unlike for ps.mu, honours the
+	// request context.
+	select {
+	case ps.gate <- struct{}{}:
+	case <-r.Context().Done():
+		c.recordStartCancellation(r, key)
+		return "", r.Context().Err()
+	}
 	ps.mu.Lock()
-	defer ps.mu.Unlock()
 
+	needsStart := c.needsStartLocked(ps, key)
+	if needsStart {
+		if err := ps.startErr; joined && err != nil && ps.coldStarts.Load() != seen {
+			ps.mu.Unlock()
+			<-ps.gate
+			if ce := c.logger.Check(zap.DebugLevel, "sharing failure of the cold start the request waited for"); ce != nil {
+				ce.Write(zap.String("key", c.processKeyName(key)), zap.Error(err))
+			}
+			return "", err
+		}
+	}
+	if needsStart && (c.MaxProcesses > 0 || c.GlobalMaxProcesses > 0) && mayActivate(r) {
+		if err := c.evictForStartLocked(ps); err != nil {
+			ps.mu.Unlock()
+			<-ps.gate
+			return "", err
+		}
+		// ps.mu was released, so the backend may have been started meanwhile.
+		needsStart = c.needsStartLocked(ps, key)
+	}
+	if needsStart {
+		return c.coldStart(r, ps, key)
+	}
+	defer func() {
+		ps.mu.Unlock()
+		<-ps.gate
+	}()
+	return c.resolveUpstreamLocked(ps)
+}
+
+// needsStartLocked checks the key's backend, clearing state of one that
+// died, and reports whether a new one must be started.
+func (c *ReverseBin) needsStartLocked(ps *processState, key string) bool {
+	if c.Kubernetes != nil {
+		return ps.scaleDown == nil
+	}
 	if ps.process != nil {
-		if !isProcessAlive(ps.process) {
+		if !ps.process.Alive() {
 			c.handleDeadProcessLocked(ps, key)
 		} else {
 			currentAddr := c.ReverseProxyTo
@@ -114,18 +371,131 @@ func (c *ReverseBin) ensureProcessRunningAndResolveUpstream(r *http.Request, ps
 			if isUnixUpstream(currentAddr) && !isUnixSocketReady(strings.TrimPrefix(currentAddr, "unix/")) {
 				c.logger.Warn("backend process alive but unix socket unavailable; restarting",
 					zap.String("key", key),
-					zap.Int("pid", ps.process.Pid),
+					zap.Int("pid", ps.process.Pid()),
 					zap.String("socket", strings.TrimPrefix(currentAddr, "unix/")))
 				c.handleDeadProcessLocked(ps, key)
 			}
 		}
 	}
-	if ps.process == nil {
-		overrides, err := c.startProcess(r, ps, key)
+	if ps.process == nil && ps.adopted {
+		if ps.overrides == nil || !upstreamReachable(*ps.overrides.ReverseProxyTo) {
+			ps.adopted = false
+		}
+	}
+	return ps.process == nil && !ps.adopted
+}
+
+// sharedFailure reports whether err, failing a start made for r, also fails
+// the requests that waited for that start. Failures owed to the request
+// itself are not shared: its lack of activation rights, a detector refusing
+// it with a 4xx, or its being one of reverse-bin's own requests, which do
+// not run the detector the way a client request would.
+func sharedFailure(r *http.Request, err error) bool {
+	if err == nil || !mayActivate(r) || isInternal(r) {
+		return false
+	}
+	var herr caddyhttp.HandlerError
+	return !errors.As(err, &herr) || herr.StatusCode < 400 || herr.StatusCode >= 500
+}
+
+// coldStart starts the key's backend in the background while holding the
+// gate and ps.mu, which the caller hands over. If r is cancelled first, the
+// request gives up; the start still completes for later requests unless
+// abort_start_on_disconnect is set.
+func (c *ReverseBin) coldStart(r *http.Request, ps *processState, key string) (string, error) {
+	sendColdStartHint(r)
+	startCtx, cancelStart := context.WithCancel(c.ctx)
+	done := make(chan struct{})
+	var addr string
+	var err error
+	ps.starting.Store(true)
+	go func() {
+		defer close(done)
+		defer cancelStart()
+		defer func() {
+			// A start aborted with its request is not a failure to share.
+			ps.startErr = nil
+			if startCtx.Err() == nil && sharedFailure(r, err) {
+				ps.startErr = err
+			}
+			ps.coldStarts.Add(1)
+			ps.starting.Store(false)
+			ps.mu.Unlock()
+			<-ps.gate
+		}()
+		if err = c.startLocked(startCtx, r, ps, key); err == nil {
+			addr, err = c.resolveUpstreamLocked(ps)
+		}
+	}()
+
+	select {
+	case <-done:
+		return addr, err
+	case <-r.Context().Done():
+		c.recordStartCancellation(r, key)
+		if c.AbortStartOnDisconnect {
+			cancelStart()
+		}
+		return "", r.Context().Err()
+	}
+}
+
+// startLocked starts or scales up the key's backend. The caller must hold ps.mu.
+func (c *ReverseBin) startLocked(ctx context.Context, r *http.Request, ps *processState, key string) (err error) {
+	if !mayActivate(r) {
+		return c.activationDenied(key)
+	}
+	// Requests that queued behind a start which flapped must not retry it.
+	if err := c.backoffError(nil, ps); err != nil {
+		return err
+	}
+	// The budget may be kept in remote storage, so ps.mu is released for the
+	// round-trip; the caller's hold on the gate keeps other starts out. The
+	// previous backend, if still being notified of its stop, keeps its
+	// address until it is gone, so that is waited for too.
+	stopping := ps.stopping
+	ps.mu.Unlock()
+	if err := awaitStopped(ctx, stopping); err != nil {
+		ps.mu.Lock()
+		return err
+	}
+	refund, err := c.spendColdStart(ctx, key)
+	ps.mu.Lock()
+	if err != nil {
+		return err
+	}
+	defer func() {
 		if err != nil {
-			return "", err
+			go refund()
 		}
-		ps.overrides = overrides
+	}()
+	c.startedLocked(ps)
+	if c.Kubernetes != nil {
+		err := c.scaleUpLocked(ctx, r, ps, key)
+		ps.failed = err != nil
+		return err
+	}
+	var overrides *Overrides
+	if c.SharedStart {
+		overrides, err = c.startOrAdoptShared(ctx, r, ps, key)
+	} else {
+		overrides, err = c.startProcess(ctx, r, ps, key)
+	}
+	ps.failed = err != nil
+	if err != nil {
+		return err
+	}
+	ps.overrides = overrides
+	ps.setStaticDir(overrides)
+	ps.setDetectedIdle(overrides)
+	return nil
+}
+
+// resolveUpstreamLocked returns the address of the key's running backend and
+// holds off its idle timeout. The caller must hold ps.mu.
+func (c *ReverseBin) resolveUpstreamLocked(ps *processState) (string, error) {
+	if err := c.ensureTransportLocked(ps); err != nil {
+		return "", err
 	}
 
 	if ps.idleTimer != nil {
@@ -143,9 +513,12 @@ func (c *ReverseBin) ensureProcessRunningAndResolveUpstream(r *http.Request, ps
 func (c *ReverseBin) handleDeadProcessLocked(ps *processState, key string) {
 	c.logger.Warn("detected dead backend process before proxying; restarting",
 		zap.String("key", key),
-		zap.Int("pid", ps.process.Pid))
+		zap.Int("pid", ps.process.Pid()))
 	ps.process = nil
 	ps.cancel = nil
+	ps.preStop = nil
+	ps.failed = true
+	ps.warm.Store(nil)
 
 	staleAddr := c.ReverseProxyTo
 	if ps.overrides != nil && ps.overrides.ReverseProxyTo != nil {
@@ -179,9 +552,30 @@ func resolveDialAddress(toAddr string) (string, error) {
 	if target.Host == "" {
 		return "", fmt.Errorf("invalid reverse_proxy_to address: missing host")
 	}
+	// IPv6 literals must be bracketed, e.g. [::1]:8080; "::1:8080" is ambiguous.
+	if _, _, err := net.SplitHostPort(target.Host); err != nil && strings.Count(target.Host, ":") > 1 {
+		return "", fmt.Errorf("invalid reverse_proxy_to address %q: bracket IPv6 literals, e.g. [::1]:8080", target.Host)
+	}
 	return target.Host, nil
 }
 
+// withLoopback completes a port-only address such as ":8080" with the
+// preferred loopback host: 127.0.0.1, or [::1] with loopback ipv6.
+func (c *ReverseBin) withLoopback(addr string) string {
+	if !strings.HasPrefix(addr, ":") {
+		return addr
+	}
+	return net.JoinHostPort(c.loopbackHost(), strings.TrimPrefix(addr, ":"))
+}
+
+// loopbackHost is the address backends on this host are reached at.
+func (c *ReverseBin) loopbackHost() string {
+	if c.Loopback == "ipv6" {
+		return "::1"
+	}
+	return "127.0.0.1"
+}
+
 func isUnixSocketReady(socketPath string) bool {
 	info, err := os.Stat(socketPath)
 	if err != nil {
@@ -190,7 +584,7 @@ func isUnixSocketReady(socketPath string) bool {
 	return info.Mode()&os.ModeSocket != 0
 }
 
-func (c *ReverseBin) killProcessGroup(proc *os.Process) {
+func killProcessGroup(proc *os.Process) {
 	if proc == nil {
 		return
 	}
@@ -202,6 +596,14 @@ func (c *ReverseBin) killProcessGroup(proc *os.Process) {
 	}
 }
 
+// signalProcessGroup sends sig to the process group led by proc.
+func signalProcessGroup(proc *os.Process, sig syscall.Signal) error {
+	if runtime.GOOS == "windows" {
+		return proc.Signal(sig)
+	}
+	return syscall.Kill(-proc.Pid, sig)
+}
+
 func isProcessAlive(proc *os.Process) bool {
 	if proc == nil {
 		return false
@@ -242,67 +644,76 @@ func isZombiePID(pid int) bool {
 	return state == 'Z'
 }
 
-type proxyOverrides struct {
-	Executable       *[]string `json:"executable"`
-	WorkingDirectory *string   `json:"working_directory"`
-	Envs             *[]string `json:"envs"`
-	ReverseProxyTo   *string   `json:"reverse_proxy_to"`
-	ReadinessMethod  *string   `json:"readiness_method"`
-	ReadinessPath    *string   `json:"readiness_path"`
+// Overrides are the backend settings a detector returns for a process key.
+// Unset fields fall back to the handler configuration; the JSON form is what
+// an exec detector prints.
+type Overrides struct {
+	Executable       *[]string         `json:"executable"`
+	WorkingDirectory *string           `json:"working_directory"`
+	Envs             *[]string         `json:"envs"`
+	ReverseProxyTo   *string           `json:"reverse_proxy_to"`
+	ReadinessMethod  *string           `json:"readiness_method"`
+	ReadinessPath    *string           `json:"readiness_path"`
+	ReadinessStatus  *[]int            `json:"readiness_status"`
+	HostRewrite      *string           `json:"host_rewrite"`
+	HeadersUp        map[string]string `json:"headers_up"`
+	HeadersDown      map[string]string `json:"headers_down"`
+	UpstreamTLS      *UpstreamTLS      `json:"upstream_tls"`
+	Transport        *TransportConfig  `json:"transport"`
+	StaticDir        *string           `json:"static_dir"`
+	IdleTimeoutMS    *int              `json:"idle_timeout_ms"`
 }
 
-func (c *ReverseBin) startProcess(r *http.Request, ps *processState, key string) (*proxyOverrides, error) {
-	overrides := new(proxyOverrides)
-	// If a dynamic proxy detector is configured, execute it to determine
-	// the specific parameters (executable, args, env, etc.) for the backend
-	// process based on the request context.
-	if len(c.DynamicProxyDetector) > 0 {
-		args := strings.Split(key, " ")
-
-		c.logger.Debug("running dynamic proxy detector",
-			zap.String("command", args[0]),
-			zap.Strings("args", args[1:]))
-
-		// Use a timeout for the detector to prevent hanging the request indefinitely
-		detCtx, detCancel := context.WithTimeout(c.ctx, 10*time.Second)
-		defer detCancel()
-
-		detectorCmd := exec.CommandContext(detCtx, args[0], args[1:]...)
-
-		configureDetectorProcAttrs(detectorCmd)
-
-		var outBuf, errBuf bytes.Buffer
-		detectorCmd.Stdout = &outBuf
-		detectorCmd.Stderr = &errBuf
-
-		err := detectorCmd.Run()
-
-		if errBuf.Len() > 0 {
-			c.logger.Info("dynamic proxy detector stderr",
-				zap.String("stderr", errBuf.String()))
-		}
-
-		if detCtx.Err() == context.DeadlineExceeded {
-			return nil, fmt.Errorf("dynamic proxy detector timed out")
+func (c *ReverseBin) startProcess(ctx context.Context, r *http.Request, ps *processState, key string) (*Overrides, error) {
+	// A warm-up from the admin API carries no request to run the detector
+	// on; it restarts the key with the settings of its last start.
+	if r.Header.Get(internalHeader) == "warm" && c.detector != nil && c.Apps[key] == nil && ps.overrides != nil {
+		return c.spawnProcess(ctx, ps, key, ps.overrides, traceFrom(r))
+	}
+	overrides, err := c.resolveOverrides(r, key)
+	if err != nil {
+		return nil, err
+	}
+	started, err := c.spawnProcess(ctx, ps, key, overrides, traceFrom(r))
+	if err != nil && c.DetectorCache != nil && ctx.Err() == nil {
+		// A cached result may be what keeps the backend from starting.
+		base, _ := c.splitInstance(key)
+		base, _ = c.splitVariant(base)
+		if c.Apps[base] == nil && c.provisionedOverrides(base) == nil {
+			c.forgetDetected(context.Background(), base)
 		}
+	}
+	return started, err
+}
 
+// resolveOverrides runs the dynamic proxy detector, if any, and fills every
+// setting it left unset from the handler configuration.
+func (c *ReverseBin) resolveOverrides(r *http.Request, key string) (*Overrides, error) {
+	key, instance := c.splitInstance(key)
+	key, variant := c.splitVariant(key)
+	overrides := new(Overrides)
+	// If a dynamic proxy detector is configured, execute it to determine
+	// the specific parameters (executable, args, env, etc.) for the backend
+	// process based on the request context. Inline apps take precedence.
+	if app, ok := c.Apps[key]; ok {
+		overrides = app.overrides()
+	} else if o := c.provisionedOverrides(key); o != nil {
+		copied := *o
+		overrides = &copied
+	} else if c.detector != nil {
+		detected, err := c.detect(r, key)
 		if err != nil {
-			return nil, fmt.Errorf("dynamic proxy detector failed: %v\nOutput: %s", err, outBuf.String())
+			return nil, err
 		}
-
-		if err := json.Unmarshal(outBuf.Bytes(), overrides); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal detector output: %v\nOutput: %s", err, outBuf.String())
+		if detected != nil {
+			overrides = detected
 		}
 	}
-	var execPath string
-	var execArgs []string
-
-	if overrides.Executable != nil && len(*overrides.Executable) > 0 {
-		execPath = (*overrides.Executable)[0]
-		execArgs = (*overrides.Executable)[1:]
-	} else if len(c.Executable) > 0 {
-		execPath = c.Executable[0]
-		execArgs = c.Executable[1:]
+	if variant != nil {
+		overrides.overlay(variant.Backend.overrides())
+	}
+	if overrides.Executable == nil || len(*overrides.Executable) == 0 {
+		overrides.Executable = &c.Executable
 	}
 	if overrides.WorkingDirectory == nil {
 		overrides.WorkingDirectory = &c.WorkingDirectory
@@ -313,16 +724,71 @@ func (c *ReverseBin) startProcess(r *http.Request, ps *processState, key string)
 	if overrides.ReverseProxyTo == nil {
 		overrides.ReverseProxyTo = &c.ReverseProxyTo
 	}
+	if c.copies() > 0 {
+		overrides = overrides.replacing(instancePlaceholder, strconv.Itoa(instance))
+	}
+	if addr := c.withLoopback(*overrides.ReverseProxyTo); addr != *overrides.ReverseProxyTo {
+		overrides.ReverseProxyTo = &addr
+	}
 	if overrides.ReadinessMethod == nil {
 		overrides.ReadinessMethod = &c.ReadinessMethod
 	}
 	if overrides.ReadinessPath == nil {
 		overrides.ReadinessPath = &c.ReadinessPath
 	}
+	if overrides.ReadinessStatus == nil {
+		overrides.ReadinessStatus = &c.ReadinessStatus
+	}
+	if overrides.HostRewrite == nil {
+		overrides.HostRewrite = &c.HostRewrite
+	}
 
-	if !isUnixUpstream(*overrides.ReverseProxyTo) && !readinessConfigured(*overrides.ReadinessMethod, *overrides.ReadinessPath) {
+	if c.Kubernetes == nil && len(*overrides.Executable) == 0 {
+		return nil, fmt.Errorf("no executable configured for process key %q", key)
+	}
+	if *overrides.ReverseProxyTo == "" {
+		return nil, fmt.Errorf("no reverse_proxy_to configured for process key %q", key)
+	}
+	if !isUnixUpstream(*overrides.ReverseProxyTo) && c.UpstreamFrom == nil && !readinessConfigured(*overrides.ReadinessMethod, *overrides.ReadinessPath) {
 		return nil, fmt.Errorf("readiness_check is required for non-unix reverse_proxy_to targets")
 	}
+	return overrides, nil
+}
+
+// spawnProcess starts the backend described by overrides and waits for it to
+// become ready or ctx to end. The caller must hold ps.mu.
+func (c *ReverseBin) spawnProcess(ctx context.Context, ps *processState, key string, overrides *Overrides, tr *requestTrace) (*Overrides, error) {
+	if len(c.WaitFor) > 0 {
+		waitStart := time.Now()
+		if err := c.waitForDependencies(ctx, key); err != nil {
+			tr.step("wait_for", waitStart, err.Error())
+			return nil, err
+		}
+		tr.step("wait_for", waitStart, "available")
+	}
+	// A fresh transport per start leaves no pooled connections to a previous
+	// process on the same address.
+	transport, err := c.newKeyTransport(overrides)
+	if err != nil {
+		return nil, err
+	}
+	ps.setTransportLocked(transport)
+
+	upstreamTLS := c.UpstreamTLS
+	if overrides.UpstreamTLS != nil {
+		upstreamTLS = overrides.UpstreamTLS
+	}
+	var readinessTLS *tls.Config
+	if upstreamTLS != nil {
+		cfg, err := upstreamTLS.clientConfig()
+		if err != nil {
+			return nil, err
+		}
+		if overrides.HostRewrite != nil && *overrides.HostRewrite != "" {
+			cfg.ServerName = serverName(*overrides.HostRewrite)
+		}
+		readinessTLS = cfg
+	}
 
 	if isUnixUpstream(*overrides.ReverseProxyTo) {
 		socketPath := strings.TrimPrefix(*overrides.ReverseProxyTo, "unix/")
@@ -331,75 +797,144 @@ func (c *ReverseBin) startProcess(r *http.Request, ps *processState, key string)
 		}
 	}
 
-	ctx, cancel := context.WithCancel(c.ctx)
-	cmd := exec.CommandContext(ctx, execPath, execArgs...)
-	configureBackendProcAttrs(cmd)
-	cmd.Dir = *overrides.WorkingDirectory
-	if cmd.Dir == "" {
-		cmd.Dir = "."
+	var port int
+	if c.PortRange != nil {
+		if port, err = c.allocatePort(ps); err != nil {
+			return nil, err
+		}
+		overrides = overrides.withPort(port)
 	}
 
-	var cmdEnv []string
-	if c.PassAll {
-		cmdEnv = os.Environ()
-	} else {
-		for _, key := range c.PassEnvs {
-			if val, ok := os.LookupEnv(key); ok {
-				cmdEnv = append(cmdEnv, key+"="+val)
+	if c.InitLock != nil {
+		lockStart := time.Now()
+		unlock, err := c.InitLock.acquire(ctx, *overrides.WorkingDirectory)
+		if err != nil {
+			tr.step("init_lock", lockStart, err.Error())
+			if port != 0 {
+				c.releasePort(ps, port)
 			}
+			return nil, err
 		}
+		tr.step("init_lock", lockStart, c.InitLock.Path)
+		defer unlock()
 	}
-	cmdEnv = append(cmdEnv, *overrides.Envs...)
-	cmd.Env = cmdEnv
 
-	// Set up output capturing before starting the process to ensure no output is missed.
-	// We use a dummy PID placeholder until the process starts and we get the real one.
-	stdoutPipe, err := cmd.StdoutPipe()
-	if err != nil {
-		cancel()
-		return nil, err
-	}
-	stderrPipe, err := cmd.StderrPipe()
-	if err != nil {
-		cancel()
-		return nil, err
+	var announcement *portAnnouncement
+	if c.UpstreamFrom != nil {
+		if announcement, err = c.UpstreamFrom.listen(*overrides.WorkingDirectory); err != nil {
+			return nil, err
+		}
 	}
 
-	var wg sync.WaitGroup
-	wg.Add(2)
+	env := append(c.baseEnv(), c.keepAliveEnv()...)
+	if c.DataDir != nil {
+		dataEnv, err := c.DataDir.prepare(c.dataDirName(key))
+		if err != nil {
+			if port != 0 {
+				c.releasePort(ps, port)
+			}
+			return nil, err
+		}
+		env = append(env, dataEnv...)
+	}
+	if c.BackendCert != nil {
+		certEnv, err := c.BackendCert.issue(c.processKeyName(key))
+		if err != nil {
+			if port != 0 {
+				c.releasePort(ps, port)
+			}
+			return nil, err
+		}
+		env = append(env, certEnv...)
+	}
+	spec := ProcessSpec{
+		Key:              key,
+		Executable:       c.wrapExecutable(*overrides.Executable),
+		WorkingDirectory: *overrides.WorkingDirectory,
+		Env:              append(env, *overrides.Envs...),
+		ReverseProxyTo:   *overrides.ReverseProxyTo,
+		Output: func(pid int, stream, text string) {
+			ps.output.write(c.logger, pid, stream, text)
+			if announcement != nil {
+				announcement.line(stream, text)
+			}
+			c.keepAliveLine(ps, pid, stream, text)
+		},
+	}
 
-	if err := cmd.Start(); err != nil {
+	// Backends outlive the configuration's context so that a reload can hand
+	// them to an identical handler; Cleanup stops the others.
+	procCtx, cancel := context.WithCancel(context.Background())
+	var proc Process
+	var exited <-chan error
+	var cgroup *backendCgroup
+	started := c.clock().Now()
+	if c.Runner != nil {
+		proc, exited, err = c.Runner.Start(procCtx, spec)
+	} else {
+		proc, exited, cgroup, err = c.startExec(procCtx, spec)
+	}
+	if err != nil {
 		cancel()
-		c.logger.Error("failed to start proxy subprocess",
-			zap.String("executable", cmd.Path),
-			zap.Strings("args", cmd.Args),
-			zap.Error(err))
-		return nil, err
+		if port != 0 {
+			c.releasePort(ps, port)
+		}
+		fields := []zap.Field{zap.Strings("executable", spec.Executable), zap.Error(err)}
+		if needsSpawnDiagnostics(err) {
+			fields = append(fields, spawnDiagnostics(spec)...)
+		}
+		c.logger.Error("failed to start proxy subprocess", fields...)
+		return nil, fmt.Errorf("%w: %w", ErrSpawnFailed, err)
 	}
-	ps.process = cmd.Process
+	ps.process = proc
 	ps.cancel = cancel
-	pid := ps.process.Pid
+	pid := proc.Pid()
+	ps.transportPID = pid
+	ps.observe(pid, BackendStarting)
 
 	c.logger.Info("started proxy subprocess",
 		zap.Int("pid", pid),
-		zap.String("executable", cmd.Path),
-		zap.Strings("args", cmd.Args))
+		zap.Strings("executable", spec.Executable))
+	tr.step("spawn", started, fmt.Sprintf("pid %d", pid))
 
-	logPipe := func(pipe io.ReadCloser, label string) {
-		defer wg.Done()
-		scanner := bufio.NewScanner(pipe)
-		for scanner.Scan() {
-			c.logger.Info("", zap.Int("pid", pid), zap.String(label, scanner.Text()))
+	// The backend's address is only known once it announces its port, and
+	// the wait counts against the readiness timeout.
+	timeout := c.readinessTimeoutLocked(ps)
+	var announceErr error
+	if announcement != nil {
+		announceStart, waitStart := time.Now(), c.clock().Now()
+		var announced int
+		announced, exited, announceErr = c.waitForAnnouncement(ctx, announcement, exited, timeout)
+		if announceErr != nil {
+			tr.step("upstream_from", announceStart, announceErr.Error())
+		} else {
+			tr.step("upstream_from", announceStart, fmt.Sprintf("port %d", announced))
+			overrides = overrides.withUpstreamPort(announced)
+			c.logger.Info("proxy subprocess announced its port",
+				zap.Int("pid", pid),
+				zap.Int("port", announced))
 		}
+		timeout -= c.clock().Now().Sub(waitStart)
 	}
 
-	go logPipe(stdoutPipe, "stdout")
-	go logPipe(stderrPipe, "stderr")
+	svc := c.ServiceRegistry.newRegistration(c.processKeyName(key), *overrides.ReverseProxyTo, pid)
 
 	exitChan := make(chan error, 1)
+	gone := make(chan struct{})
+	if c.PreStop != nil {
+		ps.preStop = c.PreStop.hook(c.logger, proc, *overrides.ReverseProxyTo, readinessTLS, gone)
+	}
+	if _, ok := proc.(osProcess); ok && c.stopGrace() > 0 {
+		ps.awaitExit = awaitExit(gone, c.stopGrace())
+	}
 	go func() {
-		err := cmd.Wait()
-		wg.Wait()
+		err := <-exited
+		// Closed and sent before taking ps.mu, which a pre-stop hook waiting
+		// for the exit and a start waiting for readiness hold.
+		close(gone)
+		exitChan <- err
+		// A reload may have handed the backend to another handler meanwhile.
+		c := ps.handler(c)
 
 		ps.mu.Lock()
 		reason := ps.terminationMsg
@@ -407,116 +942,323 @@ func (c *ReverseBin) startProcess(r *http.Request, ps *processState, key string)
 			reason = "unexpected exit"
 		}
 		ps.terminationMsg = ""
-		if ps.process == cmd.Process {
+		if ps.process == proc {
 			ps.process = nil
+			ps.preStop = nil
+			ps.awaitExit = nil
+			ps.setTransportLocked(nil)
+			ps.failed = reason == "unexpected exit"
+			if !ps.failed {
+				// A stop reverse-bin made ends a series of crashes.
+				ps.crashes = 0
+			} else if c.haltLocked(ps, exitCode(err)) {
+				reason = "exited; kept stopped by restart_policy"
+			} else if c.crashedLocked(ps, c.clock().Now().Sub(started)) {
+				reason = "exited; kept stopped by max_restarts"
+			}
 		}
+		// Reported once the transport is gone, like a stop's draining.
+		ps.observe(pid, BackendExited)
 		ps.mu.Unlock()
 
-		c.logger.Info("proxy subprocess terminated",
-			zap.Int("pid", pid),
-			zap.String("reason", reason),
-			zap.Error(err))
-		exitChan <- err
+		fields := []zap.Field{zap.Int("pid", pid), zap.String("reason", reason), zap.Error(err)}
+		if c.CaptureCore != nil && dumpedCore(err) {
+			if core := c.CaptureCore.collect(c.logger, c.processKeyName(key), pid, spec.WorkingDirectory); core != "" {
+				fields = append(fields, zap.String("core", core))
+			}
+		}
+		c.logger.Info("proxy subprocess terminated", fields...)
+		if c.DataDir != nil {
+			if err := c.DataDir.touch(c.dataDirName(key)); err != nil {
+				c.logger.Warn("failed to mark data_dir as used", zap.String("key", c.processKeyName(key)), zap.Error(err))
+			}
+		}
+		go svc.deregister(c.logger)
+		if port != 0 {
+			c.releasePort(ps, port)
+		}
+		if c.ctx.Err() != nil {
+			// The handler is unloaded, so the ports it kept reserved are
+			// given up now that the backend is gone.
+			releasePorts(ps)
+			c.logger.Debug("released ports of unloaded handler's backend", zap.String("key", c.processKeyName(key)))
+		}
+		if cgroup != nil {
+			if err := cgroup.remove(); err != nil {
+				c.logger.Warn("failed to remove backend cgroup", zap.Int("pid", pid), zap.Error(err))
+			}
+		}
 	}()
 
-	// Readiness check
-	// might be able to use caddy health check here instead https://caddyserver.com/docs/caddyfile/directives/reverse_proxy#active-health-checks
-	expected := *overrides.ReverseProxyTo
-	if strings.HasPrefix(expected, ":") {
-		expected = "127.0.0.1" + expected
+	if announceErr != nil {
+		if (errors.Is(announceErr, ErrReadinessTimeout) || ctx.Err() != nil) && ps.cancel != nil {
+			ps.cancel()
+		}
+		return nil, announceErr
 	}
-	expected = strings.TrimPrefix(expected, "http://")
-	expected = strings.TrimPrefix(expected, "https://")
 
-	readyChan := make(chan bool, 1)
-	if *overrides.ReadinessMethod != "" {
-		scheme := "http"
-		if strings.HasPrefix(*overrides.ReverseProxyTo, "https://") {
-			scheme = "https"
-		}
-
-		var checkURL string
-		var client *http.Client
-
-		if strings.HasPrefix(*overrides.ReverseProxyTo, "unix/") {
-			socketPath := strings.TrimPrefix(*overrides.ReverseProxyTo, "unix/")
-			// For unix sockets, the host in the URL is ignored by the custom dialer
-			checkURL = fmt.Sprintf("%s://localhost%s", scheme, *overrides.ReadinessPath)
-			client = &http.Client{
-				Timeout: 500 * time.Millisecond,
-				Transport: &http.Transport{
-					DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
-						return net.Dial("unix", socketPath)
-					},
-				},
+	readyStart := time.Now()
+	if err := c.waitForReadiness(ctx, overrides, readinessTLS, exitChan, timeout); err != nil {
+		tr.step("readiness", readyStart, err.Error())
+		if (errors.Is(err, ErrReadinessTimeout) || ctx.Err() != nil) && ps.cancel != nil {
+			ps.cancel()
+		}
+		return nil, err
+	}
+	tr.step("readiness", readyStart, readinessAddress(*overrides.ReverseProxyTo))
+	if c.BindCheck != "" {
+		checkStart := time.Now()
+		// Dialing the host's addresses needs no ps.mu; the caller's hold on
+		// the gate keeps other starts of the key out meanwhile.
+		ps.mu.Unlock()
+		err := c.checkBind(key, pid, *overrides.ReverseProxyTo)
+		ps.mu.Lock()
+		if err != nil {
+			tr.step("bind_check", checkStart, err.Error())
+			if ps.process == proc && ps.cancel != nil {
+				// Stopped by reverse-bin, so not counted as a crash.
+				ps.terminationMsg = "reachable beyond loopback (bind_check enforce)"
+				ps.cancel()
 			}
-		} else {
-			checkURL = fmt.Sprintf("%s://%s%s", scheme, expected, *overrides.ReadinessPath)
-			client = &http.Client{Timeout: 500 * time.Millisecond}
+			return nil, err
+		}
+	}
+	if c.MinStableTimeMS > 0 {
+		stableStart := time.Now()
+		if err := c.waitStableLocked(ctx, ps, key, pid, gone); err != nil {
+			tr.step("min_stable_time", stableStart, err.Error())
+			if ctx.Err() != nil && ps.cancel != nil {
+				ps.cancel()
+			}
+			return nil, err
 		}
+		tr.step("min_stable_time", stableStart, "stable")
+	}
+	// Named upstreams are resolved now, while the backend is known to be up.
+	if dialAddr, err := resolveDialAddress(*overrides.ReverseProxyTo); err == nil {
+		ps.pinned = pinDialAddress(ctx, dialAddr)
+		ps.upstreams = nil
+	}
+	startup := c.clock().Now().Sub(started)
+	c.recordStartupLocked(ps, key, startup)
+	ps.observe(pid, BackendReady)
+	ps.ramp.begin(c.clock().Now())
+	c.logger.Info("reverse proxy process ready",
+		zap.Int("pid", pid),
+		zap.String("address", readinessAddress(*overrides.ReverseProxyTo)),
+		zap.Duration("startup", startup))
+	go svc.register(c.logger)
+	if c.LivenessCheck != nil {
+		go c.watchLiveness(ps, pid, overrides, readinessTLS, gone)
+	}
+	if c.MaxLifetime != nil {
+		go c.watchLifetime(ps, pid, gone)
+	}
+	if c.RestartRSSAboveBytes > 0 {
+		go c.watchRSS(ps, pid, gone)
+	}
+	if cgroup != nil && c.CPULimit.StartupBurst > 0 {
+		if err := cgroup.setCPUMax(c.CPULimit.Max); err != nil {
+			c.logger.Warn("failed to tighten cpu limit after startup", zap.Int("pid", pid), zap.Error(err))
+		}
+	}
+	return overrides, nil
+}
+
+// baseEnv returns the environment every backend of the handler gets, before
+// that of its key.
+func (c *ReverseBin) baseEnv() []string {
+	var env []string
+	if c.PassAll {
+		env = os.Environ()
+	} else {
+		for _, key := range c.PassEnvs {
+			if val, ok := os.LookupEnv(key); ok {
+				env = append(env, key+"="+val)
+			}
+		}
+	}
+	if c.BindCheck != "" {
+		env = append(env, "REVERSE_BIN_HOST="+c.loopbackHost())
+	}
+	return env
+}
+
+// startExec runs spec as a child process group, inside its own cgroup when
+// cpu_limit is configured.
+func (c *ReverseBin) startExec(ctx context.Context, spec ProcessSpec) (Process, <-chan error, *backendCgroup, error) {
+	var execPath string
+	var execArgs []string
+	if len(spec.Executable) > 0 {
+		execPath = spec.Executable[0]
+		execArgs = spec.Executable[1:]
+	}
+	if c.Filesystem != nil {
+		var err error
+		if execPath, execArgs, err = c.Filesystem.wrap(execPath, execArgs, c.writableDirs(spec)); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	cmd := exec.CommandContext(ctx, execPath, execArgs...)
+	configureBackendProcAttrs(cmd)
+	if c.Filesystem != nil {
+		if err := c.Filesystem.attach(cmd); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	groupKill := c.KillMode != "process"
+	grace, stopSignal := c.stopGrace(), c.stopSignal()
+	waited := make(chan struct{})
+	var following *atomic.Bool
+	cmd.Cancel = func() error {
+		osProcess{cmd.Process, groupKill, grace, stopSignal, waited, following}.Kill()
+		return nil
+	}
+	var cgroup *backendCgroup
+	if c.CPULimit != nil {
+		cg, err := newBackendCgroup(c.CPULimit.CgroupParent)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if err := cg.setCPUMax(c.CPULimit.startupQuota()); err != nil {
+			_ = cg.remove()
+			return nil, nil, nil, fmt.Errorf("failed to set startup cpu limit: %v", err)
+		}
+		cg.attach(cmd)
+		cgroup = cg
+	}
+	cmd.Dir = spec.WorkingDirectory
+	if cmd.Dir == "" {
+		cmd.Dir = "."
+	}
+	cmd.Env = spec.Env
+
+	// Set up output capturing before starting the process to ensure no output is missed.
+	stdoutPipe, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	stderrPipe, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		if cgroup != nil {
+			_ = cgroup.remove()
+		}
+		return nil, nil, nil, err
+	}
+	pid := cmd.Process.Pid
+	if c.FollowReexec {
+		following = new(atomic.Bool)
+		following.Store(true)
+	}
+	proc := osProcess{cmd.Process, groupKill, grace, stopSignal, waited, following}
+	if c.CaptureCore != nil {
+		if err := setCoreLimit(pid, c.CaptureCore.limit()); err != nil {
+			c.logger.Warn("failed to enable core dumps for backend", zap.Int("pid", pid), zap.Error(err))
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	logPipe := func(pipe io.ReadCloser, label string) {
+		defer wg.Done()
+		scanner := bufio.NewScanner(pipe)
+		for scanner.Scan() {
+			spec.Output(pid, label, scanner.Text())
+		}
+	}
+	go logPipe(stdoutPipe, "stdout")
+	go logPipe(stderrPipe, "stderr")
+
+	exited := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		if following != nil {
+			c.followReexec(ctx, spec, proc, cgroup)
+			following.Store(false)
+		}
+		close(waited)
+		wg.Wait()
+		exited <- err
+	}()
+	return proc, exited, cgroup, nil
+}
+
+// readinessAddress is the host:port readiness checks connect to for addr.
+func readinessAddress(addr string) string {
+	if strings.HasPrefix(addr, ":") {
+		addr = "127.0.0.1" + addr
+	}
+	addr = strings.TrimPrefix(addr, "http://")
+	return strings.TrimPrefix(addr, "https://")
+}
+
+// waitForReadiness polls the backend described by overrides until it is
+// ready, exited reports that it terminated, timeout passes or ctx ends.
+// A nil exited channel is never signalled.
+func (c *ReverseBin) waitForReadiness(ctx context.Context, overrides *Overrides, readinessTLS *tls.Config, exited <-chan error, timeout time.Duration) error {
+	// Readiness check
+	// might be able to use caddy health check here instead https://caddyserver.com/docs/caddyfile/directives/reverse_proxy#active-health-checks
+	expected := readinessAddress(*overrides.ReverseProxyTo)
+
+	// Stop polling once this wait is over, whatever its outcome.
+	pollCtx, stopPolling := context.WithCancel(ctx)
+	defer stopPolling()
+
+	readyChan := make(chan bool, 1)
 
+	if strings.EqualFold(*overrides.ReadinessMethod, readinessGRPC) {
+		c.logger.Info("waiting for reverse proxy process readiness via gRPC health check",
+			zap.String("service", *overrides.ReadinessPath),
+			zap.String("target", *overrides.ReverseProxyTo))
+		probe := grpcProbe(*overrides.ReverseProxyTo, *overrides.ReadinessPath, overrides.upstreamHost(), readinessTLS, "readiness")
+		go c.pollReadiness(pollCtx, 200*time.Millisecond, probe, readyChan)
+	} else if *overrides.ReadinessMethod != "" {
+		var expect []int
+		if overrides.ReadinessStatus != nil {
+			expect = *overrides.ReadinessStatus
+		}
+		checkURL, probe := httpProbe(*overrides.ReverseProxyTo, *overrides.ReadinessMethod, *overrides.ReadinessPath,
+			overrides.upstreamHost(), expect, readinessTLS, "readiness")
 		c.logger.Info("waiting for reverse proxy process readiness via HTTP polling",
 			zap.String("method", *overrides.ReadinessMethod),
 			zap.String("url", checkURL),
 			zap.String("target", *overrides.ReverseProxyTo))
-
-		go func() {
-			ticker := time.NewTicker(200 * time.Millisecond)
-			defer ticker.Stop()
-			for {
-				select {
-				case <-ticker.C:
-					req, _ := http.NewRequest(*overrides.ReadinessMethod, checkURL, nil)
-					resp, err := client.Do(req)
-					if err == nil {
-						_, _ = io.Copy(io.Discard, resp.Body)
-						_ = resp.Body.Close()
-						if resp.StatusCode >= 200 && resp.StatusCode < 400 {
-							readyChan <- true
-							return
-						}
-					}
-				case <-c.ctx.Done():
-					return
-				}
-			}
-		}()
+		go c.pollReadiness(pollCtx, 200*time.Millisecond, probe, readyChan)
 	} else if isUnixUpstream(*overrides.ReverseProxyTo) {
 		socketPath := strings.TrimPrefix(*overrides.ReverseProxyTo, "unix/")
 		c.logger.Info("waiting for reverse proxy process readiness via unix socket creation",
 			zap.String("target", *overrides.ReverseProxyTo))
-		go func() {
-			ticker := time.NewTicker(50 * time.Millisecond)
-			defer ticker.Stop()
-			for {
-				select {
-				case <-ticker.C:
-					info, err := os.Stat(socketPath)
-					if err == nil && info.Mode()&os.ModeSocket != 0 {
-						readyChan <- true
-						return
-					}
-				case <-c.ctx.Done():
-					return
-				}
+		go c.pollReadiness(pollCtx, 50*time.Millisecond, func() bool {
+			info, err := os.Stat(socketPath)
+			return err == nil && info.Mode()&os.ModeSocket != 0
+		}, readyChan)
+	} else if c.UpstreamFrom != nil {
+		c.logger.Info("waiting for reverse proxy process readiness via TCP connect",
+			zap.String("target", *overrides.ReverseProxyTo))
+		go c.pollReadiness(pollCtx, 50*time.Millisecond, func() bool {
+			conn, err := net.DialTimeout("tcp", expected, 500*time.Millisecond)
+			if err != nil {
+				return false
 			}
-		}()
+			_ = conn.Close()
+			return true
+		}, readyChan)
 	} else {
-		return nil, fmt.Errorf("readiness_check is required for non-unix reverse_proxy_to targets")
+		return fmt.Errorf("readiness_check is required for non-unix reverse_proxy_to targets")
 	}
 
 	select {
 	case <-readyChan:
-		c.logger.Info("reverse proxy process ready",
-			zap.Int("pid", pid),
-			zap.String("address", expected))
-		return overrides, nil
-	case err := <-exitChan:
-		return nil, fmt.Errorf("reverse proxy process exited during readiness check: %v", err)
-	case <-time.After(10 * time.Second):
-		if ps.cancel != nil {
-			ps.cancel()
-		}
-		return nil, fmt.Errorf("timeout waiting for reverse proxy process readiness")
+		return nil
+	case err := <-exited:
+		return fmt.Errorf("reverse proxy process exited during readiness check: %v", err)
+	case <-c.clock().After(timeout):
+		return ErrReadinessTimeout
+	case <-ctx.Done():
+		return fmt.Errorf("cold start aborted: %w", ctx.Err())
 	}
 }
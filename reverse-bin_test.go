@@ -2,44 +2,204 @@ package reversebin
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/big"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"go.uber.org/zap"
 	"go.uber.org/zap/zaptest"
 )
 
 type reverseBinConfig struct {
-	Executable           []string
-	WorkingDirectory     string
-	Envs                 []string
-	PassEnvs             []string
-	PassAll              bool
-	ReverseProxyTo       string
-	ReadinessMethod      string
-	ReadinessPath        string
-	DynamicProxyDetector []string
-	IdleTimeoutMS        int
+	Executable            []string
+	ExecPlatforms         map[string][]string
+	ExecWrapper           []string
+	WorkingDirectory      string
+	Envs                  []string
+	PassEnvs              []string
+	PassAll               bool
+	ReverseProxyTo        string
+	ReadinessMethod       string
+	ReadinessPath         string
+	DynamicProxyDetector  []string
+	IdleTimeoutMS         int
+	UpstreamTLS           *UpstreamTLS
+	KeyJWTClaim           string
+	CPULimit              *CPULimit
+	Kubernetes            *KubernetesRuntime
+	ColdStartHint         int
+	Transport             *TransportConfig
+	Apps                  map[string]*App
+	AppKey                string
+	PortRange             *PortRange
+	UpstreamFrom          *UpstreamFrom
+	SlowStartMS           int
+	MinStableTimeMS       int
+	StopTimeoutMS         int
+	StopSignal            string
+	StartTimeoutMS        int
+	ActivationDenyStatus  int
+	MaxColdStarts         *ColdStartBudget
+	ReadinessIntervalMS   int
+	ReadinessBackoffMaxMS int
+	StateFile             *StateFile
+	ReadinessStatus       []int
+	BindCheck             string
+	HostRewrite           string
+	ActiveHours           *ActiveHours
+	IdlePolicy            *IdlePolicy
+	WaitFor               []*WaitFor
+	CrashLoop             *CrashLoop
+	SocketCleanup         *SocketCleanup
+	Prewarm               bool
+	PrewarmKeys           []string
+	FollowReexec          bool
+	Replicas              int
+	MinInstances          int
+	ReplicaPolicy         string
+	BackendKeepAliveMaxMS int
+	MaxLifetime           *MaxLifetime
+	ReplicaAffinity       *ReplicaAffinity
+	RestartRSSAboveBytes  int64
+	MaxInflightPerKey     int
+	QueueTimeoutMS        int
+	QueueSize             int
+	DetectorCache         *DetectorCache
+	KeyRules              []*KeyRule
+	MaxProcesses          int
+	UpstreamRateLimit     *UpstreamRateLimit
+	CompatMode            *CompatMode
+	ProcessStateTTLMS     int
+	ProbeUpstream         bool
+	IdleHintHeader        string
+	CGI                   *CGIMode
+	MaxRestarts           int
+	RestartBackoffMS      int
+	RestartBackoffMaxMS   int
+	LivenessCheck         *LivenessCheck
+	PreStop               *PreStop
+	DataDir               *DataDir
+	UpstreamCompression   string
+	Filesystem            *Filesystem
+	InitLock              *InitLock
+	CaptureCore           *CaptureCore
+	RestartPolicy         string
+	NoRestartCodes        []int
+	DetectorRaw           json.RawMessage
+	Variants              []*Variant
+	BackendCert           *BackendCert
 }
 
 func asConfig(c *ReverseBin) reverseBinConfig {
 	return reverseBinConfig{
-		Executable:           c.Executable,
-		WorkingDirectory:     c.WorkingDirectory,
-		Envs:                 c.Envs,
-		PassEnvs:             c.PassEnvs,
-		PassAll:              c.PassAll,
-		ReverseProxyTo:       c.ReverseProxyTo,
-		ReadinessMethod:      c.ReadinessMethod,
-		ReadinessPath:        c.ReadinessPath,
-		DynamicProxyDetector: c.DynamicProxyDetector,
-		IdleTimeoutMS:        c.IdleTimeoutMS,
+		Executable:            c.Executable,
+		ExecPlatforms:         c.ExecPlatforms,
+		ExecWrapper:           c.ExecWrapper,
+		WorkingDirectory:      c.WorkingDirectory,
+		Envs:                  c.Envs,
+		PassEnvs:              c.PassEnvs,
+		PassAll:               c.PassAll,
+		ReverseProxyTo:        c.ReverseProxyTo,
+		ReadinessMethod:       c.ReadinessMethod,
+		ReadinessPath:         c.ReadinessPath,
+		DynamicProxyDetector:  c.DynamicProxyDetector,
+		IdleTimeoutMS:         c.IdleTimeoutMS,
+		UpstreamTLS:           c.UpstreamTLS,
+		KeyJWTClaim:           c.KeyJWTClaim,
+		CPULimit:              c.CPULimit,
+		Kubernetes:            c.Kubernetes,
+		ColdStartHint:         c.ColdStartHint,
+		Transport:             c.Transport,
+		Apps:                  c.Apps,
+		AppKey:                c.AppKey,
+		PortRange:             c.PortRange,
+		UpstreamFrom:          c.UpstreamFrom,
+		SlowStartMS:           c.SlowStartMS,
+		MinStableTimeMS:       c.MinStableTimeMS,
+		StopTimeoutMS:         c.StopTimeoutMS,
+		StopSignal:            c.StopSignal,
+		StartTimeoutMS:        c.StartTimeoutMS,
+		ActivationDenyStatus:  c.ActivationDenyStatus,
+		MaxColdStarts:         c.MaxColdStarts,
+		ReadinessIntervalMS:   c.ReadinessIntervalMS,
+		ReadinessBackoffMaxMS: c.ReadinessBackoffMaxMS,
+		StateFile:             c.StateFile,
+		ReadinessStatus:       c.ReadinessStatus,
+		BindCheck:             c.BindCheck,
+		HostRewrite:           c.HostRewrite,
+		ActiveHours:           c.ActiveHours,
+		IdlePolicy:            c.IdlePolicy,
+		WaitFor:               c.WaitFor,
+		CrashLoop:             c.CrashLoop,
+		SocketCleanup:         c.SocketCleanup,
+		Prewarm:               c.Prewarm,
+		PrewarmKeys:           c.PrewarmKeys,
+		FollowReexec:          c.FollowReexec,
+		Replicas:              c.Replicas,
+		MinInstances:          c.MinInstances,
+		ReplicaPolicy:         c.ReplicaPolicy,
+		BackendKeepAliveMaxMS: c.BackendKeepAliveMaxMS,
+		MaxLifetime:           c.MaxLifetime,
+		ReplicaAffinity:       c.ReplicaAffinity,
+		RestartRSSAboveBytes:  c.RestartRSSAboveBytes,
+		MaxInflightPerKey:     c.MaxInflightPerKey,
+		QueueTimeoutMS:        c.QueueTimeoutMS,
+		QueueSize:             c.QueueSize,
+		DetectorCache:         c.DetectorCache,
+		KeyRules:              c.KeyRules,
+		MaxProcesses:          c.MaxProcesses,
+		UpstreamRateLimit:     c.UpstreamRateLimit,
+		CompatMode:            c.CompatMode,
+		ProcessStateTTLMS:     c.ProcessStateTTLMS,
+		ProbeUpstream:         c.ProbeUpstream,
+		IdleHintHeader:        c.IdleHintHeader,
+		CGI:                   c.CGI,
+		MaxRestarts:           c.MaxRestarts,
+		RestartBackoffMS:      c.RestartBackoffMS,
+		RestartBackoffMaxMS:   c.RestartBackoffMaxMS,
+		LivenessCheck:         c.LivenessCheck,
+		PreStop:               c.PreStop,
+		DataDir:               c.DataDir,
+		UpstreamCompression:   c.UpstreamCompression,
+		Filesystem:            c.Filesystem,
+		InitLock:              c.InitLock,
+		CaptureCore:           c.CaptureCore,
+		RestartPolicy:         c.RestartPolicy,
+		NoRestartCodes:        c.NoRestartCodes,
+		DetectorRaw:           c.DetectorRaw,
+		Variants:              c.Variants,
+		BackendCert:           c.BackendCert,
 	}
 }
 
@@ -184,6 +344,216 @@ func TestReverseBin_UnmarshalCaddyfile(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "with upstream_tls",
+			input: `reverse-bin {
+  exec ./main.py
+  reverse_proxy_to https://127.0.0.1:8443
+  upstream_tls {
+    client_cert /etc/app/client.pem
+    client_key /etc/app/client-key.pem
+    ca /etc/app/ca.pem
+  }
+}`,
+			expected: reverseBinConfig{
+				Executable:     []string{"./main.py"},
+				ReverseProxyTo: "https://127.0.0.1:8443",
+				UpstreamTLS: &UpstreamTLS{
+					ClientCert: "/etc/app/client.pem",
+					ClientKey:  "/etc/app/client-key.pem",
+					CA:         "/etc/app/ca.pem",
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "with key_jwt_claim",
+			input: `reverse-bin {
+  dynamic_proxy_detector ./discover.py {reverse_bin.key}
+  key_jwt_claim tenant
+}`,
+			expected: reverseBinConfig{
+				DynamicProxyDetector: []string{"./discover.py", "{reverse_bin.key}"},
+				KeyJWTClaim:          "tenant",
+			},
+			wantErr: false,
+		},
+		{
+			name: "with cpu_limit and startup burst",
+			input: `reverse-bin {
+  exec ./main.py
+  reverse_proxy_to unix//tmp/app.sock
+  cpu_limit {
+    cgroup_parent /sys/fs/cgroup/reverse-bin
+    max 0.5
+    startup_cpu_burst 2
+  }
+}`,
+			expected: reverseBinConfig{
+				Executable:     []string{"./main.py"},
+				ReverseProxyTo: "unix//tmp/app.sock",
+				CPULimit: &CPULimit{
+					CgroupParent: "/sys/fs/cgroup/reverse-bin",
+					Max:          0.5,
+					StartupBurst: 2,
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "with cpu_limit only while starting",
+			input: `reverse-bin {
+  exec ./main.py
+  reverse_proxy_to unix//tmp/app.sock
+  cpu_limit {
+    cgroup_parent /sys/fs/cgroup/reverse-bin
+    max 0
+    startup_cpu_burst 2
+  }
+}`,
+			expected: reverseBinConfig{
+				Executable:     []string{"./main.py"},
+				ReverseProxyTo: "unix//tmp/app.sock",
+				CPULimit: &CPULimit{
+					CgroupParent: "/sys/fs/cgroup/reverse-bin",
+					StartupBurst: 2,
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "with kubernetes runtime",
+			input: `reverse-bin {
+  runtime kubernetes {
+    deployment my-app
+    namespace apps
+  }
+  reverse_proxy_to my-app.apps.svc:8080
+  readiness_check GET /health
+}`,
+			expected: reverseBinConfig{
+				ReverseProxyTo:  "my-app.apps.svc:8080",
+				ReadinessMethod: "GET",
+				ReadinessPath:   "/health",
+				Kubernetes:      &KubernetesRuntime{Kind: "deployment", Name: "my-app", Namespace: "apps"},
+			},
+			wantErr: false,
+		},
+		{
+			name: "with cold_start_hint defaulting to early hints",
+			input: `reverse-bin {
+  exec ./main.py
+  reverse_proxy_to unix//tmp/app.sock
+  cold_start_hint
+}`,
+			expected: reverseBinConfig{
+				Executable:     []string{"./main.py"},
+				ReverseProxyTo: "unix//tmp/app.sock",
+				ColdStartHint:  103,
+			},
+			wantErr: false,
+		},
+		{
+			name: "cold_start_hint rejects final status",
+			input: `reverse-bin {
+  exec ./main.py
+  cold_start_hint 200
+}`,
+			expected: reverseBinConfig{},
+			wantErr:  true,
+		},
+		{
+			name: "kill_mode rejects unknown mode",
+			input: `reverse-bin {
+  exec ./main.py
+  kill_mode tree
+}`,
+			expected: reverseBinConfig{},
+			wantErr:  true,
+		},
+		{
+			name: "with transport settings",
+			input: `reverse-bin {
+  exec ./main.py
+  reverse_proxy_to unix//tmp/app.sock
+  transport {
+    versions h2c 2
+    max_conns_per_host 8
+  }
+}`,
+			expected: reverseBinConfig{
+				Executable:     []string{"./main.py"},
+				ReverseProxyTo: "unix//tmp/app.sock",
+				Transport:      &TransportConfig{Versions: []string{"h2c", "2"}, MaxConnsPerHost: 8},
+			},
+			wantErr: false,
+		},
+		{
+			name: "with upstream_compression off",
+			input: `reverse-bin {
+  exec ./main.py
+  reverse_proxy_to unix//tmp/app.sock
+  upstream_compression off
+}`,
+			expected: reverseBinConfig{
+				Executable:          []string{"./main.py"},
+				ReverseProxyTo:      "unix//tmp/app.sock",
+				UpstreamCompression: "off",
+			},
+		},
+		{
+			name: "upstream_compression rejects unknown mode",
+			input: `reverse-bin {
+  upstream_compression gzip
+}`,
+			wantErr: true,
+		},
+		{
+			name: "with inline apps",
+			input: `reverse-bin {
+  app_key {http.request.host.labels.2}
+  app blog {
+    exec ./blog
+    reverse_proxy_to unix//run/blog.sock
+    header_up X-Tenant blog
+  }
+  app shop {
+    exec ./shop --port 9000
+    reverse_proxy_to 127.0.0.1:9000
+    readiness_check get /health
+  }
+}`,
+			expected: reverseBinConfig{
+				AppKey: "{http.request.host.labels.2}",
+				Apps: map[string]*App{
+					"blog": {
+						Executable:     []string{"./blog"},
+						ReverseProxyTo: "unix//run/blog.sock",
+						HeadersUp:      map[string]string{"X-Tenant": "blog"},
+					},
+					"shop": {
+						Executable:      []string{"./shop", "--port", "9000"},
+						ReverseProxyTo:  "127.0.0.1:9000",
+						ReadinessMethod: "GET",
+						ReadinessPath:   "/health",
+					},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "duplicate app is rejected",
+			input: `reverse-bin {
+  app blog {
+    exec ./blog
+  }
+  app blog {
+    exec ./other
+  }
+}`,
+			expected: reverseBinConfig{},
+			wantErr:  true,
+		},
 		{
 			name: "exec requires argument",
 			input: `reverse-bin {
@@ -201,210 +571,5264 @@ func TestReverseBin_UnmarshalCaddyfile(t *testing.T) {
 			expected: reverseBinConfig{},
 			wantErr:  true,
 		},
+		{
+			name: "port_range",
+			input: `reverse-bin {
+  exec ./app --port {reverse_bin.port}
+  port_range 20000-20100
+}`,
+			expected: reverseBinConfig{
+				Executable: []string{"./app", "--port", "{reverse_bin.port}"},
+				PortRange:  &PortRange{First: 20000, Last: 20100},
+			},
+		},
+		{
+			name: "upstream_from stdout",
+			input: `reverse-bin {
+  exec ./app --port 0
+  upstream_from stdout "listening on port (\d+)"
+}`,
+			expected: reverseBinConfig{
+				Executable:   []string{"./app", "--port", "0"},
+				UpstreamFrom: &UpstreamFrom{Source: "stdout", Pattern: `listening on port (\d+)`},
+			},
+		},
+		{
+			name: "upstream_from file",
+			input: `reverse-bin {
+  exec ./app
+  upstream_from file run/port
+}`,
+			expected: reverseBinConfig{
+				Executable:   []string{"./app"},
+				UpstreamFrom: &UpstreamFrom{Source: "file", Path: "run/port"},
+			},
+		},
+		{
+			name: "upstream_from file without path",
+			input: `reverse-bin {
+  upstream_from file
+}`,
+			wantErr: true,
+		},
+		{
+			name: "min_stable_time",
+			input: `reverse-bin {
+  exec ./app
+  min_stable_time 3s
+}`,
+			expected: reverseBinConfig{
+				Executable:      []string{"./app"},
+				MinStableTimeMS: 3000,
+			},
+		},
+		{
+			name: "stop_timeout",
+			input: `reverse-bin {
+  exec ./app
+  stop_timeout 15s
+}`,
+			expected: reverseBinConfig{
+				Executable:    []string{"./app"},
+				StopTimeoutMS: 15000,
+			},
+		},
+		{
+			name: "stop_signal",
+			input: `reverse-bin {
+  exec ./app
+  stop_signal quit
+}`,
+			expected: reverseBinConfig{
+				Executable: []string{"./app"},
+				StopSignal: "SIGQUIT",
+			},
+		},
+		{
+			name: "stop_signal unsupported",
+			input: `reverse-bin {
+  stop_signal SIGSTOP
+}`,
+			wantErr: true,
+		},
+		{
+			name: "exec_wrapper",
+			input: `reverse-bin {
+  exec_wrapper qemu-aarch64 -L /usr/aarch64-linux-gnu
+  exec ./app
+}`,
+			expected: reverseBinConfig{
+				Executable:  []string{"./app"},
+				ExecWrapper: []string{"qemu-aarch64", "-L", "/usr/aarch64-linux-gnu"},
+			},
+		},
+		{
+			name: "start_timeout",
+			input: `reverse-bin {
+  exec ./app
+  start_timeout 2m
+}`,
+			expected: reverseBinConfig{
+				Executable:     []string{"./app"},
+				StartTimeoutMS: 120000,
+			},
+		},
+		{
+			name: "port_range reversed",
+			input: `reverse-bin {
+  port_range 20100-20000
+}`,
+			wantErr: true,
+		},
+		{
+			name: "slow_start",
+			input: `reverse-bin {
+  exec ./app
+  slow_start 10s
+}`,
+			expected: reverseBinConfig{
+				Executable:  []string{"./app"},
+				SlowStartMS: 10000,
+			},
+		},
+		{
+			name: "init_lock with timeout",
+			input: `reverse-bin {
+  exec ./app
+  init_lock .migrate.lock 30s
+}`,
+			expected: reverseBinConfig{
+				Executable: []string{"./app"},
+				InitLock:   &InitLock{Path: ".migrate.lock", TimeoutMS: 30000},
+			},
+		},
+		{
+			name: "init_lock without path",
+			input: `reverse-bin {
+  init_lock
+}`,
+			wantErr: true,
+		},
+		{
+			name: "capture_core with limit and dir",
+			input: `reverse-bin {
+  exec ./app
+  capture_core on {
+    max_mb 256
+    dir /var/crash/app
+  }
+}`,
+			expected: reverseBinConfig{
+				Executable:  []string{"./app"},
+				CaptureCore: &CaptureCore{MaxMB: 256, Dir: "/var/crash/app"},
+			},
+		},
+		{
+			name: "capture_core off",
+			input: `reverse-bin {
+  exec ./app
+  capture_core off
+}`,
+			expected: reverseBinConfig{
+				Executable: []string{"./app"},
+			},
+		},
+		{
+			name: "restart_policy with exit code exceptions",
+			input: `reverse-bin {
+  exec ./worker
+  restart_policy on-failure
+  no_restart_codes 0 143
+}`,
+			expected: reverseBinConfig{
+				Executable:     []string{"./worker"},
+				RestartPolicy:  "on-failure",
+				NoRestartCodes: []int{0, 143},
+			},
+		},
+		{
+			name: "pre_stop request and signal",
+			input: `reverse-bin {
+  exec ./app
+  pre_stop_request post /_shutdown 5s
+  pre_stop_signal term
+}`,
+			expected: reverseBinConfig{
+				Executable: []string{"./app"},
+				PreStop:    &PreStop{Method: "POST", Path: "/_shutdown", Signal: "SIGTERM", TimeoutMS: 5000},
+			},
+		},
+		{
+			name: "pre_stop_signal unknown",
+			input: `reverse-bin {
+  pre_stop_signal SIGKILL
+}`,
+			wantErr: true,
+		},
+		{
+			name: "data_dir with garbage collection",
+			input: `reverse-bin {
+  exec ./app
+  data_dir /var/lib/reverse-bin/{reverse_bin.key} {
+    gc_after 30d
+  }
+}`,
+			expected: reverseBinConfig{
+				Executable: []string{"./app"},
+				DataDir:    &DataDir{Path: "/var/lib/reverse-bin/{reverse_bin.key}", GCAfterMS: 30 * 24 * 3600 * 1000},
+			},
+		},
+		{
+			name: "mount_prefix must be a path",
+			input: `reverse-bin {
+  mount_prefix app1
+}`,
+			wantErr: true,
+		},
+		{
+			name: "readonly filesystem with tmpfs",
+			input: `reverse-bin {
+  exec ./app
+  filesystem readonly {
+    tmpfs /tmp cache
+  }
+}`,
+			expected: reverseBinConfig{
+				Executable: []string{"./app"},
+				Filesystem: &Filesystem{Mode: "readonly", Tmpfs: []string{"/tmp", "cache"}},
+			},
+		},
+		{
+			name: "filesystem rejects unknown mode",
+			input: `reverse-bin {
+  filesystem overlay
+}`,
+			wantErr: true,
+		},
+		{
+			name: "restart_policy unknown",
+			input: `reverse-bin {
+  restart_policy sometimes
+}`,
+			wantErr: true,
+		},
+		{
+			name: "detector module",
+			input: `reverse-bin {
+  detector exec ./detect {path}
+}`,
+			expected: reverseBinConfig{
+				DetectorRaw: json.RawMessage(`{"command":["./detect","{path}"],"detector":"exec"}`),
+			},
+		},
+		{
+			name: "variant",
+			input: `reverse-bin {
+  exec ./prod
+  reverse_proxy_to unix//run/prod.sock
+  variant @staging {
+    exec ./staging
+    reverse_proxy_to unix//run/staging.sock
+  }
+}`,
+			expected: reverseBinConfig{
+				Executable:     []string{"./prod"},
+				ReverseProxyTo: "unix//run/prod.sock",
+				Variants: []*Variant{{
+					Name:        "staging",
+					Backend:     App{Executable: []string{"./staging"}, ReverseProxyTo: "unix//run/staging.sock"},
+					matcherName: "@staging",
+				}},
+			},
+		},
+		{
+			name: "variant without named matcher",
+			input: `reverse-bin {
+  variant staging {
+    exec ./staging
+  }
+}`,
+			wantErr: true,
+		},
+		{
+			name: "backend_cert",
+			input: `reverse-bin {
+  exec ./app
+  backend_cert {
+    dir /run/reverse-bin/certs
+    names {reverse_bin.key}.internal 127.0.0.1
+    lifetime 24h
+  }
+}`,
+			expected: reverseBinConfig{
+				Executable: []string{"./app"},
+				BackendCert: &BackendCert{
+					Dir:        "/run/reverse-bin/certs",
+					Names:      []string{"{reverse_bin.key}.internal", "127.0.0.1"},
+					LifetimeMS: 86400000,
+				},
+			},
+		},
+		{
+			name: "idle_timeout duration",
+			input: `reverse-bin {
+  exec ./main.py
+  idle_timeout 5m
+}`,
+			expected: reverseBinConfig{
+				Executable:    []string{"./main.py"},
+				IdleTimeoutMS: 300000,
+			},
+		},
+		{
+			name: "idle_ignore requires named matchers",
+			input: `reverse-bin {
+  idle_ignore /health
+}`,
+			wantErr: true,
+		},
+		{
+			name: "activation_require with status",
+			input: `reverse-bin {
+  activation_require @authed 402
+}`,
+			expected: reverseBinConfig{
+				ActivationDenyStatus: 402,
+			},
+		},
+		{
+			name: "activation_require requires named matchers",
+			input: `reverse-bin {
+  activation_require /api
+}`,
+			wantErr: true,
+		},
+		{
+			name: "max_cold_starts per day with status",
+			input: `reverse-bin {
+  max_cold_starts 100/day 402
+}`,
+			expected: reverseBinConfig{
+				MaxColdStarts: &ColdStartBudget{Count: 100, PeriodMS: 86400000, Status: 402},
+			},
+		},
+		{
+			name: "max_cold_starts without period",
+			input: `reverse-bin {
+  max_cold_starts 100
+}`,
+			wantErr: true,
+		},
+		{
+			name: "readiness_interval with backoff",
+			input: `reverse-bin {
+  readiness_interval 100ms backoff 2s
+}`,
+			expected: reverseBinConfig{
+				ReadinessIntervalMS:   100,
+				ReadinessBackoffMaxMS: 2000,
+			},
+		},
+		{
+			name: "readiness_interval backoff below interval",
+			input: `reverse-bin {
+  readiness_interval 1s backoff 100ms
+}`,
+			wantErr: true,
+		},
+		{
+			name: "state_file with interval",
+			input: `reverse-bin {
+  state_file /var/lib/node_exporter/reverse_bin.prom 30s
+}`,
+			expected: reverseBinConfig{
+				StateFile: &StateFile{Path: "/var/lib/node_exporter/reverse_bin.prom", IntervalMS: 30000},
+			},
+		},
+		{
+			name: "readiness_check with expected status codes",
+			input: `reverse-bin {
+  readiness_check get / expect 200 204
+}`,
+			expected: reverseBinConfig{
+				ReadinessMethod: "GET",
+				ReadinessPath:   "/",
+				ReadinessStatus: []int{200, 204},
+			},
+		},
+		{
+			name: "readiness_check expect without codes",
+			input: `reverse-bin {
+  readiness_check GET / expect
+}`,
+			wantErr: true,
+		},
+		{
+			name: "replicas",
+			input: `reverse-bin {
+  replicas 4
+}`,
+			expected: reverseBinConfig{Replicas: 4},
+		},
+		{
+			name: "backend_keepalive",
+			input: `reverse-bin {
+  backend_keepalive 10m
+}`,
+			expected: reverseBinConfig{BackendKeepAliveMaxMS: 600000},
+		},
+		{
+			name: "backend_keepalive below a second",
+			input: `reverse-bin {
+  backend_keepalive 500ms
+}`,
+			wantErr: true,
+		},
+		{
+			name: "max_concurrent_requests with queue timeout",
+			input: `reverse-bin {
+  max_concurrent_requests 1 30s
+}`,
+			expected: reverseBinConfig{MaxInflightPerKey: 1, QueueTimeoutMS: 30000},
+		},
+		{
+			name: "max_concurrent_requests with bad queue timeout",
+			input: `reverse-bin {
+  max_concurrent_requests 1 soon
+}`,
+			wantErr: true,
+		},
+		{
+			name: "key_when",
+			input: `reverse-bin {
+  key_when "{path}.startsWith('/beta/')" beta-{header.X-Tenant}
+}`,
+			expected: reverseBinConfig{KeyRules: []*KeyRule{{Expression: "{path}.startsWith('/beta/')", Key: "beta-{header.X-Tenant}"}}},
+		},
+		{
+			name: "key_when without key",
+			input: `reverse-bin {
+  key_when "{path}.startsWith('/beta/')"
+}`,
+			wantErr: true,
+		},
+		{
+			name: "max_processes",
+			input: `reverse-bin {
+  max_processes 20
+}`,
+			expected: reverseBinConfig{MaxProcesses: 20},
+		},
+		{
+			name: "max_processes zero",
+			input: `reverse-bin {
+  max_processes 0
+}`,
+			wantErr: true,
+		},
+		{
+			name: "upstream_rate_limit",
+			input: `reverse-bin {
+  upstream_rate_limit 100r/s burst 50
+}`,
+			expected: reverseBinConfig{UpstreamRateLimit: &UpstreamRateLimit{Requests: 100, PeriodMS: 1000, Burst: 50}},
+		},
+		{
+			name: "upstream_rate_limit per minute",
+			input: `reverse-bin {
+  upstream_rate_limit 30r/m
+}`,
+			expected: reverseBinConfig{UpstreamRateLimit: &UpstreamRateLimit{Requests: 30, PeriodMS: 60000}},
+		},
+		{
+			name: "upstream_rate_limit bad burst",
+			input: `reverse-bin {
+  upstream_rate_limit 100r/s burst none
+}`,
+			wantErr: true,
+		},
+		{
+			name: "compat_mode",
+			input: `reverse-bin {
+  compat_mode
+}`,
+			expected: reverseBinConfig{CompatMode: &CompatMode{}},
+		},
+		{
+			name: "compat_mode max_buffer",
+			input: `reverse-bin {
+  compat_mode max_buffer 1MiB
+}`,
+			expected: reverseBinConfig{CompatMode: &CompatMode{MaxBufferBytes: 1 << 20}},
+		},
+		{
+			name: "process_state_ttl",
+			input: `reverse-bin {
+  process_state_ttl 1h
+}`,
+			expected: reverseBinConfig{ProcessStateTTLMS: 3600000},
+		},
+		{
+			name: "process_state_ttl too short",
+			input: `reverse-bin {
+  process_state_ttl 10s
+}`,
+			wantErr: true,
+		},
+		{
+			name: "probe_upstream",
+			input: `reverse-bin {
+  probe_upstream
+}`,
+			expected: reverseBinConfig{ProbeUpstream: true},
+		},
+		{
+			name: "detector_cache",
+			input: `reverse-bin {
+  detector_cache 10m
+}`,
+			expected: reverseBinConfig{DetectorCache: &DetectorCache{TTLMS: 600000}},
+		},
+		{
+			name: "queue_size and queue_timeout",
+			input: `reverse-bin {
+  max_inflight_per_key 2
+  queue_size 10
+  queue_timeout 5s
+}`,
+			expected: reverseBinConfig{MaxInflightPerKey: 2, QueueSize: 10, QueueTimeoutMS: 5000},
+		},
+		{
+			name: "restart_if_rss_above",
+			input: `reverse-bin {
+  restart_if_rss_above 800MB
+}`,
+			expected: reverseBinConfig{RestartRSSAboveBytes: 800000000},
+		},
+		{
+			name: "restart_if_rss_above without unit below 1MiB",
+			input: `reverse-bin {
+  restart_if_rss_above 4096
+}`,
+			wantErr: true,
+		},
+		{
+			name: "max_lifetime with jitter",
+			input: `reverse-bin {
+  max_lifetime 6h 30m
+}`,
+			expected: reverseBinConfig{MaxLifetime: &MaxLifetime{DurationMS: 21600000, JitterMS: 1800000}},
+		},
+		{
+			name: "max_lifetime too short",
+			input: `reverse-bin {
+  max_lifetime 30s
+}`,
+			wantErr: true,
+		},
+		{
+			name: "replica_affinity cookie with default name",
+			input: `reverse-bin {
+  replica_affinity cookie
+}`,
+			expected: reverseBinConfig{ReplicaAffinity: &ReplicaAffinity{Cookie: "reverse_bin_replica"}},
+		},
+		{
+			name: "replica_affinity header",
+			input: `reverse-bin {
+  replica_affinity header X-Session-Id
+}`,
+			expected: reverseBinConfig{ReplicaAffinity: &ReplicaAffinity{Header: "X-Session-Id"}},
+		},
+		{
+			name: "replica_affinity header without name",
+			input: `reverse-bin {
+  replica_affinity header
+}`,
+			wantErr: true,
+		},
+		{
+			name: "replica_policy",
+			input: `reverse-bin {
+  replica_policy round_robin
+}`,
+			expected: reverseBinConfig{ReplicaPolicy: "round_robin"},
+		},
+		{
+			name: "replica_policy unknown",
+			input: `reverse-bin {
+  replica_policy ip_hash
+}`,
+			wantErr: true,
+		},
+		{
+			name: "min_instances",
+			input: `reverse-bin {
+  min_instances 3
+}`,
+			expected: reverseBinConfig{MinInstances: 3},
+		},
+		{
+			name: "min_instances zero",
+			input: `reverse-bin {
+  min_instances 0
+}`,
+			wantErr: true,
+		},
+		{
+			name: "follow_reexec",
+			input: `reverse-bin {
+  follow_reexec
+}`,
+			expected: reverseBinConfig{FollowReexec: true},
+		},
+		{
+			name: "prewarm with keys",
+			input: `reverse-bin {
+  prewarm acme globex
+}`,
+			expected: reverseBinConfig{Prewarm: true, PrewarmKeys: []string{"acme", "globex"}},
+		},
+		{
+			name: "socket_cleanup with interval and min_age",
+			input: `reverse-bin {
+  socket_cleanup /run/apps 5m 1h
+}`,
+			expected: reverseBinConfig{SocketCleanup: &SocketCleanup{Dir: "/run/apps", IntervalMS: 300000, MinAgeMS: 3600000}},
+		},
+		{
+			name: "socket_cleanup without dir",
+			input: `reverse-bin {
+  socket_cleanup
+}`,
+			wantErr: true,
+		},
+		{
+			name: "crash_loop with cooldown",
+			input: `reverse-bin {
+  crash_loop 5/30s 2m
+}`,
+			expected: reverseBinConfig{CrashLoop: &CrashLoop{Count: 5, PeriodMS: 30000, CooldownMS: 120000}},
+		},
+		{
+			name: "idle_hint_header with default name",
+			input: `reverse-bin {
+  idle_hint_header
+}`,
+			expected: reverseBinConfig{IdleHintHeader: "X-Reverse-Bin-Idle-Ms"},
+		},
+		{
+			name: "cgi_until",
+			input: `reverse-bin {
+  cgi_until 30/minute
+}`,
+			expected: reverseBinConfig{CGI: &CGIMode{Count: 30, PeriodMS: 60000}},
+		},
+		{
+			name: "restart backoff and max_restarts",
+			input: `reverse-bin {
+  restart_backoff 1s 1m
+  max_restarts 5
+}`,
+			expected: reverseBinConfig{RestartBackoffMS: 1000, RestartBackoffMaxMS: 60000, MaxRestarts: 5},
+		},
+		{
+			name: "restart_backoff maximum below the initial wait",
+			input: `reverse-bin {
+  restart_backoff 1m 1s
+}`,
+			wantErr: true,
+		},
+		{
+			name: "exec per platform",
+			input: `reverse-bin {
+  exec linux/amd64 ./server-amd64 --port 8080
+  exec linux/arm64 ./server-arm64 --port 8080
+  exec bin/server --port 8080
+}`,
+			expected: reverseBinConfig{
+				Executable: []string{"bin/server", "--port", "8080"},
+				ExecPlatforms: map[string][]string{
+					"linux/amd64": {"./server-amd64", "--port", "8080"},
+					"linux/arm64": {"./server-arm64", "--port", "8080"},
+				},
+			},
+		},
+		{
+			name: "exec with only a platform",
+			input: `reverse-bin {
+  exec linux/amd64
+}`,
+			wantErr: true,
+		},
+		{
+			name: "liveness_check with interval and failures",
+			input: `reverse-bin {
+  liveness_check GET /live expect 200 {
+    interval 5s
+    failures 2
+  }
+}`,
+			expected: reverseBinConfig{
+				LivenessCheck: &LivenessCheck{Method: "GET", Path: "/live", Status: []int{200}, IntervalMS: 5000, Failures: 2},
+			},
+		},
+		{
+			name: "liveness_check zero failures",
+			input: `reverse-bin {
+  liveness_check grpc {
+    failures 0
+  }
+}`,
+			wantErr: true,
+		},
+		{
+			name: "readiness_check grpc with service",
+			input: `reverse-bin {
+  readiness_check grpc db.Store
+}`,
+			expected: reverseBinConfig{
+				ReadinessMethod: "GRPC",
+				ReadinessPath:   "db.Store",
+			},
+		},
+		{
+			name: "bind_check enforce",
+			input: `reverse-bin {
+  bind_check enforce
+}`,
+			expected: reverseBinConfig{BindCheck: "enforce"},
+		},
+		{
+			name: "bind_check unknown mode",
+			input: `reverse-bin {
+  bind_check strict
+}`,
+			wantErr: true,
+		},
+		{
+			name: "host_rewrite defaults to localhost",
+			input: `reverse-bin {
+  host_rewrite
+}`,
+			expected: reverseBinConfig{HostRewrite: "localhost"},
+		},
+		{
+			name: "active_hours with time zone",
+			input: `reverse-bin {
+  active_hours 08:00-20:00 Europe/Berlin {
+    status 403
+  }
+}`,
+			expected: reverseBinConfig{
+				ActiveHours: &ActiveHours{Windows: []string{"08:00-20:00"}, Timezone: "Europe/Berlin", Status: 403},
+			},
+		},
+		{
+			name: "active_hours with malformed window",
+			input: `reverse-bin {
+  active_hours 8-20
+}`,
+			wantErr: true,
+		},
+		{
+			name: "idle_policy adaptive with bounds",
+			input: `reverse-bin {
+  idle_policy adaptive {
+    factor 30
+    min 10s
+    max 1h
+  }
+}`,
+			expected: reverseBinConfig{
+				IdlePolicy: &IdlePolicy{Mode: "adaptive", Factor: 30, MinMS: 10000, MaxMS: 3600000},
+			},
+		},
+		{
+			name: "wait_for with timeout",
+			input: `reverse-bin {
+  wait_for tcp://db:5432 timeout 1m
+  wait_for dns://cache.internal
+}`,
+			expected: reverseBinConfig{
+				WaitFor: []*WaitFor{{Target: "tcp://db:5432", TimeoutMS: 60000}, {Target: "dns://cache.internal"}},
+			},
+		},
+		{
+			name: "wait_for tcp target without port",
+			input: `reverse-bin {
+  wait_for tcp://db
+}`,
+			wantErr: true,
+		},
+		{
+			name: "idle_timeout without unit",
+			input: `reverse-bin {
+  idle_timeout 30
+}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := caddyfile.NewTestDispenser(tt.input)
+			var c ReverseBin
+			err := c.UnmarshalCaddyfile(d)
+
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected error but got none")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Cannot parse caddyfile: %v", err)
+			}
+
+			if !reflect.DeepEqual(asConfig(&c), tt.expected) {
+				t.Errorf("Parsing yielded invalid result.\nGot:      %#v\nExpected: %#v", asConfig(&c), tt.expected)
+			}
+		})
+	}
+}
+
+func TestResolveDialAddress(t *testing.T) {
+	tests := []struct {
+		name           string
+		reverseProxyTo string
+		wantDial       string
+		wantErr        bool
+	}{
+		{name: "IP and port", reverseProxyTo: "127.0.0.1:8080", wantDial: "127.0.0.1:8080"},
+		{name: "port only", reverseProxyTo: ":8080", wantDial: "127.0.0.1:8080"},
+		{name: "with http scheme", reverseProxyTo: "http://127.0.0.1:8080", wantDial: "127.0.0.1:8080"},
+		{name: "invalid host", reverseProxyTo: "http://", wantErr: true},
+		{name: "IPv6 literal", reverseProxyTo: "[::1]:8080", wantDial: "[::1]:8080"},
+		{name: "IPv6 literal with scheme", reverseProxyTo: "https://[fd00::5]:8443", wantDial: "[fd00::5]:8443"},
+		{name: "dual-stack host name", reverseProxyTo: "localhost:8080", wantDial: "localhost:8080"},
+		{name: "unbracketed IPv6", reverseProxyTo: "::1:8080", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dialAddr, err := resolveDialAddress(tt.reverseProxyTo)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got dial=%q", dialAddr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if dialAddr != tt.wantDial {
+				t.Fatalf("expected dial %q, got %q", tt.wantDial, dialAddr)
+			}
+		})
+	}
+}
+
+// TestWithLoopback_PrefersConfiguredFamily verifies port-only addresses use
+// the configured loopback family and explicit hosts are left alone.
+func TestWithLoopback_PrefersConfiguredFamily(t *testing.T) {
+	tests := []struct {
+		loopback, addr, want string
+	}{
+		{"", ":8080", "127.0.0.1:8080"},
+		{"ipv4", ":8080", "127.0.0.1:8080"},
+		{"ipv6", ":8080", "[::1]:8080"},
+		{"ipv6", "127.0.0.1:8080", "127.0.0.1:8080"},
+		{"ipv6", "unix//tmp/app.sock", "unix//tmp/app.sock"},
+	}
+	for _, tt := range tests {
+		c := &ReverseBin{Loopback: tt.loopback}
+		if got := c.withLoopback(tt.addr); got != tt.want {
+			t.Errorf("loopback %q: withLoopback(%q) = %q, want %q", tt.loopback, tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestResolveDialAddress_UnixSocket(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "app.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("failed to listen on unix socket: %v", err)
+	}
+	defer ln.Close()
+	defer os.Remove(sock)
+
+	dialAddr, err := resolveDialAddress("unix/" + sock)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if dialAddr != "unix/"+sock {
+		t.Fatalf("expected unix dial address, got %q", dialAddr)
+	}
+}
+
+func TestReverseBin_GetProcessKey(t *testing.T) {
+	tests := []struct {
+		name          string
+		detector      []string
+		requestPath   string
+		wantKeyEmpty  bool
+	}{
+		{
+			name:         "no detector returns empty key",
+			detector:     nil,
+			requestPath:  "/app1/test",
+			wantKeyEmpty: true,
+		},
+		{
+			name:         "detector with static args",
+			detector:     []string{"/bin/detect", "arg1"},
+			requestPath:  "/test",
+			wantKeyEmpty: false,
+		},
+		{
+			name:         "detector with placeholder",
+			detector:     []string{"/bin/detect", "{path}"},
+			requestPath:  "/myapp/handler",
+			wantKeyEmpty: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &ReverseBin{
+				DynamicProxyDetector: tt.detector,
+				logger:               zaptest.NewLogger(t),
+			}
+			if len(tt.detector) > 0 {
+				c.detector = &ExecDetector{Command: tt.detector}
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://localhost"+tt.requestPath, nil)
+			repl := caddy.NewReplacer()
+			req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+
+			key := c.getProcessKey(req)
+
+			if tt.wantKeyEmpty && key != "" {
+				t.Errorf("expected empty key, got %q", key)
+			}
+			if !tt.wantKeyEmpty && key == "" {
+				t.Errorf("expected non-empty key")
+			}
+		})
+	}
+}
+
+func TestReverseBin_ProvisionValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     reverseBinConfig
+		wantErr bool
+	}{
+		{
+			name: "invalid static non-unix without readiness_check",
+			cfg: reverseBinConfig{
+				Executable:     []string{"./main.py"},
+				ReverseProxyTo: "127.0.0.1:8080",
+			},
+			wantErr: true,
+		},
+		{
+			name: "valid static non-unix with readiness_check",
+			cfg: reverseBinConfig{
+				Executable:      []string{"./main.py"},
+				ReverseProxyTo:  "127.0.0.1:8080",
+				ReadinessMethod: "GET",
+				ReadinessPath:   "/health",
+			},
+			wantErr: false,
+		},
+		{
+			name: "valid static unix without readiness_check",
+			cfg: reverseBinConfig{
+				Executable:     []string{"./main.py"},
+				ReverseProxyTo: "unix//tmp/app.sock",
+			},
+			wantErr: false,
+		},
+		{
+			name: "valid dynamic config",
+			cfg: reverseBinConfig{
+				DynamicProxyDetector: []string{"./detect.py"},
+			},
+			wantErr: false,
+		},
+		{
+			name: "missing executable without detector",
+			cfg: reverseBinConfig{
+				ReverseProxyTo: "127.0.0.1:8080",
+			},
+			wantErr: true,
+		},
+		{
+			name: "missing reverse_proxy_to without detector",
+			cfg: reverseBinConfig{
+				Executable: []string{"./main.py"},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// This tests the validation logic in Provision
+			// We check the conditions that would cause Provision to fail
+			hasDetector := len(tt.cfg.DynamicProxyDetector) > 0
+			hasExecutable := len(tt.cfg.Executable) > 0
+			hasProxyTo := tt.cfg.ReverseProxyTo != ""
+			hasReadiness := tt.cfg.ReadinessMethod != "" && tt.cfg.ReadinessPath != ""
+			nonUnix := hasProxyTo && !isUnixUpstream(tt.cfg.ReverseProxyTo)
+
+			shouldFail := (!hasDetector && !hasExecutable) || (!hasDetector && !hasProxyTo) || (nonUnix && !hasReadiness)
+
+			if shouldFail != tt.wantErr {
+				t.Errorf("expected error=%v, got error=%v (hasDetector=%v, hasExecutable=%v, hasProxyTo=%v, nonUnix=%v, hasReadiness=%v)",
+					tt.wantErr, shouldFail, hasDetector, hasExecutable, hasProxyTo, nonUnix, hasReadiness)
+			}
+		})
+	}
+}
+
+// NoOpNextHandler is a test helper that does nothing
+type NoOpNextHandler struct{}
+
+func (n NoOpNextHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// TestOutputBuffer_MergesStreamsInOrder verifies stdout and stderr lines share
+// one sequence and the ring keeps only the newest lines, oldest first.
+func TestOutputBuffer_MergesStreamsInOrder(t *testing.T) {
+	b := newOutputBuffer(3)
+	logger := zaptest.NewLogger(t)
+	b.write(logger, 1, "stdout", "a")
+	b.write(logger, 1, "stderr", "b")
+	b.write(logger, 1, "stdout", "c")
+	b.write(logger, 1, "stderr", "d")
+
+	got := b.snapshot()
+	if len(got) != 3 {
+		t.Fatalf("expected 3 buffered lines, got %d", len(got))
+	}
+	want := []struct {
+		seq    uint64
+		stream string
+		text   string
+	}{{2, "stderr", "b"}, {3, "stdout", "c"}, {4, "stderr", "d"}}
+	for i, w := range want {
+		if got[i].Seq != w.seq || got[i].Stream != w.stream || got[i].Text != w.text {
+			t.Fatalf("line %d: expected %+v, got %+v", i, w, got[i])
+		}
+	}
+}
+
+// TestAdminLogs_StreamsBacklogAsSSE verifies the admin log endpoint replays
+// buffered output as SSE events and honors Last-Event-ID.
+func TestAdminLogs_StreamsBacklogAsSSE(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	c := &ReverseBin{ReverseProxyTo: "unix//tmp/admin-logs-test.sock", logger: logger, processes: map[string]*processState{}}
+	ps := c.getOrCreateProcessState("")
+	ps.output.write(logger, 42, "stdout", "first")
+	ps.output.write(logger, 42, "stderr", "second")
+	registerHandler(c)
+	defer unregisterHandler(c)
+
+	// Cancelled context: handler must flush the backlog and return instead of waiting for live lines.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodGet, "/reverse-bin/logs?key=unix//tmp/admin-logs-test.sock", nil).WithContext(ctx)
+	req.Header.Set("Last-Event-ID", "1")
+	rec := httptest.NewRecorder()
+	if err := (adminAPI{}).handleLogs(rec, req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	body := rec.Body.String()
+	if rec.Header().Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("expected text/event-stream, got %q", rec.Header().Get("Content-Type"))
+	}
+	if strings.Contains(body, "first") {
+		t.Fatalf("line before Last-Event-ID must be skipped: %q", body)
+	}
+	if !strings.Contains(body, "id: 2\nevent: stderr\n") || !strings.Contains(body, `"text":"second"`) {
+		t.Fatalf("expected event for seq 2, got %q", body)
+	}
+}
+
+// TestAcquireSlot_PerKeyCap verifies a key at its inflight cap makes further
+// requests wait, while another key still gets a handler-wide slot.
+func TestAcquireSlot_PerKeyCap(t *testing.T) {
+	c := &ReverseBin{MaxInflightPerKey: 1, logger: zaptest.NewLogger(t), processes: map[string]*processState{}}
+	c.inflight = make(chan struct{}, 2)
+	hot := c.getOrCreateProcessState("hot")
+	cold := c.getOrCreateProcessState("cold")
+
+	release, err := c.acquireSlot(context.Background(), hot, "hot")
+	if err != nil {
+		t.Fatalf("first hot request must get a slot: %v", err)
+	}
+
+	// Second hot request cannot get a slot; a cancelled context makes it give up immediately.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.acquireSlot(ctx, hot, "hot"); err == nil {
+		t.Fatalf("second hot request must wait while the key is at its cap")
+	}
+
+	releaseCold, err := c.acquireSlot(context.Background(), cold, "cold")
+	if err != nil {
+		t.Fatalf("cold key must still get a slot while hot key is capped: %v", err)
+	}
+	releaseCold()
+	release()
+
+	if len(c.inflight) != 0 || len(hot.inflight) != 0 {
+		t.Fatalf("all slots must be released, global=%d hot=%d", len(c.inflight), len(hot.inflight))
+	}
+}
+
+// TestAcquireSlot_QueueTimeout verifies a request waiting longer than the
+// queue timeout fails with a 503 that handle_errors can tell apart
+// (synth-1270~2).
+func TestAcquireSlot_QueueTimeout(t *testing.T) {
+	c := &ReverseBin{MaxInflightPerKey: 1, QueueTimeoutMS: 20, logger: zaptest.NewLogger(t), processes: map[string]*processState{}}
+	ps := c.getOrCreateProcessState("")
+	release, err := c.acquireSlot(context.Background(), ps, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	start := time.Now()
+	_, err = c.acquireSlot(context.Background(), ps, "")
+	var herr caddyhttp.HandlerError
+	if !errors.As(err, &herr) || herr.StatusCode != http.StatusServiceUnavailable || !errors.Is(err, ErrQueueTimeout) {
+		t.Fatalf("got %v, want a 503 wrapping ErrQueueTimeout", err)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Fatalf("request waited %v despite the queue timeout", waited)
+	}
+	if code := errorCode(err); code != "queue_timeout" {
+		t.Fatalf("{reverse_bin.error} = %q, want queue_timeout", code)
+	}
+}
+
+// TestAcquireSlot_QueueFull verifies a request arriving while queue_size
+// requests already wait for a key's slot is turned away with 429 and
+// Retry-After, while the queued request still gets the slot (synth-1271).
+func TestAcquireSlot_QueueFull(t *testing.T) {
+	c := &ReverseBin{MaxInflightPerKey: 1, QueueSize: 1, logger: observedLogger(zaptest.NewLogger(t)), processes: map[string]*processState{}}
+	ps := c.getOrCreateProcessState("")
+	release, err := c.acquireSlot(context.Background(), ps, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waiting := make(chan struct{})
+	stop := ObserveLogs(func(e LogEntry) {
+		if e.Message == "request queued for a slot" {
+			close(waiting)
+		}
+	})
+	defer stop()
+	queued := make(chan error, 1)
+	go func() {
+		release, err := c.acquireSlot(context.Background(), ps, "")
+		if err == nil {
+			release()
+		}
+		queued <- err
+	}()
+	<-waiting
+
+	_, err = c.acquireSlot(context.Background(), ps, "")
+	var herr caddyhttp.HandlerError
+	if !errors.As(err, &herr) || herr.StatusCode != http.StatusTooManyRequests || !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("got %v, want a 429 wrapping ErrQueueFull", err)
+	}
+	rec := httptest.NewRecorder()
+	c.shedLoad(rec, "", err)
+	if got := rec.Header().Get("Retry-After"); got == "" {
+		t.Fatal("a shed request must be told when to retry")
+	}
+
+	release()
+	if err := <-queued; err != nil {
+		t.Fatalf("queued request must get the slot: %v", err)
+	}
+	if n := ps.queued.Load(); n != 0 {
+		t.Fatalf("%d requests still counted as queued", n)
+	}
+}
+
+// TestServiceRegistry_ConsulRegisterDeregister verifies a ready backend is
+// registered with the Consul agent API and removed again on stop.
+func TestServiceRegistry_ConsulRegisterDeregister(t *testing.T) {
+	type call struct {
+		method, path string
+		body         map[string]any
+	}
+	calls := make(chan call, 2)
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		calls <- call{r.Method, r.URL.Path, body}
+	}))
+	defer consul.Close()
+
+	sr := &ServiceRegistry{Type: "consul", Endpoint: consul.URL, Service: "apps", Tags: []string{"web"}}
+	reg := sr.newRegistration("tenant1", "127.0.0.1:9001", 1234)
+	logger := zaptest.NewLogger(t)
+
+	// Register call must PUT the service with address, port and key metadata.
+	reg.register(logger)
+	got := <-calls
+	if got.method != http.MethodPut || got.path != "/v1/agent/service/register" {
+		t.Fatalf("unexpected register call %s %s", got.method, got.path)
+	}
+	if got.body["Name"] != "apps" || got.body["Address"] != "127.0.0.1" || got.body["Port"] != float64(9001) {
+		t.Fatalf("unexpected register body: %v", got.body)
+	}
+	if meta, _ := got.body["Meta"].(map[string]any); meta["key"] != "tenant1" || meta["pid"] != "1234" {
+		t.Fatalf("unexpected register meta: %v", got.body["Meta"])
+	}
+
+	// Deregister call must target the same service ID.
+	reg.deregister(logger)
+	got = <-calls
+	if got.method != http.MethodPut || got.path != "/v1/agent/service/deregister/"+reg.id {
+		t.Fatalf("unexpected deregister call %s %s", got.method, got.path)
+	}
+
+	// These keys share the first 6 bytes of their SHA-256, so an ID built
+	// from a truncated hash would let one key deregister the other.
+	a, b := sr.newRegistration("tenant6267028", "", 0), sr.newRegistration("tenant23901481", "", 0)
+	if a.id == b.id {
+		t.Fatalf("keys with colliding hash prefixes share the ID %s", a.id)
+	}
+}
+
+// TestStartupTimeout_Deadline verifies the readiness deadline follows a key's
+// startup history within the configured bounds.
+func TestStartupTimeout_Deadline(t *testing.T) {
+	s := &StartupTimeout{MinMS: 1000, MaxMS: 60000, Factor: 2}
+	fast := []time.Duration{100 * time.Millisecond, 120 * time.Millisecond}
+	slow := []time.Duration{8 * time.Second, 10 * time.Second, 12 * time.Second}
+
+	if got := s.deadline(nil); got != time.Minute {
+		t.Errorf("no history: got %v, want max", got)
+	}
+	if got := s.deadline(fast); got != time.Second {
+		t.Errorf("fast app: got %v, want min", got)
+	}
+	if got := s.deadline(slow); got != 24*time.Second {
+		t.Errorf("slow app: got %v, want p95*factor", got)
+	}
+}
+
+// TestFinishTrace_ExplainsServerErrors verifies debug mode answers an
+// unwritten 5xx with the error and the recorded lifecycle steps.
+func TestFinishTrace_ExplainsServerErrors(t *testing.T) {
+	c := &ReverseBin{ReverseProxyTo: "127.0.0.1:9", logger: zaptest.NewLogger(t)}
+	tr := &requestTrace{start: time.Now()}
+	tr.step("detector", time.Now(), "./detect.py")
+
+	rec := httptest.NewRecorder()
+	hw := &headersDownWriter{ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: rec}, ps: &processState{}}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	err := c.finishTrace(hw, req, tr, "", caddyhttp.Error(http.StatusBadGateway, errors.New("readiness failed")))
+	if err != nil {
+		t.Fatalf("error must be answered in the body, got %v", err)
+	}
+	body := rec.Body.String()
+	if rec.Code != http.StatusBadGateway || !strings.Contains(body, "detector") || !strings.Contains(body, "readiness failed") {
+		t.Fatalf("status=%d body=%q", rec.Code, body)
+	}
+}
+
+// TestMaintenance_ServesPageWhileMarkerExists verifies the per-key marker file
+// switches a tenant to the maintenance page and back.
+func TestMaintenance_ServesPageWhileMarkerExists(t *testing.T) {
+	dir := t.TempDir()
+	page := filepath.Join(dir, "down.html")
+	if err := os.WriteFile(page, []byte("<h1>back soon</h1>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m := &Maintenance{File: filepath.Join(dir, "{reverse_bin.key}.maintenance"), Page: page}
+	newReq := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		return req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+	}
+
+	if m.serveIfActive(httptest.NewRecorder(), newReq(), "tenant1") {
+		t.Fatalf("no marker file: request must be proxied")
+	}
+	if err := os.WriteFile(filepath.Join(dir, "tenant1.maintenance"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	if !m.serveIfActive(rec, newReq(), "tenant1") {
+		t.Fatalf("marker file present: maintenance page must be served")
+	}
+	if rec.Code != http.StatusServiceUnavailable || rec.Body.String() != "<h1>back soon</h1>" {
+		t.Fatalf("status=%d body=%q", rec.Code, rec.Body.String())
+	}
+	if m.serveIfActive(httptest.NewRecorder(), newReq(), "tenant2") {
+		t.Fatalf("other tenants must not be affected")
+	}
+
+	// Keys cannot reach marker files outside the tenants' directories
+	// (synth-1212).
+	m = &Maintenance{File: filepath.Join(dir, "apps", "{reverse_bin.key}", ".maintenance")}
+	for _, name := range []string{".maintenance", "other/.maintenance"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range []string{"..", "../other"} {
+		if m.serveIfActive(httptest.NewRecorder(), newReq(), key) {
+			t.Fatalf("key %q reached a marker file outside its directory", key)
+		}
+	}
+}
+
+// TestAskProvision_ApprovesKnownTenants verifies provision_ask gates cold
+// starts and its JSON answer configures the approved backend.
+func TestAskProvision_ApprovesKnownTenants(t *testing.T) {
+	ask := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("domain") != "tenant1.example.com" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte(`{"reverse_proxy_to": "unix//run/tenant1.sock"}`))
+	}))
+	defer ask.Close()
+	c := &ReverseBin{
+		ProvisionAsk: ask.URL,
+		logger:       zaptest.NewLogger(t),
+		processes:    map[string]*processState{},
+		provisioned:  map[string]*Overrides{},
+	}
+
+	// Approved tenant: its answer is kept for the backend start.
+	req := httptest.NewRequest(http.MethodGet, "http://tenant1.example.com:8443/", nil)
+	if err := c.askProvision(req, "tenant1"); err != nil {
+		t.Fatalf("tenant1 must be approved: %v", err)
+	}
+	if o := c.provisionedOverrides("tenant1"); o == nil || *o.ReverseProxyTo != "unix//run/tenant1.sock" {
+		t.Fatalf("approved overrides not recorded: %+v", o)
+	}
+
+	// Unknown tenant: rejected with 404.
+	req = httptest.NewRequest(http.MethodGet, "http://evil.example.com/", nil)
+	var he caddyhttp.HandlerError
+	if err := c.askProvision(req, "evil"); !errors.As(err, &he) || he.StatusCode != http.StatusNotFound {
+		t.Fatalf("unknown tenant must get 404, got %v", err)
+	}
+}
+
+// TestAskProvision_SharesAskInFlight verifies requests for a key arriving
+// while its provision_ask is in flight share that ask's answer (synth-1214).
+func TestAskProvision_SharesAskInFlight(t *testing.T) {
+	var asked atomic.Int32
+	arrived, release := make(chan struct{}), make(chan struct{})
+	ask := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if asked.Add(1) == 1 {
+			close(arrived)
+		}
+		<-release
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer ask.Close()
+	defer close(release)
+	c := &ReverseBin{
+		ProvisionAsk: ask.URL,
+		logger:       observedLogger(zaptest.NewLogger(t)),
+		processes:    map[string]*processState{},
+		provisioned:  map[string]*Overrides{},
+	}
+	waiting := make(chan struct{}, 4)
+	stop := ObserveLogs(func(e LogEntry) {
+		if e.Message == "waiting for provision_ask in flight" {
+			waiting <- struct{}{}
+		}
+	})
+	defer stop()
+
+	errs := make(chan error, 5)
+	askTenant := func() {
+		errs <- c.askProvision(httptest.NewRequest(http.MethodGet, "http://tenant1.example.com/", nil), "tenant1")
+	}
+	go askTenant()
+	<-arrived
+	for range 4 {
+		go askTenant()
+	}
+	for range 4 {
+		<-waiting
+	}
+	release <- struct{}{}
+	var he caddyhttp.HandlerError
+	for range 5 {
+		if err := <-errs; !errors.As(err, &he) || he.StatusCode != http.StatusNotFound {
+			t.Fatalf("every request must get the shared refusal, got %v", err)
+		}
+	}
+	if n := asked.Load(); n != 1 {
+		t.Fatalf("provision_ask was asked %d times, want once", n)
+	}
+}
+
+// stubRunner starts backends that do nothing until their context ends.
+type stubRunner struct{}
+
+func (stubRunner) Start(ctx context.Context, spec ProcessSpec) (Process, <-chan error, error) {
+	exited := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		exited <- ctx.Err()
+	}()
+	return stubProcess{}, exited, nil
+}
+
+type stubProcess struct{}
+
+func (stubProcess) Pid() int    { return 1 }
+func (stubProcess) Alive() bool { return true }
+func (stubProcess) Kill()       {}
+
+// TestPreStop_NotifiesBackendBeforeStop verifies stopping a backend first
+// sends it the pre-stop request, marked as internal traffic, without holding
+// ps.mu while the backend takes its time, and that a start waits for the
+// stop (synth-1239).
+func TestPreStop_NotifiesBackendBeforeStop(t *testing.T) {
+	ps := &processState{process: stubProcess{}}
+	received := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The state stays usable while the backend acknowledges.
+		ps.mu.Lock()
+		ps.mu.Unlock()
+		received <- r.Method + " " + r.URL.Path + " " + r.Header.Get(internalHeader)
+	}))
+	defer backend.Close()
+
+	p := &PreStop{Method: "POST", Path: "/_shutdown", TimeoutMS: 1000}
+	cancelled := false
+	ps.cancel = func() { cancelled = true }
+	ps.preStop = p.hook(zaptest.NewLogger(t), stubProcess{}, backend.URL, nil, make(chan struct{}))
+
+	// The idle timeout and admin API both stop the backend via stopLocked.
+	ps.mu.Lock()
+	stopped := ps.stopLocked("idle timeout")
+	stopping := ps.stopping
+	ps.mu.Unlock()
+	if !stopped {
+		t.Fatal("stopLocked must report the running backend as stopped")
+	}
+	if got := <-received; got != "POST /_shutdown pre-stop" {
+		t.Fatalf("backend received %q, want the marked pre-stop request", got)
+	}
+	if err := awaitStopped(context.Background(), stopping); err != nil {
+		t.Fatal(err)
+	}
+	if !cancelled || ps.preStop != nil {
+		t.Fatalf("backend must be stopped after the notification, cancelled=%v", cancelled)
+	}
+
+	// A start gives up waiting on a stop still in progress with its request.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := awaitStopped(ctx, make(chan struct{})); err == nil {
+		t.Fatal("a start must stop waiting once its request is done")
+	}
+}
+
+// TestColdStart_CancelledRequestLeavesStartRunning verifies a disconnecting
+// client stops waiting for a cold start while the start completes for the
+// next request.
+func TestColdStart_CancelledRequestLeavesStartRunning(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "app.sock")
+	baseCtx, cancelBase := context.WithCancel(context.Background())
+	defer cancelBase()
+	c := &ReverseBin{
+		Executable:     []string{"./app"},
+		ReverseProxyTo: "unix/" + sock,
+		Runner:         stubRunner{},
+		logger:         observedLogger(zaptest.NewLogger(t)),
+		processes:      map[string]*processState{},
+		ctx:            caddy.Context{Context: baseCtx},
+	}
+	ps := c.getOrCreateProcessState("")
+
+	// Triggering request disconnects while the start waits for the backend to
+	// bind its socket.
+	reqCtx, cancelReq := context.WithCancel(context.Background())
+	stop := ObserveLogs(func(e LogEntry) {
+		if e.Message == "waiting for reverse proxy process readiness via unix socket creation" {
+			cancelReq()
+		}
+	})
+	defer stop()
+	req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(reqCtx)
+	if _, err := c.ensureProcessRunningAndResolveUpstream(req, ps, ""); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled request must stop waiting, got %v", err)
+	}
+
+	// The backend comes up after all; the next request uses the same start.
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	addr, err := c.ensureProcessRunningAndResolveUpstream(req, ps, "")
+	if err != nil || addr != "unix/"+sock {
+		t.Fatalf("next request must reach the started backend, addr=%q err=%v", addr, err)
+	}
+}
+
+// fakeClock records the durations of the idle timers it is asked to arm.
+type fakeClock struct {
+	now   time.Time
+	armed []time.Duration
+}
+
+func (f *fakeClock) Now() time.Time                       { return f.now }
+func (f *fakeClock) After(time.Duration) <-chan time.Time { return nil }
+func (f *fakeClock) AfterFunc(d time.Duration, _ func()) Timer {
+	f.armed = append(f.armed, d)
+	return time.NewTimer(time.Hour)
+}
+
+// tickClock is a Clock that stands still until advance moves it, firing the
+// After channels that come due; its AfterFunc timers never fire.
+type tickClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []tickTimer
+	// armed is signalled whenever After adds a timer
+	armed chan struct{}
+}
+
+type tickTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newTickClock() *tickClock {
+	return &tickClock{now: time.Unix(0, 0), armed: make(chan struct{}, 1)}
+}
+
+func (c *tickClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *tickClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	c.mu.Lock()
+	c.timers = append(c.timers, tickTimer{at: c.now.Add(d), ch: ch})
+	c.mu.Unlock()
+	select {
+	case c.armed <- struct{}{}:
+	default:
+	}
+	return ch
+}
+
+func (c *tickClock) AfterFunc(time.Duration, func()) Timer { return time.NewTimer(time.Hour) }
+
+// advance waits until a timer is armed that comes due within d, then moves
+// the clock forward by d and fires every timer due by then.
+func (c *tickClock) advance(d time.Duration) {
+	for {
+		c.mu.Lock()
+		now := c.now.Add(d)
+		var due, pending []tickTimer
+		for _, t := range c.timers {
+			if t.at.After(now) {
+				pending = append(pending, t)
+			} else {
+				due = append(due, t)
+			}
+		}
+		if len(due) > 0 {
+			c.now, c.timers = now, pending
+			c.mu.Unlock()
+			for _, t := range due {
+				t.ch <- now
+			}
+			return
+		}
+		c.mu.Unlock()
+		<-c.armed
+	}
+}
+
+// eventObserver sends the backend state transitions of a handler on events
+// as "<pid> <state>".
+type eventObserver struct{ events chan string }
+
+func newEventObserver() eventObserver { return eventObserver{events: make(chan string, 64)} }
+
+func (o eventObserver) BackendChanged(_ string, pid int, state BackendState) {
+	o.events <- fmt.Sprintf("%d %s", pid, state)
+}
+
+func (eventObserver) Proxying(string, int) {}
+
+// await returns once the transition want was reported, and fails if one of
+// unwanted was reported before it.
+func (o eventObserver) await(t *testing.T, want string, unwanted ...string) {
+	t.Helper()
+	for event := range o.events {
+		if event == want {
+			return
+		}
+		if slices.Contains(unwanted, event) {
+			t.Fatalf("backend went %q while waiting for %q", event, want)
+		}
+	}
+}
+
+// TestDecrementRequests_KeepsLongestIdleWindow verifies a request with a
+// short idle timeout does not cut short the window granted by an earlier one.
+func TestDecrementRequests_KeepsLongestIdleWindow(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	ps := &processState{clock: clock}
+	logger := zaptest.NewLogger(t)
+
+	ps.incrementRequests(logger, "")
+	ps.decrementRequests(logger, "", 10*time.Minute, true)
+	clock.now = clock.now.Add(time.Minute)
+	ps.incrementRequests(logger, "")
+	ps.decrementRequests(logger, "", 5*time.Second, true)
+
+	want := []time.Duration{10 * time.Minute, 9 * time.Minute}
+	if !reflect.DeepEqual(clock.armed, want) {
+		t.Fatalf("armed idle timers %v, want %v", clock.armed, want)
+	}
+}
+
+// TestDecrementRequests_IgnoredRequestDoesNotExtendIdle verifies a request
+// matching idle_ignore leaves the open idle window unchanged.
+func TestDecrementRequests_IgnoredRequestDoesNotExtendIdle(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	ps := &processState{clock: clock}
+	logger := zaptest.NewLogger(t)
+
+	ps.incrementRequests(logger, "")
+	ps.decrementRequests(logger, "", time.Minute, true)
+	clock.now = clock.now.Add(50 * time.Second)
+	ps.incrementRequests(logger, "")
+	ps.decrementRequests(logger, "", time.Minute, false)
+
+	want := []time.Duration{time.Minute, 10 * time.Second}
+	if !reflect.DeepEqual(clock.armed, want) {
+		t.Fatalf("armed idle timers %v, want %v", clock.armed, want)
+	}
+}
+
+// TestParkRequest_ReportsWaitingRequestsPerKey verifies the admin listing
+// shows how many requests wait for a key's backend and the longest wait.
+func TestParkRequest_ReportsWaitingRequestsPerKey(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	c := &ReverseBin{
+		ReverseProxyTo: "127.0.0.1:8080",
+		Clock:          clock,
+		logger:         zap.NewNop(),
+		processes:      map[string]*processState{},
+	}
+	registerHandler(c)
+	defer unregisterHandler(c)
+	ps := c.getOrCreateProcessState("")
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	first := c.parkRequest(req, ps, "")
+	clock.now = clock.now.Add(3 * time.Second)
+	second := c.parkRequest(req, ps, "")
+	if got := processes(); len(got) != 1 || got[0].WaitingRequests != 2 || got[0].LongestWaitMS != 3000 {
+		t.Fatalf("want 2 waiting requests, longest 3000ms, got %+v", got)
+	}
+
+	first()
+	second()
+	if got := processes(); got[0].WaitingRequests != 0 || got[0].LongestWaitMS != 0 {
+		t.Fatalf("requests that stopped waiting must not be reported, got %+v", got)
+	}
+
+	// reverse-bin's own requests, such as prewarm starts, are not reported
+	// (synth-1219).
+	markInternal(req, "prewarm")
+	defer c.parkRequest(req, ps, "")()
+	if got := processes(); got[0].WaitingRequests != 0 {
+		t.Fatalf("internal requests must not be reported, got %+v", got)
+	}
+}
+
+// TestWaitForReadiness_MarksProbesInternal verifies readiness checks carry
+// the internal marker so backends can exclude them from analytics.
+func TestWaitForReadiness_MarksProbesInternal(t *testing.T) {
+	marker := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case marker <- r.Header.Get(internalHeader):
+		default:
+		}
+	}))
+	defer backend.Close()
+
+	c := &ReverseBin{logger: zaptest.NewLogger(t)}
+	addr := strings.TrimPrefix(backend.URL, "http://")
+	method, path := http.MethodGet, "/health"
+	overrides := &Overrides{ReverseProxyTo: &addr, ReadinessMethod: &method, ReadinessPath: &path}
+	// The first poll reaches the backend and reports it ready.
+	if err := c.waitForReadiness(context.Background(), overrides, nil, nil, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-marker; got != "readiness" {
+		t.Fatalf("%s = %q, want %q", internalHeader, got, "readiness")
+	}
+}
+
+// warmHandler returns a static handler whose backend is already running,
+// and a request that ServeHTTP has tagged with its process state.
+func warmHandler(tb testing.TB) (*ReverseBin, *http.Request) {
+	c := &ReverseBin{
+		Executable:     []string{"./app"},
+		ReverseProxyTo: "127.0.0.1:8080",
+		logger:         zap.NewNop(),
+		processes:      map[string]*processState{},
+	}
+	ps := c.getOrCreateProcessState("")
+	ps.process = stubProcess{}
+	ps.transport = &reverseproxy.HTTPTransport{}
+	return c, withProcessState(httptest.NewRequest(http.MethodGet, "/", nil), ps)
+}
+
+// TestGetUpstreams_ReusesWarmUpstreams verifies warm requests share one
+// resolved upstream list instead of building a new one each time.
+func TestGetUpstreams_ReusesWarmUpstreams(t *testing.T) {
+	c, req := warmHandler(t)
+	first, err := c.GetUpstreams(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := c.GetUpstreams(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first[0].Dial != "127.0.0.1:8080" || &first[0] != &second[0] {
+		t.Fatalf("warm requests must share the upstream list, got %p and %p", first, second)
+	}
+}
+
+func BenchmarkGetUpstreams_Warm(b *testing.B) {
+	c, req := warmHandler(b)
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := c.GetUpstreams(req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetUpstreams_WarmParallel(b *testing.B) {
+	c, req := warmHandler(b)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := c.GetUpstreams(req); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkRequestAccounting(b *testing.B) {
+	c, req := warmHandler(b)
+	ps := processStateFrom(req)
+	b.ReportAllocs()
+	for b.Loop() {
+		ps.incrementRequests(c.logger, "")
+		ps.decrementRequests(c.logger, "", 0, true)
+	}
+}
+
+// TestWarmRoute_DroppedWhenBackendStops verifies warm requests return to the
+// slow path once the backend's transport is torn down.
+func TestWarmRoute_DroppedWhenBackendStops(t *testing.T) {
+	c, req := warmHandler(t)
+	ps := processStateFrom(req)
+	if _, err := c.GetUpstreams(req); err != nil {
+		t.Fatal(err)
+	}
+	if ps.warm.Load() == nil {
+		t.Fatal("a running static backend must publish a warm route")
+	}
+
+	ps.mu.Lock()
+	ps.setTransportLocked(nil)
+	ps.mu.Unlock()
+	if ps.warm.Load() != nil {
+		t.Fatal("stopping the backend must drop the warm route")
+	}
+}
+
+// pidRunner starts virtual backends with increasing pids that share one
+// already-listening server and exit when their context ends.
+type pidRunner struct{ next atomic.Int64 }
+
+func (r *pidRunner) Start(ctx context.Context, spec ProcessSpec) (Process, <-chan error, error) {
+	exited := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		exited <- ctx.Err()
+	}()
+	return pidProcess(r.next.Add(1)), exited, nil
+}
+
+type pidProcess int
+
+func (p pidProcess) Pid() int  { return int(p) }
+func (pidProcess) Alive() bool { return true }
+func (pidProcess) Kill()       {}
+
+// readyObserver records requests proxied to a backend that is not ready.
+type readyObserver struct {
+	mu         sync.Mutex
+	states     map[int]BackendState
+	drained    int
+	violations []string
+}
+
+func (o *readyObserver) BackendChanged(_ string, pid int, state BackendState) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.states[pid] = state
+	if state == BackendDraining {
+		o.drained++
+	}
+}
+
+func (o *readyObserver) Proxying(_ string, pid int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.states[pid] != BackendReady {
+		o.violations = append(o.violations, fmt.Sprintf("pid %d %q", pid, o.states[pid]))
+	}
+}
+
+// TestObserver_NoRequestsToStoppedBackends stresses request routing against
+// concurrent stops and cold starts and verifies no request is proxied to a
+// backend that is starting, draining or exited. Run it with -race.
+func TestObserver_NoRequestsToStoppedBackends(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	obs := &readyObserver{states: map[int]BackendState{}}
+	c := &ReverseBin{
+		Executable:      []string{"./app"},
+		ReverseProxyTo:  strings.TrimPrefix(backend.URL, "http://"),
+		ReadinessMethod: http.MethodGet,
+		ReadinessPath:   "/",
+		Runner:          &pidRunner{},
+		Observer:        obs,
+		logger:          zap.NewNop(),
+		processes:       map[string]*processState{},
+		ctx:             caddy.Context{Context: context.Background()},
+	}
+	ps := c.getOrCreateProcessState("")
+
+	var served atomic.Int64
+	servedOne := make(chan struct{}, 1)
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				ps.incrementRequests(c.logger, "")
+				// Each request selects an upstream, cold starting the backend if
+				// a stop got there first, and is proxied to it.
+				req := withProcessState(httptest.NewRequest(http.MethodGet, "/", nil), ps)
+				if upstreams, err := c.GetUpstreams(req); err == nil {
+					// The proxy's own work before the round trip gives stops a
+					// chance to land in between.
+					runtime.Gosched()
+					req.RequestURI = ""
+					req.URL.Scheme, req.URL.Host = "http", upstreams[0].Dial
+					if resp, err := (keyedTransport{c: c}).RoundTrip(req); err == nil {
+						_, _ = io.Copy(io.Discard, resp.Body)
+						_ = resp.Body.Close()
+						served.Add(1)
+						select {
+						case servedOne <- struct{}{}:
+						default:
+						}
+					}
+				}
+				ps.decrementRequests(c.logger, "", 0, true)
+			}
+		}()
+	}
+	// Stops race the requests, like idle timeouts and the admin API. Each
+	// one is followed by a cold start taking a readiness poll, and the next
+	// comes once a request was served again.
+	for range 5 {
+		<-servedOne
+		ps.mu.Lock()
+		ps.stopLocked("stress test")
+		ps.mu.Unlock()
+	}
+	close(done)
+	wg.Wait()
+
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+	if len(obs.violations) > 0 {
+		t.Fatalf("requests proxied to backends that were not ready: %v", obs.violations)
+	}
+	if served.Load() == 0 || obs.drained == 0 {
+		t.Fatalf("stress test must proxy requests and stop backends, served=%d stops=%d", served.Load(), obs.drained)
+	}
+}
+
+// announceRunner starts virtual backends that print line on stdout.
+type announceRunner struct{ line string }
+
+func (r announceRunner) Start(ctx context.Context, spec ProcessSpec) (Process, <-chan error, error) {
+	exited := make(chan error, 1)
+	go func() {
+		spec.Output(1, "stdout", "booting")
+		spec.Output(1, "stdout", r.line)
+		<-ctx.Done()
+		exited <- ctx.Err()
+	}()
+	return stubProcess{}, exited, nil
+}
+
+// TestUpstreamFrom_DialsPortAnnouncedOnStdout verifies a backend that picks
+// its own port is proxied to at the port it prints, once it accepts
+// connections.
+func TestUpstreamFrom_DialsPortAnnouncedOnStdout(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(backend.URL, "http://"))
+	c := &ReverseBin{
+		Executable:     []string{"./app"},
+		ReverseProxyTo: "127.0.0.1:" + portPlaceholder,
+		UpstreamFrom:   &UpstreamFrom{Source: "stdout"},
+		Runner:         announceRunner{line: "PORT=" + port},
+		logger:         zaptest.NewLogger(t),
+		processes:      map[string]*processState{},
+		ctx:            caddy.Context{Context: context.Background()},
+	}
+	if err := c.UpstreamFrom.validate(); err != nil {
+		t.Fatal(err)
+	}
+	ps := c.getOrCreateProcessState("")
+
+	// The first request cold starts the backend and waits for its announcement.
+	req := withProcessState(httptest.NewRequest(http.MethodGet, "/", nil), ps)
+	upstreams, err := c.GetUpstreams(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := upstreams[0].Dial, "127.0.0.1:"+port; got != want {
+		t.Fatalf("dial address = %q, want the announced %q", got, want)
+	}
+	ps.mu.Lock()
+	ps.stopLocked("test done")
+	ps.mu.Unlock()
+}
+
+// TestWaitForAnnouncement_ReadsPortFile verifies the port is read from the
+// announcement file once complete, and a stale file is removed before start.
+func TestWaitForAnnouncement_ReadsPortFile(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "port")
+	if err := os.WriteFile(file, []byte("PORT=1111\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c := &ReverseBin{logger: zaptest.NewLogger(t)}
+	u := &UpstreamFrom{Source: "file", Path: "port"}
+	a, err := u.listen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatalf("stale announcement file must be removed before start, stat: %v", err)
+	}
+	if err := os.WriteFile(file, []byte("PORT=2222\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	port, _, err := c.waitForAnnouncement(context.Background(), a, nil, 5*time.Second)
+	if err != nil || port != 2222 {
+		t.Fatalf("announced port = %d, %v; want 2222", port, err)
+	}
+}
+
+// flapRunner starts virtual backends that exit with an error once exit is
+// closed.
+type flapRunner struct {
+	exit   chan struct{}
+	starts atomic.Int32
+}
+
+func (r *flapRunner) Start(ctx context.Context, spec ProcessSpec) (Process, <-chan error, error) {
+	r.starts.Add(1)
+	exited := make(chan error, 1)
+	go func() {
+		select {
+		case <-r.exit:
+			exited <- errors.New("exit status 1")
+		case <-ctx.Done():
+			exited <- ctx.Err()
+		}
+	}()
+	return stubProcess{}, exited, nil
+}
+
+// TestMinStableTime_FailsStartOfBackendExitingAfterReadiness verifies a
+// backend exiting right after readiness fails the start and holds off the
+// next one, instead of being proxied to.
+func TestMinStableTime_FailsStartOfBackendExitingAfterReadiness(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	runner := &flapRunner{exit: make(chan struct{})}
+	c := &ReverseBin{
+		Executable:      []string{"./app"},
+		ReverseProxyTo:  strings.TrimPrefix(backend.URL, "http://"),
+		ReadinessMethod: http.MethodGet,
+		ReadinessPath:   "/",
+		MinStableTimeMS: 60000,
+		Runner:          runner,
+		logger:          observedLogger(zaptest.NewLogger(t)),
+		processes:       map[string]*processState{},
+		ctx:             caddy.Context{Context: context.Background()},
+	}
+	// The backend exits once it passed readiness.
+	terminated := make(chan struct{})
+	stop := ObserveLogs(func(e LogEntry) {
+		switch e.Message {
+		case "waiting for reverse proxy process to stay up":
+			close(runner.exit)
+		case "proxy subprocess terminated":
+			close(terminated)
+		}
+	})
+	defer stop()
+	ps := c.getOrCreateProcessState("")
+
+	// The first request starts the backend and sees it exit.
+	req := withProcessState(httptest.NewRequest(http.MethodGet, "/", nil), ps)
+	if _, err := c.GetUpstreams(req); err == nil || !strings.Contains(err.Error(), "min_stable_time") {
+		t.Fatalf("start of a flapping backend must fail, got %v", err)
+	}
+	<-terminated
+	// The next request is turned away without another start.
+	req = withProcessState(httptest.NewRequest(http.MethodGet, "/", nil), ps)
+	if _, err := c.GetUpstreams(req); err == nil {
+		t.Fatal("starts must be held off after a flap")
+	}
+	if n := runner.starts.Load(); n != 1 {
+		t.Fatalf("backend started %d times, want 1", n)
+	}
+	rec := httptest.NewRecorder()
+	var he caddyhttp.HandlerError
+	if err := c.backoffError(rec, ps); !errors.As(err, &he) || he.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("held off key must get 503, got %v", err)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "60" {
+		t.Fatalf("Retry-After = %q, want the min_stable_time backoff of 60", got)
+	}
+}
+
+// headerPresent matches requests carrying the named header.
+type headerPresent string
+
+func (h headerPresent) MatchWithError(r *http.Request) (bool, error) {
+	return r.Header.Get(string(h)) != "", nil
+}
+
+// TestActivationRequire_OnlyMatchingRequestsStartBackend verifies requests not
+// matching activation_require are refused while the backend is stopped, and
+// are proxied without a start once a matching request woke it up.
+func TestActivationRequire_OnlyMatchingRequestsStartBackend(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	runner := &pidRunner{}
+	c := &ReverseBin{
+		Executable:           []string{"./app"},
+		ReverseProxyTo:       strings.TrimPrefix(backend.URL, "http://"),
+		ReadinessMethod:      http.MethodGet,
+		ReadinessPath:        "/",
+		ActivationDenyStatus: http.StatusPaymentRequired,
+		Runner:               runner,
+		activationRequire:    caddyhttp.MatcherSets{{headerPresent("Authorization")}},
+		logger:               zaptest.NewLogger(t),
+		processes:            map[string]*processState{},
+		ctx:                  caddy.Context{Context: context.Background()},
+	}
+	ps := c.getOrCreateProcessState("")
+
+	// An anonymous request for the stopped backend is refused.
+	var he caddyhttp.HandlerError
+	anon := httptest.NewRequest(http.MethodGet, "/", nil)
+	if _, err := c.checkActivation(anon, ps); !errors.As(err, &he) || he.StatusCode != http.StatusPaymentRequired {
+		t.Fatalf("anonymous request for a stopped backend must get 402, got %v", err)
+	}
+
+	// An authorized request starts the backend.
+	authed := httptest.NewRequest(http.MethodGet, "/", nil)
+	authed.Header.Set("Authorization", "Bearer token")
+	authed, err := c.checkActivation(authed, ps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetUpstreams(withProcessState(authed, ps)); err != nil {
+		t.Fatal(err)
+	}
+
+	// An anonymous request is now proxied to the running backend.
+	anon, err = c.checkActivation(httptest.NewRequest(http.MethodGet, "/", nil), ps)
+	if err != nil {
+		t.Fatalf("anonymous request for a running backend must pass, got %v", err)
+	}
+	if _, err := c.GetUpstreams(withProcessState(anon, ps)); err != nil {
+		t.Fatal(err)
+	}
+	if n := runner.next.Load(); n != 1 {
+		t.Fatalf("backend started %d times, want 1", n)
+	}
+
+	// Had the backend stopped meanwhile, the anonymous request must not
+	// start it again.
+	ps.mu.Lock()
+	err = c.startLocked(context.Background(), anon, ps, "")
+	ps.mu.Unlock()
+	if !errors.As(err, &he) || he.StatusCode != http.StatusPaymentRequired {
+		t.Fatalf("anonymous request must not start a backend, got %v", err)
+	}
+	if n := runner.next.Load(); n != 1 {
+		t.Fatalf("backend started %d times, want 1", n)
+	}
+}
+
+// memStore is an in-memory stand-in for Caddy's storage.
+type memStore struct{ data map[string][]byte }
+
+func (m *memStore) Lock(context.Context, string) error   { return nil }
+func (m *memStore) Unlock(context.Context, string) error { return nil }
+func (m *memStore) Store(_ context.Context, key string, value []byte) error {
+	m.data[key] = value
+	return nil
+}
+func (m *memStore) Load(_ context.Context, key string) ([]byte, error) {
+	v, ok := m.data[key]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return v, nil
+}
+func (m *memStore) Delete(_ context.Context, key string) error {
+	if _, ok := m.data[key]; !ok {
+		return fs.ErrNotExist
+	}
+	delete(m.data, key)
+	return nil
+}
+
+// TestMaxColdStarts_RefusesStartsBeyondBudgetUntilNextPeriod verifies a key
+// gets max_cold_starts starts per period, with each key counted on its own.
+func TestMaxColdStarts_RefusesStartsBeyondBudgetUntilNextPeriod(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0).Add(12 * time.Hour)}
+	c := &ReverseBin{
+		MaxColdStarts:  &ColdStartBudget{Count: 2, PeriodMS: 86400000},
+		Clock:          clock,
+		coldStartStore: &memStore{data: map[string][]byte{}},
+		logger:         zaptest.NewLogger(t),
+	}
+	ctx := context.Background()
+
+	var refund func()
+	for i := 0; i < 2; i++ {
+		var err error
+		if refund, err = c.spendColdStart(ctx, "tenant1"); err != nil {
+			t.Fatalf("start %d within the budget refused: %v", i+1, err)
+		}
+	}
+	var he caddyhttp.HandlerError
+	if _, err := c.spendColdStart(ctx, "tenant1"); !errors.As(err, &he) || he.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("start beyond the budget must get 429, got %v", err)
+	}
+	if _, err := c.spendColdStart(ctx, "tenant2"); err != nil {
+		t.Fatalf("another key has its own budget, got %v", err)
+	}
+
+	// A start that failed is given back (synth-1254).
+	refund()
+	if _, err := c.spendColdStart(ctx, "tenant1"); err != nil {
+		t.Fatalf("start after a failed one was given back refused: %v", err)
+	}
+
+	// The budget is renewed at midnight UTC.
+	clock.now = time.Unix(0, 0).Add(24 * time.Hour)
+	if _, err := c.spendColdStart(ctx, "tenant1"); err != nil {
+		t.Fatalf("start in the next period refused: %v", err)
+	}
+}
+
+// TestPollReadiness_BacksOffBetweenFailedPolls verifies readiness_interval
+// backoff doubles the wait after each failed poll up to its maximum.
+func TestPollReadiness_BacksOffBetweenFailedPolls(t *testing.T) {
+	c := &ReverseBin{ReadinessIntervalMS: 1, ReadinessBackoffMaxMS: 8}
+	var polls []time.Time
+	probe := func() bool {
+		polls = append(polls, time.Now())
+		return len(polls) == 6
+	}
+	ready := make(chan bool, 1)
+	c.pollReadiness(context.Background(), time.Hour, probe, ready)
+
+	if !<-ready || len(polls) != 6 {
+		t.Fatalf("polled %d times, want 6", len(polls))
+	}
+	// Waits of 1, 2, 4 and 8ms precede the fifth poll, capped at 8ms after.
+	if gap := polls[5].Sub(polls[4]); gap < 8*time.Millisecond {
+		t.Fatalf("last wait was %s, want the 8ms backoff maximum", gap)
+	}
+	if total := polls[5].Sub(polls[0]); total < 22*time.Millisecond {
+		t.Fatalf("waited %s in total, want at least 2+4+8+8ms", total)
+	}
+}
+
+// TestWriteStateFile_WritesJSONAndPrometheusSnapshots verifies the state file
+// holds the process table as JSON, or in the Prometheus text format for .prom
+// paths.
+func TestWriteStateFile_WritesJSONAndPrometheusSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	c := &ReverseBin{
+		ReverseProxyTo: "127.0.0.1:8080",
+		logger:         zaptest.NewLogger(t),
+		processes:      map[string]*processState{},
+	}
+	ps := c.getOrCreateProcessState("tenant\"1\"")
+	ps.process = pidProcess(42)
+	ps.activeRequests = 3
+	now := time.Unix(1700000000, 0)
+
+	c.StateFile = &StateFile{Path: filepath.Join(dir, "state.json")}
+	if err := c.writeStateFile(now); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(c.StateFile.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snapshot struct {
+		Updated   time.Time     `json:"updated"`
+		Processes []processInfo `json:"processes"`
+	}
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	want := processInfo{Key: `tenant"1"`, State: "running", PID: 42, ActiveRequests: 3}
+	if !snapshot.Updated.Equal(now) || len(snapshot.Processes) != 1 || snapshot.Processes[0] != want {
+		t.Fatalf("JSON snapshot = %+v", snapshot)
+	}
+
+	c.StateFile = &StateFile{Path: filepath.Join(dir, "reverse_bin.prom")}
+	if err := c.writeStateFile(now); err != nil {
+		t.Fatal(err)
+	}
+	data, err = os.ReadFile(c.StateFile.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`caddy_reverse_bin_process_state{key="tenant\"1\"",state="running"} 1`,
+		`caddy_reverse_bin_process_pid{key="tenant\"1\""} 42`,
+		`caddy_reverse_bin_process_active_requests{key="tenant\"1\""} 3`,
+		`caddy_reverse_bin_state_file_timestamp_seconds 1700000000`,
+	} {
+		if !strings.Contains(string(data), line+"\n") {
+			t.Errorf("Prometheus snapshot lacks %s:\n%s", line, data)
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Fatalf("temporary files left behind: %v", entries)
+	}
+}
+
+// TestWaitForReadiness_WaitsForExpectedStatus verifies readiness_check expect
+// ignores redirects a framework serves before the app is up.
+func TestWaitForReadiness_WaitsForExpectedStatus(t *testing.T) {
+	var hits atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) <= 2 {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer backend.Close()
+
+	c := &ReverseBin{ReadinessIntervalMS: 10, logger: zaptest.NewLogger(t)}
+	addr := strings.TrimPrefix(backend.URL, "http://")
+	method, path, expect := http.MethodGet, "/", []int{200, 204}
+	overrides := &Overrides{ReverseProxyTo: &addr, ReadinessMethod: &method, ReadinessPath: &path, ReadinessStatus: &expect}
+	// Polls answered with 302 fail until the backend answers 204.
+	if err := c.waitForReadiness(context.Background(), overrides, nil, nil, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if n := hits.Load(); n != 3 {
+		t.Fatalf("readiness passed after %d polls, want 3", n)
+	}
+}
+
+// TestCleanSockets_RemovesOnlyOrphans verifies socket_cleanup removes an old
+// socket nothing listens on, and keeps young sockets, sockets still accepting
+// connections and other files (synth-1265).
+func TestCleanSockets_RemovesOnlyOrphans(t *testing.T) {
+	dir := t.TempDir()
+	listen := func(name string) net.Listener {
+		ln, err := net.Listen("unix", filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ln
+	}
+	orphan := listen("orphan.sock")
+	orphan.(*net.UnixListener).SetUnlinkOnClose(false)
+	orphan.Close()
+	young := listen("young.sock")
+	young.(*net.UnixListener).SetUnlinkOnClose(false)
+	young.Close()
+	live := listen("live.sock")
+	defer live.Close()
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	for _, name := range []string{"orphan.sock", "live.sock", "notes.txt"} {
+		if err := os.Chtimes(filepath.Join(dir, name), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := &ReverseBin{SocketCleanup: &SocketCleanup{Dir: dir}, logger: zap.NewNop()}
+	if n := c.cleanSockets(time.Now()); n != 1 {
+		t.Fatalf("removed %d sockets, want 1", n)
+	}
+	for name, want := range map[string]bool{"orphan.sock": false, "young.sock": true, "live.sock": true, "notes.txt": true} {
+		if _, err := os.Lstat(filepath.Join(dir, name)); (err == nil) != want {
+			t.Errorf("%s exists = %v, want %v", name, err == nil, want)
+		}
+	}
+}
+
+// TestStartedLocked_CoolsDownCrashLoops verifies a key started crash_loop
+// times within the period refuses further starts with a 503 until the
+// cooldown is over (synth-1264~2).
+func TestStartedLocked_CoolsDownCrashLoops(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	c := &ReverseBin{CrashLoop: &CrashLoop{Count: 3, PeriodMS: 30000, CooldownMS: 60000}, Clock: clock, logger: zap.NewNop()}
+	ps := &processState{key: "app", failed: true}
+	for i := range 3 {
+		if err := c.backoffError(nil, ps); err != nil {
+			t.Fatalf("start %d refused: %v", i+1, err)
+		}
+		c.startedLocked(ps)
+		clock.now = clock.now.Add(5 * time.Second)
+	}
+	err := c.backoffError(nil, ps)
+	var herr caddyhttp.HandlerError
+	if !errors.As(err, &herr) || herr.StatusCode != http.StatusServiceUnavailable || !strings.Contains(err.Error(), "crash-looping") {
+		t.Fatalf("got %v, want a 503 for the crash loop", err)
+	}
+	clock.now = clock.now.Add(time.Minute)
+	if err := c.backoffError(nil, ps); err != nil {
+		t.Fatalf("start refused after the cooldown: %v", err)
+	}
+}
+
+// TestStartedLocked_IgnoresIdleRestarts verifies starts that follow an idle
+// stop do not count towards crash_loop, however often they happen
+// (synth-1264~2).
+func TestStartedLocked_IgnoresIdleRestarts(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer backend.Close()
+	c := &ReverseBin{
+		Executable:          []string{"./app"},
+		ReverseProxyTo:      strings.TrimPrefix(backend.URL, "http://"),
+		ReadinessMethod:     http.MethodGet,
+		ReadinessPath:       "/",
+		ReadinessIntervalMS: 10,
+		IdleTimeoutMS:       60000,
+		CrashLoop:           &CrashLoop{Count: 2, PeriodMS: 30000},
+		Runner:              &pidRunner{},
+		logger:              zap.NewNop(),
+		processes:           map[string]*processState{},
+		ctx:                 caddy.Context{Context: context.Background()},
+	}
+	ps := c.getOrCreateProcessState("")
+	for i := range 5 {
+		if err := c.startUnrequested(context.Background(), ps, "prewarm", false); err != nil {
+			t.Fatalf("start %d: %v", i+1, err)
+		}
+		ps.mu.Lock()
+		ps.stopLocked("idle timeout")
+		ps.mu.Unlock()
+	}
+	if err := c.backoffError(nil, ps); err != nil {
+		t.Fatalf("idle restarts tripped crash_loop: %v", err)
+	}
+}
+
+// TestHintIdle_TellsBackendIdleTimeout verifies idle_hint_header replaces any
+// client-sent value with the request's idle timeout, and is dropped when the
+// backend is never stopped for being idle (synth-1264).
+func TestHintIdle_TellsBackendIdleTimeout(t *testing.T) {
+	c := &ReverseBin{IdleHintHeader: "X-Idle"}
+	h := http.Header{"X-Idle": {"1"}}
+	c.hintIdle(h, 90*time.Second)
+	if got := h.Values("X-Idle"); len(got) != 1 || got[0] != "90000" {
+		t.Fatalf("got %v, want [90000]", got)
+	}
+	c.hintIdle(h, 0)
+	if _, ok := h["X-Idle"]; ok {
+		t.Fatal("hint must be dropped without an idle timeout")
+	}
+}
+
+// TestReplicaPolicy_SpreadsRequests verifies round_robin sends requests to
+// each copy in turn even while one is idle, random stays among the copies,
+// and replica_policy without copies is rejected (synth-1268~2).
+func TestReplicaPolicy_SpreadsRequests(t *testing.T) {
+	c := &ReverseBin{
+		Executable:     []string{"./app"},
+		ReverseProxyTo: "unix//run/app-{reverse_bin.instance}.sock",
+		Replicas:       3,
+		ReplicaPolicy:  "round_robin",
+		logger:         zap.NewNop(),
+		processes:      map[string]*processState{},
+	}
+	if err := c.validateInstances(); err != nil {
+		t.Fatal(err)
+	}
+	idle := c.getOrCreateProcessState("")
+	idle.running.Store(true)
+	got := map[string]int{}
+	for range 6 {
+		got[c.pickInstance("")]++
+	}
+	if want := map[string]int{"": 2, "@1": 2, "@2": 2}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("round_robin picked %v, want %v", got, want)
+	}
+
+	c.ReplicaPolicy = "random"
+	for range 20 {
+		if key := c.pickInstance(""); key != "" && key != "@1" && key != "@2" {
+			t.Fatalf("random picked %q", key)
+		}
+	}
+
+	c.Replicas = 0
+	if err := c.validateInstances(); err == nil {
+		t.Fatal("replica_policy without replicas must be rejected")
+	}
+}
+
+// TestReplicaAffinity_KeepsClientOnCopy verifies a client without a cookie
+// is bound to the copy it was sent to, returns to it while other copies are
+// idle, and that a header value always maps to the same copy
+// (synth-1269~2).
+func TestReplicaAffinity_KeepsClientOnCopy(t *testing.T) {
+	c := &ReverseBin{
+		Executable:      []string{"./app"},
+		ReverseProxyTo:  "unix//run/app-{reverse_bin.instance}.sock",
+		Replicas:        3,
+		ReplicaAffinity: &ReplicaAffinity{Cookie: "replica"},
+		logger:          zap.NewNop(),
+		processes:       map[string]*processState{},
+	}
+	if err := c.validateInstances(); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	first := c.replicaFor(rec, httptest.NewRequest(http.MethodGet, "/", nil), "acme")
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != c.affinityCookie("acme") {
+		t.Fatalf("got cookies %v, want the replica cookie", cookies)
+	}
+	for range 3 {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(cookies[0])
+		rec := httptest.NewRecorder()
+		if got := c.replicaFor(rec, req, "acme"); got != first {
+			t.Fatalf("got %q, want the bound copy %q", got, first)
+		}
+		if len(rec.Result().Cookies()) != 0 {
+			t.Fatal("a bound client must not be given another cookie")
+		}
+	}
+
+	c.ReplicaAffinity = &ReplicaAffinity{Header: "X-Session"}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Session", "alice")
+	want := c.replicaFor(httptest.NewRecorder(), req, "acme")
+	for range 3 {
+		if got := c.replicaFor(httptest.NewRecorder(), req, "acme"); got != want {
+			t.Fatalf("got %q, want %q for the same session", got, want)
+		}
+	}
+
+	c.Replicas = 1
+	if err := c.validateInstances(); err == nil {
+		t.Fatal("replica_affinity with a single copy must be rejected")
+	}
+}
+
+// TestReplicaAffinity_CookieIsPerHandler verifies two handlers serving one
+// site do not bind a client through each other's affinity cookie, that a
+// config edit keeps clients bound, and that a cookie naming a copy that no
+// longer exists is replaced (synth-1269~2).
+func TestReplicaAffinity_CookieIsPerHandler(t *testing.T) {
+	handler := func(app string, replicas int, hash string) *ReverseBin {
+		return &ReverseBin{
+			Executable:      []string{app},
+			ReverseProxyTo:  "unix//run/app-{reverse_bin.instance}.sock",
+			Replicas:        replicas,
+			ReplicaAffinity: &ReplicaAffinity{Cookie: defaultAffinityCookie},
+			ReplicaPolicy:   "round_robin",
+			configHash:      hash,
+			logger:          zap.NewNop(),
+			processes:       map[string]*processState{},
+		}
+	}
+	blog, shop := handler("./blog", 4, "aaaaaaaa11"), handler("./shop", 2, "bbbbbbbb22")
+	rec := httptest.NewRecorder()
+	blog.replicaFor(rec, httptest.NewRequest(http.MethodGet, "/", nil), "acme")
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || !strings.HasPrefix(cookies[0].Name, defaultAffinityCookie+"_") {
+		t.Fatalf("got cookies %v, want one named after the handler", cookies)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[0])
+	rec = httptest.NewRecorder()
+	shop.replicaFor(rec, req, "acme")
+	got := rec.Result().Cookies()
+	if len(got) != 1 || got[0].Name == cookies[0].Name {
+		t.Fatalf("got cookies %v, want the other handler to set its own", got)
+	}
+
+	// An edit elsewhere in the config keeps the client on its copy.
+	edited := handler("./blog", 4, "cccccccc33")
+	bound := &http.Cookie{Name: cookies[0].Name, Value: "3"}
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(bound)
+	rec = httptest.NewRecorder()
+	if key := edited.replicaFor(rec, req, "acme"); key != instanceKey("acme", 3) || len(rec.Result().Cookies()) != 0 {
+		t.Fatalf("got copy %q and cookies %v, want the bound copy 3", key, rec.Result().Cookies())
+	}
+
+	// With fewer replicas, the copy is gone and the client is bound anew.
+	fewer := handler("./blog", 2, "dddddddd44")
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(bound)
+	rec = httptest.NewRecorder()
+	fewer.replicaFor(rec, req, "acme")
+	got = rec.Result().Cookies()
+	if len(got) != 1 || got[0].Name != bound.Name || got[0].Value == "3" {
+		t.Fatalf("got cookies %v, want the client bound to an existing copy", got)
+	}
+}
+
+// TestKeepAlive_ExtendsIdleTimeoutUpToMax verifies a backend printing
+// REVERSE_BIN_KEEPALIVE re-arms its idle timer for longer, capped at
+// backend_keepalive after its last request, and is ignored while the backend
+// is never stopped for being idle (synth-1268).
+func TestKeepAlive_ExtendsIdleTimeoutUpToMax(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	c := &ReverseBin{BackendKeepAliveMaxMS: 600000, logger: zap.NewNop()}
+	ps := &processState{clock: clock, process: stubProcess{}}
+	logger := zaptest.NewLogger(t)
+
+	ps.incrementRequests(logger, "")
+	ps.decrementRequests(logger, "", time.Minute, true)
+	clock.now = clock.now.Add(30 * time.Second)
+	c.keepAlive(ps, 1, 5*time.Minute)
+	c.keepAlive(ps, 1, time.Hour)
+	c.keepAlive(ps, 7, time.Hour)
+
+	want := []time.Duration{time.Minute, 5 * time.Minute, 9*time.Minute + 30*time.Second}
+	if !reflect.DeepEqual(clock.armed, want) {
+		t.Fatalf("armed idle timers %v, want %v", clock.armed, want)
+	}
+
+	idle := &processState{clock: clock, process: stubProcess{}}
+	c.keepAlive(idle, 1, time.Minute)
+	if !idle.idleDeadline.IsZero() || idle.idleTimer != nil {
+		t.Fatal("keepalive must not arm a timer for a backend without an idle timeout")
+	}
+	if got := c.keepAliveEnv(); !reflect.DeepEqual(got, []string{"REVERSE_BIN_KEEPALIVE_MAX_MS=600000"}) {
+		t.Fatalf("env %v", got)
+	}
+}
+
+// TestServeCGI_PromotesBusyKeys verifies cgi_until runs the executable as a
+// CGI script per request until requests arrive at the configured rate, and
+// then leaves the request to start a persistent backend (synth-1263~2).
+func TestServeCGI_PromotesBusyKeys(t *testing.T) {
+	dir := t.TempDir()
+	script := "#!/bin/sh\nprintf 'Content-Type: text/plain\\n\\n%s %s' \"$GATEWAY_INTERFACE\" \"$APP_MODE\"\n"
+	if err := os.WriteFile(filepath.Join(dir, "app.sh"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	c := &ReverseBin{
+		Executable:       []string{"./app.sh"},
+		WorkingDirectory: dir,
+		Envs:             []string{"APP_MODE=tenant"},
+		ReverseProxyTo:   "127.0.0.1:8080",
+		ReadinessMethod:  http.MethodGet,
+		ReadinessPath:    "/",
+		CGI:              &CGIMode{Count: 3, PeriodMS: 60000},
+		Clock:            clock,
+		logger:           zap.NewNop(),
+		processes:        map[string]*processState{},
+	}
+	det := &countingDetector{addrDetector: addrDetector{addr: "127.0.0.1:8080"}}
+	c.detector = det
+	ps := c.getOrCreateProcessState("")
+	for i := range 2 {
+		rec := httptest.NewRecorder()
+		served, err := c.serveCGI(rec, httptest.NewRequest(http.MethodGet, "/", nil), ps, "")
+		if !served || err != nil {
+			t.Fatalf("request %d: served %v, %v; want it served as CGI", i+1, served, err)
+		}
+		if body := rec.Body.String(); body != "CGI/1.1 tenant" {
+			t.Fatalf("request %d: got %q from the script", i+1, body)
+		}
+		clock.now = clock.now.Add(10 * time.Second)
+	}
+	// The detector runs for the first CGI request only (synth-1263~2).
+	if det.runs != 1 {
+		t.Fatalf("detector ran %d times for 2 CGI requests, want once", det.runs)
+	}
+	// The third request within a minute promotes the key.
+	served, err := c.serveCGI(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), ps, "")
+	if served || err != nil {
+		t.Fatalf("got served %v, %v; want the request left to a persistent backend", served, err)
+	}
+	if ps.cgiOverrides.Load() != nil {
+		t.Fatal("a promoted key must detect afresh")
+	}
+}
+
+// TestCrashedLocked_BacksOffThenHalts verifies crashes in a row hold off the
+// next start for a doubling time, and that the key is kept stopped with a
+// clear error once max_restarts is spent (synth-1263).
+func TestCrashedLocked_BacksOffThenHalts(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	c := &ReverseBin{MaxRestarts: 2, RestartBackoffMS: 1000, RestartBackoffMaxMS: 60000, Clock: clock, logger: zap.NewNop()}
+	ps := &processState{key: "app"}
+	for i, want := range []time.Duration{time.Second, 2 * time.Second} {
+		if c.crashedLocked(ps, time.Second) {
+			t.Fatalf("crash %d: halted before max_restarts was spent", i+1)
+		}
+		if got := time.Unix(0, ps.retryAt.Load()).Sub(clock.now); got != want {
+			t.Fatalf("crash %d: held off for %s, want %s", i+1, got, want)
+		}
+	}
+	err := c.backoffError(nil, ps)
+	if err == nil || !strings.Contains(err.Error(), "crashed 2 times in a row") {
+		t.Fatalf("got %v, want a crash backoff error", err)
+	}
+	if !c.crashedLocked(ps, time.Second) {
+		t.Fatal("third crash in a row must keep the key stopped")
+	}
+	if halted := ps.halted.Load(); halted == nil || !strings.Contains(*halted, "max_restarts 2") {
+		t.Fatalf("got %v, want the key halted by max_restarts", halted)
+	}
+
+	// A backend that ran for the backoff maximum starts a new series.
+	ps = &processState{key: "app", crashes: 2}
+	if c.crashedLocked(ps, time.Minute) || ps.crashes != 1 {
+		t.Fatalf("got %d crashes, want a new series", ps.crashes)
+	}
+}
+
+// TestResolvePlatformExecs_PicksHostPlatform verifies exec lines for the
+// host's GOOS/GOARCH win over the plain exec, and that a fleet member without
+// an exec of its own fails to provision (synth-1262~2).
+func TestResolvePlatformExecs_PicksHostPlatform(t *testing.T) {
+	byPlatform := map[string][]string{"linux/amd64": {"./server-amd64"}, "linux/arm64": {"./server-arm64"}}
+	c := &ReverseBin{ExecPlatforms: byPlatform, Executable: []string{"./server"},
+		Apps: map[string]*App{"a": {ExecPlatforms: map[string][]string{"linux/arm64": {"./a-arm64"}}}}}
+	if err := c.resolvePlatformExecs("linux/arm64"); err != nil {
+		t.Fatal(err)
+	}
+	if c.Executable[0] != "./server-arm64" || c.Apps["a"].Executable[0] != "./a-arm64" {
+		t.Fatalf("got %v and %v, want the arm64 builds", c.Executable, c.Apps["a"].Executable)
+	}
+
+	// Hosts without a matching line fall back to the plain exec...
+	c = &ReverseBin{ExecPlatforms: byPlatform, Executable: []string{"./server"}}
+	if err := c.resolvePlatformExecs("darwin/arm64"); err != nil || c.Executable[0] != "./server" {
+		t.Fatalf("got %v, %v, want the plain exec", c.Executable, err)
+	}
+	// ...and fail without one.
+	c = &ReverseBin{ExecPlatforms: byPlatform}
+	err := c.resolvePlatformExecs("linux/riscv64")
+	if err == nil || !strings.Contains(err.Error(), "linux/amd64, linux/arm64") {
+		t.Fatalf("got %v, want an error listing the platforms", err)
+	}
+	// An app with builds for other platforms only does not run the handler's.
+	c = &ReverseBin{Executable: []string{"./server"},
+		Apps: map[string]*App{"a": {ExecPlatforms: map[string][]string{"linux/arm64": {"./a-arm64"}}}}}
+	if err := c.resolvePlatformExecs("linux/amd64"); err == nil || !strings.Contains(err.Error(), `app "a"`) {
+		t.Fatalf("got %v, want the app to fail", err)
+	}
+
+	// Only known platforms are taken for one, not relative paths.
+	for s, want := range map[string]bool{"linux/amd64": true, "windows/arm64": true, "linux/server": false, "bin/server": false} {
+		if got := isPlatform(s); got != want {
+			t.Errorf("isPlatform(%q) = %v, want %v", s, got, want)
+		}
+	}
+}
+
+// addrDetector sends every key to the same backend address.
+type addrDetector struct{ addr string }
+
+func (addrDetector) Key(r *http.Request) string { return r.Host }
+
+func (d addrDetector) Detect(*http.Request, string) (*Overrides, error) {
+	return &Overrides{ReverseProxyTo: &d.addr}, nil
+}
+
+// countingDetector is an addrDetector counting its runs.
+type countingDetector struct {
+	addrDetector
+	runs int
+}
+
+func (d *countingDetector) Detect(r *http.Request, key string) (*Overrides, error) {
+	d.runs++
+	return d.addrDetector.Detect(r, key)
+}
+
+// TestDetectorCache_ReusesResultsUntilTTL verifies detector_cache reuses a
+// key's result, also from another handler sharing the storage, until it
+// expires or is evicted (synth-1271~2).
+func TestDetectorCache_ReusesResultsUntilTTL(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	store := &memStore{data: map[string][]byte{}}
+	newHandler := func(det *countingDetector) *ReverseBin {
+		return &ReverseBin{
+			DynamicProxyDetector: []string{"./detect"},
+			DetectorCache:        &DetectorCache{TTLMS: 60000},
+			Clock:                clock,
+			detector:             det,
+			detectorCacheStore:   store,
+			logger:               zaptest.NewLogger(t),
+		}
+	}
+	det := &countingDetector{addrDetector: addrDetector{addr: "127.0.0.1:9000"}}
+	c := newHandler(det)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	for range 2 {
+		o, err := c.detect(req, "acme")
+		if err != nil || o == nil || *o.ReverseProxyTo != "127.0.0.1:9000" {
+			t.Fatalf("detect = %v, %v", o, err)
+		}
+	}
+	if det.runs != 1 {
+		t.Fatalf("detector ran %d times, want 1", det.runs)
+	}
+
+	other := &countingDetector{addrDetector: det.addrDetector}
+	if _, err := newHandler(other).detect(req, "acme"); err != nil || other.runs != 0 {
+		t.Fatalf("another handler must reuse the stored result, runs=%d err=%v", other.runs, err)
+	}
+
+	clock.now = clock.now.Add(2 * time.Minute)
+	if _, err := c.detect(req, "acme"); err != nil || det.runs != 2 {
+		t.Fatalf("expired result must run the detector again, runs=%d err=%v", det.runs, err)
+	}
+	c.forgetDetected(context.Background(), "acme")
+	if _, err := c.detect(req, "acme"); err != nil || det.runs != 3 {
+		t.Fatalf("evicted result must run the detector again, runs=%d err=%v", det.runs, err)
+	}
+}
+
+// failingDetector fails after a while, counting its runs.
+// failingDetector fails every key. With release set, each run signals
+// entered and then waits for release to be closed.
+type failingDetector struct {
+	runs    atomic.Int32
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (*failingDetector) Key(r *http.Request) string { return r.Host }
+
+func (d *failingDetector) Detect(*http.Request, string) (*Overrides, error) {
+	d.runs.Add(1)
+	if d.release != nil {
+		d.entered <- struct{}{}
+		<-d.release
+	}
+	return nil, errors.New("no such tenant")
+}
+
+// TestColdStart_ConcurrentRequestsShareFailure verifies requests arriving
+// while a key's backend starts share the outcome of that start, so a failing
+// detector runs once rather than once per request (synth-1272).
+func TestColdStart_ConcurrentRequestsShareFailure(t *testing.T) {
+	det := &failingDetector{entered: make(chan struct{}, 2), release: make(chan struct{})}
+	c := &ReverseBin{
+		Executable:     []string{"./app"},
+		ReverseProxyTo: "127.0.0.1:9000",
+		detector:       det,
+		logger:         observedLogger(zaptest.NewLogger(t)),
+		processes:      map[string]*processState{},
+		ctx:            caddy.Context{Context: context.Background()},
+	}
+	ps := c.getOrCreateProcessState("acme")
+	errs := make(chan error, 5)
+	// The detector fails once every other request waits for the start.
+	var joined atomic.Int32
+	stop := ObserveLogs(func(e LogEntry) {
+		if e.Message == "waiting for the cold start in progress" && joined.Add(1) == int32(cap(errs)-1) {
+			close(det.release)
+		}
+	})
+	defer stop()
+	for i := range cap(errs) {
+		if i == 1 {
+			<-det.entered
+		}
+		go func() {
+			_, err := c.ensureProcessRunningAndResolveUpstream(httptest.NewRequest(http.MethodGet, "/", nil), ps, "acme")
+			errs <- err
+		}()
+	}
+	for range cap(errs) {
+		if err := <-errs; err == nil || !strings.Contains(err.Error(), "no such tenant") {
+			t.Fatalf("got %v, want the detector's error", err)
+		}
+	}
+	if n := det.runs.Load(); n != 1 {
+		t.Fatalf("detector ran %d times, want 1", n)
+	}
+
+	// A request arriving after the failure tries again.
+	if _, err := c.ensureProcessRunningAndResolveUpstream(httptest.NewRequest(http.MethodGet, "/", nil), ps, "acme"); err == nil || det.runs.Load() != 2 {
+		t.Fatalf("later request must start again, runs=%d err=%v", det.runs.Load(), err)
+	}
+}
+
+// TestDetect_ClassifiesFailuresOfAnyDetector verifies failures of detector
+// modules other than exec count as detector failures, keeping the status of
+// handler errors and leaving 4xx refusals alone (synth-1267~2).
+func TestDetect_ClassifiesFailuresOfAnyDetector(t *testing.T) {
+	c := &ReverseBin{detector: &failingDetector{}}
+	_, err := c.detect(httptest.NewRequest(http.MethodGet, "/", nil), "acme")
+	if !errors.Is(err, ErrDetectorFailed) || errorCode(err) != "detector_failed" {
+		t.Fatalf("got %v, want a detector failure", err)
+	}
+
+	outage := detectorError(caddyhttp.Error(http.StatusBadGateway, errors.New("down")))
+	var he caddyhttp.HandlerError
+	if !errors.Is(outage, ErrDetectorFailed) || !errors.As(outage, &he) || he.StatusCode != http.StatusBadGateway {
+		t.Fatalf("got %v, want a 502 detector failure", outage)
+	}
+	refusal := caddyhttp.Error(http.StatusForbidden, errors.New("no"))
+	if err := detectorError(refusal); errors.Is(err, ErrDetectorFailed) {
+		t.Fatalf("a refusal must stay a refusal, got %v", err)
+	}
+}
+
+// TestSharedFailure_KeepsRequestFailuresToTheRequest verifies requests that
+// waited for a start only share failures of the start itself, not ones owed
+// to the request that made it (synth-1272).
+func TestSharedFailure_KeepsRequestFailuresToTheRequest(t *testing.T) {
+	plain := httptest.NewRequest(http.MethodGet, "/", nil)
+	probe := httptest.NewRequest(http.MethodGet, "/", nil)
+	markInternal(probe, "prewarm")
+	denied := plain.WithContext(context.WithValue(plain.Context(), noActivationCtxKey{}, true))
+	for _, tc := range []struct {
+		name string
+		r    *http.Request
+		err  error
+		want bool
+	}{
+		{"spawn failure", plain, ErrSpawnFailed, true},
+		{"detector failure", plain, &DetectorError{ExitCode: 1, Err: errors.New("boom")}, true},
+		{"detector outage", plain, caddyhttp.Error(http.StatusBadGateway, errors.New("down")), true},
+		{"detector refusal", plain, caddyhttp.Error(http.StatusForbidden, errors.New("no")), false},
+		{"activation denied", denied, caddyhttp.Error(http.StatusServiceUnavailable, errors.New("denied")), false},
+		{"internal request", probe, ErrSpawnFailed, false},
+		{"success", plain, nil, false},
+	} {
+		if got := sharedFailure(tc.r, tc.err); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+// prefixMatcher matches requests whose path starts with it.
+type prefixMatcher string
+
+func (m prefixMatcher) MatchWithError(r *http.Request) (bool, error) {
+	return strings.HasPrefix(r.URL.Path, string(m)), nil
+}
+
+// TestKeyRules_FirstMatchingRuleKeysRequest verifies key_when keys requests
+// by the first rule that matches and yields a key, and leaves others to the
+// detector (synth-1272~2).
+func TestKeyRules_FirstMatchingRuleKeysRequest(t *testing.T) {
+	c := &ReverseBin{
+		KeyRules: []*KeyRule{
+			{Key: "{reverse_bin.test_tenant}", matcher: prefixMatcher("/t/")},
+			{Key: "beta", matcher: prefixMatcher("/")},
+		},
+		detector: addrDetector{addr: "127.0.0.1:9000"},
+		logger:   zaptest.NewLogger(t),
+	}
+	key := func(path, tenant string) string {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Host = "fallback.example"
+		repl := caddy.NewReplacer()
+		if tenant != "" {
+			repl.Set("reverse_bin.test_tenant", tenant)
+		}
+		return c.getProcessKey(req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl)))
+	}
+	if got := key("/t/x", "acme"); got != "acme" {
+		t.Fatalf("got %q, want acme", got)
+	}
+	// The first rule matches but yields no key; the next one applies.
+	if got := key("/t/x", ""); got != "beta" {
+		t.Fatalf("got %q, want beta", got)
+	}
+	c.KeyRules = c.KeyRules[:1]
+	if got := key("/other", ""); got != "fallback.example" {
+		t.Fatalf("got %q, want the detector's key", got)
+	}
+}
+
+// TestMaxProcesses_EvictsLeastRecentlyUsedIdleBackend verifies that starting
+// a backend beyond max_processes stops the one idle the longest, and fails
+// when every running backend is busy (synth-1273).
+func TestMaxProcesses_EvictsLeastRecentlyUsedIdleBackend(t *testing.T) {
+	c := &ReverseBin{MaxProcesses: 2, logger: zap.NewNop(), processes: map[string]*processState{}}
+	t0 := time.Now()
+	running := func(key string, lastUsed time.Time, active int64) *processState {
+		ps := c.getOrCreateProcessState(key)
+		ps.process = stubProcess{}
+		ps.running.Store(true)
+		ps.lastRequestEnd = lastUsed
+		ps.activeRequests = active
+		return ps
+	}
+	evict := func(key string) error {
+		ps := c.getOrCreateProcessState(key)
+		ps.mu.Lock()
+		defer ps.mu.Unlock()
+		return c.evictForStartLocked(ps)
+	}
+	older := running("older", t0, 0)
+	newer := running("newer", t0.Add(time.Minute), 0)
+
+	if err := evict("new"); err != nil {
+		t.Fatal(err)
+	}
+	if older.process != nil || newer.process == nil {
+		t.Fatal("the backend idle the longest must be evicted")
+	}
+
+	// Below the limit nothing is evicted.
+	if err := evict("new"); err != nil || newer.process == nil {
+		t.Fatalf("a backend was evicted below the limit: %v", err)
+	}
+
+	// Busy backends are never evicted.
+	newer.activeRequests = 1
+	running("busy", t0, 1)
+	err := evict("new")
+	var he caddyhttp.HandlerError
+	if !errors.Is(err, ErrMaxProcesses) || !errors.As(err, &he) || he.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("got %v, want 503 ErrMaxProcesses", err)
+	}
+	if newer.process == nil {
+		t.Fatal("a busy backend was evicted")
+	}
+}
+
+// TestGlobalMaxProcesses_EvictsAcrossHandlers verifies the global
+// reverse_bin_max_processes caps the backends of all handlers together, so a
+// start in one handler evicts the idle backend of another (synth-1273).
+func TestGlobalMaxProcesses_EvictsAcrossHandlers(t *testing.T) {
+	newHandler := func() *ReverseBin {
+		c := &ReverseBin{GlobalMaxProcesses: 2, logger: zap.NewNop(), processes: map[string]*processState{}}
+		registerHandler(c)
+		t.Cleanup(func() { unregisterHandler(c) })
+		return c
+	}
+	a, b := newHandler(), newHandler()
+	t0 := time.Now()
+	running := func(c *ReverseBin, key string, lastUsed time.Time) *processState {
+		ps := c.getOrCreateProcessState(key)
+		ps.process = stubProcess{}
+		ps.running.Store(true)
+		ps.lastRequestEnd = lastUsed
+		return ps
+	}
+	older := running(a, "older", t0)
+	newer := running(b, "newer", t0.Add(time.Minute))
+
+	ps := b.getOrCreateProcessState("new")
+	ps.mu.Lock()
+	err := b.evictForStartLocked(ps)
+	ps.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if older.process != nil || newer.process == nil {
+		t.Fatal("the backend idle the longest across handlers must be evicted")
+	}
+}
+
+// TestUpstreamRateLimit_SpacesRequestsAndShedsBeyondTimeout verifies that
+// upstream_rate_limit lets a burst through at once, spaces out later requests,
+// and turns away with 429 those whose turn comes after the queue timeout
+// (synth-1273~2).
+func TestUpstreamRateLimit_SpacesRequestsAndShedsBeyondTimeout(t *testing.T) {
+	l := &UpstreamRateLimit{Requests: 10, PeriodMS: 1000, Burst: 2}
+	var b rateBucket
+	now := time.Now()
+	for i, want := range []time.Duration{0, 0, 100 * time.Millisecond, 200 * time.Millisecond} {
+		if _, wait, ok := b.reserve(now, time.Time{}, l); !ok || wait != want {
+			t.Fatalf("request %d: waits %s, want %s", i, wait, want)
+		}
+	}
+	// A turn past the deadline is not taken.
+	if _, _, ok := b.reserve(now, now.Add(250*time.Millisecond), l); ok {
+		t.Fatal("a turn past the deadline was handed out")
+	}
+	if _, wait, _ := b.reserve(now, time.Time{}, l); wait != 300*time.Millisecond {
+		t.Fatalf("refused turn was kept: next waits %s", wait)
+	}
+
+	c := &ReverseBin{UpstreamRateLimit: &UpstreamRateLimit{Requests: 1, PeriodMS: 60000}, QueueTimeoutMS: 50}
+	ps := &processState{}
+	release, err := c.acquireSlot(context.Background(), ps, "k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	_, err = c.acquireSlot(context.Background(), ps, "k")
+	var he caddyhttp.HandlerError
+	if !errors.Is(err, ErrRateLimited) || !errors.As(err, &he) || he.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("got %v, want 429 ErrRateLimited", err)
+	}
+	rec := httptest.NewRecorder()
+	c.shedLoad(rec, "k", err)
+	if rec.Header().Get("Retry-After") == "" {
+		t.Fatal("rate-limited request must be told when to retry")
+	}
+}
+
+// TestRateBucket_CancelGivesBackOnlyTheLatestTurn verifies a request that
+// stops waiting gives its turn back only while no later turn was handed out,
+// so later requests keep theirs (synth-1273~2).
+func TestRateBucket_CancelGivesBackOnlyTheLatestTurn(t *testing.T) {
+	l := &UpstreamRateLimit{Requests: 10, PeriodMS: 1000}
+	var b rateBucket
+	now := time.Now()
+	b.reserve(now, time.Time{}, l)
+	first, _, _ := b.reserve(now, time.Time{}, l)
+	b.reserve(now, time.Time{}, l)
+	b.cancel(first, l)
+	if _, wait, _ := b.reserve(now, time.Time{}, l); wait != 300*time.Millisecond {
+		t.Fatalf("cancelling an earlier turn moved later ones: next waits %s", wait)
+	}
+	last, _, _ := b.reserve(now, time.Time{}, l)
+	b.cancel(last, l)
+	if _, wait, _ := b.reserve(now, time.Time{}, l); wait != 400*time.Millisecond {
+		t.Fatalf("latest turn was not given back: next waits %s", wait)
+	}
+}
+
+// TestWaitTurn_UsesHandlerClock verifies upstream_rate_limit reads the time
+// and arms its wait on the handler's Clock (synth-1273~2).
+func TestWaitTurn_UsesHandlerClock(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	c := &ReverseBin{UpstreamRateLimit: &UpstreamRateLimit{Requests: 1, PeriodMS: 1000}, Clock: clock}
+	ps := &processState{}
+	if err := c.waitTurn(context.Background(), ps); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.waitTurn(ctx, ps); err == nil {
+		t.Fatal("a cancelled request must stop waiting")
+	}
+	if want := []time.Duration{time.Second}; !reflect.DeepEqual(clock.armed, want) {
+		t.Fatalf("armed waits %v, want %v", clock.armed, want)
+	}
+	if want := time.Unix(1, 0); !ps.rate.due.Equal(want) {
+		t.Fatalf("turn due %s, want %s from the fake clock", ps.rate.due, want)
+	}
+}
+
+// TestCompatMode_NormalizesRequests verifies compat_mode drops Expect, sends
+// a chunked body with a Content-Length, forwards HTTP/1.0 as HTTP/1.1 and
+// refuses bodies over its buffer (synth-1274).
+func TestCompatMode_NormalizesRequests(t *testing.T) {
+	c := &ReverseBin{CompatMode: &CompatMode{MaxBufferBytes: 8}}
+	req := httptest.NewRequest(http.MethodPost, "/", io.NopCloser(strings.NewReader("hello")))
+	req.ContentLength = -1
+	req.TransferEncoding = []string{"chunked"}
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/1.0", 1, 0
+	req.Header.Set("Expect", "100-continue")
+	if err := c.normalizeRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(req.Body)
+	if string(body) != "hello" || req.ContentLength != 5 || req.TransferEncoding != nil {
+		t.Fatalf("body %q sent with length %d and encoding %v", body, req.ContentLength, req.TransferEncoding)
+	}
+	if req.Header.Get("Expect") != "" || req.Proto != "HTTP/1.1" {
+		t.Fatalf("Expect %q and protocol %s must be normalized", req.Header.Get("Expect"), req.Proto)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/", io.NopCloser(strings.NewReader("too long a body")))
+	req.ContentLength = -1
+	var he caddyhttp.HandlerError
+	if err := c.normalizeRequest(req); !errors.As(err, &he) || he.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("got %v, want 413", err)
+	}
+}
+
+// TestReapStates_ForgetsStaleKeys verifies process_state_ttl removes keys
+// without a backend or requests once unused for the TTL, and keeps running,
+// busy, backed-off and recently used ones, and that a restart of a removed
+// state is refused (synth-1274~2).
+func TestReapStates_ForgetsStaleKeys(t *testing.T) {
+	c := &ReverseBin{ProcessStateTTLMS: 60000, logger: zap.NewNop(), processes: map[string]*processState{},
+		provisioned: map[string]*Overrides{"stale": {}}}
+	for _, key := range []string{"stale", "running", "busy", "backoff", "recent"} {
+		c.getOrCreateProcessState(key)
+	}
+	reaped := c.processes["stale"]
+	now := time.Now().Add(2 * time.Minute)
+	c.processes["running"].process = stubProcess{}
+	c.processes["busy"].activeRequests = 1
+	c.processes["backoff"].retryAt.Store(now.Add(time.Minute).UnixNano())
+	c.processes["recent"].lastUsed = now.Add(-time.Second)
+
+	if removed := c.reapStates(now); removed != 1 {
+		t.Fatalf("removed %d keys, want 1", removed)
+	}
+	if _, ok := c.processes["stale"]; ok || len(c.processes) != 4 {
+		t.Fatalf("only the stale key may be forgotten, left %d keys", len(c.processes))
+	}
+	if _, ok := c.provisioned["stale"]; ok {
+		t.Fatal("a forgotten key must be asked about again")
+	}
+	// A restart racing with the reaper must not start a backend nobody tracks.
+	if err := c.startUnrequested(context.Background(), reaped, "liveness", false); err == nil || !strings.Contains(err.Error(), "forgotten") {
+		t.Fatal("a removed state must not be started")
+	}
+	if ps := c.getOrCreateProcessState("stale"); ps.activeRequests != 0 || ps.process != nil {
+		t.Fatal("a forgotten key must start from a fresh state")
+	}
+}
+
+// TestIdleTimeoutFor_DetectorSetsKeyTimeout verifies a detector's
+// idle_timeout_ms replaces the handler's idle timeout for its key, while a
+// matching idle_timeout override still wins (synth-1275).
+func TestIdleTimeoutFor_DetectorSetsKeyTimeout(t *testing.T) {
+	c := &ReverseBin{
+		IdleTimeoutMS: 5000,
+		IdleOverrides: []*IdleOverride{{TimeoutMS: 1000, matcherSets: caddyhttp.MatcherSets{{prefixMatcher("/assets/")}}}},
+	}
+	ps := &processState{}
+	ten := 600000
+	ps.setDetectedIdle(&Overrides{IdleTimeoutMS: &ten})
+	idle := func(path string) time.Duration {
+		d, err := c.idleTimeoutFor(httptest.NewRequest(http.MethodGet, path, nil), ps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	if got := idle("/"); got != 10*time.Minute {
+		t.Fatalf("got %s, want the detector's 10m", got)
+	}
+	if got := idle("/assets/app.js"); got != time.Second {
+		t.Fatalf("got %s, want the matching override's 1s", got)
+	}
+	ps.setDetectedIdle(&Overrides{})
+	if got := idle("/"); got != 5*time.Second {
+		t.Fatalf("got %s, want idle_timeout once the detector sets none", got)
+	}
+}
+
+// TestPrewarm_StartsListedDetectorKeys verifies prewarm starts the listed keys
+// of a detector handler without waiting for a request (synth-1265~2).
+func TestPrewarm_StartsListedDetectorKeys(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer backend.Close()
+	runner := &pidRunner{}
+	c := &ReverseBin{
+		Executable:          []string{"./app"},
+		ReadinessMethod:     http.MethodGet,
+		ReadinessPath:       "/",
+		ReadinessIntervalMS: 10,
+		IdleTimeoutMS:       60000,
+		PrewarmKeys:         []string{"acme", "globex"},
+		Runner:              runner,
+		detector:            addrDetector{strings.TrimPrefix(backend.URL, "http://")},
+		logger:              zap.NewNop(),
+		processes:           map[string]*processState{},
+		ctx:                 caddy.Context{Context: context.Background()},
+	}
+	c.prewarm()
+	for _, key := range c.PrewarmKeys {
+		ps := c.getOrCreateProcessState(key)
+		if !ps.running.Load() {
+			t.Errorf("key %q was not started", key)
+		}
+		ps.mu.Lock()
+		ps.stopLocked("test done")
+		ps.mu.Unlock()
+	}
+	if n := runner.next.Load(); n != 2 {
+		t.Fatalf("got %d starts, want 2", n)
+	}
+
+	// Keys the detector would only find on a request are still refused.
+	if err := c.warm(context.Background(), c.getOrCreateProcessState("initech")); err == nil {
+		t.Fatal("a key not listed in prewarm must need a request")
+	}
+}
+
+// socketRunner starts backends that listen on their unix socket, recording
+// the command lines they were started with.
+type socketRunner struct {
+	mu   sync.Mutex
+	exes [][]string
+}
+
+func (r *socketRunner) Start(ctx context.Context, spec ProcessSpec) (Process, <-chan error, error) {
+	ln, err := net.Listen("unix", strings.TrimPrefix(spec.ReverseProxyTo, "unix/"))
+	if err != nil {
+		return nil, nil, err
+	}
+	r.mu.Lock()
+	r.exes = append(r.exes, spec.Executable)
+	r.mu.Unlock()
+	exited := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+		exited <- ctx.Err()
+	}()
+	return stubProcess{}, exited, nil
+}
+
+// TestMinInstances_KeepsCopiesRunning verifies min_instances starts each copy
+// on its own socket, exempts them from the idle timeout and rotates requests
+// among them (synth-1266~2).
+func TestMinInstances_KeepsCopiesRunning(t *testing.T) {
+	runner := &socketRunner{}
+	c := &ReverseBin{
+		Executable:     []string{"./app", "--instance", "{reverse_bin.instance}"},
+		ReverseProxyTo: "unix/" + filepath.Join(t.TempDir(), "app-{reverse_bin.instance}.sock"),
+		MinInstances:   2,
+		IdleTimeoutMS:  5000,
+		Runner:         runner,
+		logger:         zap.NewNop(),
+		processes:      map[string]*processState{},
+		ctx:            caddy.Context{Context: context.Background()},
+	}
+	if err := c.validateInstances(); err != nil {
+		t.Fatal(err)
+	}
+	c.startMissingInstances()
+	defer func() {
+		for _, key := range []string{"", "@1"} {
+			ps := c.getOrCreateProcessState(key)
+			ps.mu.Lock()
+			ps.stopLocked("test done")
+			ps.mu.Unlock()
+		}
+	}()
+	got := map[string]bool{}
+	for _, exe := range runner.exes {
+		got[exe[2]] = true
+	}
+	if !reflect.DeepEqual(got, map[string]bool{"0": true, "1": true}) {
+		t.Fatalf("started copies %v, want 0 and 1", got)
+	}
+
+	if timeout, _ := c.idleTimeoutFor(httptest.NewRequest(http.MethodGet, "/", nil), c.getOrCreateProcessState("")); timeout != 0 {
+		t.Fatalf("copies must not be stopped when idle, got timeout %v", timeout)
+	}
+	first, second := c.pickInstance(""), c.pickInstance("")
+	if first == second {
+		t.Fatalf("requests must take turns among copies, got %q twice", first)
+	}
+
+	// Without a distinct address for each copy, the config is rejected.
+	c.ReverseProxyTo = "unix/app.sock"
+	if err := c.validateInstances(); err == nil {
+		t.Fatal("copies sharing one socket must be rejected")
+	}
+}
+
+// TestReplicas_StartsCopiesWhenOthersAreBusy verifies requests go to an idle
+// running copy, start another copy while all running ones are busy, and
+// otherwise go to the least busy copy; each copy gets its own address
+// (synth-1267).
+func TestReplicas_StartsCopiesWhenOthersAreBusy(t *testing.T) {
+	c := &ReverseBin{
+		Executable:     []string{"./app"},
+		ReverseProxyTo: "unix//run/app-{reverse_bin.instance}.sock",
+		Replicas:       3,
+		logger:         zap.NewNop(),
+		processes:      map[string]*processState{},
+	}
+	if err := c.validateInstances(); err != nil {
+		t.Fatal(err)
+	}
+	first := c.pickInstance("")
+	busy := c.getOrCreateProcessState(first)
+	busy.running.Store(true)
+	busy.activeRequests = 2
+
+	second := c.pickInstance("")
+	if second == first {
+		t.Fatalf("a request must start another copy while %q is busy", first)
+	}
+	c.getOrCreateProcessState(second).starting.Store(true)
+	// While a copy starts, no further one is started.
+	if got := c.pickInstance(""); got != first {
+		t.Fatalf("got %q, want the running copy %q", got, first)
+	}
+	busy.activeRequests = 0
+	if got := c.pickInstance(""); got != first {
+		t.Fatalf("got %q, want the idle copy %q", got, first)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	for key, want := range map[string]string{"": "unix//run/app-0.sock", "@2": "unix//run/app-2.sock"} {
+		overrides, err := c.resolveOverrides(req, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *overrides.ReverseProxyTo != want {
+			t.Errorf("copy %q gets %s, want %s", key, *overrides.ReverseProxyTo, want)
+		}
+	}
+	if base, n := c.splitInstance("user@3"); base != "user@3" || n != 0 {
+		t.Fatalf("a key with a number beyond the copies must stay whole, got %q, %d", base, n)
+	}
+}
+
+// TestLivenessCheck_RestartsUnresponsiveBackend verifies a backend that keeps
+// failing liveness_check after it became ready is restarted, also once a
+// reload handed it to another handler (synth-1262).
+func TestLivenessCheck_RestartsUnresponsiveBackend(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(true)
+	probed := make(chan bool)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/live" {
+			return
+		}
+		ok := healthy.Load()
+		if !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		probed <- ok
+	}))
+	defer backend.Close()
+	runner := &pidRunner{}
+	clock := newTickClock()
+	obs := newEventObserver()
+	interval := 7 * time.Second
+	handler := func(ctx context.Context) *ReverseBin {
+		return &ReverseBin{
+			Executable:          []string{"./app"},
+			ReverseProxyTo:      strings.TrimPrefix(backend.URL, "http://"),
+			ReadinessMethod:     http.MethodGet,
+			ReadinessPath:       "/ready",
+			ReadinessIntervalMS: 10,
+			StartTimeoutMS:      int(time.Hour.Milliseconds()),
+			LivenessCheck:       &LivenessCheck{Method: http.MethodGet, Path: "/live", IntervalMS: int(interval.Milliseconds()), Failures: 2},
+			Runner:              runner,
+			Clock:               clock,
+			Observer:            obs,
+			logger:              zap.NewNop(),
+			processes:           map[string]*processState{},
+			ctx:                 caddy.Context{Context: ctx},
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c := handler(ctx)
+	ps := c.getOrCreateProcessState("")
+	if err := c.warm(context.Background(), ps); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		ps.mu.Lock()
+		ps.stopLocked("test done")
+		ps.mu.Unlock()
+	}()
+
+	// A reload hands the backend over and unloads the old handler.
+	next := handler(context.Background())
+	next.processes[""] = ps
+	ps.owner.Store(next)
+	cancel()
+
+	// Passing probes leave the backend alone.
+	for range 3 {
+		clock.advance(interval)
+		<-probed
+	}
+	if n := runner.next.Load(); n != 1 {
+		t.Fatalf("healthy backend was restarted: %d starts", n)
+	}
+
+	// The backend hangs; after two failed probes a new one replaces it.
+	healthy.Store(false)
+	clock.advance(interval)
+	<-probed
+	clock.advance(interval)
+	<-probed
+	healthy.Store(true)
+	obs.await(t, "2 ready")
+}
+
+// TestMaxLifetime_RecyclesBackend verifies a backend that reached its
+// lifetime is stopped once no request is in flight and a new one is started
+// in its place, also once a reload handed it to another handler, and that
+// jitter only shortens lifetimes (synth-1269).
+func TestMaxLifetime_RecyclesBackend(t *testing.T) {
+	l := &MaxLifetime{DurationMS: 60000}
+	for range 100 {
+		if d := l.lifetime(); d > time.Minute || d < 54*time.Second {
+			t.Fatalf("lifetime %v outside [54s, 1m]", d)
+		}
+	}
+
+	backend := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer backend.Close()
+	runner := &pidRunner{}
+	clock := newTickClock()
+	obs := newEventObserver()
+	handler := func(ctx context.Context) *ReverseBin {
+		return &ReverseBin{
+			Executable:          []string{"./app"},
+			ReverseProxyTo:      strings.TrimPrefix(backend.URL, "http://"),
+			ReadinessMethod:     http.MethodGet,
+			ReadinessPath:       "/ready",
+			ReadinessIntervalMS: 10,
+			StartTimeoutMS:      int(time.Hour.Milliseconds()),
+			MaxLifetime:         &MaxLifetime{DurationMS: 50, JitterMS: 1},
+			Runner:              runner,
+			Clock:               clock,
+			Observer:            obs,
+			logger:              zap.NewNop(),
+			processes:           map[string]*processState{},
+			ctx:                 caddy.Context{Context: ctx},
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c := handler(ctx)
+	ps := c.getOrCreateProcessState("")
+	ps.incrementRequests(c.logger, "")
+	if _, err := c.ensureProcessRunningAndResolveUpstream(httptest.NewRequest(http.MethodGet, "/", nil), ps, ""); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		ps.mu.Lock()
+		ps.stopLocked("test done")
+		ps.mu.Unlock()
+	}()
+
+	// A reload hands the backend over and unloads the old handler.
+	next := handler(context.Background())
+	next.processes[""] = ps
+	ps.owner.Store(next)
+	cancel()
+
+	// A request in flight holds off recycling; each poll arms the next.
+	clock.advance(50 * time.Millisecond)
+	clock.advance(recyclePollInterval)
+	clock.advance(recyclePollInterval)
+	if n := runner.next.Load(); n != 1 {
+		t.Fatalf("backend with a request in flight was recycled: %d starts", n)
+	}
+	ps.decrementRequests(c.logger, "", time.Hour, true)
+	clock.advance(recyclePollInterval)
+	obs.await(t, "2 ready")
+}
+
+// TestRecycleTurn_RecyclesCopiesOneAtATime verifies copies of a key wait for
+// each other's recycle, so the others keep serving, while other keys do not
+// (synth-1269).
+func TestRecycleTurn_RecyclesCopiesOneAtATime(t *testing.T) {
+	c := &ReverseBin{Replicas: 3}
+	first, _ := c.splitInstance(instanceKey("app", 1))
+	second, _ := c.splitInstance(instanceKey("app", 2))
+	if !c.recycleTurn(first) {
+		t.Fatal("the first copy must get to recycle")
+	}
+	if c.recycleTurn(second) {
+		t.Fatal("a second copy must wait while the first is recycled")
+	}
+	if !c.recycleTurn("other") {
+		t.Fatal("another key must not wait")
+	}
+	c.recycleDone(first)
+	if !c.recycleTurn(second) {
+		t.Fatal("the second copy must get to recycle once the first is done")
+	}
+}
+
+// TestBackendRSS_ParsesSizesAndSamplesGroup verifies the sizes
+// restart_if_rss_above accepts and that the memory of a process group is
+// sampled (synth-1270).
+func TestBackendRSS_ParsesSizesAndSamplesGroup(t *testing.T) {
+	for in, want := range map[string]int64{
+		"800MB":  800000000,
+		"512M":   512 << 20,
+		"1.5GiB": 3 << 29,
+		"64kib":  64 << 10,
+		"100":    100,
+	} {
+		if got, err := parseByteSize(in); err != nil || got != want {
+			t.Errorf("parseByteSize(%q) = %d, %v; want %d", in, got, err, want)
+		}
+	}
+	if _, err := parseByteSize("lots"); err == nil {
+		t.Error("parseByteSize must reject sizes without a number")
+	}
+
+	rss, err := backendRSS(syscall.Getpgrp())
+	if err != nil || rss <= 0 {
+		t.Fatalf("backendRSS of the test's process group = %d, %v", rss, err)
+	}
+}
+
+// TestWaitForReadiness_GRPCHealth verifies readiness_check grpc waits for a
+// gRPC-only backend to report the service SERVING over h2c, closing each
+// check's connection (synth-1261~2).
+func TestWaitForReadiness_GRPCHealth(t *testing.T) {
+	var hits atomic.Int32
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.ProtoMajor != 2 || r.URL.Path != "/grpc.health.v1.Health/Check" ||
+			string(body) != "\x00\x00\x00\x00\x0a\x0a\x08db.Store" {
+			w.Header().Set("Grpc-Status", "12")
+			return
+		}
+		// NOT_SERVING twice, then SERVING.
+		status := byte(2)
+		if hits.Add(1) > 2 {
+			status = 1
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		_, _ = w.Write([]byte{0, 0, 0, 0, 2, 0x08, status})
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	backend.Config.Protocols = new(http.Protocols)
+	backend.Config.Protocols.SetUnencryptedHTTP2(true)
+	closed := make(chan struct{}, 3)
+	backend.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- struct{}{}
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+
+	c := &ReverseBin{ReadinessIntervalMS: 10, logger: zaptest.NewLogger(t)}
+	addr := strings.TrimPrefix(backend.URL, "http://")
+	method, service := readinessGRPC, "db.Store"
+	overrides := &Overrides{ReverseProxyTo: &addr, ReadinessMethod: &method, ReadinessPath: &service}
+	if err := c.waitForReadiness(context.Background(), overrides, nil, nil, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if n := hits.Load(); n != 3 {
+		t.Fatalf("readiness passed after %d health checks, want 3", n)
+	}
+	// No check leaves its connection open.
+	for range 3 {
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("a health check's connection was kept open")
+		}
+	}
+}
+
+// TestCheckBind_FailsBackendListeningOnAllInterfaces verifies bind_check
+// enforce rejects a backend also reachable beyond loopback, and accepts one
+// bound to loopback only.
+func TestCheckBind_FailsBackendListeningOnAllInterfaces(t *testing.T) {
+	c := &ReverseBin{BindCheck: bindCheckEnforce, logger: zaptest.NewLogger(t)}
+
+	private, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer private.Close()
+	if err := c.checkBind("tenant1", 1, private.Addr().String()); err != nil {
+		t.Fatalf("backend bound to loopback must pass, got %v", err)
+	}
+
+	public, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer public.Close()
+	_, port, _ := net.SplitHostPort(public.Addr().String())
+	if len(exposedAddrs(port)) == 0 {
+		t.Skip("host has no non-loopback address to check")
+	}
+	if err := c.checkBind("tenant1", 1, "127.0.0.1:"+port); err == nil || !strings.Contains(err.Error(), "127.0.0.1 only") {
+		t.Fatalf("backend listening on all interfaces must fail, got %v", err)
+	}
+}
+
+// TestCheckBind_StopIsNotACrash verifies a backend stopped by bind_check
+// enforce does not count as crashed, so no restart backoff follows
+// (synth-1256).
+func TestCheckBind_StopIsNotACrash(t *testing.T) {
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	ln.Close()
+	if len(exposedAddrs(port)) != 0 {
+		t.Skip("port is in use")
+	}
+
+	exit := make(chan struct{})
+	close(exit)
+	obs := newEventObserver()
+	c := &ReverseBin{
+		Executable:          []string{"./app"},
+		ReverseProxyTo:      "127.0.0.1:" + port,
+		BindCheck:           bindCheckEnforce,
+		RestartBackoffMS:    60000,
+		ReadinessMethod:     http.MethodGet,
+		ReadinessPath:       "/",
+		ReadinessIntervalMS: 10,
+		Runner:              portRunner{exit: exit, everywhere: true},
+		Observer:            obs,
+		logger:              zap.NewNop(),
+		processes:           map[string]*processState{},
+		ctx:                 caddy.Context{Context: context.Background()},
+	}
+	ps := c.getOrCreateProcessState("")
+	_, err = c.ensureProcessRunningAndResolveUpstream(httptest.NewRequest(http.MethodGet, "/", nil), ps, "")
+	if err == nil {
+		t.Skip("host has no non-loopback address to check")
+	}
+	obs.await(t, "1 exited")
+	ps.mu.Lock()
+	crashes := ps.crashes
+	ps.mu.Unlock()
+	if crashes != 0 || ps.retryAt.Load() != 0 {
+		t.Fatalf("got %d crashes, want the stop not counted", crashes)
+	}
+}
+
+// TestUpstreamHost_AddsUpstreamPortToHostRewrite verifies host_rewrite
+// values without a port get the TCP upstream's.
+func TestUpstreamHost_AddsUpstreamPortToHostRewrite(t *testing.T) {
+	tests := []struct{ rewrite, upstream, want string }{
+		{"", "127.0.0.1:8080", ""},
+		{"localhost", "127.0.0.1:8080", "localhost:8080"},
+		{"localhost", ":9000", "localhost:9000"},
+		{"::1", "[::1]:8080", "[::1]:8080"},
+		{"app.internal:443", "https://10.0.0.5:8443", "app.internal:443"},
+		{"localhost", "unix//run/app.sock", "localhost"},
+	}
+	for _, tt := range tests {
+		o := &Overrides{HostRewrite: &tt.rewrite, ReverseProxyTo: &tt.upstream}
+		if got := o.upstreamHost(); got != tt.want {
+			t.Errorf("host_rewrite %q to %s: Host = %q, want %q", tt.rewrite, tt.upstream, got, tt.want)
+		}
+	}
+}
+
+// TestWaitForReadiness_SendsRewrittenHost verifies readiness checks carry the
+// host_rewrite Host, so apps rejecting unknown hosts still become ready.
+func TestWaitForReadiness_SendsRewrittenHost(t *testing.T) {
+	var want string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != want {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer backend.Close()
+	addr := strings.TrimPrefix(backend.URL, "http://")
+	_, port, _ := net.SplitHostPort(addr)
+	want = "localhost:" + port
+
+	c := &ReverseBin{logger: zaptest.NewLogger(t)}
+	method, path, host, expect := http.MethodGet, "/", "localhost", []int{200}
+	overrides := &Overrides{ReverseProxyTo: &addr, ReadinessMethod: &method, ReadinessPath: &path,
+		ReadinessStatus: &expect, HostRewrite: &host}
+	// The first poll is answered 200 only if it carries Host localhost:<port>.
+	if err := c.waitForReadiness(context.Background(), overrides, nil, nil, time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestActiveHours_ServesClosedResponseOutsideWindows verifies requests
+// outside active_hours get the closed response with a Retry-After until the
+// next window, including windows spanning midnight.
+func TestActiveHours_ServesClosedResponseOutsideWindows(t *testing.T) {
+	a := &ActiveHours{Windows: []string{"08:00-12:00", "22:00-02:00"}, Timezone: "UTC", Status: http.StatusForbidden}
+	if err := a.provision(); err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	for _, open := range []time.Duration{8 * time.Hour, 23 * time.Hour, time.Hour} {
+		if a.serveIfClosed(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), "", day.Add(open)) {
+			t.Errorf("request at %s must be proxied", day.Add(open).Format("15:04"))
+		}
+	}
+
+	// A request at 13:00 waits for the window opening at 22:00.
+	rec := httptest.NewRecorder()
+	if !a.serveIfClosed(rec, httptest.NewRequest(http.MethodGet, "/", nil), "", day.Add(13*time.Hour)) {
+		t.Fatal("request at 13:00 must get the closed response")
+	}
+	if rec.Code != http.StatusForbidden || rec.Header().Get("Retry-After") != "32400" {
+		t.Fatalf("closed response: status %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
+
+// TestActiveHours_EscapesKeyInPage verifies a process key cannot point the
+// closed page outside its directory: the key is escaped like a file name and
+// keys that cannot be one get the default page (synth-1258).
+func TestActiveHours_EscapesKeyInPage(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "apps", "..%2Fsecret"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	a := &ActiveHours{Windows: []string{"08:00-09:00"}, Timezone: "UTC", Page: filepath.Join(dir, "apps", "{reverse_bin.key}")}
+	if err := a.provision(); err != nil {
+		t.Fatal(err)
+	}
+	closed := time.Date(2024, 3, 1, 13, 0, 0, 0, time.UTC)
+	for _, key := range []string{"../secret", "..", ""} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		rec := httptest.NewRecorder()
+		if !a.serveIfClosed(rec, req, key, closed) {
+			t.Fatalf("key %q: request at 13:00 must get the closed response", key)
+		}
+		if body := rec.Body.String(); body != defaultClosedPage {
+			t.Errorf("key %q: got page %q, want the default page", key, body)
+		}
+	}
+}
+
+// TestIdlePolicy_ScalesIdleTimeoutWithStartupTime verifies idle_policy
+// adaptive keeps slow-starting keys up longer than fast ones, within bounds,
+// and leaves keys without history at idle_timeout.
+func TestIdlePolicy_ScalesIdleTimeoutWithStartupTime(t *testing.T) {
+	c := &ReverseBin{
+		IdleTimeoutMS: 5000,
+		IdlePolicy:    &IdlePolicy{Mode: "adaptive", Factor: 10, MinMS: 1000, MaxMS: 60000},
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	tests := []struct {
+		startups []time.Duration
+		want     time.Duration
+	}{
+		{nil, 5 * time.Second},
+		{[]time.Duration{3 * time.Second}, 30 * time.Second},
+		{[]time.Duration{50 * time.Millisecond}, time.Second},
+		{[]time.Duration{3 * time.Second, 20 * time.Second}, time.Minute},
+	}
+	for _, tt := range tests {
+		ps := &processState{}
+		for _, d := range tt.startups {
+			c.recordStartupLocked(ps, "", d)
+		}
+		got, err := c.idleTimeoutFor(req, ps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("startups %v: idle timeout %s, want %s", tt.startups, got, tt.want)
+		}
+	}
+}
+
+// TestWaitForDependencies_FailsStartWhileDependencyIsDown verifies wait_for
+// lets a start proceed once its dependency accepts connections, and fails it
+// after the timeout otherwise.
+func TestWaitForDependencies_FailsStartWhileDependencyIsDown(t *testing.T) {
+	db, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	up := "tcp://" + db.Addr().String()
+	c := &ReverseBin{WaitFor: []*WaitFor{{Target: up}}, logger: zaptest.NewLogger(t)}
+	if err := c.waitForDependencies(context.Background(), "tenant1"); err != nil {
+		t.Fatalf("reachable dependency must not delay the start, got %v", err)
+	}
+
+	// With the dependency gone, the start fails once the timeout passes.
+	db.Close()
+	c.WaitFor = []*WaitFor{{Target: up, TimeoutMS: 100}}
+	if err := c.waitForDependencies(context.Background(), "tenant1"); err == nil || !strings.Contains(err.Error(), up) {
+		t.Fatalf("unreachable dependency must fail the start, got %v", err)
+	}
+}
+
+// TestObserveLogs_DeliversHandlerLogsUntilStopped verifies log observers see
+// handler messages with their fields, and nothing once stopped.
+func TestObserveLogs_DeliversHandlerLogsUntilStopped(t *testing.T) {
+	logger := observedLogger(zap.NewNop()).With(zap.String("key", "tenant1"))
+	var got []LogEntry
+	stop := ObserveLogs(func(e LogEntry) { got = append(got, e) })
+	logger.Info("proxy subprocess terminated", zap.Int("pid", 7))
+	stop()
+	logger.Info("started proxy subprocess", zap.Int("pid", 8))
+
+	if len(got) != 1 {
+		t.Fatalf("observed %d entries, want only the one logged before stop", len(got))
+	}
+	e := got[0]
+	if e.Level != "info" || e.Message != "proxy subprocess terminated" ||
+		e.Fields["pid"] != int64(7) || e.Fields["key"] != "tenant1" {
+		t.Fatalf("observed %+v", e)
+	}
+}
+
+// TestCheckUpstreamConflicts_RejectsSharedPort verifies two handlers of one
+// configuration cannot run different executables on the same port, while a
+// handler from a configuration being replaced is ignored.
+func TestCheckUpstreamConflicts_RejectsSharedPort(t *testing.T) {
+	cfg := caddy.Context{Context: context.Background()}
+	first := &ReverseBin{Executable: []string{"./blog"}, ReverseProxyTo: ":8080", ctx: cfg}
+	registerHandler(first)
+	defer unregisterHandler(first)
+
+	second := &ReverseBin{Executable: []string{"./shop"}, ReverseProxyTo: "127.0.0.1:8080", ctx: cfg}
+	if err := second.checkUpstreamConflicts(); err == nil {
+		t.Fatal("a different executable on the same port must be rejected")
+	}
+	same := &ReverseBin{Executable: []string{"./blog"}, ReverseProxyTo: "localhost:8080", ctx: cfg}
+	if err := same.checkUpstreamConflicts(); err != nil {
+		t.Fatalf("the same executable must be accepted: %v", err)
+	}
+	reloaded := &ReverseBin{Executable: []string{"./shop"}, ReverseProxyTo: ":8080",
+		ctx: caddy.Context{Context: context.TODO()}}
+	if err := reloaded.checkUpstreamConflicts(); err != nil {
+		t.Fatalf("handlers of another configuration must be ignored: %v", err)
+	}
+}
+
+// TestCheckStateFileConflicts_RejectsSharedPath verifies two handlers of one
+// configuration cannot write the same state file, while a handler from a
+// configuration being replaced is ignored (synth-1255).
+func TestCheckStateFileConflicts_RejectsSharedPath(t *testing.T) {
+	cfg := caddy.Context{Context: context.Background()}
+	dir := t.TempDir()
+	first := &ReverseBin{StateFile: &StateFile{Path: filepath.Join(dir, "state.json")}, ctx: cfg}
+	registerHandler(first)
+	defer unregisterHandler(first)
+
+	second := &ReverseBin{StateFile: &StateFile{Path: filepath.Join(dir, ".", "state.json")}, ctx: cfg}
+	if err := second.checkStateFileConflicts(); err == nil {
+		t.Fatal("a second handler writing the same state file must be rejected")
+	}
+	other := &ReverseBin{StateFile: &StateFile{Path: filepath.Join(dir, "other.json")}, ctx: cfg}
+	if err := other.checkStateFileConflicts(); err != nil {
+		t.Fatalf("a separate path must be accepted: %v", err)
+	}
+	reloaded := &ReverseBin{StateFile: &StateFile{Path: filepath.Join(dir, "state.json")},
+		ctx: caddy.Context{Context: context.TODO()}}
+	if err := reloaded.checkStateFileConflicts(); err != nil {
+		t.Fatalf("handlers of another configuration must be ignored: %v", err)
+	}
+}
+
+// TestProbeUpstreams_RejectsForeignListener verifies probe_upstream fails
+// provisioning when an unrelated process listens on reverse_proxy_to, but
+// not when the listener is a backend of a reverse-bin handler (synth-1275~2).
+func TestProbeUpstreams_RejectsForeignListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	addr := ln.Addr().String()
+
+	c := &ReverseBin{ReverseProxyTo: addr, ProbeUpstream: true}
+	if err := c.probeUpstreams(); err == nil || !strings.Contains(err.Error(), addr) {
+		t.Fatalf("got %v, want an error naming %s", err, addr)
+	}
+	free := &ReverseBin{ReverseProxyTo: "127.0.0.1:1", ProbeUpstream: true}
+	if err := free.probeUpstreams(); err != nil {
+		t.Fatalf("a free port must be accepted: %v", err)
+	}
+
+	old := &ReverseBin{ReverseProxyTo: addr, logger: zap.NewNop(), processes: map[string]*processState{}}
+	old.getOrCreateProcessState("").running.Store(true)
+	registerHandler(old)
+	defer unregisterHandler(old)
+	if err := c.probeUpstreams(); err != nil {
+		t.Fatalf("a reverse-bin backend must not count as a conflict: %v", err)
+	}
+}
+
+// TestAllocatePort_RefusesBeyondRange verifies ports are leased at most once
+// and an exhausted range refuses new backends until a port is released.
+func TestAllocatePort_RefusesBeyondRange(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	free := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	c := &ReverseBin{PortRange: &PortRange{First: free, Last: free}, logger: zaptest.NewLogger(t)}
+	a, b := &processState{key: "a"}, &processState{key: "b"}
+	defer releasePorts(a)
+	defer releasePorts(b)
+	port, err := c.allocatePort(a)
+	if err != nil || port != free {
+		t.Fatalf("allocatePort = %d, %v; want %d", port, err, free)
+	}
+	if _, err := c.allocatePort(b); err == nil {
+		t.Fatal("an exhausted port_range must refuse to allocate")
+	}
+	c.releasePort(a, port)
+	if _, err := c.allocatePort(b); err != nil {
+		t.Fatalf("a released port must be allocatable again: %v", err)
+	}
+}
+
+// portRunner starts backends that listen on their TCP reverse_proxy_to
+// address, or on its port on all interfaces with everywhere. Once killed, or
+// their context ends, they exit when exit is closed.
+type portRunner struct {
+	exit       chan struct{}
+	everywhere bool
+}
+
+func (r portRunner) Start(ctx context.Context, spec ProcessSpec) (Process, <-chan error, error) {
+	addr := spec.ReverseProxyTo
+	if r.everywhere {
+		_, port, _ := net.SplitHostPort(addr)
+		addr = ":" + port
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	go http.Serve(ln, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	ctx, kill := context.WithCancel(ctx)
+	exited := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		<-r.exit
+		ln.Close()
+		exited <- ctx.Err()
+	}()
+	return &killableProcess{kill}, exited, nil
+}
+
+// killableProcess is a backend whose Kill ends it.
+type killableProcess struct{ kill context.CancelFunc }
+
+func (*killableProcess) Pid() int    { return 1 }
+func (*killableProcess) Alive() bool { return true }
+func (p *killableProcess) Kill()     { p.kill() }
+
+// TestCleanup_ReleasesPortsOnceBackendExited verifies unloading a handler
+// keeps the ports of a backend still running leased until it has exited, so
+// no other backend is given a port in use (synth-1251~2).
+func TestCleanup_ReleasesPortsOnceBackendExited(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	free := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	exit := make(chan struct{})
+	c := &ReverseBin{
+		Executable:          []string{"./app"},
+		ReverseProxyTo:      "127.0.0.1:" + portPlaceholder,
+		PortRange:           &PortRange{First: free, Last: free},
+		ReadinessMethod:     http.MethodGet,
+		ReadinessPath:       "/",
+		ReadinessIntervalMS: 10,
+		Runner:              portRunner{exit: exit},
+		logger:              observedLogger(zap.NewNop()),
+		processes:           map[string]*processState{},
+		ctx:                 caddy.Context{Context: ctx},
+	}
+	released := make(chan struct{})
+	stop := ObserveLogs(func(e LogEntry) {
+		if e.Message == "released ports of unloaded handler's backend" {
+			close(released)
+		}
+	})
+	defer stop()
+	ps := c.getOrCreateProcessState("")
+	defer releasePorts(ps)
+	if _, err := c.ensureProcessRunningAndResolveUpstream(httptest.NewRequest(http.MethodGet, "/", nil), ps, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	leased := func() bool {
+		ports.mu.Lock()
+		defer ports.mu.Unlock()
+		return ports.leases[free] == ps
+	}
+	// Caddy cancels the handler's context and cleans it up; the backend
+	// takes a while to exit.
+	cancel()
+	if err := c.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if !leased() {
+		t.Fatal("the port of a backend still running was released")
+	}
+	close(exit)
+	<-released
+	if leased() {
+		t.Fatal("the port was not released once the backend exited")
+	}
+}
+
+// TestExpandCorePattern checks that core_pattern specifiers other than the
+// PID become wildcards and that core_uses_pid is honoured.
+func TestExpandCorePattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		usesPID bool
+		want    string
+	}{
+		{"core", false, "core"},
+		{"core", true, "core.42"},
+		{"/var/crash/core.%e.%p", true, "/var/crash/core.*.42"},
+		{"core-%t-100%%", false, "core-*-100%"},
+	}
+	for _, tt := range tests {
+		if got := expandCorePattern(tt.pattern, 42, tt.usesPID); got != tt.want {
+			t.Errorf("expandCorePattern(%q, usesPID=%v) = %q, want %q", tt.pattern, tt.usesPID, got, tt.want)
+		}
+	}
+}
+
+// TestAdmitRamp_GrowsConcurrencyAfterReadiness verifies a freshly ready
+// backend serves one request at a time at first, more as slow_start
+// progresses and any number once it ends.
+func TestAdmitRamp_GrowsConcurrencyAfterReadiness(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	c := &ReverseBin{SlowStartMS: 10000, MaxInflightPerKey: 3, Clock: clock}
+	ps := &processState{}
+	ps.ramp.begin(clock.now)
+	expired, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	first, err := c.admitRamp(context.Background(), ps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.admitRamp(expired, ps); err == nil {
+		t.Fatal("a second request must wait while the ramp allows one")
+	}
+
+	clock.now = clock.now.Add(5 * time.Second)
+	second, err := c.admitRamp(context.Background(), ps)
+	if err != nil {
+		t.Fatalf("halfway through the ramp two requests must be admitted: %v", err)
+	}
+	if _, err := c.admitRamp(expired, ps); err == nil {
+		t.Fatal("a third request must wait halfway through the ramp")
+	}
+
+	first()
+	first()
+	if _, err := c.admitRamp(expired, ps); err != nil {
+		t.Fatalf("a finished request must free its place once: %v", err)
+	}
+
+	clock.now = clock.now.Add(5 * time.Second)
+	for i := 0; i < 10; i++ {
+		if _, err := c.admitRamp(expired, ps); err != nil {
+			t.Fatalf("after slow_start requests must not be limited: %v", err)
+		}
+	}
+	second()
+}
+
+// TestDataDir_CollectsOnlyStaleManagedDirs verifies garbage collection
+// removes data directories of keys unused for gc_after, and keeps recent,
+// running and unmanaged ones.
+func TestDataDir_CollectsOnlyStaleManagedDirs(t *testing.T) {
+	root := t.TempDir()
+	dd := &DataDir{Path: filepath.Join(root, "{reverse_bin.key}"), GCAfterMS: 1000}
+	for _, name := range []string{"recent", "stale", "running"} {
+		env, err := dd.prepare(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "REVERSE_BIN_DATA_DIR=" + filepath.Join(root, name); env[0] != want {
+			t.Fatalf("env %q, want %q", env[0], want)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(root, "unmanaged"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	for _, name := range []string{"stale", "running"} {
+		if err := os.Chtimes(filepath.Join(root, name, dataDirMarker), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	running, err := dd.dirFor("running")
+	if err != nil {
+		t.Fatal(err)
+	}
+	live := map[string]bool{running: true}
+	removed := dd.collect(zaptest.NewLogger(t), live, time.Now())
+	if want := []string{filepath.Join(root, "stale")}; !reflect.DeepEqual(removed, want) {
+		t.Fatalf("removed %v, want %v", removed, want)
+	}
+	for _, name := range []string{"recent", "running", "unmanaged"} {
+		if _, err := os.Stat(filepath.Join(root, name)); err != nil {
+			t.Errorf("%s must be kept: %v", name, err)
+		}
+	}
+}
+
+// TestDataDir_RefusesTraversalKeys verifies keys that would leave the data
+// directory root are refused, and that distinct keys get distinct
+// directories (synth-1240).
+func TestDataDir_RefusesTraversalKeys(t *testing.T) {
+	root := t.TempDir()
+	dd := &DataDir{Path: filepath.Join(root, "{reverse_bin.key}")}
+	for _, key := range []string{"..", ".", ".hidden", "../etc", ""} {
+		if dir, err := dd.dirFor(key); err == nil {
+			t.Errorf("key %q must be refused, got %s", key, dir)
+		}
+	}
+	if _, err := dd.prepare(".."); err == nil {
+		t.Fatal("prepare must refuse a traversal key")
+	}
+	seen := map[string]string{}
+	for _, key := range []string{"a/b", "a_b", "a%2Fb", "a/../../b", "127.0.0.1:8080"} {
+		dir, err := dd.dirFor(key)
+		if err != nil {
+			t.Fatalf("key %q: %v", key, err)
+		}
+		if filepath.Dir(dir) != root {
+			t.Fatalf("key %q escapes the root: %s", key, dir)
+		}
+		if other, ok := seen[dir]; ok {
+			t.Fatalf("keys %q and %q share %s", key, other, dir)
+		}
+		seen[dir] = key
+	}
+}
+
+// TestMountPrefix_RewritesRedirectsAndInjectsBase verifies responses of an
+// app mounted under a prefix get prefixed redirects and a <base href>, even
+// when <head> is split across writes.
+func TestMountPrefix_RewritesRedirectsAndInjectsBase(t *testing.T) {
+	c := &ReverseBin{MountPrefix: "/app1/"}
+
+	rec := httptest.NewRecorder()
+	w, release := c.withMountPrefix(rec)
+	w.Header().Set("Location", "/login?next=/")
+	w.WriteHeader(http.StatusFound)
+	release()
+	if got := rec.Header().Get("Location"); got != "/app1/login?next=/" {
+		t.Fatalf("Location = %q, want it under the mount prefix", got)
+	}
+
+	rec = httptest.NewRecorder()
+	w, release = c.withMountPrefix(rec)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", "48")
+	_, _ = w.Write([]byte("<html><header></header><he"))
+	_, _ = w.Write([]byte(`ad lang="en"><title>x</title>`))
+	release()
+	want := `<html><header></header><head lang="en"><base href="/app1/"><title>x</title>`
+	if got := rec.Body.String(); got != want {
+		t.Fatalf("body = %q, want %q", got, want)
+	}
+	if rec.Header().Get("Content-Length") != "" {
+		t.Fatal("Content-Length must be dropped when the body grows")
+	}
+
+	// A page's own base is rewritten or kept rather than joined by a second one
+	// (synth-1241).
+	for page, want := range map[string]string{
+		`<head><base href="/" target="_top"></head><body>`:                      `<head><base href="/app1/" target="_top"></head><body>`,
+		`<head><title>x</title><BASE data-x=1 HREF='/static/'><body>`:           `<head><title>x</title><BASE data-x=1 HREF='/app1/static/'><body>`,
+		`<head><base href="https://cdn.example.com/"></head>`:                   `<head><base href="https://cdn.example.com/"></head>`,
+		`<head><base data-href="/x" target="_blank"></head><body><base href=/>`: `<head><base href="/app1/"><base data-href="/x" target="_blank"></head><body><base href=/>`,
+	} {
+		rec = httptest.NewRecorder()
+		w, release = c.withMountPrefix(rec)
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte(page))
+		release()
+		if got := rec.Body.String(); got != want {
+			t.Errorf("page %q became %q, want %q", page, got, want)
+		}
+	}
+}
+
+// TestPrepareUpstreamHeaders_CompressionModes verifies upstream_compression
+// off stops backends from compressing while passthrough keeps the client's
+// Accept-Encoding.
+func TestPrepareUpstreamHeaders_CompressionModes(t *testing.T) {
+	for mode, want := range map[string]string{compressionOff: "", compressionPassthrough: "gzip, zstd"} {
+		c := &ReverseBin{UpstreamCompression: mode}
+		h := http.Header{"Accept-Encoding": {"gzip, zstd"}}
+		c.prepareUpstreamHeaders(h, nil)
+		if got := h.Get("Accept-Encoding"); got != want {
+			t.Errorf("upstream_compression %s: Accept-Encoding %q, want %q", mode, got, want)
+		}
+	}
+}
+
+// TestSandbox_ArgsAndMountInfo verifies the sandbox helper recovers the
+// mounts and command line it was given, and reads escaped mount points.
+func TestSandbox_ArgsAndMountInfo(t *testing.T) {
+	tmpfs, bind, argv, err := parseSandboxArgs([]string{"tmpfs=/tmp", "bind=/run/app", "--", "./app", "--", "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tmpfs, []string{"/tmp"}) || !reflect.DeepEqual(bind, []string{"/run/app"}) || !reflect.DeepEqual(argv, []string{"./app", "--", "x"}) {
+		t.Fatalf("got tmpfs=%v bind=%v argv=%v", tmpfs, bind, argv)
+	}
+	if _, _, _, err := parseSandboxArgs([]string{"tmpfs=/tmp", "--"}); err == nil {
+		t.Fatal("a missing command must be rejected")
+	}
+
+	mountinfo := "22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw\n" +
+		"40 22 8:2 / /srv/my\\040apps rw,nosuid,nodev shared:2 - ext4 /dev/sda2 rw\n"
+	points, options := mountPoints([]byte(mountinfo))
+	if !reflect.DeepEqual(points, []string{"/", "/srv/my apps"}) {
+		t.Fatalf("mount points %q", points)
+	}
+	if !reflect.DeepEqual(options[1], []string{"rw", "nosuid", "nodev"}) {
+		t.Fatalf("options %q", options[1])
+	}
+}
+
+// TestSpawnDiagnostics_ReportsScriptProblems verifies a failed start of a
+// script explains its missing execute bit and its CRLF shebang.
+func TestSpawnDiagnostics_ReportsScriptProblems(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "app.sh"), []byte("#!/bin/sh\r\necho hi\r\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	spec := ProcessSpec{Executable: []string{"./app.sh"}, WorkingDirectory: dir, Env: []string{"PATH=/opt/bin"}}
+
+	got := make(map[string]string)
+	for _, f := range spawnDiagnostics(spec) {
+		got[f.Key] = f.String
+	}
+	if got["executable_file"] != filepath.Join(dir, "app.sh") {
+		t.Errorf("executable_file = %q, want the script in the working directory", got["executable_file"])
+	}
+	if !strings.HasSuffix(got["executable_status"], "(not executable)") {
+		t.Errorf("executable_status = %q, want the missing execute bit reported", got["executable_status"])
+	}
+	if !strings.Contains(got["shebang_status"], "carriage return") {
+		t.Errorf("shebang_status = %q, want the CRLF line ending reported", got["shebang_status"])
+	}
+	if got["backend_path"] != "/opt/bin" {
+		t.Errorf("backend_path = %q, want the backend's PATH", got["backend_path"])
+	}
+}
+
+// TestInitLock_WaitsForHolder checks that a second backend sharing a data
+// directory times out while the first holds init_lock, and gets the lock
+// once it is released.
+func TestInitLock_WaitsForHolder(t *testing.T) {
+	dir := t.TempDir()
+	l := &InitLock{Path: "init.lock", TimeoutMS: 200}
+	unlock, err := l.acquire(context.Background(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.acquire(context.Background(), dir); err == nil {
+		t.Fatal("a held init_lock must not be acquired twice")
+	}
+	unlock()
+	unlock, err = l.acquire(context.Background(), dir)
+	if err != nil {
+		t.Fatalf("a released init_lock must be acquirable: %v", err)
+	}
+	unlock()
+}
+
+// TestPinDialAddress_PinsReachableAddress verifies a named upstream is pinned
+// to the resolved address that accepts connections, even when the name also
+// resolves to an address family the backend does not listen on.
+func TestPinDialAddress_PinsReachableAddress(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+
+	if got := pinDialAddress(context.Background(), "localhost:"+port); got != "127.0.0.1:"+port {
+		t.Fatalf("pinDialAddress(localhost) = %q, want 127.0.0.1:%s", got, port)
+	}
+	if got := pinDialAddress(context.Background(), "[::1]:"+port); got != "[::1]:"+port {
+		t.Fatalf("IP literals must not be re-resolved, got %q", got)
+	}
+}
+
+// TestUpstreamsFor_ResolvesWithRequestContext verifies a named upstream is
+// resolved within the request's context, and that a request giving up does
+// not leave an unpinned address behind (synth-1226).
+func TestUpstreamsFor_ResolvesWithRequestContext(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	ps := &processState{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ps.upstreamsFor(ctx, "localhost:"+port, false); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want the request's cancellation", err)
+	}
+	if ps.upstreams != nil || ps.pinned != "" {
+		t.Fatal("an abandoned resolution must not be cached")
+	}
+	upstreams, err := ps.upstreamsFor(context.Background(), "localhost:"+port, false)
+	if err != nil || upstreams[0].Dial != "127.0.0.1:"+port {
+		t.Fatalf("got %v, %v, want the pinned address", upstreams, err)
+	}
+}
+
+// TestCoalescer_ReplaysLeaderResponse verifies identical requests share the
+// first one's response while requests with other credentials do not.
+func TestCoalescer_ReplaysLeaderResponse(t *testing.T) {
+	var co coalescer
+	// Two clients request the same page while the backend starts.
+	first := httptest.NewRequest(http.MethodGet, "/page", nil)
+	second := httptest.NewRequest(http.MethodGet, "/page", nil)
+	_, lead, key := co.join(first)
+	wait, notLead, _ := co.join(second)
+	if lead == nil || wait != lead || notLead != nil {
+		t.Fatal("the second identical request must wait for the first")
+	}
+	// A request with a different session gets a call of its own.
+	other := httptest.NewRequest(http.MethodGet, "/page", nil)
+	other.Header.Set("Cookie", "session=b")
+	if w, l, _ := co.join(other); w != nil || l == nil {
+		t.Fatal("requests with other credentials must not be coalesced")
+	}
+
+	rec := &recorder{ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: httptest.NewRecorder()}, call: lead}
+	rec.Header().Set("Content-Type", "text/plain")
+	_, _ = rec.Write([]byte("hello"))
+	co.finish(key, lead, false)
+
+	out := httptest.NewRecorder()
+	if !wait.shared {
+		t.Fatal("a successful public response must be shared")
+	}
+	if err := wait.replay(out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Code != http.StatusOK || out.Body.String() != "hello" || out.Header().Get("Content-Type") != "text/plain" {
+		t.Fatalf("replayed %d %q %v", out.Code, out.Body.String(), out.Header())
+	}
+}
+
+// TestCoalescer_KeepsRepresentationsApart verifies requests asking for other
+// encodings or types, and range requests, get calls of their own, and that
+// partial or varying responses are not replayed (synth-1227).
+func TestCoalescer_KeepsRepresentationsApart(t *testing.T) {
+	var co coalescer
+	_, lead, key := co.join(httptest.NewRequest(http.MethodGet, "/page", nil))
+	defer co.finish(key, lead, true)
+	for name, set := range map[string]func(h http.Header){
+		"Accept-Encoding": func(h http.Header) { h.Set("Accept-Encoding", "gzip") },
+		"Accept":          func(h http.Header) { h.Set("Accept", "application/json") },
+		"Range":           func(h http.Header) { h.Set("Range", "bytes=0-9") },
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/page", nil)
+		set(r.Header)
+		if w, _, _ := co.join(r); w != nil {
+			t.Fatalf("a request with another %s must not wait for the first", name)
+		}
+	}
+	if _, l, _ := co.join(httptest.NewRequest(http.MethodGet, "/page", nil)); l != nil {
+		t.Fatal("an identical request must still wait for the first")
+	}
+
+	for name, resp := range map[string]struct {
+		status int
+		header http.Header
+	}{
+		"206":  {http.StatusPartialContent, http.Header{}},
+		"Vary": {http.StatusOK, http.Header{"Vary": {"User-Agent"}}},
+	} {
+		if shareable(resp.status, resp.header) {
+			t.Fatalf("a %s response must not be shared", name)
+		}
+	}
+	if !shareable(http.StatusOK, http.Header{"Content-Encoding": {"gzip"}}) {
+		t.Fatal("an encoded response may go to clients with the same Accept-Encoding")
+	}
+}
+
+// TestCoalescer_SharesResponseDespiteAffinityCookie verifies that with
+// replicas and replica_affinity cookie, a cold copy's first response is
+// still shared, and every client keeps the affinity cookie set for it
+// rather than the leader's (synth-1227).
+func TestCoalescer_SharesResponseDespiteAffinityCookie(t *testing.T) {
+	c := &ReverseBin{
+		Executable:      []string{"./app"},
+		ReverseProxyTo:  "unix//run/app-{reverse_bin.instance}.sock",
+		Replicas:        2,
+		ReplicaAffinity: &ReplicaAffinity{Cookie: defaultAffinityCookie},
+		ReplicaPolicy:   "round_robin",
+		logger:          zap.NewNop(),
+		processes:       map[string]*processState{},
+	}
+	ps := &processState{}
+	leaderOut, followerOut := httptest.NewRecorder(), httptest.NewRecorder()
+	// Both clients are bound to the same copy.
+	key := c.replicaFor(leaderOut, httptest.NewRequest(http.MethodGet, "/page", nil), "acme")
+	http.SetCookie(followerOut, &http.Cookie{Name: c.affinityCookie("acme"), Value: "follower"})
+
+	_, lead, callKey := ps.coalesce.join(httptest.NewRequest(http.MethodGet, "/page", nil))
+	wait, _, _ := ps.coalesce.join(httptest.NewRequest(http.MethodGet, "/page", nil))
+	rec := &recorder{ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: leaderOut}, call: lead, ownCookie: c.ownCookie(key)}
+	_, _ = rec.Write([]byte("hello"))
+	ps.coalesce.finish(callKey, lead, false)
+
+	if !wait.shared {
+		t.Fatal("a response setting only the affinity cookie must be shared")
+	}
+	if err := wait.replay(followerOut); err != nil {
+		t.Fatal(err)
+	}
+	got := followerOut.Result().Cookies()
+	if followerOut.Body.String() != "hello" || len(got) != 1 || got[0].Value != "follower" {
+		t.Fatalf("follower got %q with cookies %v, want the page and its own cookie", followerOut.Body.String(), got)
+	}
+	if cookies := leaderOut.Result().Cookies(); len(cookies) != 1 {
+		t.Fatalf("leader got cookies %v, want its affinity cookie", cookies)
+	}
+
+	// Cookies of the backend's own still keep the response private.
+	h := http.Header{"Set-Cookie": {c.affinityCookie("acme") + "=1", "session=abc"}}
+	dropCookie(h, c.affinityCookie("acme"))
+	if shareable(http.StatusOK, h) {
+		t.Fatal("a response setting a session cookie must not be shared")
+	}
+}
+
+// TestAdminStop_StopsRunningBackend verifies the admin API lists a running
+// backend and stops it on request.
+func TestAdminStop_StopsRunningBackend(t *testing.T) {
+	c, _ := warmHandler(t)
+	ps := c.processes[""]
+	cancelled := false
+	ps.cancel = func() { cancelled = true }
+	registerHandler(c)
+	defer unregisterHandler(c)
+
+	// List processes; the static backend is shown under its upstream.
+	rec := httptest.NewRecorder()
+	if err := (adminAPI{}).handleProcesses(rec, httptest.NewRequest(http.MethodGet, "/reverse-bin/processes", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(rec.Body.String(), `"key":"127.0.0.1:8080","state":"running"`) {
+		t.Fatalf("process list = %s", rec.Body.String())
+	}
+
+	// Stop the backend by that key.
+	rec = httptest.NewRecorder()
+	if err := (adminAPI{}).handleStop(rec, httptest.NewRequest(http.MethodPost, "/reverse-bin/stop?key=127.0.0.1:8080", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusNoContent || !cancelled || ps.process != nil {
+		t.Fatalf("stop: status %d, cancelled %v, process %v", rec.Code, cancelled, ps.process)
+	}
+}
+
+// TestStopTimeout_TerminatesBackendBeforeKilling verifies that with
+// stop_timeout or stop_signal a stopped backend gets the stop signal and may
+// exit on its own.
+func TestStopTimeout_TerminatesBackendBeforeKilling(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+	for _, tc := range []struct {
+		name string
+		c    *ReverseBin
+		trap string
+	}{
+		{name: "stop_timeout", c: &ReverseBin{StopTimeoutMS: 10000}, trap: "TERM"},
+		{name: "stop_signal", c: &ReverseBin{StopSignal: "SIGUSR2"}, trap: "USR2"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			marker := filepath.Join(t.TempDir(), "stopped")
+			tc.c.logger = zap.NewNop()
+			lines := make(chan string, 10)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			_, exited, _, err := tc.c.startExec(ctx, ProcessSpec{
+				Executable: []string{"sh", "-c", "trap 'touch " + marker + "; exit 0' " + tc.trap + "; echo ready; while :; do sleep 0.05; done"},
+				Output:     func(_ int, _, text string) { lines <- text },
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := <-lines; got != "ready" {
+				t.Fatalf("backend printed %q, want ready", got)
+			}
+			// Stopping cancels the backend's context, as stopLocked does.
+			cancel()
+			<-exited
+			if _, err := os.Stat(marker); err != nil {
+				t.Fatalf("backend must run its %s handler before exiting: %v", tc.trap, err)
+			}
+		})
+	}
+}
+
+// TestFollowReexec_TracksProcessGroup verifies that with follow_reexec a
+// backend whose first process exits stays alive while a process it started
+// runs, and that stopping it stops that process (synth-1266).
+func TestFollowReexec_TracksProcessGroup(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+	c := &ReverseBin{FollowReexec: true, logger: observedLogger(zap.NewNop())}
+	// The first process has exited once the backend follows its child.
+	following := make(chan struct{})
+	stop := ObserveLogs(func(e LogEntry) {
+		if e.Message == "backend process exited; following the processes it left running" {
+			close(following)
+		}
+	})
+	defer stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	proc, exited, _, err := c.startExec(ctx, ProcessSpec{
+		Executable: []string{"sh", "-c", "sleep 30 >/dev/null 2>&1 & exit 0"},
+		Output:     func(int, string, string) {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-following
+	if !proc.Alive() {
+		t.Fatal("backend must stay alive while its child runs")
+	}
+	select {
+	case err := <-exited:
+		t.Fatalf("backend reported exited while its child runs: %v", err)
+	default:
+	}
+
+	cancel()
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stopping the backend must stop its child")
+	}
+	if proc.Alive() {
+		t.Fatal("backend must not be alive once stopped")
+	}
+}
+
+// TestExecWrapper_PrependsWrapperToBackendCommand verifies the global
+// exec_wrapper option is parsed and the wrapper runs the backend's command
+// line, unchanged, as its arguments.
+func TestExecWrapper_PrependsWrapperToBackendCommand(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`reverse_bin_exec_wrapper bwrap --ro-bind / / --`)
+	wrapper, err := parseExecWrapperOption(d, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &ReverseBin{ExecWrapper: wrapper.([]string)}
+	got := c.wrapExecutable([]string{"./app", "--name", "a b"})
+	want := []string{"bwrap", "--ro-bind", "/", "/", "--", "./app", "--name", "a b"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("wrapped command = %q, want %q", got, want)
+	}
+	// Wrapping another command must not reuse the first one's arguments.
+	if got := c.wrapExecutable([]string{"./other"}); got[len(got)-1] != "./other" || len(c.ExecWrapper) != 5 {
+		t.Fatalf("wrapped command = %q, wrapper now %q", got, c.ExecWrapper)
+	}
+}
+
+// TestResolveOverrides_RejectsOversizedDetectorOutput checks that a detector
+// printing more than the stdout cap fails with a clear error quoting only
+// the tail of its output.
+func TestResolveOverrides_RejectsOversizedDetectorOutput(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+	c := &ReverseBin{
+		detector: &ExecDetector{
+			Command: []string{"sh", "-c", "head -c 2000000 /dev/zero | tr '\\0' x"},
+			ctx:     caddy.Context{Context: context.Background()},
+			logger:  zap.NewNop(),
+		},
+		logger: zap.NewNop(),
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+	_, err := c.resolveOverrides(req, "tenant")
+	if err == nil || !strings.Contains(err.Error(), "output exceeds") || !strings.Contains(err.Error(), "bytes truncated") {
+		t.Fatalf("oversized detector output must fail clearly, got %.200v", err)
+	}
+	if len(err.Error()) > 2*detectorTailBytes {
+		t.Fatalf("error must quote only the output tail, got %d bytes", len(err.Error()))
+	}
+}
+
+// TestDetectorError_ExposesExitCodeAndStderr verifies a failing exec detector
+// returns a *DetectorError matching ErrDetectorFailed, and that the request
+// gets {reverse_bin.error} for handle_errors routes (synth-1267~2).
+func TestDetectorError_ExposesExitCodeAndStderr(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+	c := &ReverseBin{
+		detector: &ExecDetector{
+			Command: []string{"sh", "-c", "echo no such tenant >&2; exit 3"},
+			ctx:     caddy.Context{Context: context.Background()},
+			logger:  zap.NewNop(),
+		},
+		logger: zap.NewNop(),
+	}
+	repl := caddy.NewReplacer()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+	_, err := c.resolveOverrides(req, "tenant")
+	var derr *DetectorError
+	if !errors.As(err, &derr) || !errors.Is(err, ErrDetectorFailed) {
+		t.Fatalf("got %v, want a DetectorError", err)
+	}
+	if derr.ExitCode != 3 || !strings.Contains(derr.Stderr, "no such tenant") {
+		t.Fatalf("got exit code %d and stderr %q", derr.ExitCode, derr.Stderr)
+	}
+	recordError(req, fmt.Errorf("starting backend: %w", err))
+	if got, _ := repl.GetString(errorPlaceholder); got != "detector_failed" {
+		t.Fatalf("{reverse_bin.error} = %q, want detector_failed", got)
+	}
+	if got := errorCode(fmt.Errorf("%w: exec: not found", ErrSpawnFailed)); got != "spawn_failed" {
+		t.Fatalf("got %q, want spawn_failed", got)
+	}
+}
+
+// tenantDetector is a detector compiled into Caddy: it keys requests by
+// their first path segment and serves each from its own socket.
+type tenantDetector struct{}
+
+func (tenantDetector) Key(r *http.Request) string {
+	return strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[0]
+}
+
+func (tenantDetector) Detect(r *http.Request, key string) (*Overrides, error) {
+	addr := "unix//run/" + key + ".sock"
+	return &Overrides{ReverseProxyTo: &addr}, nil
+}
+
+// TestDetector_ModuleReplacesExecDetector checks that a Go detector derives
+// the process key and backend settings without running a program, and that
+// unset fields fall back to the handler configuration.
+func TestDetector_ModuleReplacesExecDetector(t *testing.T) {
+	c := &ReverseBin{
+		Executable: []string{"./app"},
+		detector:   tenantDetector{},
+		logger:     zap.NewNop(),
+	}
+	req := httptest.NewRequest(http.MethodGet, "/acme/index.html", nil)
+	key := c.getProcessKey(req)
+	if key != "acme" {
+		t.Fatalf("key = %q, want acme", key)
+	}
+	overrides, err := c.resolveOverrides(req, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *overrides.ReverseProxyTo != "unix//run/acme.sock" || (*overrides.Executable)[0] != "./app" {
+		t.Fatalf("overrides = %s %v", *overrides.ReverseProxyTo, *overrides.Executable)
+	}
+}
+
+// TestVariant_SeparateKeyAndBackend checks that a request matching a variant
+// gets its own process key and the variant's backend, with unset fields
+// taken from the regular backend.
+func TestVariant_SeparateKeyAndBackend(t *testing.T) {
+	c := &ReverseBin{
+		Executable:     []string{"./prod"},
+		Envs:           []string{"MODE=live"},
+		ReverseProxyTo: "unix//run/prod.sock",
+		Variants: []*Variant{{
+			Name:    "staging",
+			Backend: App{Executable: []string{"./staging"}, ReverseProxyTo: "unix//run/staging.sock"},
+		}},
+		logger: zap.NewNop(),
 	}
+	// The stub matcher set of the variant matches every request.
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	key, err := c.variantKey(req, "")
+	if err != nil || key != "#staging" || c.processKeyName(key) != "unix//run/prod.sock#staging" {
+		t.Fatalf("variantKey = %q (%q), %v", key, c.processKeyName(key), err)
+	}
+	overrides, err := c.resolveOverrides(req, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (*overrides.Executable)[0] != "./staging" || *overrides.ReverseProxyTo != "unix//run/staging.sock" || (*overrides.Envs)[0] != "MODE=live" {
+		t.Fatalf("overrides = %v %s %v", *overrides.Executable, *overrides.ReverseProxyTo, *overrides.Envs)
+	}
+}
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			d := caddyfile.NewTestDispenser(tt.input)
-			var c ReverseBin
-			err := c.UnmarshalCaddyfile(d)
+// TestVariant_KeepsKeysApart verifies a key that looks like the key of a
+// variant is refused rather than served by the variant, and that a variant
+// of several keys may not give them one fixed address (synth-1235).
+func TestVariant_KeepsKeysApart(t *testing.T) {
+	c := &ReverseBin{
+		ReverseProxyTo: "127.0.0.1:{reverse_bin.port}",
+		Variants:       []*Variant{{Name: "staging", Backend: App{ReverseProxyTo: "127.0.0.1:9001"}}},
+		detector:       addrDetector{"127.0.0.1:9000"},
+		logger:         zap.NewNop(),
+	}
+	_, err := c.variantKey(httptest.NewRequest(http.MethodGet, "/", nil), "acme#staging")
+	var herr caddyhttp.HandlerError
+	if !errors.As(err, &herr) || herr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("got %v, want a 400 for a key containing the variant separator", err)
+	}
 
-			if tt.wantErr {
-				if err == nil {
-					t.Errorf("expected error but got none")
-				}
-				return
-			}
+	if err := c.provisionVariants(caddy.Context{}); err == nil || !strings.Contains(err.Error(), portPlaceholder) {
+		t.Fatalf("got %v, want a variant of several keys to need a port placeholder", err)
+	}
+	c.detector = nil
+	c.Replicas = 2
+	if err := c.provisionVariants(caddy.Context{}); err == nil || !strings.Contains(err.Error(), instancePlaceholder) {
+		t.Fatalf("got %v, want a variant of several copies to need an instance placeholder", err)
+	}
+}
 
-			if err != nil {
-				t.Fatalf("Cannot parse caddyfile: %v", err)
-			}
+// TestIssueLeaf_ChainsToIssuer checks that a minted backend certificate
+// verifies against the CA, carries the requested names and does not outlive
+// its issuer.
+func TestIssueLeaf_ChainsToIssuer(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(48 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-			if !reflect.DeepEqual(asConfig(&c), tt.expected) {
-				t.Errorf("Parsing yielded invalid result.\nGot:      %#v\nExpected: %#v", asConfig(&c), tt.expected)
-			}
-		})
+	certPEM, keyPEM, err := issueLeaf([]*x509.Certificate{caCert}, caKey, "tenant1", []string{"tenant1.internal", "127.0.0.1"}, 7*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		t.Fatalf("certificate and key must form a pair: %v", err)
+	}
+	block, _ := pem.Decode(certPEM)
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: roots, DNSName: "tenant1.internal", KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		t.Fatalf("leaf must verify against the CA: %v", err)
+	}
+	if leaf.Subject.CommonName != "tenant1" || len(leaf.IPAddresses) != 1 || leaf.NotAfter.After(caCert.NotAfter) {
+		t.Fatalf("leaf CN %q, IPs %v, expires %v after CA %v", leaf.Subject.CommonName, leaf.IPAddresses, leaf.NotAfter, caCert.NotAfter)
 	}
 }
 
-func TestResolveDialAddress(t *testing.T) {
+// TestRestartPolicy_KeepsDeliberateExitStopped checks which exits each
+// policy restarts, that a halted key answers 503, and that stopping it via
+// the admin API allows starts again.
+func TestRestartPolicy_KeepsDeliberateExitStopped(t *testing.T) {
 	tests := []struct {
-		name           string
-		reverseProxyTo string
-		wantDial       string
-		wantErr        bool
+		policy string
+		codes  []int
+		code   int
+		want   bool
 	}{
-		{name: "IP and port", reverseProxyTo: "127.0.0.1:8080", wantDial: "127.0.0.1:8080"},
-		{name: "port only", reverseProxyTo: ":8080", wantDial: "127.0.0.1:8080"},
-		{name: "with http scheme", reverseProxyTo: "http://127.0.0.1:8080", wantDial: "127.0.0.1:8080"},
-		{name: "invalid host", reverseProxyTo: "http://", wantErr: true},
+		{"", nil, 0, true},
+		{"", []int{143}, 143, false},
+		{"on-failure", nil, 0, false},
+		{"on-failure", nil, 1, true},
+		{"on-failure", []int{3}, 3, false},
+		{"never", nil, 1, false},
 	}
-
 	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			dialAddr, err := resolveDialAddress(tt.reverseProxyTo)
-			if tt.wantErr {
-				if err == nil {
-					t.Fatalf("expected error, got dial=%q", dialAddr)
-				}
-				return
-			}
-			if err != nil {
-				t.Fatalf("unexpected error: %v", err)
-			}
-			if dialAddr != tt.wantDial {
-				t.Fatalf("expected dial %q, got %q", tt.wantDial, dialAddr)
-			}
-		})
+		c := &ReverseBin{RestartPolicy: tt.policy, NoRestartCodes: tt.codes}
+		if got := c.restartAllowed(tt.code); got != tt.want {
+			t.Errorf("policy %q codes %v: restartAllowed(%d) = %v, want %v", tt.policy, tt.codes, tt.code, got, tt.want)
+		}
+	}
+
+	c, _ := warmHandler(t)
+	c.RestartPolicy = restartOnFailure
+	ps := c.processes[""]
+	ps.process = nil
+	if !c.haltLocked(ps, 0) {
+		t.Fatal("a clean exit under on-failure must keep the key stopped")
+	}
+	registerHandler(c)
+	defer unregisterHandler(c)
+
+	// A request for the halted key is refused without starting a backend.
+	var he caddyhttp.HandlerError
+	err := c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), nil)
+	if !errors.As(err, &he) || he.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("halted key must answer 503, got %v", err)
+	}
+
+	// Stopping the key through the admin API lifts the halt.
+	rec := httptest.NewRecorder()
+	if err := (adminAPI{}).handleStop(rec, httptest.NewRequest(http.MethodPost, "/reverse-bin/stop?key=127.0.0.1:8080", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusNoContent || ps.halted.Load() != nil {
+		t.Fatalf("stop must lift the halt: status %d", rec.Code)
 	}
 }
 
-func TestResolveDialAddress_UnixSocket(t *testing.T) {
-	sock := filepath.Join(t.TempDir(), "app.sock")
-	ln, err := net.Listen("unix", sock)
-	if err != nil {
-		t.Fatalf("failed to listen on unix socket: %v", err)
+// TestHandleStop_StopsKeysMatchingPattern verifies a glob or regexp stops
+// every matching backend, reporting each key, and leaves the rest running.
+func TestHandleStop_StopsKeysMatchingPattern(t *testing.T) {
+	c := &ReverseBin{logger: zap.NewNop(), processes: map[string]*processState{}}
+	for _, key := range []string{"tenant-a", "tenant-b", "other"} {
+		c.getOrCreateProcessState(key).process = stubProcess{}
 	}
-	defer ln.Close()
-	defer os.Remove(sock)
+	registerHandler(c)
+	defer unregisterHandler(c)
 
-	dialAddr, err := resolveDialAddress("unix/" + sock)
-	if err != nil {
-		t.Fatalf("unexpected error: %v", err)
+	// Glob selects both tenants.
+	rec := httptest.NewRecorder()
+	if err := (adminAPI{}).handleStop(rec, httptest.NewRequest(http.MethodPost, "/reverse-bin/stop?key=tenant-*", nil)); err != nil {
+		t.Fatal(err)
 	}
-	if dialAddr != "unix/"+sock {
-		t.Fatalf("expected unix dial address, got %q", dialAddr)
+	if got := strings.TrimSpace(rec.Body.String()); got != `[{"key":"tenant-a"},{"key":"tenant-b"}]` {
+		t.Fatalf("glob stop reported %s", got)
+	}
+	if c.processes["other"].process == nil || c.processes["tenant-a"].process != nil {
+		t.Fatal("only matching backends may be stopped")
+	}
+
+	// Regexp selects the same keys, which are no longer running.
+	rec = httptest.NewRecorder()
+	if err := (adminAPI{}).handleStop(rec, httptest.NewRequest(http.MethodPost, "/reverse-bin/stop?key_regexp=^tenant-", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(rec.Body.String()); !strings.Contains(got, `"key":"tenant-b","error":"process key \"tenant-b\" is not running"`) {
+		t.Fatalf("regexp stop must report keys that were not running, got %s", got)
+	}
+
+	// A pattern matching nothing is an error rather than a silent no-op.
+	err := (adminAPI{}).handleStop(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/reverse-bin/stop?key=shop-*", nil))
+	var apiErr caddy.APIError
+	if !errors.As(err, &apiErr) || apiErr.HTTPStatus != http.StatusNotFound {
+		t.Fatalf("unmatched pattern must answer 404, got %v", err)
 	}
 }
 
-func TestReverseBin_GetProcessKey(t *testing.T) {
-	tests := []struct {
-		name          string
-		detector      []string
-		requestPath   string
-		wantKeyEmpty  bool
-	}{
-		{
-			name:         "no detector returns empty key",
-			detector:     nil,
-			requestPath:  "/app1/test",
-			wantKeyEmpty: true,
-		},
-		{
-			name:         "detector with static args",
-			detector:     []string{"/bin/detect", "arg1"},
-			requestPath:  "/test",
-			wantKeyEmpty: false,
-		},
-		{
-			name:         "detector with placeholder",
-			detector:     []string{"/bin/detect", "{path}"},
-			requestPath:  "/myapp/handler",
-			wantKeyEmpty: false,
-		},
+// TestStaticFile_ServesOnlyAssetsInsideStaticDir verifies a detector's
+// relative static_dir is resolved against the working directory and only
+// regular, non-hidden files inside it bypass the backend.
+func TestStaticFile_ServesOnlyAssetsInsideStaticDir(t *testing.T) {
+	app := t.TempDir()
+	for name, content := range map[string]string{"public/app.js": "js", "public/.env": "secret", "secret.txt": "x"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(app, name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(app, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ps := &processState{}
+	rel := "public"
+	ps.setStaticDir(&Overrides{StaticDir: &rel, WorkingDirectory: &app})
+	dir := *ps.staticDir.Load()
+	if dir != filepath.Join(app, "public") {
+		t.Fatalf("static_dir resolved to %q", dir)
 	}
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			c := &ReverseBin{
-				DynamicProxyDetector: tt.detector,
-				logger:               zaptest.NewLogger(t),
-			}
+	for urlPath, want := range map[string]bool{
+		"/app.js":           true,
+		"/":                 false, // directories are left to the app
+		"/api/users":        false,
+		"/.env":             false,
+		"/../secret.txt":    false,
+		"/public/../app.js": true,
+	} {
+		if got := staticFile(dir, urlPath); got != want {
+			t.Errorf("staticFile(%q) = %v, want %v", urlPath, got, want)
+		}
+	}
+	// An encoded dot-dot segment reaches the handler decoded, so only
+	// staticFile's own cleaning keeps it inside the directory (synth-1249).
+	for _, raw := range []string{"/%2e%2e/secret.txt", "/%2E%2E/%2e%2e/secret.txt"} {
+		req := httptest.NewRequest(http.MethodGet, raw, nil)
+		if staticFile(dir, req.URL.Path) {
+			t.Errorf("staticFile(%q) from %q must not leave the directory", req.URL.Path, raw)
+		}
+	}
 
-			req := httptest.NewRequest(http.MethodGet, "http://localhost"+tt.requestPath, nil)
-			repl := caddy.NewReplacer()
-			req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+	ps.setStaticDir(&Overrides{})
+	if ps.staticDir.Load() != nil {
+		t.Fatal("a start without static_dir must stop serving the previous one")
+	}
+}
 
-			key := c.getProcessKey(req)
+// TestAdoptPredecessor_CarriesOverUnchangedHandler verifies a reload keeps
+// the backends of an unchanged handler running, while a changed handler
+// starts afresh.
+func TestAdoptPredecessor_CarriesOverUnchangedHandler(t *testing.T) {
+	old, _ := warmHandler(t)
+	old.ctx = caddy.Context{Context: context.Background()}
+	old.configHash = old.fingerprint()
+	ps := old.processes[""]
+	registerHandler(old)
+	defer unregisterHandler(old)
 
-			if tt.wantKeyEmpty && key != "" {
-				t.Errorf("expected empty key, got %q", key)
-			}
-			if !tt.wantKeyEmpty && key == "" {
-				t.Errorf("expected non-empty key")
-			}
-		})
+	// The reloaded configuration contains a changed and an identical handler.
+	changed := &ReverseBin{Executable: []string{"./other"}, ReverseProxyTo: old.ReverseProxyTo,
+		ctx: caddy.Context{Context: context.TODO()}, logger: zap.NewNop(),
+		processes: map[string]*processState{}, provisioned: map[string]*Overrides{}}
+	changed.configHash = changed.fingerprint()
+	changed.adoptPredecessor()
+	if len(changed.processes) != 0 {
+		t.Fatal("a changed handler must not take over backends")
+	}
+	same := &ReverseBin{Executable: old.Executable, ReverseProxyTo: old.ReverseProxyTo,
+		ctx: caddy.Context{Context: context.TODO()}, logger: zap.NewNop(),
+		processes: map[string]*processState{}, provisioned: map[string]*Overrides{}}
+	same.configHash = same.fingerprint()
+	same.adoptPredecessor()
+	if same.processes[""] != ps {
+		t.Fatal("an unchanged handler must take over the running backend")
+	}
+
+	// Unloading the old configuration leaves the carried-over backend alone.
+	if err := old.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if ps.process == nil {
+		t.Fatal("cleanup of the old handler stopped a carried-over backend")
 	}
 }
 
-func TestReverseBin_ProvisionValidation(t *testing.T) {
-	tests := []struct {
+// TestAdoptPredecessor_FailedReloadGivesBackendsBack verifies a handler of
+// a configuration that never loaded returns the backends it took over, so
+// they keep running and the handler still loaded stops them on unload
+// (synth-1229).
+func TestAdoptPredecessor_FailedReloadGivesBackendsBack(t *testing.T) {
+	old, _ := warmHandler(t)
+	old.ctx = caddy.Context{Context: context.Background()}
+	old.configHash = old.fingerprint()
+	ps := old.processes[""]
+	ps.owner.Store(old)
+	registerHandler(old)
+	defer unregisterHandler(old)
+
+	same := &ReverseBin{Executable: old.Executable, ReverseProxyTo: old.ReverseProxyTo,
+		ctx: caddy.Context{Context: context.TODO()}, logger: zap.NewNop(),
+		processes: map[string]*processState{}, provisioned: map[string]*Overrides{}}
+	same.configHash = same.fingerprint()
+	same.adoptPredecessor()
+	if ps.handler(nil) != same {
+		t.Fatal("the exit of an adopted backend must be handled by the new handler")
+	}
+
+	// The new configuration fails to load while the old one is running.
+	if err := same.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if ps.process == nil {
+		t.Fatal("cleanup of a handler that never loaded stopped the running backend")
+	}
+	if ps.handler(nil) != old {
+		t.Fatal("a returned backend must be handled by the handler still loaded")
+	}
+	if err := old.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if ps.process != nil {
+		t.Fatal("unloading the old handler must stop the backend it got back")
+	}
+}
+
+// exitedProcess is a backend that has died but whose exit was not handled yet.
+type exitedProcess struct{ pidProcess }
+
+func (exitedProcess) Alive() bool { return false }
+
+// TestFailureKind_SeparatesAppFromLifecycle verifies failed requests to a
+// running backend count as the application's, and ones sent to a backend that
+// exited or was replaced as lifecycle failures (synth-1261).
+func TestFailureKind_SeparatesAppFromLifecycle(t *testing.T) {
+	cases := []struct {
 		name    string
-		cfg     reverseBinConfig
-		wantErr bool
+		process Process
+		pid     int
+		want    string
 	}{
-		{
-			name: "invalid static non-unix without readiness_check",
-			cfg: reverseBinConfig{
-				Executable:     []string{"./main.py"},
-				ReverseProxyTo: "127.0.0.1:8080",
-			},
-			wantErr: true,
-		},
-		{
-			name: "valid static non-unix with readiness_check",
-			cfg: reverseBinConfig{
-				Executable:      []string{"./main.py"},
-				ReverseProxyTo:  "127.0.0.1:8080",
-				ReadinessMethod: "GET",
-				ReadinessPath:   "/health",
-			},
-			wantErr: false,
-		},
-		{
-			name: "valid static unix without readiness_check",
-			cfg: reverseBinConfig{
-				Executable:     []string{"./main.py"},
-				ReverseProxyTo: "unix//tmp/app.sock",
-			},
-			wantErr: false,
-		},
-		{
-			name: "valid dynamic config",
-			cfg: reverseBinConfig{
-				DynamicProxyDetector: []string{"./detect.py"},
-			},
-			wantErr: false,
-		},
-		{
-			name: "missing executable without detector",
-			cfg: reverseBinConfig{
-				ReverseProxyTo: "127.0.0.1:8080",
-			},
-			wantErr: true,
-		},
-		{
-			name: "missing reverse_proxy_to without detector",
-			cfg: reverseBinConfig{
-				Executable: []string{"./main.py"},
-			},
-			wantErr: true,
-		},
+		{"running", pidProcess(7), 7, failureApp},
+		{"running, backend unknown", pidProcess(7), 0, failureApp},
+		{"stopped", nil, 7, failureLifecycle},
+		{"replaced by a restart", pidProcess(8), 7, failureLifecycle},
+		{"crashed, exit not handled yet", exitedProcess{7}, 7, failureLifecycle},
+	}
+	for _, tc := range cases {
+		ps := &processState{process: tc.process}
+		if got := ps.failureKind(tc.pid); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
 	}
+}
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			// This tests the validation logic in Provision
-			// We check the conditions that would cause Provision to fail
-			hasDetector := len(tt.cfg.DynamicProxyDetector) > 0
-			hasExecutable := len(tt.cfg.Executable) > 0
-			hasProxyTo := tt.cfg.ReverseProxyTo != ""
-			hasReadiness := tt.cfg.ReadinessMethod != "" && tt.cfg.ReadinessPath != ""
-			nonUnix := hasProxyTo && !isUnixUpstream(tt.cfg.ReverseProxyTo)
+// TestWatchBody_CountsResponsesCutShort verifies a response body failing
+// after its headers counts as a failed request, unless the client went away
+// (synth-1237).
+func TestWatchBody_CountsResponsesCutShort(t *testing.T) {
+	c := &ReverseBin{logger: observedLogger(zap.NewNop())}
+	ps := &processState{process: pidProcess(7)}
+	var failures []string
+	stop := ObserveLogs(func(e LogEntry) { failures = append(failures, e.Message) })
+	defer stop()
 
-			shouldFail := (!hasDetector && !hasExecutable) || (!hasDetector && !hasProxyTo) || (nonUnix && !hasReadiness)
+	read := func(r *http.Request) {
+		resp := &http.Response{StatusCode: http.StatusOK,
+			Body: io.NopCloser(io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(io.ErrUnexpectedEOF)))}
+		keyedTransport{c: c}.watchBody(r, ps, 7, resp)
+		_, _ = io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+	}
+	read(httptest.NewRequest(http.MethodGet, "/", nil))
+	if len(failures) != 1 || failures[0] != "running backend failed request" {
+		t.Fatalf("logged %q, want one app failure", failures)
+	}
 
-			if shouldFail != tt.wantErr {
-				t.Errorf("expected error=%v, got error=%v (hasDetector=%v, hasExecutable=%v, hasProxyTo=%v, nonUnix=%v, hasReadiness=%v)",
-					tt.wantErr, shouldFail, hasDetector, hasExecutable, hasProxyTo, nonUnix, hasReadiness)
-			}
-		})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	read(httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+	if len(failures) != 1 {
+		t.Fatalf("a client going away was counted as a failure: %q", failures)
 	}
 }
 
-// NoOpNextHandler is a test helper that does nothing
-type NoOpNextHandler struct{}
+// TestHTTPProbe_ClosesConnectionAfterCheck verifies readiness and liveness
+// checks leave no connection open to the backend between checks
+// (synth-1262).
+func TestHTTPProbe_ClosesConnectionAfterCheck(t *testing.T) {
+	closed := make(chan struct{}, 1)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	backend.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- struct{}{}
+		}
+	}
+	backend.Start()
+	defer backend.Close()
 
-func (n NoOpNextHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
-	return nil
+	_, probe := httpProbe(strings.TrimPrefix(backend.URL, "http://"), http.MethodGet, "/", "", nil, nil, "liveness")
+	if !probe() {
+		t.Fatal("check of a healthy backend failed")
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the check's connection was kept open")
+	}
+}
+
+// TestAutoNice_DeprioritizesBackendsWhileSaturated verifies auto_nice
+// counts the CPUs as saturated from the threshold until load drops well
+// below it, and renices running backends' process groups (synth-1215).
+func TestAutoNice_DeprioritizesBackendsWhileSaturated(t *testing.T) {
+	cfg := (&AutoNice{}).withDefaults()
+	saturated := false
+	for i, step := range []struct {
+		busy float64
+		want bool
+	}{
+		{0.5, false},
+		{0.95, true},
+		{0.85, true}, // within the hysteresis
+		{0.75, false},
+		{0.85, false},
+	} {
+		if saturated = cfg.saturated(saturated, step.busy); saturated != step.want {
+			t.Fatalf("sample %d at %.2f busy: saturated %v, want %v", i, step.busy, saturated, step.want)
+		}
+	}
+
+	if runtime.GOOS != "linux" {
+		t.Skip("reading nice values needs /proc")
+	}
+	cmd := exec.Command("sleep", "60")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Skipf("cannot start a process: %v", err)
+	}
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+	c := &ReverseBin{logger: zap.NewNop(), processes: map[string]*processState{}}
+	c.getOrCreateProcessState("app").process = osProcess{Process: cmd.Process, group: true}
+	// Fakes are left alone: their pids mean nothing to the kernel.
+	c.getOrCreateProcessState("fake").process = pidProcess(1)
+
+	c.reniceBackends(cfg.Nice)
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", cmd.Process.Pid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The nice value is the 19th field; the command name before it is in
+	// parentheses.
+	_, rest, _ := strings.Cut(string(stat), ") ")
+	if fields := strings.Fields(rest); len(fields) < 17 || fields[16] != strconv.Itoa(cfg.Nice) {
+		t.Fatalf("backend not reniced to %d: %s", cfg.Nice, stat)
+	}
+}
+
+// TestKubernetesRuntime_ScalesWorkloadOnDemand verifies the kubernetes
+// runtime scales its workload to 1 for a request, proxies to its Service once
+// ready, and scales it back to 0 when stopped (synth-1204).
+func TestKubernetesRuntime_ScalesWorkloadOnDemand(t *testing.T) {
+	scaled := make(chan string, 2)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/healthz":
+		case r.Method == http.MethodPatch && r.URL.Path == "/apis/apps/v1/namespaces/apps/deployments/my-app/scale":
+			if r.Header.Get("Authorization") != "Bearer s3cret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			body, _ := io.ReadAll(r.Body)
+			scaled <- string(body)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer api.Close()
+	token := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(token, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	addr := strings.TrimPrefix(api.URL, "http://")
+	c := &ReverseBin{
+		ReverseProxyTo:  addr,
+		ReadinessMethod: http.MethodGet,
+		ReadinessPath:   "/healthz",
+		Kubernetes: &KubernetesRuntime{Kind: "deployment", Name: "my-app", Namespace: "apps",
+			APIServer: api.URL, TokenFile: token, client: api.Client()},
+		logger:    zap.NewNop(),
+		processes: map[string]*processState{},
+		ctx:       caddy.Context{Context: context.Background()},
+	}
+	ps := c.getOrCreateProcessState("")
+	upstream, err := c.ensureProcessRunningAndResolveUpstream(httptest.NewRequest(http.MethodGet, "/", nil), ps, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := <-scaled; got != `{"spec":{"replicas":1}}` {
+		t.Fatalf("scaled up with %s", got)
+	}
+	if upstream != addr {
+		t.Fatalf("proxying to %q, want the Service at %q", upstream, addr)
+	}
+
+	// A request while scaled up does not scale again.
+	if _, err := c.ensureProcessRunningAndResolveUpstream(httptest.NewRequest(http.MethodGet, "/", nil), ps, ""); err != nil {
+		t.Fatal(err)
+	}
+	ps.mu.Lock()
+	ps.stopLocked("idle timeout")
+	ps.mu.Unlock()
+	if got := <-scaled; got != `{"spec":{"replicas":0}}` {
+		t.Fatalf("scaled down with %s", got)
+	}
 }
@@ -0,0 +1,266 @@
+// Package reversebintest provides fakes for unit-testing reverse-bin
+// configurations without spawning real backend processes.
+//
+// Wire a provisioned handler to an in-memory backend and a manual clock:
+//
+//	runner, clock := reversebintest.Wire(handler, backend)
+//	// ... serve requests through handler ...
+//	clock.Advance(idleTimeout) // fires the idle timer, stopping the backend
+package reversebintest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	reversebin "github.com/tarasglek/reverse-bin"
+)
+
+// Wire sets h to start backends with a Runner serving backend and to measure
+// time with a Clock starting now.
+func Wire(h *reversebin.ReverseBin, backend http.Handler) (*Runner, *Clock) {
+	runner := NewRunner(backend)
+	clock := NewClock(time.Now())
+	h.Runner = runner
+	h.Clock = clock
+	return runner, clock
+}
+
+// Runner is a reversebin.Runner that serves Handler in-process on each
+// backend's reverse_proxy_to address instead of executing it.
+type Runner struct {
+	Handler http.Handler
+	// StartErr, when set, is returned by every Start call.
+	StartErr error
+
+	mu      sync.Mutex
+	starts  []reversebin.ProcessSpec
+	running int
+	nextPID int
+}
+
+// NewRunner returns a Runner serving h.
+func NewRunner(h http.Handler) *Runner {
+	return &Runner{Handler: h}
+}
+
+// Start implements reversebin.Runner.
+func (r *Runner) Start(ctx context.Context, spec reversebin.ProcessSpec) (reversebin.Process, <-chan error, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.starts = append(r.starts, spec)
+	if r.StartErr != nil {
+		return nil, nil, r.StartErr
+	}
+	ln, err := listen(spec.ReverseProxyTo)
+	if err != nil {
+		return nil, nil, err
+	}
+	r.nextPID++
+	r.running++
+	p := &process{pid: r.nextPID, killed: make(chan struct{})}
+	p.alive.Store(true)
+
+	srv := &http.Server{Handler: r.Handler}
+	go func() { _ = srv.Serve(ln) }()
+
+	exited := make(chan error, 1)
+	go func() {
+		var err error
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-p.killed:
+		}
+		_ = srv.Close()
+		p.alive.Store(false)
+		r.mu.Lock()
+		r.running--
+		r.mu.Unlock()
+		exited <- err
+	}()
+	return p, exited, nil
+}
+
+// Starts returns the spec of every backend start attempted so far.
+func (r *Runner) Starts() []reversebin.ProcessSpec {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]reversebin.ProcessSpec(nil), r.starts...)
+}
+
+// Running returns the number of backends currently serving.
+func (r *Runner) Running() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.running
+}
+
+// listen binds addr the way a real backend would for reverse_proxy_to.
+func listen(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, "unix/") {
+		path := strings.TrimPrefix(addr, "unix/")
+		_ = os.Remove(path)
+		return net.Listen("unix", path)
+	}
+	addr = strings.TrimPrefix(strings.TrimPrefix(addr, "http://"), "https://")
+	if strings.HasPrefix(addr, ":") {
+		addr = "127.0.0.1" + addr
+	}
+	return net.Listen("tcp", addr)
+}
+
+type process struct {
+	pid    int
+	alive  atomic.Bool
+	once   sync.Once
+	killed chan struct{}
+}
+
+func (p *process) Pid() int    { return p.pid }
+func (p *process) Alive() bool { return p.alive.Load() }
+func (p *process) Kill()       { p.once.Do(func() { close(p.killed) }) }
+
+// Invariants is a reversebin.Observer that records every request proxied to
+// a backend that is not ready: still starting, draining or exited. Set it as
+// a handler's Observer, drive requests and stops concurrently, then check
+// Violations. The zero value is ready to use.
+type Invariants struct {
+	mu         sync.Mutex
+	states     map[backendID]reversebin.BackendState
+	proxied    int
+	violations []string
+}
+
+type backendID struct {
+	key string
+	pid int
+}
+
+// BackendChanged implements reversebin.Observer.
+func (inv *Invariants) BackendChanged(key string, pid int, state reversebin.BackendState) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	if inv.states == nil {
+		inv.states = map[backendID]reversebin.BackendState{}
+	}
+	inv.states[backendID{key, pid}] = state
+}
+
+// Proxying implements reversebin.Observer. Backends started by another Caddy
+// instance (pid 0) have no states to check.
+func (inv *Invariants) Proxying(key string, pid int) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	inv.proxied++
+	if pid == 0 {
+		return
+	}
+	if state := inv.states[backendID{key, pid}]; state != reversebin.BackendReady {
+		inv.violations = append(inv.violations,
+			fmt.Sprintf("request to key %q proxied to pid %d in state %q", key, pid, state))
+	}
+}
+
+// Proxied returns the number of requests proxied so far.
+func (inv *Invariants) Proxied() int {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	return inv.proxied
+}
+
+// Violations describes every request proxied to a backend that was not ready.
+func (inv *Invariants) Violations() []string {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	return append([]string(nil), inv.violations...)
+}
+
+// Clock is a reversebin.Clock that only moves when advanced.
+type Clock struct {
+	mu      sync.Mutex
+	now     time.Time
+	pending []*timer
+}
+
+// NewClock returns a Clock reading now.
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+// Now implements reversebin.Clock.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// After implements reversebin.Clock.
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	c.schedule(d, func(now time.Time) { ch <- now })
+	return ch
+}
+
+// AfterFunc implements reversebin.Clock.
+func (c *Clock) AfterFunc(d time.Duration, f func()) reversebin.Timer {
+	return c.schedule(d, func(time.Time) { f() })
+}
+
+// Advance moves the clock forward by d and runs everything that became due,
+// in deadline order, on the calling goroutine.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	now := c.now
+	var due, rest []*timer
+	for _, t := range c.pending {
+		if !t.at.After(now) {
+			due = append(due, t)
+		} else {
+			rest = append(rest, t)
+		}
+	}
+	c.pending = rest
+	c.mu.Unlock()
+
+	sort.SliceStable(due, func(i, j int) bool { return due[i].at.Before(due[j].at) })
+	for _, t := range due {
+		t.f(now)
+	}
+}
+
+func (c *Clock) schedule(d time.Duration, f func(time.Time)) *timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &timer{clock: c, at: c.now.Add(d), f: f}
+	c.pending = append(c.pending, t)
+	return t
+}
+
+type timer struct {
+	clock *Clock
+	at    time.Time
+	f     func(time.Time)
+}
+
+// Stop implements reversebin.Timer.
+func (t *timer) Stop() bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, p := range c.pending {
+		if p == t {
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
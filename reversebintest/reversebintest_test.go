@@ -0,0 +1,112 @@
+package reversebintest
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	reversebin "github.com/tarasglek/reverse-bin"
+)
+
+// TestRunner_ServesHandlerUntilStopped verifies a fake backend answers on its
+// unix socket and exits when its context is cancelled.
+func TestRunner_ServesHandlerUntilStopped(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "app.sock")
+	runner := NewRunner(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "fake")
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	proc, exited, err := runner.Start(ctx, reversebin.ProcessSpec{ReverseProxyTo: "unix/" + sock})
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+		},
+	}}
+	// Request through the socket reaches the fake handler.
+	resp, err := client.Get("http://backend/")
+	if err != nil {
+		t.Fatalf("request to fake backend: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if string(body) != "fake" || !proc.Alive() || runner.Running() != 1 {
+		t.Fatalf("body=%q alive=%v running=%d", body, proc.Alive(), runner.Running())
+	}
+
+	cancel()
+	<-exited
+	if proc.Alive() || runner.Running() != 0 {
+		t.Fatalf("backend must stop when its context is cancelled")
+	}
+}
+
+// TestClock_AdvanceFiresDueTimers verifies timers fire only once the clock
+// passes their deadline and stopped timers never fire.
+func TestClock_AdvanceFiresDueTimers(t *testing.T) {
+	clock := NewClock(time.Unix(0, 0))
+	var fired []string
+	clock.AfterFunc(2*time.Second, func() { fired = append(fired, "idle") })
+	stopped := clock.AfterFunc(time.Second, func() { fired = append(fired, "stopped") })
+	deadline := clock.After(3 * time.Second)
+
+	if !stopped.Stop() {
+		t.Fatalf("pending timer must report being stopped")
+	}
+	clock.Advance(time.Second)
+	if len(fired) != 0 {
+		t.Fatalf("nothing is due after 1s, fired %v", fired)
+	}
+	clock.Advance(2 * time.Second)
+	if len(fired) != 1 || fired[0] != "idle" {
+		t.Fatalf("fired %v, want [idle]", fired)
+	}
+	select {
+	case <-deadline:
+	default:
+		t.Fatalf("After channel must fire at its deadline")
+	}
+}
+
+// TestInvariants_FlagsRequestsToBackendsNotReady verifies only requests to a
+// ready backend pass, and a pid reused by a later start is judged afresh.
+func TestInvariants_FlagsRequestsToBackendsNotReady(t *testing.T) {
+	var inv Invariants
+	inv.BackendChanged("a", 7, reversebin.BackendStarting)
+	inv.Proxying("a", 7)
+	inv.BackendChanged("a", 7, reversebin.BackendReady)
+	inv.Proxying("a", 7)
+	inv.BackendChanged("a", 7, reversebin.BackendDraining)
+	inv.Proxying("a", 7)
+	inv.BackendChanged("a", 7, reversebin.BackendExited)
+	inv.Proxying("a", 7)
+	// The same pid under another key was never reported.
+	inv.Proxying("b", 7)
+	// Backends of another Caddy instance are not checked.
+	inv.Proxying("a", 0)
+
+	got := inv.Violations()
+	want := []string{
+		`request to key "a" proxied to pid 7 in state "starting"`,
+		`request to key "a" proxied to pid 7 in state "draining"`,
+		`request to key "a" proxied to pid 7 in state "exited"`,
+		`request to key "b" proxied to pid 7 in state ""`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") || inv.Proxied() != 6 {
+		t.Fatalf("violations %q after %d requests, want %q after 6", got, inv.Proxied(), want)
+	}
+
+	inv.BackendChanged("a", 7, reversebin.BackendReady)
+	inv.Proxying("a", 7)
+	if len(inv.Violations()) != len(want) {
+		t.Fatal("a restarted backend reusing the pid must be accepted once ready")
+	}
+}
@@ -0,0 +1,205 @@
+package reversebin
+
+import (
+	"bytes"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// mountScanLimit bounds how much of an HTML response is buffered while
+// looking for its <head> tag and the end of the head; pages without them in
+// time are left alone.
+const mountScanLimit = 16 << 10
+
+// prefixWriter adapts the responses of an app that assumes it is served from
+// / to the path prefix it is mounted at: root-relative redirects get the
+// prefix and HTML pages get a <base href> for their relative links.
+type prefixWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	prefix string
+	// scanning is set while an HTML body is held back until <head> is seen
+	scanning    bool
+	buf         []byte
+	wroteHeader bool
+}
+
+// withMountPrefix wraps w to rewrite responses for mount_prefix, or returns w
+// when none is configured. The returned func sends anything still held back.
+func (c *ReverseBin) withMountPrefix(w http.ResponseWriter) (http.ResponseWriter, func()) {
+	if c.MountPrefix == "" {
+		return w, func() {}
+	}
+	pw := &prefixWriter{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+		prefix:                strings.TrimSuffix(c.MountPrefix, "/"),
+	}
+	return pw, pw.release
+}
+
+// prefixed returns loc under the mount prefix if it is a root-relative URL
+// the app produced, and loc unchanged otherwise.
+func (w *prefixWriter) prefixed(loc string) string {
+	if !strings.HasPrefix(loc, "/") || strings.HasPrefix(loc, "//") {
+		return loc
+	}
+	if loc == w.prefix || strings.HasPrefix(loc, w.prefix+"/") {
+		return loc
+	}
+	return w.prefix + loc
+}
+
+func (w *prefixWriter) WriteHeader(status int) {
+	// 1xx responses are informational; wait for the final status.
+	if status < 200 || w.wroteHeader {
+		w.ResponseWriterWrapper.WriteHeader(status)
+		return
+	}
+	w.wroteHeader = true
+	h := w.Header()
+	if loc := h.Get("Location"); loc != "" {
+		h.Set("Location", w.prefixed(loc))
+	}
+	mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	if mediaType == "text/html" && h.Get("Content-Encoding") == "" &&
+		status != http.StatusNoContent && status != http.StatusNotModified {
+		w.scanning = true
+		// The injected element changes the body length.
+		h.Del("Content-Length")
+	}
+	w.ResponseWriterWrapper.WriteHeader(status)
+}
+
+func (w *prefixWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.scanning {
+		return w.ResponseWriterWrapper.Write(b)
+	}
+	w.buf = append(w.buf, b...)
+	if out, ok := w.withBase(w.buf, false); ok {
+		w.scanning, w.buf = false, nil
+		if _, err := w.ResponseWriterWrapper.Write(out); err != nil {
+			return 0, err
+		}
+	} else if len(w.buf) > mountScanLimit {
+		if err := w.flushBuffered(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// withBase returns page with a <base href> for the prefix right after its
+// <head> tag, once the head has been seen in full or, when complete, the page
+// ended. A <base href> of the page's own is kept instead, since only the first
+// one counts: a root-relative href gets the prefix and any other is left
+// alone.
+func (w *prefixWriter) withBase(page []byte, complete bool) ([]byte, bool) {
+	at := headEnd(page)
+	if at < 0 {
+		return nil, false
+	}
+	end := headClose(page[at:])
+	if end < 0 {
+		if !complete {
+			return nil, false
+		}
+		end = len(page) - at
+	}
+	if m := baseHref.FindSubmatchIndex(page[at : at+end]); m != nil {
+		// Exactly one of the quoted, single-quoted and bare values matched.
+		for g := 2; g < len(m); g += 2 {
+			if m[g] < 0 {
+				continue
+			}
+			from, to := at+m[g], at+m[g+1]
+			href := html.UnescapeString(string(page[from:to]))
+			if w.prefixed(href) == href {
+				return page, true
+			}
+			out := make([]byte, 0, len(page)+len(w.prefix))
+			out = append(append(out, page[:from]...), html.EscapeString(w.prefixed(href))...)
+			return append(out, page[to:]...), true
+		}
+	}
+	base := `<base href="` + html.EscapeString(w.prefix) + `/">`
+	out := make([]byte, 0, len(page)+len(base))
+	return append(append(append(out, page[:at]...), base...), page[at:]...), true
+}
+
+// ReadFrom keeps copies of the body going through Write while scanning.
+func (w *prefixWriter) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(writerOnly{w}, r)
+}
+
+// Flush sends the held back part of the page unchanged, so streamed HTML is
+// never delayed.
+func (w *prefixWriter) Flush() {
+	if w.scanning {
+		_ = w.flushBuffered()
+	}
+	_ = http.NewResponseController(w.ResponseWriterWrapper).Flush()
+}
+
+func (w *prefixWriter) flushBuffered() error {
+	buf := w.buf
+	w.scanning, w.buf = false, nil
+	_, err := w.ResponseWriterWrapper.Write(buf)
+	return err
+}
+
+// release sends a page that ended while it was held back, with a base if
+// its <head> tag was found.
+func (w *prefixWriter) release() {
+	if !w.scanning {
+		return
+	}
+	if out, ok := w.withBase(w.buf, true); ok {
+		w.buf = out
+	}
+	_ = w.flushBuffered()
+}
+
+// headEnd returns the offset just past the opening <head> tag in b, or -1.
+func headEnd(b []byte) int {
+	lower := bytes.ToLower(b)
+	for from := 0; ; {
+		i := bytes.Index(lower[from:], []byte("<head"))
+		if i < 0 {
+			return -1
+		}
+		i += from + len("<head")
+		// Skip <header> and other tags starting with "head".
+		if i < len(lower) && (lower[i] == '>' || lower[i] == ' ' || lower[i] == '\t' || lower[i] == '\n' || lower[i] == '\r') {
+			if j := bytes.IndexByte(lower[i:], '>'); j >= 0 {
+				return i + j + 1
+			}
+			return -1
+		}
+		from = i
+	}
+}
+
+// headClose returns the offset in b, the part of a page after its <head>
+// tag, where the head ends, at </head> or the <body> that implies it, or -1.
+func headClose(b []byte) int {
+	lower := bytes.ToLower(b)
+	end := bytes.Index(lower, []byte("</head"))
+	if i := bytes.Index(lower, []byte("<body")); i >= 0 && (end < 0 || i < end) {
+		end = i
+	}
+	return end
+}
+
+// baseHref matches a <base> element with an href, capturing its value.
+var baseHref = regexp.MustCompile(`(?i)<base\s(?:[^>]*?\s)?href\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+
+// writerOnly hides ReadFrom so io.Copy uses Write.
+type writerOnly struct{ io.Writer }
@@ -0,0 +1,68 @@
+package reversebin
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// rssCheckInterval is how often the memory of backends is sampled for
+// restart_if_rss_above.
+const rssCheckInterval = 10 * time.Second
+
+// byteUnits are the size suffixes parseByteSize accepts, in any case.
+var byteUnits = []struct {
+	suffix string
+	size   float64
+}{
+	{"KIB", 1 << 10}, {"MIB", 1 << 20}, {"GIB", 1 << 30},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30},
+	{"B", 1},
+}
+
+// parseByteSize parses a size such as 800MB, 1.5GiB or 512M; single-letter
+// suffixes are binary, like ulimit's.
+func parseByteSize(s string) (int64, error) {
+	number, size := s, 1.0
+	for _, u := range byteUnits {
+		if strings.HasSuffix(strings.ToUpper(s), u.suffix) {
+			number, size = s[:len(s)-len(u.suffix)], u.size
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(v * size), nil
+}
+
+// watchRSS samples the memory of the backend pid of ps until it exits and
+// gone is closed, also after a reload hands it to another handler, and
+// recycles it once it uses more than restart_if_rss_above.
+func (c *ReverseBin) watchRSS(ps *processState, pid int, gone <-chan struct{}) {
+	limit := c.RestartRSSAboveBytes
+	for {
+		select {
+		case <-ps.handler(c).clock().After(rssCheckInterval):
+		case <-gone:
+			return
+		}
+		rss, err := backendRSS(pid)
+		if err != nil {
+			h := ps.handler(c)
+			h.logger.Warn("failed to sample backend memory; restart_if_rss_above is not enforced for it",
+				zap.String("key", h.processKeyName(ps.key)), zap.Int("pid", pid), zap.Error(err))
+			return
+		}
+		if rss > limit {
+			c.recycle(ps, pid, gone, "rss", "rss limit exceeded",
+				zap.Int64("rss_bytes", rss), zap.Int64("limit_bytes", limit))
+			return
+		}
+	}
+}
@@ -0,0 +1,42 @@
+//go:build linux
+
+package reversebin
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// backendRSS returns the resident memory in bytes of the processes in the
+// process group pgid, which covers a backend and its children.
+func backendRSS(pgid int) (int64, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return 0, err
+	}
+	var pages int64
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err != nil {
+			continue
+		}
+		data, err := os.ReadFile("/proc/" + entry.Name() + "/stat")
+		if err != nil {
+			continue
+		}
+		// "pid (comm) state ppid pgrp ... rss ..."; comm may contain spaces.
+		closeIdx := bytes.LastIndexByte(data, ')')
+		if closeIdx == -1 {
+			continue
+		}
+		fields := strings.Fields(string(data[closeIdx+1:]))
+		if len(fields) < 22 || fields[2] != strconv.Itoa(pgid) {
+			continue
+		}
+		if n, err := strconv.ParseInt(fields[21], 10, 64); err == nil {
+			pages += n
+		}
+	}
+	return pages * int64(os.Getpagesize()), nil
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+
+package reversebin
+
+import (
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// backendRSS returns the resident memory in bytes of the backend process
+// pid; children are not counted outside Linux.
+func backendRSS(pid int) (int64, error) {
+	out, err := exec.Command("ps", "-o", "rss=", "-p", strconv.Itoa(pid)).Output()
+	if err != nil {
+		return 0, err
+	}
+	kib, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return kib << 10, nil
+}
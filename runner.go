@@ -0,0 +1,142 @@
+package reversebin
+
+import (
+	"context"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Process is a running backend as tracked by the handler.
+type Process interface {
+	Pid() int
+	// Alive reports whether the backend still exists and can serve requests.
+	Alive() bool
+	// Kill stops the backend without waiting for it to exit.
+	Kill()
+}
+
+// ProcessSpec describes a backend to start, after detector overrides and
+// environment passing have been applied.
+type ProcessSpec struct {
+	Key              string
+	Executable       []string
+	WorkingDirectory string
+	Env              []string
+	ReverseProxyTo   string
+	// Output receives each line the backend writes to stdout or stderr.
+	Output func(pid int, stream, text string)
+}
+
+// Runner starts backends. Without one the handler executes spec.Executable
+// with os/exec; tests can substitute a fake (see package reversebintest).
+type Runner interface {
+	// Start launches the backend. Cancelling ctx stops it. The returned
+	// channel receives the exit error once the backend has stopped and all
+	// of its output has been delivered.
+	Start(ctx context.Context, spec ProcessSpec) (Process, <-chan error, error)
+}
+
+// Clock is the time source for idle timeouts and readiness deadlines.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a pending Clock.AfterFunc call.
+type Timer interface {
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// clock returns the configured Clock, defaulting to the wall clock.
+func (c *ReverseBin) clock() Clock {
+	if c.Clock != nil {
+		return c.Clock
+	}
+	return realClock{}
+}
+
+// osProcess is a backend started with os/exec. Unless group is false
+// (kill_mode process), Kill takes down the backend's whole process group.
+type osProcess struct {
+	*os.Process
+	group bool
+	// grace is how long the backend may take to exit after stopSignal
+	// before it is killed (stop_timeout); 0 kills it right away
+	grace      time.Duration
+	stopSignal syscall.Signal
+	// done is closed once the backend has exited
+	done <-chan struct{}
+	// following is true until the processes a backend left running when its
+	// first one exited are gone (follow_reexec); nil when they are not followed
+	following *atomic.Bool
+}
+
+func (p osProcess) Pid() int { return p.Process.Pid }
+
+func (p osProcess) Alive() bool {
+	return isProcessAlive(p.Process) || (p.following != nil && p.following.Load())
+}
+
+// Kill sends the stop signal when a grace period is set and escalates to
+// SIGKILL in the background if the backend is still running once it is over.
+func (p osProcess) Kill() {
+	if p.grace <= 0 || p.done == nil || p.terminate() != nil {
+		p.kill()
+		return
+	}
+	go func() {
+		timer := time.NewTimer(p.grace)
+		defer timer.Stop()
+		select {
+		case <-p.done:
+		case <-timer.C:
+			p.kill()
+		}
+	}()
+}
+
+func (p osProcess) terminate() error {
+	if p.group {
+		return signalProcessGroup(p.Process, p.stopSignal)
+	}
+	return p.Process.Signal(p.stopSignal)
+}
+
+func (p osProcess) kill() {
+	if p.group {
+		killProcessGroup(p.Process)
+		return
+	}
+	_ = p.Process.Kill()
+}
+
+// stopGrace is how long stopped backends may take to exit before they are
+// killed: stop_timeout, or defaultStopTimeout when only stop_signal is set.
+func (c *ReverseBin) stopGrace() time.Duration {
+	if c.StopTimeoutMS > 0 {
+		return time.Duration(c.StopTimeoutMS) * time.Millisecond
+	}
+	if c.StopSignal != "" {
+		return defaultStopTimeout
+	}
+	return 0
+}
+
+// stopSignal is the signal asking stopped backends to exit (default, SIGTERM).
+func (c *ReverseBin) stopSignal() syscall.Signal {
+	if sig, ok := preStopSignals[c.StopSignal]; ok {
+		return sig
+	}
+	return syscall.SIGTERM
+}
@@ -0,0 +1,172 @@
+package reversebin
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// defaultClosedPage is the body served outside active_hours when no page is
+// configured.
+const defaultClosedPage = "Service is only available during its active hours.\n"
+
+// ActiveHours limits when backends may run to daily windows. Outside them
+// every request gets a static response, so backends are never started and
+// running ones are stopped by their idle timeout.
+type ActiveHours struct {
+	// Daily windows such as "08:00-20:00"; a window ending before it starts,
+	// such as "22:00-06:00", spans midnight
+	Windows []string `json:"windows"`
+	// IANA time zone of the windows, e.g. "Europe/Berlin" (default, local time)
+	Timezone string `json:"timezone,omitempty"`
+	// File whose contents are the response body outside the windows
+	// (default, a short notice)
+	Page string `json:"page,omitempty"`
+	// Response status outside the windows (default, 503)
+	Status int `json:"status,omitempty"`
+
+	loc   *time.Location
+	spans []hourSpan
+}
+
+// hourSpan is a window in minutes since midnight; end may be 1440.
+type hourSpan struct{ start, end int }
+
+func (s hourSpan) contains(minute int) bool {
+	if s.start < s.end {
+		return minute >= s.start && minute < s.end
+	}
+	return minute >= s.start || minute < s.end
+}
+
+// unmarshalCaddyfile parses "active_hours <window>... [<timezone>]" with an
+// optional block of page and status.
+func (a *ActiveHours) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	args := d.RemainingArgs()
+	if len(args) == 0 {
+		return d.ArgErr()
+	}
+	if last := args[len(args)-1]; !strings.Contains(last, "-") || strings.Contains(last, "/") {
+		a.Timezone = last
+		args = args[:len(args)-1]
+	}
+	if len(args) == 0 {
+		return d.Err("active_hours needs at least one window such as 08:00-20:00")
+	}
+	a.Windows = args
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "page":
+			if !d.Args(&a.Page) {
+				return d.ArgErr()
+			}
+		case "status":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			status, err := strconv.Atoi(d.Val())
+			if err != nil || status < 400 || status > 599 {
+				return d.Errf("active_hours status must be an HTTP error status, got %q", d.Val())
+			}
+			a.Status = status
+		default:
+			return d.Errf("unknown active_hours subdirective: %q", d.Val())
+		}
+	}
+	// Report bad windows and time zones while adapting the Caddyfile.
+	check := *a
+	return check.provision()
+}
+
+// provision parses the windows and loads the time zone.
+func (a *ActiveHours) provision() error {
+	if len(a.Windows) == 0 {
+		return fmt.Errorf("active_hours needs at least one window")
+	}
+	a.loc = time.Local
+	if a.Timezone != "" {
+		loc, err := time.LoadLocation(a.Timezone)
+		if err != nil {
+			return fmt.Errorf("active_hours time zone: %v", err)
+		}
+		a.loc = loc
+	}
+	a.spans = nil
+	for _, w := range a.Windows {
+		from, to, ok := strings.Cut(w, "-")
+		start, err1 := parseClock(from)
+		end, err2 := parseClock(to)
+		if !ok || err1 != nil || err2 != nil || start == end || start == 24*60 {
+			return fmt.Errorf("active_hours window must look like 08:00-20:00, got %q", w)
+		}
+		a.spans = append(a.spans, hourSpan{start, end})
+	}
+	return nil
+}
+
+// parseClock parses HH:MM into minutes since midnight, allowing 24:00.
+func parseClock(s string) (int, error) {
+	h, m, ok := strings.Cut(s, ":")
+	hours, err1 := strconv.Atoi(h)
+	minutes, err2 := strconv.Atoi(m)
+	if !ok || len(m) != 2 || err1 != nil || err2 != nil || hours < 0 || minutes < 0 || minutes > 59 ||
+		hours > 24 || (hours == 24 && minutes != 0) {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return hours*60 + minutes, nil
+}
+
+// active reports whether now falls in one of the windows.
+func (a *ActiveHours) active(now time.Time) bool {
+	local := now.In(a.loc)
+	minute := local.Hour()*60 + local.Minute()
+	for _, s := range a.spans {
+		if s.contains(minute) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextOpening returns when the next window after now begins.
+func (a *ActiveHours) nextOpening(now time.Time) time.Time {
+	local := now.In(a.loc)
+	var next time.Time
+	for _, s := range a.spans {
+		at := time.Date(local.Year(), local.Month(), local.Day(), 0, s.start, 0, 0, a.loc)
+		if !at.After(now) {
+			at = time.Date(local.Year(), local.Month(), local.Day()+1, 0, s.start, 0, 0, a.loc)
+		}
+		if next.IsZero() || at.Before(next) {
+			next = at
+		}
+	}
+	return next
+}
+
+// serveIfClosed writes the closed response and reports true when now is
+// outside every window.
+func (a *ActiveHours) serveIfClosed(w http.ResponseWriter, r *http.Request, key string, now time.Time) bool {
+	if a.active(now) {
+		return false
+	}
+	body, contentType := []byte(defaultClosedPage), "text/plain; charset=utf-8"
+	if data, pageType, ok := readKeyPage(r, key, a.Page); ok {
+		body, contentType = data, pageType
+	}
+	status := a.Status
+	if status == 0 {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(a.nextOpening(now).Sub(now).Seconds()))))
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+	return true
+}
@@ -0,0 +1,77 @@
+package reversebin
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// sharedStartLock names the storage lock serializing spawns of a key across
+// Caddy instances that share storage.
+func (c *ReverseBin) sharedStartLock(key string) string {
+	sum := sha256.Sum256([]byte(c.processKeyName(key)))
+	return "reverse_bin/start/" + hex.EncodeToString(sum[:8])
+}
+
+// startOrAdoptShared starts a key's backend at most once across Caddy
+// instances sharing storage (e.g. a socket directory on shared NFS). An
+// instance that finds the upstream already answering adopts it and only
+// proxies; the instance that spawned it owns its lifecycle. The caller must
+// hold ps.mu.
+func (c *ReverseBin) startOrAdoptShared(ctx context.Context, r *http.Request, ps *processState, key string) (*Overrides, error) {
+	overrides, err := c.resolveOverrides(r, key)
+	if err != nil {
+		return nil, err
+	}
+	if upstreamReachable(*overrides.ReverseProxyTo) {
+		ps.adopted = true
+		return overrides, nil
+	}
+
+	storage := c.ctx.Storage()
+	lockName := c.sharedStartLock(key)
+	if err := storage.Lock(ctx, lockName); err != nil {
+		return nil, fmt.Errorf("failed to acquire shared start lock: %v", err)
+	}
+	defer func() {
+		if err := storage.Unlock(context.Background(), lockName); err != nil {
+			c.logger.Warn("failed to release shared start lock", zap.String("lock", lockName), zap.Error(err))
+		}
+	}()
+
+	// Another instance may have finished starting the backend while we waited.
+	if upstreamReachable(*overrides.ReverseProxyTo) {
+		c.logger.Info("adopting backend started by another instance",
+			zap.String("key", key),
+			zap.String("address", *overrides.ReverseProxyTo))
+		ps.adopted = true
+		return overrides, nil
+	}
+	ps.adopted = false
+	return c.spawnProcess(ctx, ps, key, overrides, traceFrom(r))
+}
+
+// upstreamReachable reports whether something accepts connections at addr.
+func upstreamReachable(addr string) bool {
+	network, dialAddr := "unix", strings.TrimPrefix(addr, "unix/")
+	if !isUnixUpstream(addr) {
+		resolved, err := resolveDialAddress(addr)
+		if err != nil {
+			return false
+		}
+		network, dialAddr = "tcp", resolved
+	}
+	conn, err := net.DialTimeout(network, dialAddr, 500*time.Millisecond)
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
@@ -0,0 +1,102 @@
+package reversebin
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// slowStartCeiling is the concurrency slow_start ramps up to when
+// max_inflight_per_key is not set.
+const slowStartCeiling = 100
+
+// slowStartPoll is how often a request held back by slow_start rechecks the
+// ramp, which widens with time as well as when requests finish.
+const slowStartPoll = 50 * time.Millisecond
+
+// rampState tracks the requests admitted to a freshly started backend while
+// slow_start limits its concurrency.
+type rampState struct {
+	mu      sync.Mutex
+	readyAt time.Time
+	active  int
+}
+
+// begin starts the ramp for a backend that just passed readiness.
+func (rs *rampState) begin(now time.Time) {
+	rs.mu.Lock()
+	rs.readyAt = now
+	rs.mu.Unlock()
+}
+
+// rampLimit returns how many requests a backend ready for elapsed may serve
+// concurrently: one at first, growing linearly to the per-key cap.
+func (c *ReverseBin) rampLimit(elapsed time.Duration) int {
+	ceiling := c.MaxInflightPerKey
+	if ceiling <= 0 {
+		ceiling = slowStartCeiling
+	}
+	period := time.Duration(c.SlowStartMS) * time.Millisecond
+	return 1 + int(int64(ceiling-1)*int64(elapsed)/int64(period))
+}
+
+// admitRamp blocks while the key's backend is within its slow_start period
+// and already serving as many requests as the ramp allows. The returned
+// func ends the request's share of the ramp.
+func (c *ReverseBin) admitRamp(ctx context.Context, ps *processState) (func(), error) {
+	if c.SlowStartMS <= 0 {
+		return func() {}, nil
+	}
+	period := time.Duration(c.SlowStartMS) * time.Millisecond
+	for {
+		ps.ramp.mu.Lock()
+		elapsed := c.clock().Now().Sub(ps.ramp.readyAt)
+		if ps.ramp.readyAt.IsZero() || elapsed >= period {
+			ps.ramp.mu.Unlock()
+			return func() {}, nil
+		}
+		if ps.ramp.active < c.rampLimit(elapsed) {
+			ps.ramp.active++
+			ps.ramp.mu.Unlock()
+			var once sync.Once
+			return func() {
+				once.Do(func() {
+					ps.ramp.mu.Lock()
+					ps.ramp.active--
+					ps.ramp.mu.Unlock()
+				})
+			}, nil
+		}
+		ps.ramp.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("gave up waiting for slow start: %w", ctx.Err())
+		case <-time.After(slowStartPoll):
+		}
+	}
+}
+
+// releaseOnClose keeps a request counted against the ramp until the proxy
+// has finished copying the response body.
+func releaseOnClose(resp *http.Response, release func()) {
+	// Upgraded connections must keep their io.ReadWriteCloser body.
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		release()
+		return
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+}
+
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
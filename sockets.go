@@ -0,0 +1,159 @@
+package reversebin
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// Defaults of socket_cleanup.
+const (
+	defaultSocketCleanupInterval = 10 * time.Minute
+	defaultSocketMinAge          = 10 * time.Minute
+)
+
+// SocketCleanup periodically removes unix sockets left behind in a directory
+// by backends that crashed, or by handlers that are gone.
+type SocketCleanup struct {
+	Dir string `json:"dir"`
+	// Milliseconds between scans (default, 600000)
+	IntervalMS int `json:"interval_ms,omitempty"`
+	// Sockets modified more recently are kept, in milliseconds (default, 600000)
+	MinAgeMS int `json:"min_age_ms,omitempty"`
+}
+
+// parseSocketCleanup parses "socket_cleanup <dir> [<interval> [<min_age>]]".
+func parseSocketCleanup(d *caddyfile.Dispenser) (*SocketCleanup, error) {
+	args := d.RemainingArgs()
+	if len(args) == 0 || len(args) > 3 {
+		return nil, d.ArgErr()
+	}
+	sc := &SocketCleanup{Dir: args[0]}
+	for i, field := range []*int{&sc.IntervalMS, &sc.MinAgeMS} {
+		if len(args) < i+2 {
+			break
+		}
+		dur, err := caddy.ParseDuration(args[i+1])
+		if err != nil || dur < time.Second {
+			return nil, d.Errf("socket_cleanup interval and min_age must be durations of at least 1s: %s", args[i+1])
+		}
+		*field = int(dur.Milliseconds())
+	}
+	return sc, nil
+}
+
+func (sc *SocketCleanup) interval() time.Duration {
+	if sc.IntervalMS > 0 {
+		return time.Duration(sc.IntervalMS) * time.Millisecond
+	}
+	return defaultSocketCleanupInterval
+}
+
+func (sc *SocketCleanup) minAge() time.Duration {
+	if sc.MinAgeMS > 0 {
+		return time.Duration(sc.MinAgeMS) * time.Millisecond
+	}
+	return defaultSocketMinAge
+}
+
+// runSocketCleanup removes orphaned sockets until the handler is cleaned up.
+func (c *ReverseBin) runSocketCleanup() {
+	ticker := time.NewTicker(c.SocketCleanup.interval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		c.cleanSockets(time.Now())
+	}
+}
+
+// cleanSockets removes the sockets in the directory that are older than
+// min_age, belong to no running backend of any handler and accept no
+// connections, and returns how many it removed.
+func (c *ReverseBin) cleanSockets(now time.Time) int {
+	dir := c.SocketCleanup.Dir
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		c.logger.Warn("failed to scan socket_cleanup directory", zap.String("dir", dir), zap.Error(err))
+		return 0
+	}
+	live, ok := liveSockets()
+	if !ok {
+		// A start or stop is under way; try again next time.
+		return 0
+	}
+	removed := 0
+	for _, entry := range entries {
+		path := absPath(filepath.Join(dir, entry.Name()))
+		info, err := entry.Info()
+		if err != nil || info.Mode()&os.ModeSocket == 0 || live[path] || now.Sub(info.ModTime()) < c.SocketCleanup.minAge() {
+			continue
+		}
+		// Sockets of processes reverse-bin does not manage are still in use.
+		if conn, err := net.DialTimeout("unix", path, 200*time.Millisecond); err == nil {
+			_ = conn.Close()
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			c.logger.Warn("failed to remove orphaned socket", zap.String("path", path), zap.Error(err))
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		c.logger.Info("removed orphaned sockets", zap.String("dir", dir), zap.Int("count", removed))
+		if c.metrics != nil {
+			c.metrics.socketsRemoved.Add(float64(removed))
+		}
+	}
+	return removed
+}
+
+// liveSockets returns the socket paths of the backends of every handler that
+// are running or starting. It reports false when a key's state is locked by a
+// start or stop, which could be about to create a socket.
+func liveSockets() (map[string]bool, bool) {
+	live := make(map[string]bool)
+	handlers.mu.Lock()
+	defer handlers.mu.Unlock()
+	for c := range handlers.set {
+		c.mu.Lock()
+		for _, ps := range c.processes {
+			if !ps.running.Load() && !ps.starting.Load() {
+				continue
+			}
+			if !ps.mu.TryLock() {
+				c.mu.Unlock()
+				return nil, false
+			}
+			upstream := c.ReverseProxyTo
+			if ps.overrides != nil && ps.overrides.ReverseProxyTo != nil {
+				upstream = *ps.overrides.ReverseProxyTo
+			}
+			ps.mu.Unlock()
+			if isUnixUpstream(upstream) {
+				live[absPath(strings.TrimPrefix(upstream, "unix/"))] = true
+			}
+		}
+		c.mu.Unlock()
+	}
+	return live, true
+}
+
+// absPath makes path absolute so that sockets named relative to different
+// directories compare equal.
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
@@ -0,0 +1,114 @@
+package reversebin
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// needsSpawnDiagnostics reports whether a failed start looks like the
+// executable could not be found or run, the classic "works in my shell"
+// problem.
+func needsSpawnDiagnostics(err error) bool {
+	return errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) || errors.Is(err, exec.ErrNotFound)
+}
+
+// spawnDiagnostics explains how the executable of spec was looked up: the
+// PATH used, the working directory, the file found and the interpreter its
+// shebang names.
+func spawnDiagnostics(spec ProcessSpec) []zap.Field {
+	dir := spec.WorkingDirectory
+	if dir == "" {
+		dir = "."
+	}
+	fields := []zap.Field{
+		// Bare names are resolved with Caddy's PATH, not the backend's.
+		zap.String("lookup_path", os.Getenv("PATH")),
+		zap.String("working_directory", dir),
+		zap.String("working_directory_status", fileStatus(dir)),
+	}
+	if backendPath, ok := envValue(spec.Env, "PATH"); ok {
+		fields = append(fields, zap.String("backend_path", backendPath))
+	}
+	if len(spec.Executable) == 0 {
+		return fields
+	}
+
+	name := spec.Executable[0]
+	var file string
+	switch {
+	case strings.ContainsRune(name, filepath.Separator) && filepath.IsAbs(name):
+		file = name
+	case strings.ContainsRune(name, filepath.Separator):
+		// Relative paths are resolved against the working directory.
+		file = filepath.Join(dir, name)
+	default:
+		found, err := exec.LookPath(name)
+		if err != nil {
+			return append(fields, zap.String("executable_status", "not found in lookup_path"))
+		}
+		file = found
+	}
+	fields = append(fields,
+		zap.String("executable_file", file),
+		zap.String("executable_status", fileStatus(file)))
+	if interp := shebang(file); interp != "" {
+		fields = append(fields, zap.String("shebang", interp))
+		if strings.HasSuffix(interp, "\r") {
+			fields = append(fields, zap.String("shebang_status", "ends in a carriage return (CRLF line endings)"))
+		} else if args := strings.Fields(interp); len(args) > 0 {
+			fields = append(fields, zap.String("shebang_status", fileStatus(args[0])))
+		}
+	}
+	return fields
+}
+
+// fileStatus describes whether path exists and its permission bits.
+func fileStatus(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "does not exist"
+		}
+		return err.Error()
+	}
+	status := info.Mode().String()
+	if info.Mode().IsRegular() && info.Mode().Perm()&0o111 == 0 {
+		status += " (not executable)"
+	}
+	return status
+}
+
+// shebang returns the interpreter line of a script without the leading #!,
+// or "" when path is not a readable script.
+func shebang(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	buf := make([]byte, 256)
+	n, _ := io.ReadFull(f, buf)
+	line, _, _ := strings.Cut(string(buf[:n]), "\n")
+	interp, ok := strings.CutPrefix(line, "#!")
+	if !ok {
+		return ""
+	}
+	return strings.TrimLeft(interp, " \t")
+}
+
+// envValue returns the value of name in an environment list.
+func envValue(env []string, name string) (string, bool) {
+	for i := len(env) - 1; i >= 0; i-- {
+		if v, ok := strings.CutPrefix(env[i], name+"="); ok {
+			return v, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,191 @@
+package reversebin
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// defaultReadinessTimeout is the readiness deadline when neither start_timeout
+// nor startup_timeout is configured.
+const defaultReadinessTimeout = 10 * time.Second
+
+// startupHistorySize is the number of recent startup durations kept per process key.
+const startupHistorySize = 20
+
+// StartupTimeout derives each key's readiness deadline from its own startup
+// history: the p95 of recent startups times Factor, bounded by Min and Max.
+// Keys without history get Max, so slow apps survive their first start while
+// apps known to start quickly fail fast when they hang.
+type StartupTimeout struct {
+	// Lower bound of the deadline in milliseconds (default, 2000)
+	MinMS int `json:"min_ms,omitempty"`
+	// Upper bound of the deadline in milliseconds, also used without history (default, 120000)
+	MaxMS int `json:"max_ms,omitempty"`
+	// Multiplier applied to the p95 startup duration (default, 3)
+	Factor float64 `json:"factor,omitempty"`
+}
+
+func (s *StartupTimeout) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		name := d.Val()
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		switch name {
+		case "min_ms", "max_ms":
+			v, err := strconv.Atoi(d.Val())
+			if err != nil || v <= 0 {
+				return d.Errf("%s must be a positive integer", name)
+			}
+			if name == "min_ms" {
+				s.MinMS = v
+			} else {
+				s.MaxMS = v
+			}
+		case "factor":
+			v, err := strconv.ParseFloat(d.Val(), 64)
+			if err != nil || v < 1 {
+				return d.Errf("factor must be a number of at least 1")
+			}
+			s.Factor = v
+		default:
+			return d.Errf("unknown startup_timeout subdirective: %q", name)
+		}
+	}
+	if s.MinMS > 0 && s.MaxMS > 0 && s.MinMS > s.MaxMS {
+		return d.Err("startup_timeout min_ms must not exceed max_ms")
+	}
+	return nil
+}
+
+// deadline returns the readiness deadline for a key with the given history.
+func (s *StartupTimeout) deadline(history []time.Duration) time.Duration {
+	lo, hi, factor := 2*time.Second, 2*time.Minute, 3.0
+	if s.MinMS > 0 {
+		lo = time.Duration(s.MinMS) * time.Millisecond
+	}
+	if s.MaxMS > 0 {
+		hi = time.Duration(s.MaxMS) * time.Millisecond
+	}
+	if s.Factor > 0 {
+		factor = s.Factor
+	}
+	if len(history) == 0 {
+		return hi
+	}
+	d := time.Duration(float64(percentile(history, 0.95)) * factor)
+	return min(max(d, lo), hi)
+}
+
+// percentile returns the nearest-rank q-quantile of durations.
+func percentile(durations []time.Duration, q float64) time.Duration {
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rank := int(math.Ceil(q*float64(len(sorted)))) - 1
+	return sorted[max(rank, 0)]
+}
+
+// readinessTimeoutLocked returns how long the next start of ps may take to
+// become ready. The caller must hold ps.mu.
+func (c *ReverseBin) readinessTimeoutLocked(ps *processState) time.Duration {
+	if c.StartupTimeout == nil {
+		if c.StartTimeoutMS > 0 {
+			return time.Duration(c.StartTimeoutMS) * time.Millisecond
+		}
+		return defaultReadinessTimeout
+	}
+	return c.StartupTimeout.deadline(ps.startupHistory)
+}
+
+// recordStartupLocked adds a successful startup duration to the key's history
+// and metrics. The caller must hold ps.mu.
+func (c *ReverseBin) recordStartupLocked(ps *processState, key string, d time.Duration) {
+	ps.startupHistory = append(ps.startupHistory, d)
+	if len(ps.startupHistory) > startupHistorySize {
+		ps.startupHistory = ps.startupHistory[len(ps.startupHistory)-startupHistorySize:]
+	}
+	if c.IdlePolicy != nil {
+		ps.adaptiveIdle.Store(int64(c.IdlePolicy.timeout(ps.startupHistory)))
+	}
+	if c.metrics != nil {
+		c.metrics.startupDuration.WithLabelValues(c.processKeyName(key)).Observe(d.Seconds())
+	}
+}
+
+// waitQueue tracks the requests of a key waiting for its backend to be
+// resolved or started. It has its own lock so the admin API can read it while
+// a cold start holds ps.mu.
+type waitQueue struct {
+	mu    sync.Mutex
+	next  uint64
+	since map[uint64]time.Time
+}
+
+func (q *waitQueue) add(now time.Time) uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.since == nil {
+		q.since = make(map[uint64]time.Time)
+	}
+	q.next++
+	q.since[q.next] = now
+	return q.next
+}
+
+func (q *waitQueue) remove(id uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.since, id)
+}
+
+// snapshot returns the number of waiting requests and the longest wait.
+func (q *waitQueue) snapshot(now time.Time) (int, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var longest time.Duration
+	for _, since := range q.since {
+		longest = max(longest, now.Sub(since))
+	}
+	return len(q.since), longest
+}
+
+// parkRequest records a request of key waiting for its backend and returns
+// the func to call once it stops waiting. reverse-bin's own requests are not
+// recorded.
+func (c *ReverseBin) parkRequest(r *http.Request, ps *processState, key string) func() {
+	if isInternal(r) {
+		return func() {}
+	}
+	id := ps.waiting.add(c.clock().Now())
+	var gauge prometheus.Gauge
+	if c.metrics != nil {
+		gauge = c.metrics.waiting.WithLabelValues(c.processKeyName(key))
+		gauge.Inc()
+	}
+	return func() {
+		ps.waiting.remove(id)
+		if gauge != nil {
+			gauge.Dec()
+		}
+	}
+}
+
+// recordStartCancellation counts a client request that stopped waiting for
+// key's backend.
+func (c *ReverseBin) recordStartCancellation(r *http.Request, key string) {
+	if isInternal(r) {
+		return
+	}
+	c.logger.Debug("request cancelled while waiting for backend start", zap.String("key", key))
+	if c.metrics != nil {
+		c.metrics.startCancellations.WithLabelValues(c.processKeyName(key)).Inc()
+	}
+}
@@ -0,0 +1,170 @@
+package reversebin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// defaultStateFileInterval is how often the state file is rewritten when no
+// interval is given.
+const defaultStateFileInterval = 15 * time.Second
+
+// StateFile periodically writes the handler's process table to disk, for
+// node_exporter's textfile collector or scripts that should not need the
+// admin API. Paths ending in .prom get the Prometheus text format, others
+// JSON.
+type StateFile struct {
+	Path string `json:"path"`
+	// Milliseconds between snapshots (default, 15000)
+	IntervalMS int `json:"interval_ms,omitempty"`
+}
+
+// parseStateFile parses "state_file <path> [<interval>]".
+func parseStateFile(d *caddyfile.Dispenser) (*StateFile, error) {
+	args := d.RemainingArgs()
+	if len(args) == 0 || len(args) > 2 {
+		return nil, d.ArgErr()
+	}
+	sf := &StateFile{Path: args[0]}
+	if len(args) == 2 {
+		dur, err := caddy.ParseDuration(args[1])
+		if err != nil || dur < time.Millisecond {
+			return nil, d.Errf("state_file interval must be a positive duration: %s", args[1])
+		}
+		sf.IntervalMS = int(dur.Milliseconds())
+	}
+	return sf, nil
+}
+
+func (sf *StateFile) interval() time.Duration {
+	if sf.IntervalMS > 0 {
+		return time.Duration(sf.IntervalMS) * time.Millisecond
+	}
+	return defaultStateFileInterval
+}
+
+// checkStateFileConflicts fails provisioning when another handler of the
+// same configuration writes its state file to the same path; each would
+// replace the other's snapshot. Handlers of a configuration being replaced
+// by a reload are not compared.
+func (c *ReverseBin) checkStateFileConflicts() error {
+	if c.StateFile == nil {
+		return nil
+	}
+	path, err := filepath.Abs(c.StateFile.Path)
+	if err != nil {
+		return fmt.Errorf("state_file: %v", err)
+	}
+	handlers.mu.Lock()
+	defer handlers.mu.Unlock()
+	for other := range handlers.set {
+		if other == c || other.ctx.Context != c.ctx.Context || other.StateFile == nil {
+			continue
+		}
+		if otherPath, err := filepath.Abs(other.StateFile.Path); err == nil && otherPath == path {
+			return fmt.Errorf("state_file %s is also written by another reverse-bin handler; each handler needs its own path", c.StateFile.Path)
+		}
+	}
+	return nil
+}
+
+// runStateFile writes the state file until the handler is cleaned up.
+func (c *ReverseBin) runStateFile() {
+	ticker := time.NewTicker(c.StateFile.interval())
+	defer ticker.Stop()
+	for {
+		if err := c.writeStateFile(time.Now()); err != nil {
+			c.logger.Warn("failed to write state file", zap.String("path", c.StateFile.Path), zap.Error(err))
+		}
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// writeStateFile replaces the state file with a snapshot taken at now. The
+// snapshot is renamed into place so readers never see a partial file.
+func (c *ReverseBin) writeStateFile(now time.Time) error {
+	list := c.processInfos()
+	var data []byte
+	if filepath.Ext(c.StateFile.Path) == ".prom" {
+		data = promSnapshot(list, now)
+	} else {
+		var err error
+		data, err = json.MarshalIndent(struct {
+			Updated   time.Time     `json:"updated"`
+			Processes []processInfo `json:"processes"`
+		}{now.UTC(), list}, "", "  ")
+		if err != nil {
+			return err
+		}
+		data = append(data, '\n')
+	}
+
+	dir, base := filepath.Split(c.StateFile.Path)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := os.CreateTemp(dir, "."+base+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.StateFile.Path)
+}
+
+// promSnapshot renders list in the Prometheus text exposition format.
+func promSnapshot(list []processInfo, now time.Time) []byte {
+	var b bytes.Buffer
+	gauge := func(name, help string) {
+		fmt.Fprintf(&b, "# HELP caddy_reverse_bin_%s %s\n# TYPE caddy_reverse_bin_%s gauge\n", name, help, name)
+	}
+	gauge("process_state", "State of the backend of a process key, 1 for the current state.")
+	for _, p := range list {
+		fmt.Fprintf(&b, "caddy_reverse_bin_process_state{key=%s,state=%s} 1\n", promLabel(p.Key), promLabel(p.State))
+	}
+	gauge("process_pid", "PID of the running backend of a process key.")
+	for _, p := range list {
+		if p.PID != 0 {
+			fmt.Fprintf(&b, "caddy_reverse_bin_process_pid{key=%s} %d\n", promLabel(p.Key), p.PID)
+		}
+	}
+	gauge("process_active_requests", "Requests being proxied to the backend of a process key.")
+	for _, p := range list {
+		fmt.Fprintf(&b, "caddy_reverse_bin_process_active_requests{key=%s} %d\n", promLabel(p.Key), p.ActiveRequests)
+	}
+	gauge("process_waiting_requests", "Requests waiting for the backend of a process key to start.")
+	for _, p := range list {
+		fmt.Fprintf(&b, "caddy_reverse_bin_process_waiting_requests{key=%s} %d\n", promLabel(p.Key), p.WaitingRequests)
+	}
+	gauge("state_file_timestamp_seconds", "Unix time the snapshot was taken.")
+	fmt.Fprintf(&b, "caddy_reverse_bin_state_file_timestamp_seconds %d\n", now.Unix())
+	return b.Bytes()
+}
+
+// promLabel quotes a label value, escaping as the text format requires.
+func promLabel(v string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v) + `"`
+}
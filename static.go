@@ -0,0 +1,83 @@
+package reversebin
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/fileserver"
+)
+
+// staticDirPlaceholder holds the static asset directory of the request's key
+// for the shared file server.
+const staticDirPlaceholder = "reverse_bin.static_dir"
+
+// provisionFileServer sets up the file server that serves the static asset
+// directories detectors report, preferring precompressed sidecar files
+// (.zst, .br, .gz) when the client accepts them.
+func (c *ReverseBin) provisionFileServer(ctx caddy.Context) error {
+	fs := &fileserver.FileServer{
+		Root: "{" + staticDirPlaceholder + "}",
+		PrecompressedRaw: caddy.ModuleMap{
+			"zstd": json.RawMessage("{}"),
+			"br":   json.RawMessage("{}"),
+			"gzip": json.RawMessage("{}"),
+		},
+		PrecompressedOrder: []string{"zstd", "br", "gzip"},
+	}
+	if err := fs.Provision(ctx); err != nil {
+		return err
+	}
+	c.fileServer = fs
+	return nil
+}
+
+// setStaticDir records the static asset directory of the key's last start,
+// relative to its working directory unless absolute. It stays in effect while
+// the backend is stopped, so asset requests never wake it.
+func (ps *processState) setStaticDir(overrides *Overrides) {
+	if overrides.StaticDir == nil || *overrides.StaticDir == "" {
+		ps.staticDir.Store(nil)
+		return
+	}
+	dir := *overrides.StaticDir
+	if !filepath.IsAbs(dir) && overrides.WorkingDirectory != nil {
+		dir = filepath.Join(*overrides.WorkingDirectory, dir)
+	}
+	ps.staticDir.Store(&dir)
+}
+
+// staticFile reports whether urlPath names a regular file in dir. Dotfiles
+// are never served, and directories are left to the app.
+func staticFile(dir, urlPath string) bool {
+	clean := path.Clean("/" + urlPath)
+	for _, segment := range strings.Split(clean, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return false
+		}
+	}
+	info, err := os.Stat(filepath.Join(dir, filepath.FromSlash(clean)))
+	return err == nil && info.Mode().IsRegular()
+}
+
+// serveStatic serves r from the key's static asset directory if it names a
+// file there, and reports whether it did.
+func (c *ReverseBin) serveStatic(w http.ResponseWriter, r *http.Request, ps *processState, next caddyhttp.Handler) (bool, error) {
+	dir := ps.staticDir.Load()
+	if dir == nil || c.fileServer == nil || !staticFile(*dir, r.URL.Path) {
+		return false, nil
+	}
+	repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return false, nil
+	}
+	repl.Set(staticDirPlaceholder, *dir)
+	out, release := c.withMountPrefix(w)
+	defer release()
+	return true, c.fileServer.ServeHTTP(out, r, next)
+}
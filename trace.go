@@ -0,0 +1,102 @@
+package reversebin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+type traceCtxKey struct{}
+
+// requestTrace records the timed lifecycle steps of one request for handlers
+// with debug enabled. All methods are no-ops on a nil trace.
+type requestTrace struct {
+	start time.Time
+	mu    sync.Mutex
+	steps []traceStep
+}
+
+type traceStep struct {
+	Name     string
+	Duration time.Duration
+	Detail   string
+}
+
+func (s traceStep) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("step", s.Name)
+	enc.AddDuration("duration", s.Duration)
+	if s.Detail != "" {
+		enc.AddString("detail", s.Detail)
+	}
+	return nil
+}
+
+func withTrace(r *http.Request, tr *requestTrace) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), traceCtxKey{}, tr))
+}
+
+func traceFrom(r *http.Request) *requestTrace {
+	tr, _ := r.Context().Value(traceCtxKey{}).(*requestTrace)
+	return tr
+}
+
+// step records that name, begun at since, has finished.
+func (t *requestTrace) step(name string, since time.Time, detail string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.steps = append(t.steps, traceStep{Name: name, Duration: time.Since(since), Detail: detail})
+}
+
+func (t *requestTrace) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var b strings.Builder
+	for _, s := range t.steps {
+		fmt.Fprintf(&b, "%-10s %10s  %s\n", s.Name, s.Duration.Round(time.Microsecond), s.Detail)
+	}
+	fmt.Fprintf(&b, "%-10s %10s\n", "total", time.Since(t.start).Round(time.Microsecond))
+	return b.String()
+}
+
+// finishTrace logs the trace of a request at INFO. A 5xx error that has not
+// yet produced a response is answered with the error and the trace, so the
+// developer sees why without digging through logs.
+func (c *ReverseBin) finishTrace(w *headersDownWriter, r *http.Request, tr *requestTrace, key string, err error) error {
+	tr.mu.Lock()
+	steps := zap.Objects("steps", tr.steps)
+	tr.mu.Unlock()
+	c.logger.Info("request trace",
+		zap.String("method", r.Method),
+		zap.String("uri", r.RequestURI),
+		zap.String("key", c.processKeyName(key)),
+		steps,
+		zap.Duration("total", time.Since(tr.start)),
+		zap.Error(err))
+
+	if err == nil || w.applied {
+		return err
+	}
+	status := http.StatusInternalServerError
+	var he caddyhttp.HandlerError
+	if errors.As(err, &he) && he.StatusCode != 0 {
+		status = he.StatusCode
+	}
+	if status < 500 {
+		return err
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	_, _ = fmt.Fprintf(w, "reverse-bin debug: %v\n\n%s", err, tr)
+	return nil
+}
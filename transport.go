@@ -0,0 +1,306 @@
+package reversebin
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"go.uber.org/zap"
+)
+
+// Values of upstream_compression.
+const (
+	compressionOff         = "off"
+	compressionPassthrough = "passthrough"
+)
+
+// TransportConfig tunes the connections to a backend. Every process key gets
+// its own transport and therefore its own connection pool.
+type TransportConfig struct {
+	// HTTP versions to speak to the backend, e.g. ["h2c"] or ["1.1", "2"]
+	Versions []string `json:"versions,omitempty"`
+	// Maximum connections to the backend (0 = unlimited)
+	MaxConnsPerHost int `json:"max_conns_per_host,omitempty"`
+}
+
+func (t *TransportConfig) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "versions":
+			t.Versions = d.RemainingArgs()
+			if len(t.Versions) == 0 {
+				return d.ArgErr()
+			}
+		case "max_conns_per_host":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			v, err := strconv.Atoi(d.Val())
+			if err != nil || v < 0 {
+				return d.Errf("max_conns_per_host must be a non-negative integer")
+			}
+			t.MaxConnsPerHost = v
+		default:
+			return d.Errf("unknown transport subdirective: %q", d.Val())
+		}
+	}
+	return nil
+}
+
+// newKeyTransport returns a provisioned transport for one process key,
+// preferring the detector's settings over the handler's.
+func (c *ReverseBin) newKeyTransport(overrides *Overrides) (*reverseproxy.HTTPTransport, error) {
+	upstreamTLS, cfg := c.UpstreamTLS, c.Transport
+	if overrides != nil && overrides.UpstreamTLS != nil {
+		upstreamTLS = overrides.UpstreamTLS
+	}
+	if overrides != nil && overrides.Transport != nil {
+		cfg = overrides.Transport
+	}
+	hostRewrite := c.HostRewrite
+	if overrides != nil && overrides.HostRewrite != nil {
+		hostRewrite = *overrides.HostRewrite
+	}
+
+	tr := &reverseproxy.HTTPTransport{}
+	if upstreamTLS != nil {
+		tlsCfg, err := upstreamTLS.proxyTLS()
+		if err != nil {
+			return nil, err
+		}
+		if hostRewrite != "" {
+			tlsCfg.ServerName = serverName(hostRewrite)
+		}
+		tr.TLS = tlsCfg
+	}
+	if cfg != nil {
+		tr.Versions = cfg.Versions
+		tr.MaxConnsPerHost = cfg.MaxConnsPerHost
+	}
+	if c.UpstreamCompression != "" {
+		// Without this the transport asks for gzip on its own and
+		// decompresses the response, only for Caddy to compress it again.
+		compress := false
+		tr.Compression = &compress
+	}
+	if err := tr.Provision(c.ctx); err != nil {
+		return nil, fmt.Errorf("failed to provision transport: %v", err)
+	}
+	return tr, nil
+}
+
+// ensureTransportLocked creates the key's transport if it has none, e.g. for
+// a backend adopted from another instance. The caller must hold ps.mu.
+func (c *ReverseBin) ensureTransportLocked(ps *processState) error {
+	if ps.transport != nil {
+		return nil
+	}
+	tr, err := c.newKeyTransport(ps.overrides)
+	if err != nil {
+		return err
+	}
+	ps.setTransportLocked(tr)
+	return nil
+}
+
+// prepareUpstreamHeaders adjusts the request headers sent to a backend.
+func (c *ReverseBin) prepareUpstreamHeaders(h http.Header, headersUp map[string]string) {
+	stripInternal(h)
+	if c.UpstreamCompression == compressionOff {
+		h.Del("Accept-Encoding")
+	}
+	applyHeaders(h, headersUp)
+}
+
+type processStateCtxKey struct{}
+
+// withProcessState records the request's process state so the transport can
+// pick that key's connection pool.
+func withProcessState(r *http.Request, ps *processState) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), processStateCtxKey{}, ps))
+}
+
+// processStateFrom returns the process state recorded by withProcessState,
+// or nil.
+func processStateFrom(r *http.Request) *processState {
+	ps, _ := r.Context().Value(processStateCtxKey{}).(*processState)
+	return ps
+}
+
+// keyedTransport routes each proxied request through the transport of its
+// process key and records per-key upstream metrics.
+type keyedTransport struct {
+	c *ReverseBin
+}
+
+func (t keyedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	ps, route := warmFrom(r)
+	if ps == nil {
+		return nil, fmt.Errorf("no process state for proxied request")
+	}
+	release, err := t.c.admitRamp(r.Context(), ps)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.roundTrip(r, ps, route)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	releaseOnClose(resp, release)
+	return resp, nil
+}
+
+func (t keyedTransport) roundTrip(r *http.Request, ps *processState, route *warmRoute) (*http.Response, error) {
+	if route != nil {
+		t.proxying(ps, route.pid)
+		// Stops drop the route before reporting the backend as draining, so a
+		// route still published now was reported as used before any stop.
+		if ps.warm.Load() != route {
+			route = nil
+		}
+	}
+	if route != nil {
+		start := time.Now()
+		resp, err := route.transport.RoundTrip(r)
+		t.observe(r, ps, route.pid, start, resp, err)
+		if err != nil {
+			ps.dropWarm(route)
+			if isDialError(err) {
+				ps.unpin()
+			}
+		}
+		return resp, err
+	}
+	tr, pid := t.dispatchTransport(ps)
+	if tr == nil {
+		// The backend stopped between upstream selection and the round trip.
+		err := fmt.Errorf("backend for process key is not running")
+		t.failed(ps, failureLifecycle, err)
+		return nil, err
+	}
+	start := time.Now()
+	resp, err := tr.RoundTrip(r)
+	t.observe(r, ps, pid, start, resp, err)
+	if err != nil && isDialError(err) {
+		ps.unpin()
+	}
+	return resp, err
+}
+
+func (t keyedTransport) proxying(ps *processState, pid int) {
+	if ps.observer != nil {
+		ps.observer.Proxying(ps.key, pid)
+	}
+}
+
+func (t keyedTransport) observe(r *http.Request, ps *processState, pid int, start time.Time, resp *http.Response, err error) {
+	if t.c.metrics != nil {
+		t.c.metrics.observeUpstream(t.c.processKeyName(ps.key), start, resp, err)
+	}
+	switch {
+	case err != nil:
+		t.failed(ps, ps.failureKind(pid), err)
+		return
+	case resp.StatusCode >= 500 && t.c.metrics != nil:
+		// Logged by Caddy like any other response.
+		t.c.metrics.upstreamFailures.WithLabelValues(t.c.processKeyName(ps.key), failureApp).Inc()
+	}
+	t.watchBody(r, ps, pid, resp)
+}
+
+// watchBody counts and logs a response whose body fails before its end, as
+// when the backend dies mid-response, like a round trip that got no
+// response. A body cut short by the client going away is not the backend's
+// failure.
+func (t keyedTransport) watchBody(r *http.Request, ps *processState, pid int, resp *http.Response) {
+	// Upgraded connections must keep their io.ReadWriteCloser body.
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return
+	}
+	resp.Body = &watchedBody{ReadCloser: resp.Body, failed: func(err error) {
+		if r.Context().Err() == nil {
+			t.failed(ps, ps.failureKind(pid), err)
+		}
+	}}
+}
+
+type watchedBody struct {
+	io.ReadCloser
+	failed func(error)
+	once   sync.Once
+}
+
+func (b *watchedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		b.once.Do(func() { b.failed(err) })
+	}
+	return n, err
+}
+
+// Kinds of failed round trips: the backend was running and failed the
+// request itself, or the backend it was sent to had exited.
+const (
+	failureApp       = "app"
+	failureLifecycle = "lifecycle"
+)
+
+// failed counts and logs a round trip that got no response, with a message
+// per kind so log alerts can tell them apart as well.
+func (t keyedTransport) failed(ps *processState, kind string, err error) {
+	key := t.c.processKeyName(ps.key)
+	if t.c.metrics != nil {
+		t.c.metrics.upstreamFailures.WithLabelValues(key, kind).Inc()
+	}
+	if kind == failureLifecycle {
+		t.c.logger.Warn("backend process was not running to serve request",
+			zap.String("key", key), zap.Error(err))
+		return
+	}
+	t.c.logger.Warn("running backend failed request",
+		zap.String("key", key), zap.Error(err))
+}
+
+// failureKind classifies a failed round trip to the backend with pid, 0 when
+// unknown: a lifecycle failure when that backend has exited or been replaced.
+// A crashing backend is still found here as a zombie until its exit is
+// handled, which Alive reports as gone.
+func (ps *processState) failureKind(pid int) string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.process == nil || (pid != 0 && ps.process.Pid() != pid) || !ps.process.Alive() {
+		return failureLifecycle
+	}
+	return failureApp
+}
+
+// dispatchTransport returns the key's transport and the backend it connects
+// to, or nil when its backend is not running. The request is reported to the
+// observer under ps.mu, so it is ordered with the backend's state transitions.
+func (t keyedTransport) dispatchTransport(ps *processState) (*reverseproxy.HTTPTransport, int) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.transport != nil {
+		t.proxying(ps, ps.transportPID)
+	}
+	return ps.transport, ps.transportPID
+}
+
+// setTransportLocked replaces the key's transport, closing the previous one
+// and with it any pooled connections to a stopped backend.
+func (ps *processState) setTransportLocked(tr *reverseproxy.HTTPTransport) {
+	if ps.transport != nil && ps.transport != tr {
+		_ = ps.transport.Cleanup()
+	}
+	ps.transport = tr
+	ps.transportPID = 0
+	ps.running.Store(tr != nil)
+	ps.warm.Store(nil)
+}
@@ -0,0 +1,93 @@
+package reversebin
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+)
+
+// UpstreamTLS configures TLS for connections to the backend, including a
+// client certificate for backends that require mutual TLS.
+type UpstreamTLS struct {
+	// PEM-encoded client certificate presented to the backend
+	ClientCert string `json:"client_cert,omitempty"`
+	// PEM-encoded private key for ClientCert
+	ClientKey string `json:"client_key,omitempty"`
+	// PEM-encoded CA used to verify the backend certificate (default, system roots)
+	CA string `json:"ca,omitempty"`
+}
+
+func (t *UpstreamTLS) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "client_cert":
+			if !d.Args(&t.ClientCert) {
+				return d.ArgErr()
+			}
+		case "client_key":
+			if !d.Args(&t.ClientKey) {
+				return d.ArgErr()
+			}
+		case "ca":
+			if !d.Args(&t.CA) {
+				return d.ArgErr()
+			}
+		default:
+			return d.Errf("unknown upstream_tls subdirective: %q", d.Val())
+		}
+	}
+	return nil
+}
+
+func (t *UpstreamTLS) validate() error {
+	if (t.ClientCert == "") != (t.ClientKey == "") {
+		return fmt.Errorf("upstream_tls: client_cert and client_key must be set together")
+	}
+	return nil
+}
+
+// proxyTLS returns the equivalent reverse proxy transport TLS settings.
+func (t *UpstreamTLS) proxyTLS() (*reverseproxy.TLSConfig, error) {
+	if err := t.validate(); err != nil {
+		return nil, err
+	}
+	tlsCfg := &reverseproxy.TLSConfig{
+		ClientCertificateFile:    t.ClientCert,
+		ClientCertificateKeyFile: t.ClientKey,
+	}
+	if t.CA != "" {
+		tlsCfg.RootCAPEMFiles = []string{t.CA}
+	}
+	return tlsCfg, nil
+}
+
+// clientConfig builds the equivalent crypto/tls config for readiness probes.
+func (t *UpstreamTLS) clientConfig() (*tls.Config, error) {
+	if err := t.validate(); err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{}
+	if t.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(t.ClientCert, t.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("upstream_tls: loading client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if t.CA != "" {
+		pem, err := os.ReadFile(t.CA)
+		if err != nil {
+			return nil, fmt.Errorf("upstream_tls: reading ca: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("upstream_tls: no certificates found in %s", t.CA)
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
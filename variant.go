@@ -0,0 +1,184 @@
+package reversebin
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// variantSep joins a process key and the name of the variant serving it.
+const variantSep = "#"
+
+// Variant serves matching requests from another backend definition, such as
+// a staging build behind a preview cookie. A variant runs its own processes
+// with their own idle accounting, keyed as <key>#<name>.
+type Variant struct {
+	// Name of the variant, the Caddyfile matcher name without @
+	Name           string                   `json:"name"`
+	MatcherSetsRaw caddyhttp.RawMatcherSets `json:"match,omitempty" caddy:"namespace=http.matchers"`
+	// Backend settings; unset fields fall back to those of the request's key
+	Backend App `json:"backend"`
+
+	// matcherName is the Caddyfile @name, resolved by parseCaddyfile
+	matcherName string
+	matcherSets caddyhttp.MatcherSets
+}
+
+// parseVariant parses "variant @name { <app subdirectives> }".
+func (c *ReverseBin) parseVariant(d *caddyfile.Dispenser) error {
+	var name string
+	if !d.Args(&name) {
+		return d.ArgErr()
+	}
+	if len(name) < 2 || name[0] != '@' {
+		return d.Errf("variant takes a named matcher, got %s", name)
+	}
+	v := &Variant{Name: name[1:], matcherName: name}
+	if err := v.Backend.unmarshalCaddyfile(d); err != nil {
+		return err
+	}
+	c.Variants = append(c.Variants, v)
+	return nil
+}
+
+// resolveVariantMatchers replaces the @names of variants with the matcher
+// sets defined in the site block.
+func (c *ReverseBin) resolveVariantMatchers(h httpcaddyfile.Helper) error {
+	for _, v := range c.Variants {
+		if v.matcherName == "" {
+			continue
+		}
+		set, err := namedMatcherSet(h, "variant", v.matcherName)
+		if err != nil {
+			return err
+		}
+		v.MatcherSetsRaw = caddyhttp.RawMatcherSets{set}
+	}
+	return nil
+}
+
+// provisionVariants loads and validates the variants.
+func (c *ReverseBin) provisionVariants(ctx caddy.Context) error {
+	seen := make(map[string]bool)
+	for _, v := range c.Variants {
+		if v.Name == "" || strings.Contains(v.Name, variantSep) {
+			return fmt.Errorf("variant name %q must be non-empty and not contain %q", v.Name, variantSep)
+		}
+		if seen[v.Name] {
+			return fmt.Errorf("variant %q is defined twice", v.Name)
+		}
+		seen[v.Name] = true
+		if c.Kubernetes != nil {
+			return fmt.Errorf("variants are not supported with the kubernetes runtime")
+		}
+		// Sharing the address of the regular backend would proxy to
+		// whichever of the two started last.
+		if v.Backend.ReverseProxyTo == "" && c.PortRange == nil && c.UpstreamFrom == nil {
+			return fmt.Errorf("variant %q needs its own reverse_proxy_to", v.Name)
+		}
+		// Likewise for the variants of several keys, or of several copies of
+		// a key, given one fixed address.
+		if addr := v.Backend.ReverseProxyTo; addr != "" && !strings.Contains(addr, portPlaceholder) {
+			if c.detector != nil || len(c.Apps) > 1 || c.ProvisionAsk != "" {
+				return fmt.Errorf("variant %q serves several keys, so its reverse_proxy_to needs %s", v.Name, portPlaceholder)
+			}
+			if c.copies() > 1 && !strings.Contains(addr, instancePlaceholder) {
+				return fmt.Errorf("variant %q serves several copies, so its reverse_proxy_to needs %s or %s",
+					v.Name, instancePlaceholder, portPlaceholder)
+			}
+		}
+		if v.Backend.UpstreamTLS != nil {
+			if err := v.Backend.UpstreamTLS.validate(); err != nil {
+				return fmt.Errorf("variant %q: %v", v.Name, err)
+			}
+		}
+		mods, err := ctx.LoadModule(v, "MatcherSetsRaw")
+		if err != nil {
+			return fmt.Errorf("loading variant %q matchers: %v", v.Name, err)
+		}
+		if err := v.matcherSets.FromInterface(mods); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// variantKey appends the name of the first variant matching r to key. Keys
+// containing variantSep are refused with 400, since splitVariant would take
+// them for the key of a variant.
+func (c *ReverseBin) variantKey(r *http.Request, key string) (string, error) {
+	if strings.Contains(key, variantSep) {
+		return "", caddyhttp.Error(http.StatusBadRequest,
+			fmt.Errorf("process key %q must not contain %q when variants are configured", key, variantSep))
+	}
+	for _, v := range c.Variants {
+		match, err := v.matcherSets.AnyMatchWithError(r)
+		if err != nil {
+			return "", caddyhttp.Error(http.StatusInternalServerError, err)
+		}
+		if match {
+			return key + variantSep + v.Name, nil
+		}
+	}
+	return key, nil
+}
+
+// splitVariant returns the key a process key was derived from and the
+// variant serving it, if any.
+func (c *ReverseBin) splitVariant(key string) (string, *Variant) {
+	i := strings.LastIndex(key, variantSep)
+	if i < 0 {
+		return key, nil
+	}
+	for _, v := range c.Variants {
+		if v.Name == key[i+len(variantSep):] {
+			return key[:i], v
+		}
+	}
+	return key, nil
+}
+
+// overlay sets the fields of o that src sets.
+func (o *Overrides) overlay(src *Overrides) {
+	if src.Executable != nil {
+		o.Executable = src.Executable
+	}
+	if src.WorkingDirectory != nil {
+		o.WorkingDirectory = src.WorkingDirectory
+	}
+	if src.Envs != nil {
+		o.Envs = src.Envs
+	}
+	if src.ReverseProxyTo != nil {
+		o.ReverseProxyTo = src.ReverseProxyTo
+	}
+	if src.ReadinessMethod != nil {
+		o.ReadinessMethod, o.ReadinessPath, o.ReadinessStatus = src.ReadinessMethod, src.ReadinessPath, src.ReadinessStatus
+	}
+	if src.HostRewrite != nil {
+		o.HostRewrite = src.HostRewrite
+	}
+	if src.HeadersUp != nil {
+		o.HeadersUp = src.HeadersUp
+	}
+	if src.HeadersDown != nil {
+		o.HeadersDown = src.HeadersDown
+	}
+	if src.UpstreamTLS != nil {
+		o.UpstreamTLS = src.UpstreamTLS
+	}
+	if src.Transport != nil {
+		o.Transport = src.Transport
+	}
+	if src.StaticDir != nil {
+		o.StaticDir = src.StaticDir
+	}
+	if src.IdleTimeoutMS != nil {
+		o.IdleTimeoutMS = src.IdleTimeoutMS
+	}
+}
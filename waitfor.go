@@ -0,0 +1,122 @@
+package reversebin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// defaultWaitForTimeout bounds the wait for a dependency when no timeout is given.
+const defaultWaitForTimeout = 30 * time.Second
+
+// waitForPoll is how often an unavailable dependency is checked again.
+const waitForPoll = 500 * time.Millisecond
+
+// WaitFor is an external service a backend needs, checked before every start
+// so that a transient outage delays the start instead of crashing the app.
+type WaitFor struct {
+	// tcp://host:port, available once it accepts connections, or dns://host,
+	// available once it resolves
+	Target string `json:"target"`
+	// How long a start waits for the dependency in milliseconds (default, 30000)
+	TimeoutMS int `json:"timeout_ms,omitempty"`
+}
+
+// parseWaitFor parses "wait_for <target> [timeout <duration>]".
+func parseWaitFor(d *caddyfile.Dispenser) (*WaitFor, error) {
+	args := d.RemainingArgs()
+	if len(args) != 1 && (len(args) != 3 || args[1] != "timeout") {
+		return nil, d.ArgErr()
+	}
+	w := &WaitFor{Target: args[0]}
+	if len(args) == 3 {
+		dur, err := caddy.ParseDuration(args[2])
+		if err != nil || dur < time.Millisecond {
+			return nil, d.Errf("wait_for timeout must be a positive duration: %s", args[2])
+		}
+		w.TimeoutMS = int(dur.Milliseconds())
+	}
+	if err := w.validate(); err != nil {
+		return nil, d.Err(err.Error())
+	}
+	return w, nil
+}
+
+func (w *WaitFor) validate() error {
+	u, err := url.Parse(w.Target)
+	if err != nil {
+		return fmt.Errorf("wait_for target %q: %v", w.Target, err)
+	}
+	switch {
+	case u.Scheme == "tcp" && u.Port() != "":
+	case u.Scheme == "dns" && u.Hostname() != "":
+	default:
+		return fmt.Errorf("wait_for target must be tcp://host:port or dns://host, got %q", w.Target)
+	}
+	return nil
+}
+
+func (w *WaitFor) timeout() time.Duration {
+	if w.TimeoutMS > 0 {
+		return time.Duration(w.TimeoutMS) * time.Millisecond
+	}
+	return defaultWaitForTimeout
+}
+
+// available checks the dependency once.
+func (w *WaitFor) available(ctx context.Context) bool {
+	u, err := url.Parse(w.Target)
+	if err != nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if u.Scheme == "dns" {
+		addrs, err := net.DefaultResolver.LookupHost(ctx, u.Hostname())
+		return err == nil && len(addrs) > 0
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", u.Host)
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
+
+// waitForDependencies returns once every wait_for target is available, or an
+// error naming the first one still unavailable after its timeout.
+func (c *ReverseBin) waitForDependencies(ctx context.Context, key string) error {
+	for _, w := range c.WaitFor {
+		if w.available(ctx) {
+			continue
+		}
+		c.logger.Info("waiting for backend dependency",
+			zap.String("key", c.processKeyName(key)),
+			zap.String("target", w.Target),
+			zap.Duration("timeout", w.timeout()))
+		deadline := c.clock().After(w.timeout())
+		ticker := time.NewTicker(waitForPoll)
+		available := false
+		for !available {
+			select {
+			case <-ticker.C:
+				available = w.available(ctx)
+			case <-deadline:
+				ticker.Stop()
+				return fmt.Errorf("dependency %s of %q unavailable after %s", w.Target, c.processKeyName(key), w.timeout())
+			case <-ctx.Done():
+				ticker.Stop()
+				return fmt.Errorf("cold start aborted: %w", ctx.Err())
+			}
+		}
+		ticker.Stop()
+	}
+	return nil
+}
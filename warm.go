@@ -0,0 +1,55 @@
+package reversebin
+
+import (
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+)
+
+// warmRoute is the upstream and transport of a running backend, published
+// so that warm requests for static handlers bypass ps.mu, the gate and the
+// liveness checks of the slow path.
+type warmRoute struct {
+	upstreams []*reverseproxy.Upstream
+	transport *reverseproxy.HTTPTransport
+	pid       int
+	headersUp map[string]string
+	// Host header for the backend, "" to keep the client's
+	host string
+}
+
+// fastPathEligible reports whether the handler always proxies to one locally
+// started backend whose upstream only changes when it restarts.
+func (c *ReverseBin) fastPathEligible() bool {
+	return c.detector == nil && len(c.Apps) == 0 && c.ProvisionAsk == "" &&
+		c.Kubernetes == nil && !c.SharedStart
+}
+
+// publishWarmLocked makes the key's current upstreams the warm route if a
+// backend started by this handler serves them. The caller must hold ps.mu.
+func (ps *processState) publishWarmLocked() {
+	if ps.process == nil || ps.adopted || ps.transport == nil || ps.upstreams == nil {
+		return
+	}
+	route := &warmRoute{upstreams: ps.upstreams, transport: ps.transport, pid: ps.transportPID}
+	if ps.overrides != nil {
+		route.headersUp = ps.overrides.HeadersUp
+		route.host = ps.overrides.upstreamHost()
+	}
+	ps.warm.Store(route)
+}
+
+// dropWarm sends later requests back to the slow path, which notices a
+// stopped or unreachable backend and restarts it.
+func (ps *processState) dropWarm(route *warmRoute) {
+	ps.warm.CompareAndSwap(route, nil)
+}
+
+// warmFrom returns the warm route of the request's process state, or nil.
+func warmFrom(r *http.Request) (*processState, *warmRoute) {
+	ps := processStateFrom(r)
+	if ps == nil {
+		return nil, nil
+	}
+	return ps, ps.warm.Load()
+}